@@ -13,9 +13,12 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/klog"
-	//"github.com/ryo-watanabe/k8s-snap/pkg/cluster"
+
+	"github.com/ryo-watanabe/k8s-snap/pkg/cluster"
 	//"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
+	"github.com/ryo-watanabe/k8s-snap/pkg/utils"
 )
 
 // runWorker is a long-running function that will continually call the
@@ -64,10 +67,6 @@ func (c *Controller) processNextSnapshotItem(queueonly bool) bool {
 	return true
 }
 
-func retryNotify(err error, wait time.Duration) {
-	klog.Infof("Retrying after %.2f seconds with error : %s", wait.Seconds(), err.Error())
-}
-
 // snapshotSyncHandler compares the actual state with the desired, and attempts to
 // converge the two. It then updates the Status block of the Snapshot resource
 // with the current status of the resource.
@@ -75,8 +74,8 @@ func (c *Controller) snapshotSyncHandler(key string, queueonly bool) error {
 
 	//getOptions := metav1.GetOptions{IncludeUninitialized: false}
 
-	// context for snapshot
-	ctx := context.TODO()
+	// context for status updates, the snapshot itself bounded with its own timeout
+	ctx := c.ctx
 
 	// Convert the namespace/name string into a distinct namespace and name
 	namespace, name, err := cache.SplitMetaNamespaceKey(key)
@@ -95,6 +94,16 @@ func (c *Controller) snapshotSyncHandler(key string, queueonly bool) error {
 		}
 		return err
 	}
+	snapshot = snapshot.DeepCopy()
+
+	// cancel requested in queue, or in progress while the controller stopped
+	if snapshotCancelRequested(snapshot) &&
+		(snapshot.Status.Phase == "InQueue" || snapshot.Status.Phase == "InProgress") {
+		snapshot, err = c.updateSnapshotStatus(ctx, snapshot, "Cancelled", "Cancel requested")
+		if err != nil {
+			return err
+		}
+	}
 
 	// controller stopped wwhile taking the snapshot
 	if snapshot.Status.Phase == "InProgress" {
@@ -113,24 +122,45 @@ func (c *Controller) snapshotSyncHandler(key string, queueonly bool) error {
 
 	// do snapshot
 	if !queueonly && snapshot.Status.Phase == "InQueue" {
+		// context cancelled on cancel request
+		opCtx, done := c.snapshotOps.start(c.ctx, key, c.snapshotTimeout(snapshot))
+		defer done()
+
+		// log of the snapshot uploaded with the archive, or kept in a ConfigMap on failure
+		logName := "snapshot:" + snapshot.ObjectMeta.Name
+		stopCapture := utils.StartLogCapture(logName)
+		defer stopCapture()
+		blog := utils.NewNamedLog(logName)
+		notify := func(err error, wait time.Duration) {
+			blog.Infof("Retrying after %.2f seconds with error : %s", wait.Seconds(), err.Error())
+		}
+
 		snapshot, err = c.updateSnapshotStatus(ctx, snapshot, "InProgress", "")
 		if err != nil {
 			return err
 		}
+		c.setSnapshotCompression(opCtx, snapshot)
 
 		// bucket
-		bucket, err := c.getBucket(ctx, c.namespace, snapshot.Spec.ObjectstoreConfig,
+		bucket, err := c.getBucket(opCtx, c.namespace, snapshot.Spec.ObjectstoreConfig,
 			c.kubeclientset, c.cbclientset, c.insecure)
 		if err != nil {
-			snapshot, err = c.updateSnapshotStatus(ctx, snapshot, "Failed", err.Error())
-			if err != nil {
-				return err
-			}
-			return nil
+			return c.snapshotFailed(ctx, opCtx, snapshot, err)
 		}
 		klog.Infof("- Objectstore Config name:%s endpoint:%s bucket:%s",
 			bucket.GetName(), bucket.GetEndpoint(), bucket.GetBucketName())
 
+		// progress updated on a copy not to race with the operation
+		progressed := snapshot.DeepCopy()
+		progress := newProgressUpdater(func(p *cbv1alpha1.Progress) {
+			progressed = c.updateSnapshotProgress(ctx, progressed, p)
+		})
+		opCtx = cluster.WithProgress(opCtx, progress.report)
+		stopProgress := func() {
+			snapshot.Status.Progress = progress.stop()
+			snapshot.ObjectMeta.ResourceVersion = progressed.ObjectMeta.ResourceVersion
+		}
+
 		// do snapshot with backoff retry
 		b := backoff.NewExponentialBackOff()
 		b.MaxElapsedTime = time.Duration(c.maxretryelapsedsec) * time.Second
@@ -138,29 +168,41 @@ func (c *Controller) snapshotSyncHandler(key string, queueonly bool) error {
 		b.Multiplier = 2.0
 		b.InitialInterval = 2 * time.Second
 		operationSnapshot := func() error {
-			return c.clusterCmd.Snapshot(ctx, snapshot)
+			return c.clusterCmd.Snapshot(opCtx, snapshot)
+		}
+
+		// hooks run once around the retries, post hooks also when failed after pre hooks
+		snapshot.Status.HookResults = nil
+		err = c.clusterCmd.SnapshotHooks(opCtx, snapshot, cluster.HookPhasePre)
+		if err == nil {
+			err = backoff.RetryNotify(operationSnapshot, backoff.WithContext(b, opCtx), notify)
+		}
+		postErr := c.runPostHooks(opCtx, snapshot)
+		if err == nil {
+			err = postErr
+		} else if postErr != nil {
+			klog.Warningf("snapshot:%s Post-snapshot hooks on failure : %s", snapshot.ObjectMeta.Name, postErr.Error())
 		}
-		err = backoff.RetryNotify(operationSnapshot, b, retryNotify)
 		if err != nil {
-			snapshot, err = c.updateSnapshotStatus(ctx, snapshot, "Failed", err.Error())
-			if err != nil {
-				return err
-			}
-			return nil
+			stopProgress()
+			return c.snapshotFailed(ctx, opCtx, snapshot, err)
 		}
 
 		// upload snapshot with backoff retry
 		b.Reset()
 		operationUpload := func() error {
-			return c.clusterCmd.UploadSnapshot(snapshot, bucket)
+			return c.clusterCmd.UploadSnapshot(opCtx, snapshot, bucket)
 		}
-		err = backoff.RetryNotify(operationUpload, b, retryNotify)
+		err = backoff.RetryNotify(operationUpload, backoff.WithContext(b, opCtx), notify)
+		stopProgress()
 		if err != nil {
-			snapshot, err = c.updateSnapshotStatus(ctx, snapshot, "Failed", err.Error())
-			if err != nil {
-				return err
-			}
-			return nil
+			return c.snapshotFailed(ctx, opCtx, snapshot, err)
+		}
+		snapshot.Status.Progress = nil
+
+		err = cluster.UploadSnapshotLog(opCtx, snapshot, utils.CapturedLog(logName), bucket)
+		if err != nil {
+			klog.Warningf("snapshot:%s %s", snapshot.ObjectMeta.Name, err.Error())
 		}
 
 		snapshot, err = c.updateSnapshotStatus(ctx, snapshot, "Completed", "")
@@ -174,12 +216,7 @@ func (c *Controller) snapshotSyncHandler(key string, queueonly bool) error {
 	// initialize
 	if snapshot.Status.Phase == "" {
 		// Check AvailableUntil
-		if snapshot.Spec.AvailableUntil.IsZero() {
-			// Check TTL string
-			if snapshot.Spec.TTL.Duration == 0 {
-				snapshot.Spec.TTL.Duration = 24 * 30 * time.Hour
-			}
-		} else if snapshot.Spec.AvailableUntil.Before(&nowTime) {
+		if !snapshot.Spec.AvailableUntil.IsZero() && snapshot.Spec.AvailableUntil.Before(&nowTime) {
 			snapshot, err = c.updateSnapshotStatus(ctx, snapshot, "Failed", "AvailableUntil is set as past.")
 			if err != nil {
 				return err
@@ -193,8 +230,9 @@ func (c *Controller) snapshotSyncHandler(key string, queueonly bool) error {
 		}
 	}
 
-	// expiration for failed snapshot
-	if snapshot.Status.Phase == "Failed" && snapshot.Status.AvailableUntil.IsZero() {
+	// expiration for failed or cancelled snapshot
+	if (snapshot.Status.Phase == "Failed" || snapshot.Status.Phase == "Cancelled") &&
+		snapshot.Status.AvailableUntil.IsZero() {
 		if !snapshot.Spec.AvailableUntil.IsZero() {
 			snapshot.Status.AvailableUntil = snapshot.Spec.AvailableUntil
 			snapshot.Status.TTL.Duration = snapshot.Status.AvailableUntil.Time.Sub(snapshot.ObjectMeta.CreationTimestamp.Time)
@@ -210,7 +248,8 @@ func (c *Controller) snapshotSyncHandler(key string, queueonly bool) error {
 	}
 
 	// expiration edited
-	if snapshot.Status.Phase == "Completed" || snapshot.Status.Phase == "Failed" {
+	if snapshot.Status.Phase == "Completed" || snapshot.Status.Phase == "Failed" ||
+		snapshot.Status.Phase == "Cancelled" {
 		if !snapshot.Spec.AvailableUntil.IsZero() && !snapshot.Spec.AvailableUntil.Equal(&snapshot.Status.AvailableUntil) {
 			snapshot.Status.AvailableUntil = snapshot.Spec.AvailableUntil
 			snapshot, err = c.updateSnapshotStatus(ctx, snapshot, snapshot.Status.Phase, snapshot.Status.Reason)
@@ -238,18 +277,125 @@ func (c *Controller) snapshotSyncHandler(key string, queueonly bool) error {
 	return nil
 }
 
+// updateSnapshotStatus updates the status subresource of the snapshot.
+// On conflicts the status is set on the latest snapshot and the update retried.
 func (c *Controller) updateSnapshotStatus(ctx context.Context, snapshot *cbv1alpha1.Snapshot,
 	phase, reason string) (*cbv1alpha1.Snapshot, error) {
-	snapshotCopy := snapshot.DeepCopy()
-	snapshotCopy.Status.Phase = phase
-	snapshotCopy.Status.Reason = reason
+	status := snapshot.Status.DeepCopy()
+	status.Phase = phase
+	status.Reason = reason
 	klog.Infof("snapshot:%s status %s => %s : %s", snapshot.ObjectMeta.Name, snapshot.Status.Phase, phase, reason)
-	snapshot, err := c.cbclientset.ClustersnapshotV1alpha1().Snapshots(snapshot.Namespace).Update(
-		ctx, snapshotCopy, metav1.UpdateOptions{})
+	snapshots := c.cbclientset.ClustersnapshotV1alpha1().Snapshots(snapshot.Namespace)
+	snapshotCopy := snapshot.DeepCopy()
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		snapshotCopy.Status = *status.DeepCopy()
+		updated, err := snapshots.UpdateStatus(ctx, snapshotCopy, metav1.UpdateOptions{})
+		if errors.IsConflict(err) {
+			latest, getErr := snapshots.Get(ctx, snapshot.ObjectMeta.Name, metav1.GetOptions{})
+			if getErr != nil {
+				return getErr
+			}
+			snapshotCopy = latest
+		} else if err == nil {
+			snapshotCopy = updated
+		}
+		return err
+	})
 	if err != nil {
 		return snapshot, fmt.Errorf("Failed to update snapshot status for %s : %s", snapshot.ObjectMeta.Name, err.Error())
 	}
-	return snapshot, err
+	return snapshotCopy, nil
+}
+
+// updateSnapshotProgress updates the progress of the snapshot in progress.
+// The snapshot is returned as is when the update failed.
+func (c *Controller) updateSnapshotProgress(ctx context.Context, snapshot *cbv1alpha1.Snapshot,
+	progress *cbv1alpha1.Progress) *cbv1alpha1.Snapshot {
+	snapshotCopy := snapshot.DeepCopy()
+	snapshotCopy.Status.Progress = progress
+	updated, err := c.cbclientset.ClustersnapshotV1alpha1().Snapshots(snapshot.Namespace).UpdateStatus(
+		ctx, snapshotCopy, metav1.UpdateOptions{})
+	if err != nil {
+		klog.Warningf("snapshot:%s progress update failed : %s", snapshot.ObjectMeta.Name, err.Error())
+		return snapshot
+	}
+	return updated
+}
+
+// snapshotFailed sets the snapshot Failed, or Cancelled when the operation cancelled
+func (c *Controller) snapshotFailed(ctx, opCtx context.Context, snapshot *cbv1alpha1.Snapshot, err error) error {
+	if c.ctx.Err() != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = stoppedContext()
+		defer cancel()
+	}
+	c.saveSnapshotLog(ctx, snapshot, err)
+	if c.ctx.Err() != nil {
+		_, err = c.updateSnapshotStatus(ctx, snapshot, "Failed", "Controller stopped while taking the snapshot")
+		return err
+	}
+	switch opCtx.Err() {
+	case nil:
+		_, err = c.updateSnapshotStatus(ctx, snapshot, "Failed", err.Error())
+		return err
+	case context.DeadlineExceeded:
+		_, err = c.updateSnapshotStatus(ctx, snapshot, "Failed",
+			fmt.Sprintf("Timed out after %s : %s", c.snapshotTimeout(snapshot), err.Error()))
+		return err
+	}
+	_, err = c.updateSnapshotStatus(ctx, snapshot, "Cancelled", "Cancelled in progress")
+	return err
+}
+
+// saveSnapshotLog keeps the log captured of the failed snapshot in a ConfigMap owned by the snapshot
+func (c *Controller) saveSnapshotLog(ctx context.Context, snapshot *cbv1alpha1.Snapshot, cause error) {
+	logName := "snapshot:" + snapshot.ObjectMeta.Name
+	utils.NewNamedLog(logName).Warningf("Failed : %s", cause.Error())
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      snapshot.ObjectMeta.Name + "-log",
+			Namespace: c.namespace,
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(snapshot, cbv1alpha1.SchemeGroupVersion.WithKind("Snapshot")),
+			},
+		},
+		Data: map[string]string{"snapshot.log": string(utils.CapturedLog(logName))},
+	}
+	configMaps := c.kubeclientset.CoreV1().ConfigMaps(c.namespace)
+	_, err := configMaps.Create(ctx, cm, metav1.CreateOptions{})
+	if errors.IsAlreadyExists(err) {
+		_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		klog.Warningf("snapshot:%s saving log failed : %s", snapshot.ObjectMeta.Name, err.Error())
+		return
+	}
+	snapshot.Status.Log = &cbv1alpha1.LogReference{ConfigMap: cm.ObjectMeta.Name}
+}
+
+// snapshotLog returns the log of the snapshot referred in the status, from the ConfigMap or the objectstore
+func (c *Controller) snapshotLog(ctx context.Context, name string) ([]byte, error) {
+	snapshot, err := c.cbclientset.ClustersnapshotV1alpha1().Snapshots(c.namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if snapshot.Status.Log == nil {
+		return nil, fmt.Errorf("No log of snapshot %s", name)
+	}
+	if snapshot.Status.Log.ConfigMap != "" {
+		cm, err := c.kubeclientset.CoreV1().ConfigMaps(c.namespace).Get(
+			ctx, snapshot.Status.Log.ConfigMap, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return []byte(cm.Data["snapshot.log"]), nil
+	}
+	bucket, err := c.getBucket(ctx, c.namespace, snapshot.Status.Log.ObjectstoreConfig,
+		c.kubeclientset, c.cbclientset, c.insecure)
+	if err != nil {
+		return nil, err
+	}
+	return cluster.DownloadSnapshotLog(ctx, snapshot, bucket)
 }
 
 // enqueueSnapshot takes a Snapshot resource and converts it into a namespace/name
@@ -274,6 +420,13 @@ func (c *Controller) enqueueSnapshot(obj interface{}) {
 		runtime.HandleError(err)
 		return
 	}
+
+	// cancel the snapshot in progress
+	if snapshot, ok := obj.(*cbv1alpha1.Snapshot); ok && snapshotCancelRequested(snapshot) {
+		if c.snapshotOps.cancel(key) {
+			klog.Infof("snapshot:%s cancel requested", snapshot.ObjectMeta.Name)
+		}
+	}
 	c.snapshotQueue.AddRateLimited(key)
 }
 
@@ -293,7 +446,8 @@ func (c *Controller) deleteSnapshot(obj interface{}) {
 	}
 
 	// context for delete snapshot
-	ctx := context.TODO()
+	ctx, cancel := c.handlerContext()
+	defer cancel()
 
 	bucket, err := c.getBucket(ctx, c.namespace, snapshot.Spec.ObjectstoreConfig,
 		c.kubeclientset, c.cbclientset, c.insecure)
@@ -303,9 +457,32 @@ func (c *Controller) deleteSnapshot(obj interface{}) {
 	}
 
 	// Delete snapshot data.
+	// Blobs of incremental snapshots are deleted by the object syncer.
 	klog.Infof("Deleting snapshot %s data from objectstore %s", snapshot.ObjectMeta.Name, snapshot.Spec.ObjectstoreConfig)
-	err = bucket.Delete(snapshot.ObjectMeta.Name + ".tgz")
+	err = bucket.Delete(ctx, cluster.SnapshotObjectName(snapshot))
 	if err != nil {
 		runtime.HandleError(err)
 	}
+	if snapshot.Status.Report != nil {
+		err = bucket.Delete(ctx, snapshot.Status.Report.Name)
+		if err != nil {
+			runtime.HandleError(err)
+		}
+	}
+	if snapshot.Status.Log != nil && snapshot.Status.Log.Name != "" {
+		err = bucket.Delete(ctx, snapshot.Status.Log.Name)
+		if err != nil {
+			runtime.HandleError(err)
+		}
+	}
+}
+
+// runPostHooks runs post-snapshot hooks, apart from the operation context when it is done
+func (c *Controller) runPostHooks(opCtx context.Context, snapshot *cbv1alpha1.Snapshot) error {
+	if opCtx.Err() != nil {
+		ctx, cancel := stoppedContext()
+		defer cancel()
+		return c.clusterCmd.SnapshotHooks(ctx, snapshot, cluster.HookPhasePost)
+	}
+	return c.clusterCmd.SnapshotHooks(opCtx, snapshot, cluster.HookPhasePost)
 }
@@ -1,21 +1,22 @@
 package main
 
 import (
-	"archive/tar"
-	"compress/gzip"
 	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"os"
 	"strings"
 	"time"
 
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	apiruntime "k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
 
 	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/cluster"
 	"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
 	"github.com/ryo-watanabe/k8s-snap/pkg/utils"
 )
@@ -48,7 +49,7 @@ func (c *Controller) getObjectList(ctx context.Context) ([]objectstore.ObjectInf
 		}
 
 		// Append objects list
-		objList, err := bucket.ListObjectInfo()
+		objList, err := bucket.ListObjectInfo(ctx)
 		if err != nil {
 			return nil, fmt.Errorf("List objects error : %s", err.Error())
 		}
@@ -60,86 +61,42 @@ func (c *Controller) getObjectList(ctx context.Context) ([]objectstore.ObjectInf
 
 func (c *Controller) restoreSnapshotFromObject(ctx context.Context, object objectstore.ObjectInfo) error {
 
-	// Download object
-	snapshotFile, err := os.Create("/tmp/" + object.Name)
-	if err != nil {
-		return err
+	name, ok := cluster.SnapshotNameFromObject(object.Name)
+	if !ok {
+		return fmt.Errorf("%s is not a snapshot object", object.Name)
 	}
-	defer func() { _ = snapshotFile.Close() }()
+
+	// Download object
 	bucket, err := c.getBucket(ctx, c.namespace, object.BucketConfigName, c.kubeclientset, c.cbclientset, c.insecure)
 	if err != nil {
 		return err
 	}
-	err = bucket.Download(snapshotFile, object.Name)
+	err = cluster.DownloadSnapshotArchive(ctx, name, bucket)
 	if err != nil {
 		return err
 	}
-	_ = snapshotFile.Close()
 
 	return c.restoreSnapshotFromObjectFile(ctx, object)
 }
 
 func (c *Controller) restoreSnapshotFromObjectFile(ctx context.Context, object objectstore.ObjectInfo) error {
 
-	// Read tar.gz
-	snapshotFile, err := os.Open("/tmp/" + object.Name)
-	if err != nil {
-		return err
-	}
-	tgz, err := gzip.NewReader(snapshotFile)
-	if err != nil {
-		return err
-	}
-	defer func() { _ = tgz.Close() }()
-
-	// Search snapshot.json in tgz file
-	tarReader := tar.NewReader(tgz)
-	name := strings.TrimSuffix(object.Name, ".tgz")
-	found := false
-	for {
-		header, err := tarReader.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
-		if header.Typeflag == tar.TypeReg {
-			path := strings.Replace(header.Name, name, "", 1)
-			if path == "/snapshot.json" {
-				found = true
-				break
-			}
-		}
-	}
-	if !found {
-		return fmt.Errorf("Cannot find snapshot.json file in %s", object.Name)
+	name, ok := cluster.SnapshotNameFromObject(object.Name)
+	if !ok {
+		return fmt.Errorf("%s is not a snapshot object", object.Name)
 	}
 
-	// Load item
-	var item unstructured.Unstructured
-	bytes, err := ioutil.ReadAll(tarReader)
+	// Read snapshot.json with the reader for the archive format version, skipping entries
+	archive, err := cluster.StreamSnapshotArchive(name, "/tmp/"+name+cluster.ArchiveSuffix,
+		func(string, io.Reader) error { return nil })
 	if err != nil {
 		return err
 	}
-	err = item.UnmarshalJSON(bytes)
+	item := *archive.Snapshot
+	archived := &cbv1alpha1.Snapshot{}
+	err = apiruntime.DefaultUnstructuredConverter.FromUnstructured(item.Object, archived)
 	if err != nil {
-		ermsg := err.Error()
-		if len(ermsg) > 300 {
-			ermsg = ermsg[0:300] + "....."
-		}
-		// Add kind and apiVersion to older snapshots
-		//if strings.Contains(ermsg, "Object 'Kind' is missing") {
-		//	snapshotJSON := "{\"kind\":\"Snapshot\",\"apiVersion\":\"clustersnapshot.rywt.io/v1alpha1\","
-		//	snapshotJSON += string(bytes)[1:]
-		//	err = item.UnmarshalJSON([]byte(snapshotJSON))
-		//	if err != nil {
-		//		return err
-		//	}
-		//} else {
-		//	return fmt.Errorf("UnmarshalJSON error : %s", ermsg)
-		//}
-		return fmt.Errorf("UnmarshalJSON error : %s", ermsg)
+		return fmt.Errorf("Converting snapshot.json failed : %s", err.Error())
 	}
 
 	// Create item
@@ -156,13 +113,30 @@ func (c *Controller) restoreSnapshotFromObjectFile(ctx context.Context, object o
 	if err != nil {
 		return err
 	}
+	// Status is not created with the resource, set it from snapshot.json
+	snapshot = snapshot.DeepCopy()
+	snapshot.Status = archived.Status
 	snapshot.Status.StoredFileSize = object.Size
 	snapshot.Status.StoredTimestamp = metav1.NewTime(object.Timestamp)
+	snapshot.Status.ArchiveFormatVersion = int32(archive.FormatVersion)
+	snapshot.Status.Compression = cluster.CompressionFromObject(object.Name)
 	tmpAvailableUntil := metav1.NewTime(time.Now().Add(24 * 30 * time.Hour))
 	if snapshot.Status.AvailableUntil.Before(&tmpAvailableUntil) {
 		snapshot.Status.AvailableUntil = tmpAvailableUntil
 	}
 
+	// Move contents to the report, the snapshot fails without it
+	bucket, err := c.getBucket(ctx, c.namespace, object.BucketConfigName, c.kubeclientset, c.cbclientset, c.insecure)
+	if err == nil {
+		err = cluster.UploadSnapshotReport(ctx, snapshot, bucket)
+	}
+	if err != nil {
+		klog.Warningf("snapshot:%s uploading report failed : %s", name, err.Error())
+		snapshot.Status.Contents = nil
+		_, err = c.updateSnapshotStatus(ctx, snapshot, "Failed", "Uploading report failed : "+err.Error())
+		return err
+	}
+
 	// Update snapshot as 'Completed'
 	_, err = c.updateSnapshotStatus(ctx, snapshot, "Completed", "")
 	if err != nil {
@@ -176,13 +150,16 @@ func (c *Controller) syncObjects(deleteOrphanObjects, restoreOrphanedSnapshots,
 
 	if !deleteOrphanObjects &&
 		!restoreOrphanedSnapshots &&
-		!validateFileinfo {
+		!validateFileinfo &&
+		!c.migratesnapshots &&
+		c.verifyintervalsec == 0 {
 		// Do nothing
 		return nil
 	}
 
 	// context for sync objects
-	ctx := context.TODO()
+	ctx, cancel := c.handlerContext()
+	defer cancel()
 
 	// sync objects log
 	slog := utils.NewNamedLog("sync objects:")
@@ -201,10 +178,21 @@ func (c *Controller) syncObjects(deleteOrphanObjects, restoreOrphanedSnapshots,
 
 	// Compare to find orphan objects
 	orphanObjects := make([]objectstore.ObjectInfo, 0)
+	blobBuckets := make(map[string]bool)
 	for _, object := range objectList {
+		// Blobs are collected by reference from manifests
+		if strings.HasPrefix(object.Name, cluster.BlobPrefix) {
+			blobBuckets[object.BucketConfigName] = true
+			continue
+		}
+		// Reports and logs are deleted with snapshots and restores
+		if strings.HasPrefix(object.Name, cluster.ReportPrefix) || strings.HasSuffix(object.Name, cluster.LogSuffix) {
+			continue
+		}
+		name, _ := cluster.SnapshotNameFromObject(object.Name)
 		found := false
 		for _, snap := range snapshots.Items {
-			if snap.ObjectMeta.Name+".tgz" == object.Name {
+			if snap.ObjectMeta.Name == name {
 				found = true
 				break
 			}
@@ -227,7 +215,7 @@ func (c *Controller) syncObjects(deleteOrphanObjects, restoreOrphanedSnapshots,
 		found := false
 		valid := false
 		for _, object := range objectList {
-			if snap.ObjectMeta.Name+".tgz" == object.Name {
+			if cluster.SnapshotObjectName(&snap) == object.Name {
 				found = true
 				t := metav1.NewTime(object.Timestamp).Rfc3339Copy()
 				if snap.Status.StoredTimestamp.Equal(&t) &&
@@ -235,8 +223,7 @@ func (c *Controller) syncObjects(deleteOrphanObjects, restoreOrphanedSnapshots,
 
 					// If the object found in other bucket, update the snapshot with correct config
 					if snap.Spec.ObjectstoreConfig != object.BucketConfigName {
-						snapshots.Items[i].Spec.ObjectstoreConfig = object.BucketConfigName
-						updatedSnap, err := c.updateSnapshotStatus(ctx, &snapshots.Items[i], snap.Status.Phase, snap.Status.Reason)
+						updatedSnap, err := c.updateSnapshotObjectstoreConfig(ctx, &snapshots.Items[i], object.BucketConfigName)
 						if err != nil {
 							return err
 						}
@@ -269,12 +256,24 @@ func (c *Controller) syncObjects(deleteOrphanObjects, restoreOrphanedSnapshots,
 			if err != nil {
 				return err
 			}
-			err = bucket.Delete(object.Name)
+			err = bucket.Delete(ctx, object.Name)
 			if err != nil {
 				slog.Warningf("- Cannot delete object %s : %s", object.Name, err.Error())
 			}
 		}
 
+		// Delete blobs no longer referenced
+		for bucketConfigName := range blobBuckets {
+			bucket, err := c.getBucket(ctx, c.namespace, bucketConfigName, c.kubeclientset, c.cbclientset, c.insecure)
+			if err != nil {
+				return err
+			}
+			err = cluster.GarbageCollectBlobs(ctx, bucket)
+			if err != nil {
+				slog.Warningf("- Cannot collect blobs in %s : %s", bucketConfigName, err.Error())
+			}
+		}
+
 		// Or restore orphaned snapshots
 	} else if restoreOrphanedSnapshots {
 		for _, object := range orphanObjects {
@@ -323,12 +322,115 @@ func (c *Controller) syncObjects(deleteOrphanObjects, restoreOrphanedSnapshots,
 	// Set 'Completed' for valid snaps
 	for i, snap := range validSnaps {
 		if snap.Status.Phase != "Completed" {
-			_, err = c.updateSnapshotStatus(ctx, &validSnaps[i], "Completed", "")
+			updatedSnap, err := c.updateSnapshotStatus(ctx, &validSnaps[i], "Completed", "")
 			if err != nil {
 				return err
 			}
+			validSnaps[i] = *updatedSnap
+		}
+	}
+
+	// Migrate archives of valid snaps in older formats
+	if c.migratesnapshots {
+		for i, snap := range validSnaps {
+			if snap.Status.ArchiveFormatVersion >= cluster.ArchiveFormatVersion {
+				continue
+			}
+			slog.Infof("Migrating snapshot %s", snap.ObjectMeta.Name)
+			snapshot, err := c.migrateSnapshot(ctx, &validSnaps[i])
+			if err != nil {
+				slog.Warningf("- Cannot migrate snapshot %s : %s", snap.ObjectMeta.Name, err.Error())
+				continue
+			}
+			validSnaps[i] = *snapshot
+		}
+	}
+
+	// Verify archives of valid snaps periodically
+	if c.verifyintervalsec > 0 {
+		nowTime := metav1.NewTime(time.Now())
+		for i, snap := range validSnaps {
+			verifyTime := metav1.NewTime(snap.Status.VerifiedTimestamp.Add(time.Duration(c.verifyintervalsec) * time.Second))
+			if !verifyTime.Before(&nowTime) {
+				continue
+			}
+			// Archives in format version 0 have no manifest to verify
+			if snap.Status.ArchiveFormatVersion < 1 {
+				c.skipVerification(ctx, &validSnaps[i], slog)
+				continue
+			}
+			slog.Infof("Verifying snapshot %s", snap.ObjectMeta.Name)
+			_, _, err = c.verifySnapshot(ctx, &validSnaps[i])
+			if err != nil {
+				slog.Warningf("- Cannot verify snapshot %s : %s", snap.ObjectMeta.Name, err.Error())
+			}
 		}
 	}
 
 	return nil
 }
+
+// skipVerification records the snapshot not verified for no manifest
+func (c *Controller) skipVerification(ctx context.Context, snapshot *cbv1alpha1.Snapshot, slog *utils.NamedLog) {
+	slog.Infof("Skipped verifying snapshot %s : no manifest", snapshot.ObjectMeta.Name)
+	condition := meta.FindStatusCondition(snapshot.Status.Conditions, cluster.ConditionVerified)
+	if condition != nil && condition.Reason == cluster.ReasonNoManifest {
+		return
+	}
+	snapshotCopy := snapshot.DeepCopy()
+	cluster.SetNoManifestCondition(snapshotCopy)
+	_, err := c.updateSnapshotStatus(ctx, snapshotCopy, snapshotCopy.Status.Phase, snapshotCopy.Status.Reason)
+	if err != nil {
+		slog.Warningf("- Cannot update snapshot %s : %s", snapshot.ObjectMeta.Name, err.Error())
+	}
+}
+
+// migrateSnapshot rewrites the archive of the snapshot into the current format version
+func (c *Controller) migrateSnapshot(ctx context.Context, snapshot *cbv1alpha1.Snapshot) (*cbv1alpha1.Snapshot, error) {
+
+	opCtx, cancel := withTimeout(ctx, c.snapshotTimeout(snapshot))
+	defer cancel()
+
+	bucket, err := c.getBucket(opCtx, c.namespace, snapshot.Spec.ObjectstoreConfig,
+		c.kubeclientset, c.cbclientset, c.insecure)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotCopy := snapshot.DeepCopy()
+	_, err = c.clusterCmd.Migrate(opCtx, snapshotCopy, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.updateSnapshotStatus(ctx, snapshotCopy, snapshotCopy.Status.Phase, snapshotCopy.Status.Reason)
+}
+
+// updateSnapshotObjectstoreConfig points the snapshot to the objectstore config where its object found.
+// This is the only spec update of the controller, retried on conflicts with the latest snapshot.
+func (c *Controller) updateSnapshotObjectstoreConfig(ctx context.Context, snapshot *cbv1alpha1.Snapshot,
+	configName string) (*cbv1alpha1.Snapshot, error) {
+	klog.Infof("snapshot:%s objectstore config %s => %s",
+		snapshot.ObjectMeta.Name, snapshot.Spec.ObjectstoreConfig, configName)
+	snapshots := c.cbclientset.ClustersnapshotV1alpha1().Snapshots(snapshot.Namespace)
+	snapshotCopy := snapshot.DeepCopy()
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		snapshotCopy.Spec.ObjectstoreConfig = configName
+		updated, err := snapshots.Update(ctx, snapshotCopy, metav1.UpdateOptions{})
+		if errors.IsConflict(err) {
+			latest, getErr := snapshots.Get(ctx, snapshot.ObjectMeta.Name, metav1.GetOptions{})
+			if getErr != nil {
+				return getErr
+			}
+			snapshotCopy = latest
+		} else if err == nil {
+			snapshotCopy = updated
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to update objectstore config of snapshot %s : %s",
+			snapshot.ObjectMeta.Name, err.Error())
+	}
+	return snapshotCopy, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/cluster"
+)
+
+// operations holds cancel funcs of snapshots or restores in progress
+type operations struct {
+	lock    sync.Mutex
+	cancels map[string]context.CancelFunc
+}
+
+func newOperations() *operations {
+	return &operations{cancels: make(map[string]context.CancelFunc)}
+}
+
+// start returns the context of the operation derived from the parent and the func to call when the operation ends
+func (o *operations) start(parent context.Context, key string, timeout time.Duration) (context.Context, func()) {
+	ctx, cancel := withTimeout(parent, timeout)
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.cancels[key] = cancel
+	return ctx, func() {
+		o.lock.Lock()
+		defer o.lock.Unlock()
+		delete(o.cancels, key)
+		cancel()
+	}
+}
+
+// cancel cancels the operation in progress, returns false when not in progress
+func (o *operations) cancel(key string) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	cancel, ok := o.cancels[key]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// Timeout of handlers calling API and object store other than snapshots and restores
+var handlerTimeout = 30 * time.Minute
+
+// handlerContext returns a context derived from the controller run context with the handler timeout
+func (c *Controller) handlerContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(c.ctx, handlerTimeout)
+}
+
+// stoppedContext returns a context apart from the controller run context to update status after stopped
+func stoppedContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), handlerTimeout)
+}
+
+// withTimeout returns a context with the timeout, or without deadline when the timeout is 0
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// snapshotTimeout returns the deadline of the snapshot, or the controller default
+func (c *Controller) snapshotTimeout(snapshot *cbv1alpha1.Snapshot) time.Duration {
+	if snapshot.Spec.Timeout.Duration > 0 {
+		return snapshot.Spec.Timeout.Duration
+	}
+	return time.Duration(c.snapshottimeoutsec) * time.Second
+}
+
+// restoreTimeout returns the deadline of the restore, or the controller default
+func (c *Controller) restoreTimeout(restore *cbv1alpha1.Restore) time.Duration {
+	if restore.Spec.Timeout.Duration > 0 {
+		return restore.Spec.Timeout.Duration
+	}
+	return time.Duration(c.restoretimeoutsec) * time.Second
+}
+
+func snapshotCancelRequested(snapshot *cbv1alpha1.Snapshot) bool {
+	return snapshot.Spec.Cancel || snapshot.ObjectMeta.Annotations[cluster.CancelAnnotation] == "true"
+}
+
+func restoreCancelRequested(restore *cbv1alpha1.Restore) bool {
+	return restore.Spec.Cancel || restore.ObjectMeta.Annotations[cluster.CancelAnnotation] == "true"
+}
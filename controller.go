@@ -58,21 +58,35 @@ type Controller struct {
 	restoreLister   listers.RestoreLister
 	restoresSynced  cache.InformerSynced
 
-	snapshotQueue workqueue.RateLimitingInterface
-	restoreQueue  workqueue.RateLimitingInterface
-	recorder      record.EventRecorder
+	verificationLister  listers.SnapshotVerificationLister
+	verificationsSynced cache.InformerSynced
+
+	snapshotQueue     workqueue.RateLimitingInterface
+	restoreQueue      workqueue.RateLimitingInterface
+	verificationQueue workqueue.RateLimitingInterface
+	recorder          record.EventRecorder
 
 	housekeepstore   bool
 	restoresnapshots bool
 	validatefileinfo bool
 	insecure         bool
 	createbucket     bool
+	migratesnapshots bool
 
 	maxretryelapsedsec int
+	verifyintervalsec  int
+	snapshottimeoutsec int
+	restoretimeoutsec  int
 
 	namespace string
 	labels    map[string]string
 
+	// Snapshots and restores in progress to cancel
+	snapshotOps *operations
+	restoreOps  *operations
+	// Context of the controller run, operations in progress are cancelled when stopped
+	ctx context.Context
+
 	clusterCmd cluster.Cluster
 	getBucket  func(ctx context.Context, namespace, objectstoreConfig string, kubeclient kubernetes.Interface,
 		client clientset.Interface, insecure bool) (objectstore.Objectstore, error)
@@ -85,9 +99,10 @@ func NewController(
 	cbclientset clientset.Interface,
 	snapshotInformer informers.SnapshotInformer,
 	restoreInformer informers.RestoreInformer,
+	verificationInformer informers.SnapshotVerificationInformer,
 	namespace string,
-	housekeepstore, restoresnapshots, validatefileinfo, insecure, createbucket bool,
-	maxretryelapsedsec int,
+	housekeepstore, restoresnapshots, validatefileinfo, insecure, createbucket, migratesnapshots bool,
+	maxretryelapsedsec, verifyintervalsec, snapshottimeoutsec, restoretimeoutsec int,
 	clusterCmd cluster.Cluster) *Controller {
 	//bucket *objectstore.Bucket) *Controller {
 
@@ -102,29 +117,40 @@ func NewController(
 	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerAgentName})
 
 	controller := &Controller{
-		kubeclientset:      kubeclientset,
-		cbclientset:        cbclientset,
-		dynamic:            dynamic,
-		snapshotLister:     snapshotInformer.Lister(),
-		snapshotsSynced:    snapshotInformer.Informer().HasSynced,
-		restoreLister:      restoreInformer.Lister(),
-		restoresSynced:     restoreInformer.Informer().HasSynced,
-		snapshotQueue:      workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Snapshots"),
-		restoreQueue:       workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Restores"),
+		kubeclientset:       kubeclientset,
+		cbclientset:         cbclientset,
+		dynamic:             dynamic,
+		snapshotLister:      snapshotInformer.Lister(),
+		snapshotsSynced:     snapshotInformer.Informer().HasSynced,
+		restoreLister:       restoreInformer.Lister(),
+		restoresSynced:      restoreInformer.Informer().HasSynced,
+		verificationLister:  verificationInformer.Lister(),
+		verificationsSynced: verificationInformer.Informer().HasSynced,
+		snapshotQueue:       workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Snapshots"),
+		restoreQueue:        workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Restores"),
+		verificationQueue: workqueue.NewNamedRateLimitingQueue(
+			workqueue.DefaultControllerRateLimiter(), "SnapshotVerifications"),
 		recorder:           recorder,
 		housekeepstore:     housekeepstore,
 		restoresnapshots:   restoresnapshots,
 		validatefileinfo:   validatefileinfo,
 		insecure:           insecure,
 		createbucket:       createbucket,
+		migratesnapshots:   migratesnapshots,
 		maxretryelapsedsec: maxretryelapsedsec,
+		verifyintervalsec:  verifyintervalsec,
+		snapshottimeoutsec: snapshottimeoutsec,
+		restoretimeoutsec:  restoretimeoutsec,
 		namespace:          namespace,
 		labels: map[string]string{
 			"app":        "k8s-snap",
 			"controller": "k8s-snap-controller",
 		},
-		clusterCmd: clusterCmd,
-		getBucket:  getBucketFunc,
+		snapshotOps: newOperations(),
+		restoreOps:  newOperations(),
+		ctx:         context.Background(),
+		clusterCmd:  clusterCmd,
+		getBucket:   getBucketFunc,
 	}
 
 	klog.Info("Setting up event handlers")
@@ -144,7 +170,15 @@ func NewController(
 		UpdateFunc: func(old, new interface{}) {
 			controller.enqueueRestore(new)
 		},
-		//DeleteFunc: controller.enqueueRestore,
+		DeleteFunc: controller.deleteRestore,
+	})
+
+	// Set up an event handler for when SnapshotVerification resources change
+	verificationInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: controller.enqueueVerification,
+		UpdateFunc: func(old, new interface{}) {
+			controller.enqueueVerification(new)
+		},
 	})
 
 	return controller
@@ -158,9 +192,16 @@ func (c *Controller) Run(snapshotthreads, restorethreads int, stopCh <-chan stru
 	defer runtime.HandleCrash()
 	defer c.snapshotQueue.ShutDown()
 	defer c.restoreQueue.ShutDown()
+	defer c.verificationQueue.ShutDown()
 
-	// context for controller run
-	ctx := context.TODO()
+	// context for controller run, done when stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+	c.ctx = ctx
 
 	klog.Info("Checking namespace")
 	_, err := c.kubeclientset.CoreV1().Namespaces().Get(ctx, c.namespace, metav1.GetOptions{})
@@ -186,14 +227,14 @@ func (c *Controller) Run(snapshotthreads, restorethreads int, stopCh <-chan stru
 		klog.Infof("- Objectstore Config name:%s endpoint:%s bucket:%s",
 			bucket.GetName(), bucket.GetEndpoint(), bucket.GetBucketName())
 
-		found, err := bucket.ChkBucket()
+		found, err := bucket.ChkBucket(ctx)
 		if err != nil {
 			klog.Fatalf("Check bucket error : %s", err.Error())
 		}
 		if !found {
 			if c.createbucket {
 				klog.Infof("Creating bucket %s", bucket.GetBucketName())
-				err = bucket.CreateBucket()
+				err = bucket.CreateBucket(ctx)
 				if err != nil {
 					klog.Fatalf("Create bucket error : %s", err.Error())
 				}
@@ -202,7 +243,7 @@ func (c *Controller) Run(snapshotthreads, restorethreads int, stopCh <-chan stru
 			}
 		}
 
-		objList, err := bucket.ListObjectInfo()
+		objList, err := bucket.ListObjectInfo(ctx)
 		if err != nil {
 			klog.Fatalf("List objects error : %s", err.Error())
 		}
@@ -217,7 +258,7 @@ func (c *Controller) Run(snapshotthreads, restorethreads int, stopCh <-chan stru
 
 	// Wait for the caches to be synced before starting workers
 	klog.Info("Waiting for informer caches to sync")
-	if ok := cache.WaitForCacheSync(stopCh, c.snapshotsSynced, c.restoresSynced); !ok {
+	if ok := cache.WaitForCacheSync(stopCh, c.snapshotsSynced, c.restoresSynced, c.verificationsSynced); !ok {
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
 
@@ -239,6 +280,7 @@ func (c *Controller) Run(snapshotthreads, restorethreads int, stopCh <-chan stru
 	for i := 0; i < restorethreads; i++ {
 		go wait.Until(c.runRestoreWorker, time.Second, stopCh)
 	}
+	go wait.Until(c.runVerificationWorker, time.Second, stopCh)
 
 	// Start object syncer
 	go wait.Until(c.runObjectSyncer, time.Duration(300)*time.Second, stopCh)
@@ -4,17 +4,22 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/cenkalti/backoff"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/diff"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
 	dynamicfake "k8s.io/client-go/dynamic/fake"
 	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
@@ -31,6 +36,7 @@ import (
 	"github.com/ryo-watanabe/k8s-snap/pkg/client/clientset/versioned/fake"
 	"github.com/ryo-watanabe/k8s-snap/pkg/cluster"
 	"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
+	"github.com/ryo-watanabe/k8s-snap/pkg/utils"
 )
 
 var (
@@ -52,8 +58,12 @@ type Case struct {
 	queueOnly        bool
 	handleKey        string
 	restoreerror     error
+	rollbackerror    error
 	snaperror        error
 	uploaderror      error
+	cancel           bool
+	timeout          bool
+	stop             bool
 }
 
 func newSnapshotCase(resultStatus, reason string) Case {
@@ -74,6 +84,12 @@ func newSnapshotCase(resultStatus, reason string) Case {
 		handleKey: "test1",
 	}
 	c.updatedSnapshots[1].Status.Reason = reason
+	// Log uploaded with the archive, or kept in a ConfigMap on failure
+	if resultStatus == "Completed" {
+		c.updatedSnapshots[1].Status.Log = &clustersnapshot.LogReference{ObjectstoreConfig: "config", Name: "test1.log"}
+	} else {
+		c.updatedSnapshots[1].Status.Log = &clustersnapshot.LogReference{ConfigMap: "test1-log"}
+	}
 	return c
 }
 
@@ -127,7 +143,7 @@ func TestSnapshot(t *testing.T) {
 			},
 			handleKey: "test1",
 		},
-		// 5:Mark Failed to InProgress snapshot
+		// 5:Mark Failed to InProgress snapshot and delete
 		Case{
 			snapshots: []*clustersnapshot.Snapshot{
 				newConfiguredSnapshot("test1", "InProgress"),
@@ -136,6 +152,9 @@ func TestSnapshot(t *testing.T) {
 				newConfiguredSnapshot("test1", "Failed"),
 				newConfiguredSnapshot("test1", "Failed"),
 			},
+			deleteSnapshots: []*clustersnapshot.Snapshot{
+				newConfiguredSnapshot("test1", "Failed"),
+			},
 			handleKey: "test1",
 		},
 		// 6:Past date AvailableUntil
@@ -183,6 +202,27 @@ func TestSnapshot(t *testing.T) {
 		Case{handleKey: "test1"},
 		// 14:Invalid key
 		Case{handleKey: "test1/test1"},
+		// 15:Compression of the objectstore config as default, not written to spec
+		newSnapshotCase("Completed", ""),
+		// 16:Cancel annotated in queue
+		Case{
+			snapshots: []*clustersnapshot.Snapshot{
+				newConfiguredSnapshot("test1", "InQueue"),
+			},
+			updatedSnapshots: []*clustersnapshot.Snapshot{
+				newConfiguredSnapshot("test1", "Cancelled"),
+				newConfiguredSnapshot("test1", "Cancelled"),
+			},
+			handleKey: "test1",
+		},
+		// 17:InQueue > InProgress > Cancelled
+		newSnapshotCase("Cancelled", "Cancelled in progress"),
+		// 18:InQueue > InProgress > Failed - timed out
+		newSnapshotCase("Failed", "Timed out after 10ms : context deadline exceeded"),
+		// 19:Compression of the objectstore config as default, level of the snapshot kept
+		newSnapshotCase("Completed", ""),
+		// 20:InQueue > InProgress > Failed - controller stopped
+		newSnapshotCase("Failed", "Controller stopped while taking the snapshot"),
 	}
 
 	// Additional test data:
@@ -206,6 +246,9 @@ func TestSnapshot(t *testing.T) {
 	// 5:Mark Failed to InProgress snapshot
 	cases[5].updatedSnapshots[0].Status.Reason = "Controller stopped while taking the snapshot"
 	cases[5].updatedSnapshots[1].Status.Reason = "Controller stopped while taking the snapshot"
+	cases[5].updatedSnapshots[1].Status.AvailableUntil = metav1.NewTime(
+		cases[5].updatedSnapshots[1].ObjectMeta.CreationTimestamp.Add(dur))
+	cases[5].updatedSnapshots[1].Status.TTL.Duration = dur
 	// 6:Past date AvailableUntil
 	past := metav1.NewTime(time.Date(2001, 5, 20, 23, 59, 59, 0, time.UTC))
 	cases[6].snapshots[0].Spec.AvailableUntil = past
@@ -233,9 +276,52 @@ func TestSnapshot(t *testing.T) {
 	cases[12].uploaderror = fmt.Errorf("Mock cluster upload returns not perm error")
 	// 13:Key not found (not error)
 	// 14:Invalid key (not error)
+	// 15:Compression of the objectstore config as default
+	cases[15].configs[0].Spec.Compression = "zstd"
+	cases[15].configs[0].Spec.CompressionLevel = 19
+	cases[15].updatedSnapshots[1].Spec.Compression = "zstd"
+	cases[15].updatedSnapshots[1].Spec.CompressionLevel = 19
+	// 16:Cancel annotated in queue
+	for _, s := range append(cases[16].snapshots, cases[16].updatedSnapshots...) {
+		s.ObjectMeta.Annotations = map[string]string{cluster.CancelAnnotation: "true"}
+		s.Spec.AvailableUntil = future
+	}
+	for _, s := range cases[16].updatedSnapshots {
+		s.Status.Reason = "Cancel requested"
+	}
+	cases[16].updatedSnapshots[1].Status.AvailableUntil = future
+	cases[16].updatedSnapshots[1].Status.TTL.Duration = future.Time.Sub(
+		cases[16].snapshots[0].ObjectMeta.CreationTimestamp.Time)
+	// 17:InQueue > InProgress > Cancelled
+	cases[17].cancel = true
+	// 18:InQueue > InProgress > Failed - timed out
+	cases[18].timeout = true
+	for _, s := range append(cases[18].snapshots, cases[18].updatedSnapshots...) {
+		s.Spec.Timeout.Duration = 10 * time.Millisecond
+	}
+	// 19:Compression of the objectstore config as default, level of the snapshot kept
+	cases[19].configs[0].Spec.Compression = "zstd"
+	cases[19].configs[0].Spec.CompressionLevel = 19
+	for _, s := range append(cases[19].snapshots, cases[19].updatedSnapshots...) {
+		s.Spec.CompressionLevel = 3
+	}
+	cases[19].updatedSnapshots[1].Spec.Compression = "zstd"
+	// 20:InQueue > InProgress > Failed - controller stopped
+	cases[20].stop = true
 
 	for i := range cases {
+		snapshotCalls, hookPhases = 0, nil
 		SnapshotTestCase(&cases[i], t)
+
+		// Hooks run once around snapshots retried
+		if i == 2 || i == 10 || i == 17 {
+			if !reflect.DeepEqual(hookPhases, []string{cluster.HookPhasePre, cluster.HookPhasePost}) {
+				t.Errorf("#%d Hook phases %v not run once", i, hookPhases)
+			}
+		}
+		if i == 10 && snapshotCalls < 2 {
+			t.Errorf("#%d Snapshot not retried : %d", i, snapshotCalls)
+		}
 	}
 }
 
@@ -348,6 +434,57 @@ func TestRestore(t *testing.T) {
 		Case{handleKey: "test1"},
 		// 13:Invalid key
 		Case{handleKey: "test1/test1"},
+		// 14:Rollback annotated > RollingBack > RolledBack
+		Case{
+			restores: []*clustersnapshot.Restore{
+				newConfiguredRestore("test1", "Completed"),
+			},
+			updatedRestores: []*clustersnapshot.Restore{
+				newConfiguredRestore("test1", "RollingBack"),
+				newConfiguredRestore("test1", "RolledBack"),
+			},
+			handleKey: "test1",
+		},
+		// 15:Rollback annotated > RollingBack > RollbackFailed
+		Case{
+			restores: []*clustersnapshot.Restore{
+				newConfiguredRestore("test1", "Failed"),
+			},
+			updatedRestores: []*clustersnapshot.Restore{
+				newConfiguredRestore("test1", "RollingBack"),
+				newConfiguredRestore("test1", "RollbackFailed"),
+			},
+			rollbackerror: fmt.Errorf("Rollback failed for 1 resources"),
+			handleKey:     "test1",
+		},
+		// 16:Cancel requested in queue
+		Case{
+			restores: []*clustersnapshot.Restore{
+				newConfiguredRestore("test1", "InQueue"),
+			},
+			updatedRestores: []*clustersnapshot.Restore{
+				newConfiguredRestore("test1", "Cancelled"),
+				newConfiguredRestore("test1", "Cancelled"),
+			},
+			handleKey: "test1",
+		},
+		// 17:InQueue > InProgress > Cancelled
+		newRestoreCase("Cancelled", "Cancelled in progress"),
+		// 18:InQueue > InProgress > Failed - timed out
+		newRestoreCase("Failed", "Timed out after 10ms : context deadline exceeded"),
+		// 19:Rollback annotated to cancelled restore
+		Case{
+			restores: []*clustersnapshot.Restore{
+				newConfiguredRestore("test1", "Cancelled"),
+			},
+			updatedRestores: []*clustersnapshot.Restore{
+				newConfiguredRestore("test1", "RollingBack"),
+				newConfiguredRestore("test1", "RolledBack"),
+			},
+			handleKey: "test1",
+		},
+		// 20:InQueue > InProgress > Failed - controller stopped
+		newRestoreCase("Failed", "Controller stopped while restoring"),
 	}
 
 	dur, _ := time.ParseDuration("168h0m0s")
@@ -393,6 +530,38 @@ func TestRestore(t *testing.T) {
 	cases[11].updatedRestores[0].Status.AvailableUntil = past
 	// 12:Key not found (not error)
 	// 13:Invalid key (not error)
+	// 14:Rollback annotated
+	for _, i := range []int{14, 15, 19} {
+		cases[i].restores[0].Status.AvailableUntil = future
+		for _, r := range append(cases[i].restores, cases[i].updatedRestores...) {
+			r.ObjectMeta.Annotations = map[string]string{cluster.RollbackAnnotation: "true"}
+		}
+		for _, r := range cases[i].updatedRestores {
+			r.Status.AvailableUntil = future
+		}
+	}
+	// 15:Rollback failed
+	cases[15].updatedRestores[1].Status.Reason = "Rollback failed for 1 resources"
+	// 16:Cancel requested in queue
+	for _, r := range append(cases[16].restores, cases[16].updatedRestores...) {
+		r.Spec.Cancel = true
+		r.Spec.AvailableUntil = future
+	}
+	for _, r := range cases[16].updatedRestores {
+		r.Status.Reason = "Cancel requested"
+	}
+	cases[16].updatedRestores[1].Status.AvailableUntil = future
+	cases[16].updatedRestores[1].Status.TTL.Duration = future.Time.Sub(
+		cases[16].restores[0].ObjectMeta.CreationTimestamp.Time)
+	// 17:InQueue > InProgress > Cancelled
+	cases[17].cancel = true
+	// 18:InQueue > InProgress > Failed - timed out
+	cases[18].timeout = true
+	for _, r := range append(cases[18].restores, cases[18].updatedRestores...) {
+		r.Spec.Timeout.Duration = 10 * time.Millisecond
+	}
+	// 20:InQueue > InProgress > Failed - controller stopped
+	cases[20].stop = true
 
 	for i := range cases {
 		RestoreTestCase(&cases[i], t)
@@ -423,6 +592,12 @@ func newFixture(t *testing.T) *fixture {
 	return f
 }
 
+// Snapshots and restores as stored with the CRD defaults
+var (
+	crdSnapshotTTL = metav1.Duration{Duration: 720 * time.Hour}
+	crdRestoreTTL  = metav1.Duration{Duration: 168 * time.Hour}
+)
+
 func newConfiguredSnapshot(name, phase string) *clustersnapshot.Snapshot {
 	return &clustersnapshot.Snapshot{
 		TypeMeta: metav1.TypeMeta{APIVersion: clustersnapshot.SchemeGroupVersion.String()},
@@ -434,6 +609,7 @@ func newConfiguredSnapshot(name, phase string) *clustersnapshot.Snapshot {
 			ClusterName:       name,
 			Kubeconfig:        "kubeconfig",
 			ObjectstoreConfig: "objectstoreConfig",
+			TTL:               crdSnapshotTTL,
 		},
 		Status: clustersnapshot.SnapshotStatus{
 			Phase: phase,
@@ -494,6 +670,7 @@ func newConfiguredRestore(name, phase string) *clustersnapshot.Restore {
 			Kubeconfig:            "kubeconfig",
 			SnapshotName:          "snapshot",
 			RestorePreferenceName: "restorePreference",
+			TTL:                   crdRestoreTTL,
 		},
 		Status: clustersnapshot.RestoreStatus{
 			Phase: phase,
@@ -509,25 +686,104 @@ type mockCluster struct {
 // Snapshot for fake cluster interface
 var snapshotErr error
 
+// Cancel request while taking the snapshot
+var snapshotCancel func()
+
+// Hung cluster blocking until the deadline
+var snapshotHung bool
+
+// Snapshot calls and hook phases run
+var snapshotCalls int
+var hookPhases []string
+
 func (c *mockCluster) Snapshot(ctx context.Context, snapshot *cbv1alpha1.Snapshot) error {
+	snapshotCalls++
+	if snapshotCancel != nil {
+		snapshotCancel()
+		return ctx.Err()
+	}
+	if snapshotHung {
+		<-ctx.Done()
+		return ctx.Err()
+	}
 	return snapshotErr
 }
 
+// SnapshotHooks for fake cluster interface
+func (c *mockCluster) SnapshotHooks(ctx context.Context, snapshot *cbv1alpha1.Snapshot, phase string) error {
+	hookPhases = append(hookPhases, phase)
+	return nil
+}
+
 // UploadSnapshot for fake cluster interface
 var uploadErr error
 
-func (c *mockCluster) UploadSnapshot(snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) error {
+func (c *mockCluster) UploadSnapshot(ctx context.Context, snapshot *cbv1alpha1.Snapshot,
+	bucket objectstore.Objectstore) error {
 	return uploadErr
 }
 
 // Restore for fake cluster interface
 var restoreErr error
 
-func (c *mockCluster) Restore(restore *cbv1alpha1.Restore, pref *cbv1alpha1.RestorePreference,
+// Cancel request while restoring
+var restoreCancel func()
+
+// Hung cluster blocking until the deadline
+var restoreHung bool
+
+func (c *mockCluster) Restore(ctx context.Context, restore *cbv1alpha1.Restore, pref *cbv1alpha1.RestorePreference,
 	bucket objectstore.Objectstore) error {
+	if restoreCancel != nil {
+		restoreCancel()
+		return ctx.Err()
+	}
+	if restoreHung {
+		<-ctx.Done()
+		return ctx.Err()
+	}
 	return restoreErr
 }
 
+// Rollback for fake cluster interface
+var rollbackErr error
+
+func (c *mockCluster) Rollback(ctx context.Context, restore *cbv1alpha1.Restore, bucket objectstore.Objectstore) error {
+	return rollbackErr
+}
+
+// Verify for fake cluster interface
+var verifyErr error
+var verifyStatus = metav1.ConditionTrue
+
+func (c *mockCluster) Verify(ctx context.Context, snapshot *cbv1alpha1.Snapshot,
+	bucket objectstore.Objectstore) (*cluster.ArchiveManifest, error) {
+	if verifyErr != nil {
+		return nil, verifyErr
+	}
+	meta.SetStatusCondition(&snapshot.Status.Conditions, metav1.Condition{
+		Type:    cluster.ConditionVerified,
+		Status:  verifyStatus,
+		Reason:  "Verify",
+		Message: "verify message",
+	})
+	snapshot.Status.VerifiedTimestamp = metav1.NewTime(time.Now())
+	return &cluster.ArchiveManifest{FormatVersion: 1, NumberOfEntries: 2}, nil
+}
+
+// Migrate for fake cluster interface
+var migrateErr error
+
+func (c *mockCluster) Migrate(ctx context.Context, snapshot *cbv1alpha1.Snapshot,
+	bucket objectstore.Objectstore) (bool, error) {
+	if migrateErr != nil {
+		return false, migrateErr
+	}
+	snapshot.Status.ArchiveFormatVersion = cluster.ArchiveFormatVersion
+	snapshot.Status.StoredFileSize = int64(262144)
+	return true, nil
+}
+
 func (f *fixture) newController() (*Controller, informers.SharedInformerFactory, kubeinformers.SharedInformerFactory) {
 	f.client = fake.NewSimpleClientset(f.objects...)
 	f.dynamic = dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
@@ -540,12 +796,14 @@ func (f *fixture) newController() (*Controller, informers.SharedInformerFactory,
 		f.kubeclient, f.dynamic, f.client,
 		i.Clustersnapshot().V1alpha1().Snapshots(),
 		i.Clustersnapshot().V1alpha1().Restores(),
-		snapshotNamespace, true, true, true, false, true, 5,
+		i.Clustersnapshot().V1alpha1().SnapshotVerifications(),
+		snapshotNamespace, true, true, true, false, true, false, 5, 0, 0, 0,
 		&mockCluster{},
 	)
 
 	c.snapshotsSynced = alwaysReady
 	c.restoresSynced = alwaysReady
+	c.verificationsSynced = alwaysReady
 	c.recorder = &record.FakeRecorder{}
 
 	return c, i, k8sI
@@ -664,6 +922,7 @@ func filterInformerActions(actions []core.Action) []core.Action {
 			action.Matches("get", "restorepreferences") ||
 			action.Matches("list", "snapshots") ||
 			action.Matches("get", "snapshots") ||
+			action.Matches("get", "restores") ||
 			action.Matches("watch", "snapshots")) {
 			continue
 		}
@@ -673,9 +932,9 @@ func filterInformerActions(actions []core.Action) []core.Action {
 	return ret
 }
 
-func (f *fixture) expectUpdateSnapshotAction(s *clustersnapshot.Snapshot) {
-	f.actions = append(f.actions, core.NewUpdateAction(
-		schema.GroupVersionResource{Resource: "snapshots"}, s.Namespace, s))
+func (f *fixture) expectUpdateSnapshotStatusAction(s *clustersnapshot.Snapshot) {
+	f.actions = append(f.actions, core.NewUpdateSubresourceAction(
+		schema.GroupVersionResource{Resource: "snapshots"}, "status", s.Namespace, s))
 }
 
 func (f *fixture) expectDeleteSnapshotAction(s *clustersnapshot.Snapshot) {
@@ -683,9 +942,9 @@ func (f *fixture) expectDeleteSnapshotAction(s *clustersnapshot.Snapshot) {
 		schema.GroupVersionResource{Resource: "snapshots"}, s.Namespace, s.Name))
 }
 
-func (f *fixture) expectUpdateRestoreAction(s *clustersnapshot.Restore) {
-	f.actions = append(f.actions, core.NewUpdateAction(
-		schema.GroupVersionResource{Resource: "restores"}, s.Namespace, s))
+func (f *fixture) expectUpdateRestoreStatusAction(s *clustersnapshot.Restore) {
+	f.actions = append(f.actions, core.NewUpdateSubresourceAction(
+		schema.GroupVersionResource{Resource: "restores"}, "status", s.Namespace, s))
 }
 
 func (f *fixture) expectDeleteRestoreAction(s *clustersnapshot.Restore) {
@@ -708,9 +967,18 @@ func SnapshotTestCase(c *Case, t *testing.T) {
 	}
 
 	cntl, i, k8sI := f.newController()
+	// Bucket mocked after the objectstore config and the secret got
+	cntl.getBucket = func(ctx context.Context, namespace, objectstoreConfig string, kubeclient kubernetes.Interface,
+		client clientset.Interface, insecure bool) (objectstore.Objectstore, error) {
+		_, err := getBucketFunc(ctx, namespace, objectstoreConfig, kubeclient, client, insecure)
+		if err != nil {
+			return nil, err
+		}
+		return bucketMock{}, nil
+	}
 
 	for _, us := range c.updatedSnapshots {
-		f.expectUpdateSnapshotAction(us)
+		f.expectUpdateSnapshotStatusAction(us)
 	}
 	for _, ds := range c.deleteSnapshots {
 		f.expectDeleteSnapshotAction(ds)
@@ -718,6 +986,13 @@ func SnapshotTestCase(c *Case, t *testing.T) {
 
 	snapshotErr = c.snaperror
 	uploadErr = c.uploaderror
+	if c.cancel {
+		snapshotCancel = func() { cntl.snapshotOps.cancel("default/" + c.handleKey) }
+	}
+	if c.stop {
+		cntl.ctx, snapshotCancel = context.WithCancel(context.Background())
+	}
+	snapshotHung = c.timeout
 
 	f.initInformers(i, k8sI)
 	f.startInformers(i, k8sI)
@@ -728,8 +1003,45 @@ func SnapshotTestCase(c *Case, t *testing.T) {
 		f.run(cntl, "default/"+c.handleKey, "snapshots")
 	}
 
+	// Log of the failed snapshot kept in a ConfigMap
+	if len(c.updatedSnapshots) > 0 {
+		last := c.updatedSnapshots[len(c.updatedSnapshots)-1]
+		if last.Status.Log != nil && last.Status.Log.ConfigMap != "" {
+			cm, err := cntl.kubeclientset.CoreV1().ConfigMaps(cntl.namespace).Get(
+				context.TODO(), last.Status.Log.ConfigMap, metav1.GetOptions{})
+			if err != nil {
+				t.Errorf("Error get log configmap : %s", err.Error())
+			} else if !strings.Contains(cm.Data["snapshot.log"], "Failed : ") {
+				t.Errorf("Failure not logged in configmap : %s", cm.Data["snapshot.log"])
+			}
+			log, err := cntl.snapshotLog(context.TODO(), c.handleKey)
+			if err != nil {
+				t.Errorf("Error get snapshot log : %s", err.Error())
+			} else if string(log) != cm.Data["snapshot.log"] {
+				t.Errorf("Snapshot log not from configmap : %s", string(log))
+			}
+		}
+		// Log uploaded with the archive downloaded from the objectstore
+		if last.Status.Log != nil && last.Status.Log.Name != "" {
+			downloadFilename = ""
+			cntl.getBucket = getBucketMock
+			_, err := cntl.snapshotLog(context.TODO(), c.handleKey)
+			if err != nil {
+				t.Errorf("Error get snapshot log : %s", err.Error())
+			} else if downloadFilename != last.Status.Log.Name {
+				t.Errorf("Snapshot log downloaded from %s, expected %s", downloadFilename, last.Status.Log.Name)
+			}
+		}
+	}
+	// Log capture released when the snapshot ended
+	if utils.CapturedLog("snapshot:"+c.handleKey) != nil {
+		t.Errorf("Log capture of %s not released", c.handleKey)
+	}
+
 	snapshotErr = nil
 	uploadErr = nil
+	snapshotCancel = nil
+	snapshotHung = false
 }
 
 func RestoreTestCase(c *Case, t *testing.T) {
@@ -756,13 +1068,21 @@ func RestoreTestCase(c *Case, t *testing.T) {
 	cntl, i, k8sI := f.newController()
 
 	for _, ur := range c.updatedRestores {
-		f.expectUpdateRestoreAction(ur)
+		f.expectUpdateRestoreStatusAction(ur)
 	}
 	for _, dr := range c.deleteRestores {
 		f.expectDeleteRestoreAction(dr)
 	}
 
 	restoreErr = c.restoreerror
+	rollbackErr = c.rollbackerror
+	if c.cancel {
+		restoreCancel = func() { cntl.restoreOps.cancel("default/" + c.handleKey) }
+	}
+	if c.stop {
+		cntl.ctx, restoreCancel = context.WithCancel(context.Background())
+	}
+	restoreHung = c.timeout
 
 	f.initInformers(i, k8sI)
 	f.startInformers(i, k8sI)
@@ -774,6 +1094,9 @@ func RestoreTestCase(c *Case, t *testing.T) {
 	}
 
 	restoreErr = nil
+	rollbackErr = nil
+	restoreCancel = nil
+	restoreHung = false
 }
 
 func TestQueues(t *testing.T) {
@@ -808,6 +1131,32 @@ func TestQueues(t *testing.T) {
 	}
 }
 
+func TestHandlerContext(t *testing.T) {
+
+	f := newFixture(t)
+	cntl, _, _ := f.newController()
+	var stop context.CancelFunc
+	cntl.ctx, stop = context.WithCancel(context.Background())
+
+	// Bounded and derived from the controller run context
+	ctx, cancel := cntl.handlerContext()
+	defer cancel()
+	if _, ok := ctx.Deadline(); !ok {
+		t.Error("Handler context has no deadline")
+	}
+	stop()
+	if ctx.Err() != context.Canceled {
+		t.Errorf("Handler context not cancelled with the controller : %v", ctx.Err())
+	}
+
+	// Status updated apart from the stopped run context
+	ctx, cancel = stoppedContext()
+	defer cancel()
+	if _, ok := ctx.Deadline(); !ok || ctx.Err() != nil {
+		t.Errorf("Context to update status after stopped not usable : %v", ctx.Err())
+	}
+}
+
 type bucketMock struct {
 	objectstore.Objectstore
 }
@@ -824,34 +1173,60 @@ func (b bucketMock) GetBucketName() string {
 
 var bucketFound bool
 
-func (b bucketMock) ChkBucket() (bool, error) {
+func (b bucketMock) ChkBucket(ctx context.Context) (bool, error) {
 	return bucketFound, nil
 }
 
-func (b bucketMock) CreateBucket() error {
+func (b bucketMock) CreateBucket(ctx context.Context) error {
 	return nil
 }
 
 var deleteFilename string
 
-func (b bucketMock) Delete(filename string) error {
+func (b bucketMock) Delete(ctx context.Context, filename string) error {
 	deleteFilename = filename
 	return nil
 }
 
+var uploadFilename string
+
+func (b bucketMock) Upload(ctx context.Context, file io.Reader, filename string) error {
+	uploadFilename = filename
+	return nil
+}
+
 var downloadFilename string
 
-func (b bucketMock) Download(file *os.File, filename string) error {
+func (b bucketMock) Download(ctx context.Context, file *os.File, filename string) error {
 	downloadFilename = filename
 	return nil
 }
 
 var objectInfoList []objectstore.ObjectInfo
 
-func (b bucketMock) ListObjectInfo() ([]objectstore.ObjectInfo, error) {
+func (b bucketMock) ListObjectInfo(ctx context.Context) ([]objectstore.ObjectInfo, error) {
 	return objectInfoList, nil
 }
 
+func (b bucketMock) ListObjectInfoWithPrefix(ctx context.Context, prefix string) ([]objectstore.ObjectInfo, error) {
+	list := []objectstore.ObjectInfo{}
+	for _, obj := range objectInfoList {
+		if strings.HasPrefix(obj.Name, prefix) {
+			list = append(list, obj)
+		}
+	}
+	return list, nil
+}
+
+func (b bucketMock) GetObjectInfo(ctx context.Context, filename string) (*objectstore.ObjectInfo, error) {
+	for _, obj := range objectInfoList {
+		if obj.Name == filename {
+			return &obj, nil
+		}
+	}
+	return nil, fmt.Errorf("Object %s not found", filename)
+}
+
 func getBucketMock(ctx context.Context, namespace, objectstoreConfig string, kubeclient kubernetes.Interface,
 	client clientset.Interface, insecure bool) (objectstore.Objectstore, error) {
 	return bucketMock{}, nil
@@ -941,11 +1316,34 @@ func TestBucket(t *testing.T) {
 			Timestamp:        time.Date(2001, 5, 20, 23, 59, 59, 0, time.UTC),
 			BucketConfigName: "bucket",
 		},
+		objectstore.ObjectInfo{
+			Name:             "reports/restores/restore1.json",
+			Size:             int64(1024),
+			Timestamp:        time.Date(2001, 5, 20, 23, 59, 59, 0, time.UTC),
+			BucketConfigName: "bucket",
+		},
 	}
 	cntl = newBucketTestController(t, snapshots)
 	doSyncObjects(t, cntl, true, false, false)
 	if deleteFilename != "orphan.tgz" {
-		t.Errorf("Error in delete orphan object")
+		t.Errorf("Error in delete orphan object, or report deleted as orphan")
+	}
+
+	// syncObjects delete unreferenced blob
+	t.Logf("Test:syncObjects delete unreferenced blob")
+	snapshots = []*clustersnapshot.Snapshot{}
+	objectInfoList = []objectstore.ObjectInfo{
+		objectstore.ObjectInfo{
+			Name:             "blobs/unreferenced",
+			Size:             int64(1024),
+			Timestamp:        time.Date(2001, 5, 20, 23, 59, 59, 0, time.UTC),
+			BucketConfigName: "bucket",
+		},
+	}
+	cntl = newBucketTestController(t, snapshots)
+	doSyncObjects(t, cntl, true, false, false)
+	if deleteFilename != "blobs/unreferenced" {
+		t.Errorf("Error in delete unreferenced blob")
 	}
 
 	// syncObjects find snapshot without object and set Failed
@@ -1048,6 +1446,215 @@ func TestBucket(t *testing.T) {
 		t.Errorf("Error in restoreSnapshotFromObjectFile : %s", err.Error())
 	}
 	chkSnapshot(t, cntl, "test1", "Completed", "")
+	if uploadFilename != "reports/snapshots/test1.json" {
+		t.Errorf("Error report %s not uploaded for restored snapshot", uploadFilename)
+	}
+}
+
+func newSnapshotVerification(name, snapshotName string) *clustersnapshot.SnapshotVerification {
+	return &clustersnapshot.SnapshotVerification{
+		TypeMeta: metav1.TypeMeta{APIVersion: clustersnapshot.SchemeGroupVersion.String()},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: metav1.NamespaceDefault,
+		},
+		Spec: clustersnapshot.SnapshotVerificationSpec{
+			SnapshotName: snapshotName,
+		},
+	}
+}
+
+func newVerificationTestController(t *testing.T, snapshot *clustersnapshot.Snapshot,
+	verification *clustersnapshot.SnapshotVerification) *Controller {
+	f := newFixture(t)
+	f.objects = append(f.objects, newObjectstoreConfig(), snapshot, verification)
+	cntl, i, k8sI := f.newController()
+	cntl.getBucket = getBucketMock
+	f.initInformers(i, k8sI)
+	_ = i.Clustersnapshot().V1alpha1().SnapshotVerifications().Informer().GetIndexer().Add(verification)
+	return cntl
+}
+
+func chkVerification(t *testing.T, cntl *Controller, name, status, reason string) *clustersnapshot.SnapshotVerification {
+	verification, err := cntl.cbclientset.ClustersnapshotV1alpha1().SnapshotVerifications(cntl.namespace).Get(
+		context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Error get verification %s : %s", name, err.Error())
+	}
+	if verification.Status.Phase != status || verification.Status.Reason != reason {
+		t.Errorf("Error verification is not expected (%s:%s) : %v", status, reason, verification.Status)
+	}
+	return verification
+}
+
+func chkVerifiedCondition(t *testing.T, cntl *Controller, name string, status metav1.ConditionStatus) {
+	snap, err := cntl.cbclientset.ClustersnapshotV1alpha1().Snapshots(cntl.namespace).Get(
+		context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Error get snapshot %s : %s", name, err.Error())
+	}
+	condition := meta.FindStatusCondition(snap.Status.Conditions, cluster.ConditionVerified)
+	if condition == nil || condition.Status != status {
+		t.Errorf("Error verified condition is not expected (%s) : %v", status, condition)
+	}
+	if snap.Status.VerifiedTimestamp.IsZero() {
+		t.Errorf("Error verified timestamp not set")
+	}
+}
+
+func TestVerification(t *testing.T) {
+
+	// Verification succeeded
+	t.Logf("Test:Verification succeeded")
+	verifyErr = nil
+	verifyStatus = metav1.ConditionTrue
+	cntl := newVerificationTestController(t,
+		newConfiguredSnapshot("test1", "Completed"), newSnapshotVerification("verify1", "test1"))
+	err := cntl.verificationSyncHandler("default/verify1")
+	if err != nil {
+		t.Errorf("Error in verificationSyncHandler : %s", err.Error())
+	}
+	verification := chkVerification(t, cntl, "verify1", "Completed", "")
+	if verification.Status.NumberOfEntries != 2 || verification.Status.FormatVersion != 1 {
+		t.Errorf("Error manifest not recorded in verification : %v", verification.Status)
+	}
+	chkVerifiedCondition(t, cntl, "test1", metav1.ConditionTrue)
+
+	// Checksum not matched
+	t.Logf("Test:Verification checksum not matched")
+	verifyStatus = metav1.ConditionFalse
+	cntl = newVerificationTestController(t,
+		newConfiguredSnapshot("test1", "Completed"), newSnapshotVerification("verify1", "test1"))
+	err = cntl.verificationSyncHandler("default/verify1")
+	if err != nil {
+		t.Errorf("Error in verificationSyncHandler : %s", err.Error())
+	}
+	chkVerification(t, cntl, "verify1", "Failed", "verify message")
+	chkVerifiedCondition(t, cntl, "test1", metav1.ConditionFalse)
+
+	// Download failed
+	t.Logf("Test:Verification download failed")
+	verifyErr = fmt.Errorf("download failed")
+	cntl = newVerificationTestController(t,
+		newConfiguredSnapshot("test1", "Completed"), newSnapshotVerification("verify1", "test1"))
+	err = cntl.verificationSyncHandler("default/verify1")
+	if err != nil {
+		t.Errorf("Error in verificationSyncHandler : %s", err.Error())
+	}
+	chkVerification(t, cntl, "verify1", "Failed", "download failed")
+	verifyErr = nil
+
+	// Snapshot not completed
+	t.Logf("Test:Verification snapshot not completed")
+	cntl = newVerificationTestController(t,
+		newConfiguredSnapshot("test1", "InProgress"), newSnapshotVerification("verify1", "test1"))
+	err = cntl.verificationSyncHandler("default/verify1")
+	if err != nil {
+		t.Errorf("Error in verificationSyncHandler : %s", err.Error())
+	}
+	chkVerification(t, cntl, "verify1", "Failed", "Snapshot data is not in status 'Completed'")
+
+	// Periodic verification in syncObjects
+	t.Logf("Test:syncObjects verifies snapshots periodically")
+	verifyStatus = metav1.ConditionTrue
+	snapshots := []*clustersnapshot.Snapshot{newConfiguredSnapshot("test1", "Completed")}
+	snapshots[0].Status.ArchiveFormatVersion = cluster.ArchiveFormatVersion
+	snapshots[0].Status.StoredTimestamp = metav1.NewTime(time.Date(2001, 5, 20, 23, 59, 59, 0, time.UTC)).Rfc3339Copy()
+	snapshots[0].Status.StoredFileSize = int64(131072)
+	objectInfoList = []objectstore.ObjectInfo{
+		objectstore.ObjectInfo{
+			Name:             "test1.tgz",
+			Size:             int64(131072),
+			Timestamp:        time.Date(2001, 5, 20, 23, 59, 59, 0, time.UTC),
+			BucketConfigName: "objectstoreConfig",
+		},
+	}
+	cntl = newBucketTestController(t, snapshots)
+	cntl.verifyintervalsec = 3600
+	doSyncObjects(t, cntl, false, false, false)
+	chkVerifiedCondition(t, cntl, "test1", metav1.ConditionTrue)
+
+	// Archive in format version 0 skipped for no manifest
+	t.Logf("Test:syncObjects skips verifying archives without manifest")
+	verifyStatus = metav1.ConditionFalse
+	snapshots[0].Status.ArchiveFormatVersion = 0
+	cntl = newBucketTestController(t, snapshots)
+	cntl.verifyintervalsec = 3600
+	doSyncObjects(t, cntl, false, false, false)
+	chkVerifiedCondition(t, cntl, "test1", metav1.ConditionUnknown)
+	snap, err := cntl.cbclientset.ClustersnapshotV1alpha1().Snapshots(cntl.namespace).Get(
+		context.TODO(), "test1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Error get snapshot test1 : %s", err.Error())
+	}
+	condition := meta.FindStatusCondition(snap.Status.Conditions, cluster.ConditionVerified)
+	if condition.Reason != cluster.ReasonNoManifest {
+		t.Errorf("Error verified condition reason %s not %s", condition.Reason, cluster.ReasonNoManifest)
+	}
+	verifyStatus = metav1.ConditionTrue
+}
+
+func chkArchiveFormatVersion(t *testing.T, cntl *Controller, name string, version int32, size int64) {
+	snap, err := cntl.cbclientset.ClustersnapshotV1alpha1().Snapshots(cntl.namespace).Get(
+		context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Error get snapshot %s : %s", name, err.Error())
+	}
+	if snap.Status.ArchiveFormatVersion != version {
+		t.Errorf("Error archive format version expected %d but %d", version, snap.Status.ArchiveFormatVersion)
+	}
+	if snap.Status.StoredFileSize != size {
+		t.Errorf("Error stored file size expected %d but %d", size, snap.Status.StoredFileSize)
+	}
+}
+
+func TestMigration(t *testing.T) {
+
+	newMigrationTestController := func() *Controller {
+		snapshots := []*clustersnapshot.Snapshot{
+			newConfiguredSnapshot("test1", "Completed"),
+			newConfiguredSnapshot("test2", "Completed"),
+		}
+		for _, snap := range snapshots {
+			snap.Status.StoredTimestamp = metav1.NewTime(time.Date(2001, 5, 20, 23, 59, 59, 0, time.UTC)).Rfc3339Copy()
+			snap.Status.StoredFileSize = int64(131072)
+		}
+		snapshots[1].Status.ArchiveFormatVersion = cluster.ArchiveFormatVersion
+		objectInfoList = []objectstore.ObjectInfo{}
+		for _, name := range []string{"test1.tgz", "test2.tgz"} {
+			objectInfoList = append(objectInfoList, objectstore.ObjectInfo{
+				Name:             name,
+				Size:             int64(131072),
+				Timestamp:        time.Date(2001, 5, 20, 23, 59, 59, 0, time.UTC),
+				BucketConfigName: "objectstoreConfig",
+			})
+		}
+		return newBucketTestController(t, snapshots)
+	}
+
+	// Older archives migrated
+	t.Logf("Test:syncObjects migrates older archives")
+	migrateErr = nil
+	cntl := newMigrationTestController()
+	cntl.migratesnapshots = true
+	doSyncObjects(t, cntl, false, false, false)
+	chkArchiveFormatVersion(t, cntl, "test1", cluster.ArchiveFormatVersion, int64(262144))
+	chkArchiveFormatVersion(t, cntl, "test2", cluster.ArchiveFormatVersion, int64(131072))
+
+	// Migration disabled
+	t.Logf("Test:syncObjects migration disabled")
+	cntl = newMigrationTestController()
+	doSyncObjects(t, cntl, false, false, false)
+	chkArchiveFormatVersion(t, cntl, "test1", 0, int64(131072))
+
+	// Migration failed
+	t.Logf("Test:syncObjects migration failed")
+	migrateErr = fmt.Errorf("migration failed")
+	cntl = newMigrationTestController()
+	cntl.migratesnapshots = true
+	doSyncObjects(t, cntl, false, false, false)
+	chkArchiveFormatVersion(t, cntl, "test1", 0, int64(131072))
+	migrateErr = nil
 }
 
 func TestControllerRun(t *testing.T) {
@@ -1103,3 +1710,141 @@ func TestControllerRun(t *testing.T) {
 		t.Errorf("Error in controller Run : %s", err.Error())
 	}
 }
+
+func TestProgress(t *testing.T) {
+
+	f := newFixture(t)
+	snap := newConfiguredSnapshot("test1", "InProgress")
+	f.objects = append(f.objects, snap)
+	f.snapshotLister = append(f.snapshotLister, snap)
+	cntl, i, k8sI := f.newController()
+	f.initInformers(i, k8sI)
+	ctx := context.TODO()
+
+	interval := progressUpdateInterval
+	progressUpdateInterval = 20 * time.Millisecond
+	defer func() { progressUpdateInterval = interval }()
+
+	// Progress reported at once updated only with the latest
+	progressed := snap.DeepCopy()
+	updates := 0
+	progress := newProgressUpdater(func(p *cbv1alpha1.Progress) {
+		progressed = cntl.updateSnapshotProgress(ctx, progressed, p)
+		updates++
+	})
+	for n := int32(1); n <= 3; n++ {
+		progress.report(cbv1alpha1.Progress{Stage: cluster.StageArchiving, ResourcesDone: n, ResourcesTotal: 3})
+	}
+	time.Sleep(100 * time.Millisecond)
+	last := progress.stop()
+	if updates != 1 {
+		t.Errorf("Progress updated %d times, expected once", updates)
+	}
+	if last == nil || last.ResourcesDone != 3 {
+		t.Errorf("Unexpected last progress %#v", last)
+	}
+	updated, _ := cntl.cbclientset.ClustersnapshotV1alpha1().Snapshots(cntl.namespace).Get(
+		ctx, "test1", metav1.GetOptions{})
+	if updated.Status.Progress == nil || updated.Status.Progress.ResourcesDone != 3 ||
+		updated.Status.Phase != "InProgress" {
+		t.Errorf("Unexpected status %#v", updated.Status)
+	}
+}
+
+func TestUpdateStatusConflict(t *testing.T) {
+
+	f := newFixture(t)
+	snap := newConfiguredSnapshot("test1", "InProgress")
+	f.objects = append(f.objects, snap)
+	f.snapshotLister = append(f.snapshotLister, snap)
+	cntl, i, k8sI := f.newController()
+	f.initInformers(i, k8sI)
+	ctx := context.TODO()
+
+	// Spec edited by a user and the first status update conflicts
+	conflicts := 0
+	f.client.PrependReactor("update", "snapshots", func(action core.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "status" || conflicts > 0 {
+			return false, nil, nil
+		}
+		conflicts++
+		edited := snap.DeepCopy()
+		edited.Spec.Cancel = true
+		_ = f.client.Tracker().Update(action.GetResource(), edited, snap.Namespace)
+		return true, nil, apierrors.NewConflict(action.GetResource().GroupResource(), snap.Name, fmt.Errorf("conflict"))
+	})
+
+	snapCopy := snap.DeepCopy()
+	snapCopy.Status.NumberOfContents = 3
+	updated, err := cntl.updateSnapshotStatus(ctx, snapCopy, "Completed", "")
+	if err != nil {
+		t.Fatalf("Error in updateSnapshotStatus : %s", err.Error())
+	}
+	if conflicts != 1 {
+		t.Errorf("Status update not conflicted")
+	}
+	stored, _ := f.client.ClustersnapshotV1alpha1().Snapshots(snap.Namespace).Get(ctx, "test1", metav1.GetOptions{})
+	for _, s := range []*clustersnapshot.Snapshot{updated, stored} {
+		if s.Status.Phase != "Completed" || s.Status.NumberOfContents != 3 || !s.Spec.Cancel {
+			t.Errorf("Status not updated on the latest snapshot : %#v", s)
+		}
+	}
+}
+
+func TestCRDSchema(t *testing.T) {
+
+	file, err := os.Open("artifacts/crd.yaml")
+	if err != nil {
+		t.Fatalf("Error open crd.yaml : %s", err.Error())
+	}
+	defer file.Close()
+
+	specs := map[string]reflect.Type{
+		"Snapshot":             reflect.TypeOf(cbv1alpha1.SnapshotSpec{}),
+		"Restore":              reflect.TypeOf(cbv1alpha1.RestoreSpec{}),
+		"RestorePreference":    reflect.TypeOf(cbv1alpha1.RestorePreferenceSpec{}),
+		"ObjectstoreConfig":    reflect.TypeOf(cbv1alpha1.ObjectstoreConfigSpec{}),
+		"SnapshotVerification": reflect.TypeOf(cbv1alpha1.SnapshotVerificationSpec{}),
+	}
+	decoder := utilyaml.NewYAMLOrJSONDecoder(file, 4096)
+	for {
+		crd := make(map[string]interface{})
+		err := decoder.Decode(&crd)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error decode crd.yaml : %s", err.Error())
+		}
+		kind := crd["spec"].(map[string]interface{})["names"].(map[string]interface{})["kind"].(string)
+		version := crd["spec"].(map[string]interface{})["versions"].([]interface{})[0].(map[string]interface{})
+		schema := version["schema"].(map[string]interface{})["openAPIV3Schema"].(map[string]interface{})
+		spec := schema["properties"].(map[string]interface{})["spec"].(map[string]interface{})
+
+		// Spec fields typed, not preserved as unknown
+		if _, ok := spec["x-kubernetes-preserve-unknown-fields"]; ok {
+			t.Errorf("Spec of %s preserves unknown fields", kind)
+		}
+		properties := spec["properties"].(map[string]interface{})
+		specType := specs[kind]
+		for i := 0; i < specType.NumField(); i++ {
+			name := strings.Split(specType.Field(i).Tag.Get("json"), ",")[0]
+			if _, ok := properties[name]; !ok {
+				t.Errorf("Spec field %s of %s not in the schema", name, kind)
+			}
+		}
+
+		// TTL defaults of fixtures
+		ttl, _ := properties["ttl"].(map[string]interface{})
+		switch kind {
+		case "Snapshot":
+			if d, _ := time.ParseDuration(ttl["default"].(string)); d != crdSnapshotTTL.Duration {
+				t.Errorf("Snapshot TTL default %s not equal to %s", ttl["default"], crdSnapshotTTL.Duration)
+			}
+		case "Restore":
+			if d, _ := time.ParseDuration(ttl["default"].(string)); d != crdRestoreTTL.Duration {
+				t.Errorf("Restore TTL default %s not equal to %s", ttl["default"], crdRestoreTTL.Duration)
+			}
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+)
+
+// Spec defaults are set by the CRDs in artifacts/crd.yaml.
+// Compression of the objectstore config is set on copies in memory only, never written back.
+
+// setSnapshotCompression sets compression and its level of the objectstore config each when not specified
+// for the snapshot
+func (c *Controller) setSnapshotCompression(ctx context.Context, snapshot *cbv1alpha1.Snapshot) {
+	if snapshot.Spec.Compression != "" && snapshot.Spec.CompressionLevel != 0 {
+		return
+	}
+	osConfig, err := c.cbclientset.ClustersnapshotV1alpha1().ObjectstoreConfigs(c.namespace).Get(
+		ctx, snapshot.Spec.ObjectstoreConfig, metav1.GetOptions{})
+	if err != nil {
+		return
+	}
+	if snapshot.Spec.Compression == "" {
+		snapshot.Spec.Compression = osConfig.Spec.Compression
+	}
+	if snapshot.Spec.CompressionLevel == 0 {
+		snapshot.Spec.CompressionLevel = osConfig.Spec.CompressionLevel
+	}
+}
@@ -6,6 +6,7 @@ require (
 	github.com/aws/aws-sdk-go v1.36.30
 	github.com/cenkalti/backoff v2.2.1+incompatible
 	github.com/imdario/mergo v0.3.11 // indirect
+	github.com/klauspost/compress v1.11.7
 	golang.org/x/time v0.0.0-20201208040808-7e3f01d25324 // indirect
 	k8s.io/api v0.20.1
 	k8s.io/apimachinery v0.20.2
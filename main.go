@@ -17,7 +17,9 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
+	"os"
 	"time"
 
 	"k8s.io/client-go/dynamic"
@@ -45,7 +47,12 @@ var (
 	validatefileinfo   bool
 	insecure           bool
 	createbucket       bool
+	migratesnapshots   bool
 	maxretryelapsedsec int
+	verifyintervalsec  int
+	snapshottimeoutsec int
+	restoretimeoutsec  int
+	snapshotlog        string
 	version            string
 	revision           string
 )
@@ -57,6 +64,7 @@ func main() {
 	flag.Parse()
 	klog.Infof("k8s-snap version:%s revision:%s", version, revision)
 	klog.Flush()
+	cluster.Version = version
 
 	// set up signals so we handle the first shutdown signal gracefully
 	stopCh := signals.SetupSignalHandler()
@@ -86,12 +94,23 @@ func main() {
 	controller := NewController(kubeClient, dynamicClient, cbClient,
 		cbInformerFactory.Clustersnapshot().V1alpha1().Snapshots(),
 		cbInformerFactory.Clustersnapshot().V1alpha1().Restores(),
+		cbInformerFactory.Clustersnapshot().V1alpha1().SnapshotVerifications(),
 		namespace,
-		housekeepstore, restoresnapshots, validatefileinfo, insecure, createbucket,
-		maxretryelapsedsec,
+		housekeepstore, restoresnapshots, validatefileinfo, insecure, createbucket, migratesnapshots,
+		maxretryelapsedsec, verifyintervalsec, snapshottimeoutsec, restoretimeoutsec,
 		cluster.NewClusterCmd(),
 	)
 
+	// Print the log of a snapshot and exit
+	if snapshotlog != "" {
+		log, err := controller.snapshotLog(context.TODO(), snapshotlog)
+		if err != nil {
+			klog.Fatalf("Error getting snapshot log: %s", err.Error())
+		}
+		_, _ = os.Stdout.Write(log)
+		return
+	}
+
 	// notice that there is no need to run Start methods in a separate goroutine.
 	// (i.e. go kubeInformerFactory.Start(stopCh)
 	// Start method is non-blocking and runs all registered informers in a dedicated goroutine.
@@ -114,5 +133,14 @@ func init() {
 	flag.BoolVar(&validatefileinfo, "validatefileinfo", true, "Validate size and timestamp of files on object store")
 	flag.BoolVar(&insecure, "insecure", false, "Skip ssl certificate verification on connecting object store")
 	flag.BoolVar(&createbucket, "createbucket", false, "Create bucket if not exists")
+	flag.BoolVar(&migratesnapshots, "migratesnapshots", false,
+		"Rewrite snapshot archives in older formats on object store into the current format")
 	flag.IntVar(&maxretryelapsedsec, "maxretryelapsedsec", 300, "Max elaspsed seconds to retry snapshot")
+	flag.IntVar(&verifyintervalsec, "verifyintervalsec", 0,
+		"Interval seconds to verify snapshot archives on object store, 0 to disable")
+	flag.IntVar(&snapshottimeoutsec, "snapshottimeoutsec", 3600,
+		"Default seconds to time out a snapshot, 0 to disable")
+	flag.IntVar(&restoretimeoutsec, "restoretimeoutsec", 3600,
+		"Default seconds to time out a restore, 0 to disable")
+	flag.StringVar(&snapshotlog, "snapshotlog", "", "Print the log of the snapshot and exit")
 }
@@ -55,6 +55,8 @@ func addKnownTypes(scheme *runtime.Scheme) error {
 		&ObjectstoreConfigList{},
 		&RestorePreference{},
 		&RestorePreferenceList{},
+		&SnapshotVerification{},
+		&SnapshotVerificationList{},
 	)
 	metav1.AddToGroupVersion(scheme, SchemeGroupVersion)
 	return nil
@@ -1,6 +1,7 @@
 package v1alpha1
 
 import (
+	batchv1 "k8s.io/api/batch/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -23,20 +24,135 @@ type SnapshotSpec struct {
 	ObjectstoreConfig string          `json:"objectstoreConfig"`
 	AvailableUntil    metav1.Time     `json:"availableUntil"`
 	TTL               metav1.Duration `json:"ttl"`
+	Incremental       bool            `json:"incremental"`
+	Compression       string          `json:"compression,omitempty"`
+	CompressionLevel  int             `json:"compressionLevel,omitempty"`
+	// Workers listing resources. Snapshots of the same API server taken at once
+	// share the limit of the first one, the value of later snapshots is not applied.
+	ListConcurrency  int             `json:"listConcurrency,omitempty"`
+	ClientQPS        int             `json:"clientQPS,omitempty"`
+	ClientBurst      int             `json:"clientBurst,omitempty"`
+	MarkerMode       string          `json:"markerMode,omitempty"`
+	MarkerNamespace  string          `json:"markerNamespace,omitempty"`
+	MarkerPrefix     string          `json:"markerPrefix,omitempty"`
+	PreHooks         []SnapshotHook  `json:"preHooks,omitempty"`
+	PostHooks        []SnapshotHook  `json:"postHooks,omitempty"`
+	VersionSelection string          `json:"versionSelection,omitempty"`
+	GroupVersions    []string        `json:"groupVersions,omitempty"`
+	SecretPolicy     []SecretRule    `json:"secretPolicy,omitempty"`
+	Cancel           bool            `json:"cancel,omitempty"`
+	Timeout          metav1.Duration `json:"timeout,omitempty"`
+}
+
+// SecretRule excludes or redacts secrets matched on snapshot.
+// Secrets match when all of the conditions set match.
+type SecretRule struct {
+	Action     string                `json:"action"`
+	Types      []string              `json:"types,omitempty"`
+	Namespaces []string              `json:"namespaces,omitempty"`
+	Selector   *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+// SnapshotHook is a command executed in target cluster pods on snapshot
+type SnapshotHook struct {
+	Name      string                `json:"name"`
+	Namespace string                `json:"namespace"`
+	Selector  *metav1.LabelSelector `json:"selector,omitempty"`
+	Container string                `json:"container,omitempty"`
+	Command   []string              `json:"command"`
+	Timeout   metav1.Duration       `json:"timeout,omitempty"`
+	OnError   string                `json:"onError,omitempty"`
+}
+
+// HookResult is the result of a hook command in a pod or a hook job
+type HookResult struct {
+	Name      string `json:"name"`
+	Phase     string `json:"phase"`
+	Pod       string `json:"pod,omitempty"`
+	Job       string `json:"job,omitempty"`
+	Container string `json:"container"`
+	ExitCode  int32  `json:"exitCode"`
+	Stdout    string `json:"stdout,omitempty"`
+	Stderr    string `json:"stderr,omitempty"`
+	Error     string `json:"error,omitempty"`
 }
 
 // SnapshotStatus is the status for a Snapshot resource
 type SnapshotStatus struct {
-	Phase                   string          `json:"phase"`
-	Reason                  string          `json:"reason"`
-	SnapshotResourceVersion string          `json:"snapshotResourceVersion"`
-	SnapshotTimestamp       metav1.Time     `json:"snapshotTimestamp"`
-	AvailableUntil          metav1.Time     `json:"availableUntil"`
-	TTL                     metav1.Duration `json:"ttl"`
-	Contents                []string        `json:"contents"`
-	StoredFileSize          int64           `json:"storedFileSize"`
-	StoredTimestamp         metav1.Time     `json:"storedTimestamp"`
-	NumberOfContents        int32           `json:"numberOfContents"`
+	Phase                   string             `json:"phase"`
+	Reason                  string             `json:"reason"`
+	SnapshotResourceVersion string             `json:"snapshotResourceVersion"`
+	SnapshotTimestamp       metav1.Time        `json:"snapshotTimestamp"`
+	AvailableUntil          metav1.Time        `json:"availableUntil"`
+	TTL                     metav1.Duration    `json:"ttl"`
+	Contents                []string           `json:"contents"`
+	StoredFileSize          int64              `json:"storedFileSize"`
+	StoredTimestamp         metav1.Time        `json:"storedTimestamp"`
+	NumberOfContents        int32              `json:"numberOfContents"`
+	UploadedFileSize        int64              `json:"uploadedFileSize"`
+	ArchiveFormatVersion    int32              `json:"archiveFormatVersion"`
+	Compression             string             `json:"compression"`
+	VerifiedTimestamp       metav1.Time        `json:"verifiedTimestamp"`
+	Conditions              []metav1.Condition `json:"conditions"`
+	HookResults             []HookResult       `json:"hookResults,omitempty"`
+	NumSecretsExcluded      int32              `json:"numSecretsExcluded,omitempty"`
+	NumSecretsRedacted      int32              `json:"numSecretsRedacted,omitempty"`
+	Progress                *Progress          `json:"progress,omitempty"`
+	Report                  *ReportReference   `json:"report,omitempty"`
+	Log                     *LogReference      `json:"log,omitempty"`
+}
+
+// LogReference refers the log of an operation, an object in the objectstore or a ConfigMap on failure
+type LogReference struct {
+	ObjectstoreConfig string `json:"objectstoreConfig,omitempty"`
+	Name              string `json:"name,omitempty"`
+	ConfigMap         string `json:"configMap,omitempty"`
+}
+
+// ReportReference refers a report object in the objectstore holding lists too large for the status
+type ReportReference struct {
+	ObjectstoreConfig string `json:"objectstoreConfig"`
+	Name              string `json:"name"`
+	JUnit             string `json:"junit,omitempty"`
+}
+
+// Progress is the progress of a snapshot or restore in progress
+type Progress struct {
+	Stage          string       `json:"stage"`
+	ResourcesDone  int32        `json:"resourcesDone"`
+	ResourcesTotal int32        `json:"resourcesTotal"`
+	BytesUploaded  int64        `json:"bytesUploaded,omitempty"`
+	BytesTotal     int64        `json:"bytesTotal,omitempty"`
+	ETA            *metav1.Time `json:"eta,omitempty"`
+	UpdatedAt      metav1.Time  `json:"updatedAt"`
+}
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// SnapshotVerification is a specification for a SnapshotVerification resource
+type SnapshotVerification struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SnapshotVerificationSpec   `json:"spec"`
+	Status SnapshotVerificationStatus `json:"status"`
+}
+
+// SnapshotVerificationSpec is the spec for a SnapshotVerification resource
+type SnapshotVerificationSpec struct {
+	SnapshotName string `json:"snapshotName"`
+}
+
+// SnapshotVerificationStatus is the status for a SnapshotVerification resource
+type SnapshotVerificationStatus struct {
+	Phase             string      `json:"phase"`
+	Reason            string      `json:"reason"`
+	VerifiedTimestamp metav1.Time `json:"verifiedTimestamp"`
+	FormatVersion     int32       `json:"formatVersion"`
+	NumberOfEntries   int32       `json:"numberOfEntries"`
+	SnapVersion       string      `json:"snapVersion"`
+	ClusterVersion    string      `json:"clusterVersion"`
 }
 
 // +genclient
@@ -59,28 +175,73 @@ type RestoreSpec struct {
 	RestorePreferenceName string          `json:"restorePreferenceName"`
 	AvailableUntil        metav1.Time     `json:"availableUntil"`
 	TTL                   metav1.Duration `json:"ttl"`
+	ReadinessTimeout      metav1.Duration `json:"readinessTimeout,omitempty"`
+	PostHooks             []RestoreHook   `json:"postHooks,omitempty"`
+	// Resource paths or glob patterns matched per path segment, '*' does not match '/'.
+	// e.g. /api/v1/namespaces/app/* matches no resources, /api/v1/namespaces/app/*/* matches all in app.
+	Resources       []string        `json:"resources,omitempty"`
+	Cancel          bool            `json:"cancel,omitempty"`
+	Timeout         metav1.Duration `json:"timeout,omitempty"`
+	JUnitReport     bool            `json:"junitReport,omitempty"`
+	MarkerMode      string          `json:"markerMode,omitempty"`
+	MarkerNamespace string          `json:"markerNamespace,omitempty"`
+	MarkerPrefix    string          `json:"markerPrefix,omitempty"`
+}
+
+// RestoreHook is a command executed in target cluster pods or a job created after restore
+type RestoreHook struct {
+	Name      string                `json:"name"`
+	Namespace string                `json:"namespace"`
+	Selector  *metav1.LabelSelector `json:"selector,omitempty"`
+	Container string                `json:"container,omitempty"`
+	Command   []string              `json:"command,omitempty"`
+	Job       *batchv1.JobSpec      `json:"job,omitempty"`
+	Timeout   metav1.Duration       `json:"timeout,omitempty"`
+	OnError   string                `json:"onError,omitempty"`
+}
+
+// WorkloadReadiness is the readiness of a restored workload
+type WorkloadReadiness struct {
+	Path   string `json:"path"`
+	Ready  bool   `json:"ready"`
+	Reason string `json:"reason,omitempty"`
 }
 
 // RestoreStatus is the status for a Restore resource
 type RestoreStatus struct {
-	Phase                  string          `json:"phase"`
-	Reason                 string          `json:"reason"`
-	RestoreResourceVersion string          `json:"restoreResourceVersion"`
-	RestoreTimestamp       metav1.Time     `json:"restoreTimestamp"`
-	AvailableUntil         metav1.Time     `json:"availableUntil"`
-	TTL                    metav1.Duration `json:"ttl"`
-	NumSnapshotContents    int32           `json:"numSnapshotContents"`
-	NumPreferenceExcluded  int32           `json:"numPreferenceExcluded"`
-	Excluded               []string        `json:"excluded"`
-	NumExcluded            int32           `json:"numExcluded"`
-	Created                []string        `json:"created"`
-	NumCreated             int32           `json:"numCreated"`
-	Updated                []string        `json:"updated"`
-	NumUpdated             int32           `json:"numUpdated"`
-	AlreadyExisted         []string        `json:"alreadyExisted"`
-	NumAlreadyExisted      int32           `json:"numAlreadyExisted"`
-	Failed                 []string        `json:"failed"`
-	NumFailed              int32           `json:"numFailed"`
+	Phase                  string                `json:"phase"`
+	Reason                 string                `json:"reason"`
+	RestoreResourceVersion string                `json:"restoreResourceVersion"`
+	RestoreTimestamp       metav1.Time           `json:"restoreTimestamp"`
+	AvailableUntil         metav1.Time           `json:"availableUntil"`
+	TTL                    metav1.Duration       `json:"ttl"`
+	NumSnapshotContents    int32                 `json:"numSnapshotContents"`
+	NumPreferenceExcluded  int32                 `json:"numPreferenceExcluded"`
+	Excluded               []string              `json:"excluded"`
+	NumExcluded            int32                 `json:"numExcluded"`
+	Created                []string              `json:"created"`
+	NumCreated             int32                 `json:"numCreated"`
+	Updated                []string              `json:"updated"`
+	NumUpdated             int32                 `json:"numUpdated"`
+	AlreadyExisted         []string              `json:"alreadyExisted"`
+	NumAlreadyExisted      int32                 `json:"numAlreadyExisted"`
+	Failed                 []string              `json:"failed"`
+	NumFailed              int32                 `json:"numFailed"`
+	Converted              []string              `json:"converted,omitempty"`
+	NumConverted           int32                 `json:"numConverted,omitempty"`
+	Workloads              []WorkloadReadiness   `json:"workloads,omitempty"`
+	HookResults            []HookResult          `json:"hookResults,omitempty"`
+	Journal                []RestoreJournalEntry `json:"journal,omitempty"`
+	RolledBack             []string              `json:"rolledBack,omitempty"`
+	NumRolledBack          int32                 `json:"numRolledBack,omitempty"`
+	Progress               *Progress             `json:"progress,omitempty"`
+	Report                 *ReportReference      `json:"report,omitempty"`
+}
+
+// RestoreJournalEntry is a resource created by restore in the order of creation
+type RestoreJournalEntry struct {
+	Path string `json:"path"`
+	UID  string `json:"uid"`
 }
 
 // +genclient
@@ -96,12 +257,36 @@ type RestorePreference struct {
 
 // RestorePreferenceSpec is the spec for a RestorePreference resource
 type RestorePreferenceSpec struct {
-	ExcludeNamespaces        []string `json:"excludeNamespaces"`
-	ExcludeCRDs              []string `json:"excludeCRDs"`
-	ExcludeAPIPathes         []string `json:"excludeApiPathes"`
-	RestoreAppAPIPathes      []string `json:"restoreAppApiPathes"`
-	RestoreNfsStorageClasses []string `json:"restoreNfsStorageClasses"`
-	RestoreOptions           []string `json:"restoreOptions"`
+	ExcludeNamespaces        []string               `json:"excludeNamespaces"`
+	ExcludeCRDs              []string               `json:"excludeCRDs"`
+	ExcludeAPIPathes         []string               `json:"excludeApiPathes"`
+	RestoreAppAPIPathes      []string               `json:"restoreAppApiPathes"`
+	RestoreNfsStorageClasses []string               `json:"restoreNfsStorageClasses"`
+	RestoreOptions           []string               `json:"restoreOptions"`
+	RestoreConcurrency       int                    `json:"restoreConcurrency,omitempty"`
+	ClientQPS                int                    `json:"clientQPS,omitempty"`
+	ClientBurst              int                    `json:"clientBurst,omitempty"`
+	OwnerReferencePolicies   []OwnerReferencePolicy `json:"ownerReferencePolicies,omitempty"`
+	SanitizePolicies         []SanitizePolicy       `json:"sanitizePolicies,omitempty"`
+	RedactedSecrets          string                 `json:"redactedSecrets,omitempty"`
+}
+
+// OwnerReferencePolicy is how to restore resources of a kind with owner references
+type OwnerReferencePolicy struct {
+	APIVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind"`
+	Policy     string `json:"policy"`
+}
+
+// SanitizePolicy is cluster-bound fields to remove from resources of a kind on restore
+type SanitizePolicy struct {
+	APIVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind"`
+	// Dotted field paths, "[]" for every item of a list. e.g. spec.ports[].nodePort
+	Fields      []string `json:"fields,omitempty"`
+	Annotations []string `json:"annotations,omitempty"`
+	// Do not remove built-in fields for the kind
+	DisableDefaults bool `json:"disableDefaults,omitempty"`
 }
 
 // +genclient
@@ -121,6 +306,8 @@ type ObjectstoreConfigSpec struct {
 	Endpoint              string `json:"endpoint"`
 	CloudCredentialSecret string `json:"cloudCredentialSecret"`
 	Bucket                string `json:"bucket"`
+	Compression           string `json:"compression,omitempty"`
+	CompressionLevel      int    `json:"compressionLevel,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -155,6 +342,16 @@ type RestorePreferenceList struct {
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 
+// SnapshotVerificationList is a list of SnapshotVerification resources
+type SnapshotVerificationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+
+	Items []SnapshotVerification `json:"items"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
 // ObjectstoreConfigList is a list of ObjectstoreConfig resources
 type ObjectstoreConfigList struct {
 	metav1.TypeMeta `json:",inline"`
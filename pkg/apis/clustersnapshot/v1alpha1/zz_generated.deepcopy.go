@@ -21,9 +21,43 @@ limitations under the License.
 package v1alpha1
 
 import (
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HookResult) DeepCopyInto(out *HookResult) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HookResult.
+func (in *HookResult) DeepCopy() *HookResult {
+	if in == nil {
+		return nil
+	}
+	out := new(HookResult)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LogReference) DeepCopyInto(out *LogReference) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LogReference.
+func (in *LogReference) DeepCopy() *LogReference {
+	if in == nil {
+		return nil
+	}
+	out := new(LogReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ObjectstoreConfig) DeepCopyInto(out *ObjectstoreConfig) {
 	*out = *in
@@ -100,6 +134,59 @@ func (in *ObjectstoreConfigSpec) DeepCopy() *ObjectstoreConfigSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OwnerReferencePolicy) DeepCopyInto(out *OwnerReferencePolicy) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OwnerReferencePolicy.
+func (in *OwnerReferencePolicy) DeepCopy() *OwnerReferencePolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(OwnerReferencePolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Progress) DeepCopyInto(out *Progress) {
+	*out = *in
+	if in.ETA != nil {
+		in, out := &in.ETA, &out.ETA
+		*out = (*in).DeepCopy()
+	}
+	in.UpdatedAt.DeepCopyInto(&out.UpdatedAt)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Progress.
+func (in *Progress) DeepCopy() *Progress {
+	if in == nil {
+		return nil
+	}
+	out := new(Progress)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ReportReference) DeepCopyInto(out *ReportReference) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ReportReference.
+func (in *ReportReference) DeepCopy() *ReportReference {
+	if in == nil {
+		return nil
+	}
+	out := new(ReportReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Restore) DeepCopyInto(out *Restore) {
 	*out = *in
@@ -128,6 +215,54 @@ func (in *Restore) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RestoreHook) DeepCopyInto(out *RestoreHook) {
+	*out = *in
+	if in.Selector != nil {
+		in, out := &in.Selector, &out.Selector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Command != nil {
+		in, out := &in.Command, &out.Command
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Job != nil {
+		in, out := &in.Job, &out.Job
+		*out = new(batchv1.JobSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	out.Timeout = in.Timeout
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RestoreHook.
+func (in *RestoreHook) DeepCopy() *RestoreHook {
+	if in == nil {
+		return nil
+	}
+	out := new(RestoreHook)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RestoreJournalEntry) DeepCopyInto(out *RestoreJournalEntry) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RestoreJournalEntry.
+func (in *RestoreJournalEntry) DeepCopy() *RestoreJournalEntry {
+	if in == nil {
+		return nil
+	}
+	out := new(RestoreJournalEntry)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *RestoreList) DeepCopyInto(out *RestoreList) {
 	*out = *in
@@ -254,6 +389,18 @@ func (in *RestorePreferenceSpec) DeepCopyInto(out *RestorePreferenceSpec) {
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.OwnerReferencePolicies != nil {
+		in, out := &in.OwnerReferencePolicies, &out.OwnerReferencePolicies
+		*out = make([]OwnerReferencePolicy, len(*in))
+		copy(*out, *in)
+	}
+	if in.SanitizePolicies != nil {
+		in, out := &in.SanitizePolicies, &out.SanitizePolicies
+		*out = make([]SanitizePolicy, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	return
 }
 
@@ -272,6 +419,20 @@ func (in *RestoreSpec) DeepCopyInto(out *RestoreSpec) {
 	*out = *in
 	in.AvailableUntil.DeepCopyInto(&out.AvailableUntil)
 	out.TTL = in.TTL
+	out.ReadinessTimeout = in.ReadinessTimeout
+	if in.PostHooks != nil {
+		in, out := &in.PostHooks, &out.PostHooks
+		*out = make([]RestoreHook, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Resources != nil {
+		in, out := &in.Resources, &out.Resources
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	out.Timeout = in.Timeout
 	return
 }
 
@@ -316,6 +477,41 @@ func (in *RestoreStatus) DeepCopyInto(out *RestoreStatus) {
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.Converted != nil {
+		in, out := &in.Converted, &out.Converted
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Workloads != nil {
+		in, out := &in.Workloads, &out.Workloads
+		*out = make([]WorkloadReadiness, len(*in))
+		copy(*out, *in)
+	}
+	if in.HookResults != nil {
+		in, out := &in.HookResults, &out.HookResults
+		*out = make([]HookResult, len(*in))
+		copy(*out, *in)
+	}
+	if in.Journal != nil {
+		in, out := &in.Journal, &out.Journal
+		*out = make([]RestoreJournalEntry, len(*in))
+		copy(*out, *in)
+	}
+	if in.RolledBack != nil {
+		in, out := &in.RolledBack, &out.RolledBack
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Progress != nil {
+		in, out := &in.Progress, &out.Progress
+		*out = new(Progress)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Report != nil {
+		in, out := &in.Report, &out.Report
+		*out = new(ReportReference)
+		**out = **in
+	}
 	return
 }
 
@@ -329,6 +525,63 @@ func (in *RestoreStatus) DeepCopy() *RestoreStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SanitizePolicy) DeepCopyInto(out *SanitizePolicy) {
+	*out = *in
+	if in.Fields != nil {
+		in, out := &in.Fields, &out.Fields
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Annotations != nil {
+		in, out := &in.Annotations, &out.Annotations
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SanitizePolicy.
+func (in *SanitizePolicy) DeepCopy() *SanitizePolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(SanitizePolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SecretRule) DeepCopyInto(out *SecretRule) {
+	*out = *in
+	if in.Types != nil {
+		in, out := &in.Types, &out.Types
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Namespaces != nil {
+		in, out := &in.Namespaces, &out.Namespaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Selector != nil {
+		in, out := &in.Selector, &out.Selector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SecretRule.
+func (in *SecretRule) DeepCopy() *SecretRule {
+	if in == nil {
+		return nil
+	}
+	out := new(SecretRule)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Snapshot) DeepCopyInto(out *Snapshot) {
 	*out = *in
@@ -357,6 +610,33 @@ func (in *Snapshot) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SnapshotHook) DeepCopyInto(out *SnapshotHook) {
+	*out = *in
+	if in.Selector != nil {
+		in, out := &in.Selector, &out.Selector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Command != nil {
+		in, out := &in.Command, &out.Command
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	out.Timeout = in.Timeout
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SnapshotHook.
+func (in *SnapshotHook) DeepCopy() *SnapshotHook {
+	if in == nil {
+		return nil
+	}
+	out := new(SnapshotHook)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SnapshotList) DeepCopyInto(out *SnapshotList) {
 	*out = *in
@@ -395,6 +675,33 @@ func (in *SnapshotSpec) DeepCopyInto(out *SnapshotSpec) {
 	*out = *in
 	in.AvailableUntil.DeepCopyInto(&out.AvailableUntil)
 	out.TTL = in.TTL
+	if in.PreHooks != nil {
+		in, out := &in.PreHooks, &out.PreHooks
+		*out = make([]SnapshotHook, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.PostHooks != nil {
+		in, out := &in.PostHooks, &out.PostHooks
+		*out = make([]SnapshotHook, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.GroupVersions != nil {
+		in, out := &in.GroupVersions, &out.GroupVersions
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.SecretPolicy != nil {
+		in, out := &in.SecretPolicy, &out.SecretPolicy
+		*out = make([]SecretRule, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	out.Timeout = in.Timeout
 	return
 }
 
@@ -420,6 +727,34 @@ func (in *SnapshotStatus) DeepCopyInto(out *SnapshotStatus) {
 		copy(*out, *in)
 	}
 	in.StoredTimestamp.DeepCopyInto(&out.StoredTimestamp)
+	in.VerifiedTimestamp.DeepCopyInto(&out.VerifiedTimestamp)
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.HookResults != nil {
+		in, out := &in.HookResults, &out.HookResults
+		*out = make([]HookResult, len(*in))
+		copy(*out, *in)
+	}
+	if in.Progress != nil {
+		in, out := &in.Progress, &out.Progress
+		*out = new(Progress)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Report != nil {
+		in, out := &in.Report, &out.Report
+		*out = new(ReportReference)
+		**out = **in
+	}
+	if in.Log != nil {
+		in, out := &in.Log, &out.Log
+		*out = new(LogReference)
+		**out = **in
+	}
 	return
 }
 
@@ -432,3 +767,113 @@ func (in *SnapshotStatus) DeepCopy() *SnapshotStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SnapshotVerification) DeepCopyInto(out *SnapshotVerification) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec = in.Spec
+	in.Status.DeepCopyInto(&out.Status)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SnapshotVerification.
+func (in *SnapshotVerification) DeepCopy() *SnapshotVerification {
+	if in == nil {
+		return nil
+	}
+	out := new(SnapshotVerification)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *SnapshotVerification) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SnapshotVerificationList) DeepCopyInto(out *SnapshotVerificationList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]SnapshotVerification, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SnapshotVerificationList.
+func (in *SnapshotVerificationList) DeepCopy() *SnapshotVerificationList {
+	if in == nil {
+		return nil
+	}
+	out := new(SnapshotVerificationList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *SnapshotVerificationList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SnapshotVerificationSpec) DeepCopyInto(out *SnapshotVerificationSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SnapshotVerificationSpec.
+func (in *SnapshotVerificationSpec) DeepCopy() *SnapshotVerificationSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(SnapshotVerificationSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SnapshotVerificationStatus) DeepCopyInto(out *SnapshotVerificationStatus) {
+	*out = *in
+	in.VerifiedTimestamp.DeepCopyInto(&out.VerifiedTimestamp)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SnapshotVerificationStatus.
+func (in *SnapshotVerificationStatus) DeepCopy() *SnapshotVerificationStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(SnapshotVerificationStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkloadReadiness) DeepCopyInto(out *WorkloadReadiness) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkloadReadiness.
+func (in *WorkloadReadiness) DeepCopy() *WorkloadReadiness {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkloadReadiness)
+	in.DeepCopyInto(out)
+	return out
+}
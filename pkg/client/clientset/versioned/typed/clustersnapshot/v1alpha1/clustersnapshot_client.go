@@ -30,6 +30,7 @@ type ClustersnapshotV1alpha1Interface interface {
 	RestoresGetter
 	RestorePreferencesGetter
 	SnapshotsGetter
+	SnapshotVerificationsGetter
 }
 
 // ClustersnapshotV1alpha1Client is used to interact with features provided by the clustersnapshot.rywt.io group.
@@ -53,6 +54,10 @@ func (c *ClustersnapshotV1alpha1Client) Snapshots(namespace string) SnapshotInte
 	return newSnapshots(c, namespace)
 }
 
+func (c *ClustersnapshotV1alpha1Client) SnapshotVerifications(namespace string) SnapshotVerificationInterface {
+	return newSnapshotVerifications(c, namespace)
+}
+
 // NewForConfig creates a new ClustersnapshotV1alpha1Client for the given config.
 func NewForConfig(c *rest.Config) (*ClustersnapshotV1alpha1Client, error) {
 	config := *c
@@ -44,6 +44,10 @@ func (c *FakeClustersnapshotV1alpha1) Snapshots(namespace string) v1alpha1.Snaps
 	return &FakeSnapshots{c, namespace}
 }
 
+func (c *FakeClustersnapshotV1alpha1) SnapshotVerifications(namespace string) v1alpha1.SnapshotVerificationInterface {
+	return &FakeSnapshotVerifications{c, namespace}
+}
+
 // RESTClient returns a RESTClient that is used to communicate
 // with API server by this client implementation.
 func (c *FakeClustersnapshotV1alpha1) RESTClient() rest.Interface {
@@ -25,3 +25,5 @@ type RestoreExpansion interface{}
 type RestorePreferenceExpansion interface{}
 
 type SnapshotExpansion interface{}
+
+type SnapshotVerificationExpansion interface{}
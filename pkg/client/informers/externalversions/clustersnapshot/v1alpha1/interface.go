@@ -32,6 +32,8 @@ type Interface interface {
 	RestorePreferences() RestorePreferenceInformer
 	// Snapshots returns a SnapshotInformer.
 	Snapshots() SnapshotInformer
+	// SnapshotVerifications returns a SnapshotVerificationInformer.
+	SnapshotVerifications() SnapshotVerificationInformer
 }
 
 type version struct {
@@ -64,3 +66,8 @@ func (v *version) RestorePreferences() RestorePreferenceInformer {
 func (v *version) Snapshots() SnapshotInformer {
 	return &snapshotInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
 }
+
+// SnapshotVerifications returns a SnapshotVerificationInformer.
+func (v *version) SnapshotVerifications() SnapshotVerificationInformer {
+	return &snapshotVerificationInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
+}
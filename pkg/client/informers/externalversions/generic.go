@@ -61,6 +61,8 @@ func (f *sharedInformerFactory) ForResource(resource schema.GroupVersionResource
 		return &genericInformer{resource: resource.GroupResource(), informer: f.Clustersnapshot().V1alpha1().RestorePreferences().Informer()}, nil
 	case v1alpha1.SchemeGroupVersion.WithResource("snapshots"):
 		return &genericInformer{resource: resource.GroupResource(), informer: f.Clustersnapshot().V1alpha1().Snapshots().Informer()}, nil
+	case v1alpha1.SchemeGroupVersion.WithResource("snapshotverifications"):
+		return &genericInformer{resource: resource.GroupResource(), informer: f.Clustersnapshot().V1alpha1().SnapshotVerifications().Informer()}, nil
 
 	}
 
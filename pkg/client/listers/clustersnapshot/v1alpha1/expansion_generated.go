@@ -49,3 +49,11 @@ type SnapshotListerExpansion interface{}
 // SnapshotNamespaceListerExpansion allows custom methods to be added to
 // SnapshotNamespaceLister.
 type SnapshotNamespaceListerExpansion interface{}
+
+// SnapshotVerificationListerExpansion allows custom methods to be added to
+// SnapshotVerificationLister.
+type SnapshotVerificationListerExpansion interface{}
+
+// SnapshotVerificationNamespaceListerExpansion allows custom methods to be added to
+// SnapshotVerificationNamespaceLister.
+type SnapshotVerificationNamespaceListerExpansion interface{}
@@ -0,0 +1,279 @@
+package cluster
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
+	"github.com/ryo-watanabe/k8s-snap/pkg/utils"
+)
+
+// SnapshotFile is the file name of the snapshot resource in snapshot archives
+const SnapshotFile = "snapshot.json"
+
+// SnapshotArchive is the content of a snapshot archive
+type SnapshotArchive struct {
+	Name          string
+	FormatVersion int
+	Manifest      *ArchiveManifest
+	Snapshot      *unstructured.Unstructured
+	Entries       []ArchiveEntry
+}
+
+// ArchiveEntry is a resource file in a snapshot archive
+type ArchiveEntry struct {
+	// Path in the archive without the snapshot name
+	Path    string
+	Content []byte
+}
+
+// archiveReader fills a SnapshotArchive from snapshot.json of an archive in a format version
+type archiveReader func(archive *SnapshotArchive, snapshotJSON []byte) error
+
+// Readers for each archive format version
+// 0 : No manifest. snapshot.json may lack kind and apiVersion.
+// 1 : manifest.json with checksums of all entries.
+var archiveReaders = map[int]archiveReader{
+	0: readArchiveV0,
+	1: readArchiveV1,
+}
+
+// ArchiveEntryFunc is called with each resource file streamed from a snapshot archive
+type ArchiveEntryFunc func(path string, content io.Reader) error
+
+// StreamSnapshotArchive reads a snapshot tgz file with the reader for its format version.
+// Resource files are passed to fn one by one and not kept in the archive returned.
+func StreamSnapshotArchive(name, archivePath string, fn ArchiveEntryFunc) (*SnapshotArchive, error) {
+	archiveFile, err := os.Open(filepath.Clean(archivePath))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = archiveFile.Close() }()
+	tgz, err := newArchiveReader(archiveFile)
+	if err != nil {
+		return nil, fmt.Errorf("Reading tgz file failed : %s", err.Error())
+	}
+	defer func() { _ = tgz.Close() }()
+
+	// snapshot.json and manifest.json are read after all entries, the manifest is the last file
+	var snapshotJSON, manifestJSON []byte
+	tarReader := tar.NewReader(tgz)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Reading tgz file failed : %s", err.Error())
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		path := strings.TrimPrefix(header.Name, name)
+		switch path {
+		case "/" + SnapshotFile:
+			snapshotJSON, err = ioutil.ReadAll(tarReader)
+		case "/" + ManifestFile:
+			manifestJSON, err = ioutil.ReadAll(tarReader)
+		default:
+			err = fn(path, tarReader)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Reading %s failed : %s", header.Name, err.Error())
+		}
+	}
+
+	// Archives without manifest are format version 0
+	archive := &SnapshotArchive{Name: name}
+	if manifestJSON != nil {
+		archive.Manifest = &ArchiveManifest{}
+		err = json.Unmarshal(manifestJSON, archive.Manifest)
+		if err != nil {
+			return nil, fmt.Errorf("Unmarshalling manifest.json failed : %s", err.Error())
+		}
+		archive.FormatVersion = archive.Manifest.FormatVersion
+	}
+
+	reader, ok := archiveReaders[archive.FormatVersion]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported archive format version %d in %s", archive.FormatVersion, name)
+	}
+	if snapshotJSON == nil {
+		return nil, fmt.Errorf("Cannot find snapshot.json file in %s", name)
+	}
+	err = reader(archive, snapshotJSON)
+	if err != nil {
+		return nil, err
+	}
+	return archive, nil
+}
+
+// ReadSnapshotArchive reads a snapshot tgz file with all entries in memory
+func ReadSnapshotArchive(name, archivePath string) (*SnapshotArchive, error) {
+	entries := make([]ArchiveEntry, 0)
+	archive, err := StreamSnapshotArchive(name, archivePath, func(path string, content io.Reader) error {
+		b, err := ioutil.ReadAll(content)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, ArchiveEntry{Path: path, Content: b})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	archive.Entries = entries
+	return archive, nil
+}
+
+func truncateMessage(msg string) string {
+	if len(msg) > 300 {
+		return msg[0:300] + "....."
+	}
+	return msg
+}
+
+func readArchiveV0(archive *SnapshotArchive, snapshotJSON []byte) error {
+	// Add kind and apiVersion to older snapshots
+	obj := make(map[string]interface{})
+	err := json.Unmarshal(snapshotJSON, &obj)
+	if err != nil {
+		return fmt.Errorf("UnmarshalJSON error : %s", truncateMessage(err.Error()))
+	}
+	if getUnstructuredString(obj, "kind") == "" {
+		obj["kind"] = "Snapshot"
+	}
+	if getUnstructuredString(obj, "apiVersion") == "" {
+		obj["apiVersion"] = cbv1alpha1.SchemeGroupVersion.String()
+	}
+	archive.Snapshot = &unstructured.Unstructured{Object: obj}
+	return nil
+}
+
+func readArchiveV1(archive *SnapshotArchive, snapshotJSON []byte) error {
+	archive.Snapshot = &unstructured.Unstructured{}
+	err := archive.Snapshot.UnmarshalJSON(snapshotJSON)
+	if err != nil {
+		return fmt.Errorf("UnmarshalJSON error : %s", truncateMessage(err.Error()))
+	}
+	return nil
+}
+
+// Write a snapshot archive in the current format version
+func writeSnapshotArchive(archive *SnapshotArchive, archivePath, compression string, level int) error {
+	archiveFile, err := os.Create(filepath.Clean(archivePath))
+	if err != nil {
+		return fmt.Errorf("Creating tgz file failed : %s", err.Error())
+	}
+	defer func() { _ = archiveFile.Close() }()
+	tgz, err := newArchiveWriter(archiveFile, compression, level)
+	if err != nil {
+		return fmt.Errorf("Creating archive writer failed : %s", err.Error())
+	}
+	defer func() { _ = tgz.Close() }()
+	tarWriter := tar.NewWriter(tgz)
+	defer func() { _ = tarWriter.Close() }()
+
+	clusterVersion := ""
+	if archive.Manifest != nil {
+		clusterVersion = archive.Manifest.ClusterVersion
+	}
+	manifest := newArchiveManifest(clusterVersion)
+
+	snapshotJSON, err := archive.Snapshot.MarshalJSON()
+	if err != nil {
+		return fmt.Errorf("Marshalling snapshot.json failed : %s", err.Error())
+	}
+	entries := append(append([]ArchiveEntry(nil), archive.Entries...),
+		ArchiveEntry{Path: "/" + SnapshotFile, Content: snapshotJSON})
+
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Name:     archive.Name + entry.Path,
+			Size:     int64(len(entry.Content)),
+			Typeflag: tar.TypeReg,
+			Mode:     0755,
+			ModTime:  time.Now(),
+		}
+		if err := tarWriter.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("Tar writer writing header failed : %s", err.Error())
+		}
+		if _, err := tarWriter.Write(entry.Content); err != nil {
+			return fmt.Errorf("Tar writer writing content failed : %s", err.Error())
+		}
+		manifest.add(hdr.Name, entry.Content)
+	}
+
+	return writeManifest(tarWriter, archive.Name, manifest)
+}
+
+// MigrateSnapshot rewrites the snapshot archive in the bucket into the current format version.
+// It returns false when the archive is already in the current format.
+func MigrateSnapshot(ctx context.Context, snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) (bool, error) {
+
+	// Snapshot log
+	blog := utils.NewNamedLog("migrate:" + snapshot.ObjectMeta.Name)
+
+	tmpDir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	// Download and read with the reader for the format version
+	archivePath := filepath.Join(tmpDir, "old"+ArchiveSuffix)
+	err = downloadSnapshotArchive(ctx, snapshot.ObjectMeta.Name, archivePath, bucket)
+	if err != nil {
+		return false, fmt.Errorf("Downloading snapshot failed : %s", err.Error())
+	}
+	archive, err := ReadSnapshotArchive(snapshot.ObjectMeta.Name, archivePath)
+	if err != nil {
+		return false, err
+	}
+	if archive.FormatVersion == ArchiveFormatVersion {
+		snapshot.Status.ArchiveFormatVersion = int32(archive.FormatVersion)
+		return false, nil
+	}
+	blog.Infof("Migrating archive format version %d => %d", archive.FormatVersion, ArchiveFormatVersion)
+
+	// Write in the current format and check it
+	err = unstructured.SetNestedField(archive.Snapshot.Object, int64(ArchiveFormatVersion),
+		"status", "archiveFormatVersion")
+	if err != nil {
+		return false, err
+	}
+	migratedPath := filepath.Join(tmpDir, "new"+ArchiveSuffix)
+	err = writeSnapshotArchive(archive, migratedPath, ArchiveCompression(snapshot), snapshot.Spec.CompressionLevel)
+	if err != nil {
+		return false, err
+	}
+	_, err = VerifyArchive(snapshot.ObjectMeta.Name, migratedPath)
+	if err != nil {
+		return false, fmt.Errorf("Migrated archive is invalid : %s", err.Error())
+	}
+
+	// Replace the archive in the bucket
+	if snapshot.Spec.Incremental {
+		err = uploadSnapshotBlobs(ctx, snapshot, migratedPath, bucket, blog)
+	} else {
+		err = uploadSnapshotFile(ctx, snapshot, migratedPath, bucket, blog)
+	}
+	if err != nil {
+		return false, err
+	}
+	snapshot.Status.ArchiveFormatVersion = ArchiveFormatVersion
+	blog.Infof("Migrated %d entries", len(archive.Entries)+1)
+
+	return true, nil
+}
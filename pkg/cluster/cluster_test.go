@@ -1,37 +1,54 @@
 package cluster
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/cenkalti/backoff"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	rbac "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/watch"
 	discoveryfake "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/dynamic"
 	dynamicfake "k8s.io/client-go/dynamic/fake"
 	k8sfake "k8s.io/client-go/kubernetes/fake"
 	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
 	"k8s.io/klog"
 
 	clustersnapshot "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
 	"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
+	"github.com/ryo-watanabe/k8s-snap/pkg/utils"
 )
 
 var kubeobjects []runtime.Object
@@ -218,17 +235,30 @@ func TestCluster(t *testing.T) {
 		)
 	}
 
+	// Verify the snapshot file
+	manifest, err := VerifyArchive("test1", "/tmp/test1.tgz")
+	if err != nil {
+		t.Errorf("Error in VerifyArchive : %s", err.Error())
+	} else if manifest.NumberOfEntries != int(snap.Status.NumberOfContents)+1 {
+		t.Errorf("Number of manifest entries %d not equals to contents + snapshot.json", manifest.NumberOfEntries)
+	}
+
 	// TEST2 : Uplaod the snapshot file
 	bucket := &bucketMock{}
 	objSize := int64(131072)
 	objTime := time.Date(2001, 5, 20, 23, 59, 59, 0, time.UTC)
 	objectInfo = &objectstore.ObjectInfo{Name: "test1.tgz", Size: objSize, Timestamp: objTime, BucketConfigName: "bucket"}
-	err = UploadSnapshot(snap, bucket)
+	uploadFilenames = nil
+	err = UploadSnapshot(context.TODO(), snap, bucket)
 	if err != nil {
 		t.Errorf("Error in UploadSnapshot : %s", err.Error())
 	}
-	if uploadFilename != "test1.tgz" {
-		t.Error("Error upload filename not match")
+	if !reflect.DeepEqual(uploadFilenames, []string{"test1.tgz", "reports/snapshots/test1.json"}) {
+		t.Errorf("Error upload filenames %v not match", uploadFilenames)
+	}
+	if snap.Status.Report == nil || snap.Status.Report.Name != "reports/snapshots/test1.json" ||
+		snap.Status.Report.ObjectstoreConfig != "bucket" {
+		t.Errorf("Error report reference %v not match", snap.Status.Report)
 	}
 	if getObjectInfoFilename != "test1.tgz" {
 		t.Error("Error GetObjectInfo filename not match")
@@ -245,7 +275,7 @@ func TestCluster(t *testing.T) {
 	restore := newConfiguredRestore("test1", "test2", "pref1", "InProgress")
 
 	// TEST3 : Download snapshot tgz
-	err = downloadSnapshot(restore, bucket)
+	err = downloadSnapshot(context.TODO(), restore, bucket)
 	if err != nil {
 		t.Errorf("Error in downloadSnapshot : %s", err.Error())
 	}
@@ -283,7 +313,8 @@ func TestCluster(t *testing.T) {
 
 	// TEST4 : Restore resources
 	restore = newConfiguredRestore("test1", "test1", "pref1", "InProgress")
-	err = restoreResources(restore, pref, kubeClient, dynamicClient)
+	outcomesCtx, outcomes := withOutcomes(context.TODO())
+	err = restoreResources(outcomesCtx, restore, pref, kubeClient, dynamicClient, nil)
 	if err != nil {
 		t.Errorf("Error in restoreResources : %s", err.Error())
 	}
@@ -328,6 +359,123 @@ func TestCluster(t *testing.T) {
 			expectedNumFailed,
 		)
 	}
+
+	// Outcomes of all resources recorded with stages and rules
+	resources := outcomes.list()
+	numOutcomes := expectedNumPreferenceExcluded + len(expectedExcluded) + len(expectedCreated) + len(expectedAlreadyExisted)
+	if len(resources) != numOutcomes {
+		t.Errorf("Number of outcomes not match : Result %d / Expected %d", len(resources), numOutcomes)
+	}
+	for _, r := range resources {
+		switch {
+		case r.Outcome == OutcomePreferenceExcluded && r.Rule == "":
+			t.Errorf("Rule not recorded for preference excluded %s", r.Path)
+		case r.Path == "/api/v1/persistentvolumes/pv1" && (r.Outcome != OutcomeCreated || r.Stage != "PV"):
+			t.Errorf("Outcome of pv1 not match : %v", r)
+		case r.Path == "/api/v1/namespaces/default/pods/pod1" && (r.Outcome != OutcomeExcluded || r.Message != "owner-ref"):
+			t.Errorf("Outcome of pod1 not match : %v", r)
+		}
+	}
+
+	// TEST5 : Restore selected resources only
+	err = dynamicTracker.Delete(
+		schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterroles"}, "", "cluster-role1")
+	if err != nil {
+		t.Errorf("Error in delete clusterrole : %s", err.Error())
+	}
+	restore = newConfiguredRestore("test1", "test1", "pref1", "InProgress")
+	restore.Spec.Resources = []string{
+		"/api/v1/namespaces/default/secrets/*",
+		"/apis/rbac.authorization.k8s.io/v1/clusterroles/cluster-role1",
+		"/api/v1/namespaces/default/pods/pod1",
+	}
+	err = restoreResources(context.TODO(), restore, pref, kubeClient, dynamicClient, nil)
+	if err != nil {
+		t.Errorf("Error in restoreResources : %s", err.Error())
+	}
+	chkResourceList(t, restore.Status.Excluded, []string{"/api/v1/namespaces/default/secrets/token1,(token-secret)"})
+	chkResourceList(t, restore.Status.Created, []string{"/apis/rbac.authorization.k8s.io/v1/clusterroles/cluster-role1"})
+	// Selected resources with owner references not excluded by the default owner reference policy
+	chkResourceList(t, restore.Status.AlreadyExisted, []string{
+		"/api/v1/namespaces/default/secrets/secret1",
+		"/api/v1/namespaces/default/pods/pod1",
+	})
+	if restore.Status.NumPreferenceExcluded != 0 {
+		t.Errorf("NumPreferenceExcluded %d not 0 on selected restore", restore.Status.NumPreferenceExcluded)
+	}
+
+	// Patterns matched per path segment
+	for i, c := range []struct {
+		pattern  string
+		selected bool
+	}{
+		{"/api/v1/namespaces/app/secrets/*", true},
+		{"/api/v1/namespaces/app/*/*", true},
+		{"/api/v1/namespaces/*/secrets/secret1", true},
+		{"/api/v1/namespaces/app/*", false},
+		{"/api/v1/namespaces/*", false},
+		{"/api/v1/namespaces/app/secrets", false},
+	} {
+		if isSelected("/api/v1/namespaces/app/secrets/secret1", []string{c.pattern}) != c.selected {
+			t.Errorf("#%d Pattern %s selected not %t", i, c.pattern, c.selected)
+		}
+	}
+
+	restore.Spec.Resources = []string{"/api/v1/namespaces/default/secrets/["}
+	err = restoreResources(context.TODO(), restore, pref, kubeClient, dynamicClient, nil)
+	if err == nil {
+		t.Error("Invalid resource pattern not rejected")
+	}
+
+	// TEST6 : Journal kept to rollback a restore cancelled partway
+	var cancelRestore context.CancelFunc
+	dynamicClient.Fake.PrependReactor("create", "*", func(action core.Action) (bool, runtime.Object, error) {
+		if cancelRestore != nil {
+			cancelRestore()
+		}
+		return false, nil, nil
+	})
+	cancelledRestore := func(bucket objectstore.Objectstore) (*clustersnapshot.Restore, error) {
+		err := dynamicTracker.Delete(schema.GroupVersionResource{
+			Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterroles"}, "", "cluster-role1")
+		if err != nil {
+			t.Errorf("Error in delete clusterrole : %s", err.Error())
+		}
+		restore := newConfiguredRestore("test6", "test1", "pref1", "InProgress")
+		restore.Spec.Resources = []string{"/apis/rbac.authorization.k8s.io/v1/clusterroles/cluster-role1"}
+		var ctx context.Context
+		ctx, cancelRestore = context.WithCancel(context.TODO())
+		defer func() { cancelRestore = nil }()
+		return restore, restoreWithReport(ctx, restore, pref, kubeClient, dynamicClient, nil, bucket)
+	}
+	reportBucket := newMemBucketMock()
+	restore, err = cancelledRestore(reportBucket)
+	if err != context.Canceled {
+		t.Errorf("Restore not cancelled : %v", err)
+	}
+	if restore.Status.Report == nil {
+		t.Fatal("Report of cancelled restore not uploaded")
+	}
+	restoreReport := &RestoreReport{}
+	err = downloadReport(context.TODO(), restoreReport, restore.Status.Report.Name, reportBucket)
+	if err != nil {
+		t.Fatalf("Error in downloadReport : %s", err.Error())
+	}
+	if len(restoreReport.Journal) != 1 ||
+		restoreReport.Journal[0].Path != "/apis/rbac.authorization.k8s.io/v1/clusterroles/cluster-role1" {
+		t.Errorf("Journal of cancelled restore not in report : %v", restoreReport.Journal)
+	}
+	// Journal left in status when the report not uploaded
+	retryElapsed := reportRetryElapsed
+	reportRetryElapsed = 10 * time.Millisecond
+	defer func() { reportRetryElapsed = retryElapsed }()
+	restore, err = cancelledRestore(&prefixFailingBucketMock{newMemBucketMock(), ReportPrefix})
+	if err != context.Canceled {
+		t.Errorf("Restore not cancelled : %v", err)
+	}
+	if len(restore.Status.Journal) != 1 || restore.Status.Report != nil {
+		t.Errorf("Journal of cancelled restore not kept in status : %v", restore.Status.Journal)
+	}
 }
 
 const kubeconfigSrc = `apiVersion: v1
@@ -403,7 +551,7 @@ func TestObjectstoreConfig(t *testing.T) {
 	url, _ := url.Parse(ts.URL)
 	endpoint := url.Scheme + "://" + url.Hostname() + ".nip.io:" + url.Port()
 	bucket := objectstore.NewBucket("test1", "ACCESSKEY", "SECRETKEY", endpoint, "jp-east-2", "test1", false)
-	err := UploadSnapshot(snap, bucket)
+	err := UploadSnapshot(context.TODO(), snap, bucket)
 	fmt.Println(err.Error())
 	_, ok := err.(*backoff.PermanentError)
 	if !ok {
@@ -412,7 +560,7 @@ func TestObjectstoreConfig(t *testing.T) {
 
 	// Test02 Connection refused - Error for retry
 	ts.Close()
-	err = UploadSnapshot(snap, bucket)
+	err = UploadSnapshot(context.TODO(), snap, bucket)
 	fmt.Println(err.Error())
 	_, ok = err.(*backoff.PermanentError)
 	if ok {
@@ -420,141 +568,934 @@ func TestObjectstoreConfig(t *testing.T) {
 	}
 }
 
-// Test util funcs //////////////
+func TestIncrementalSnapshot(t *testing.T) {
 
-func chkResourceList(t *testing.T, res, ref []string) {
-	notMatch := false
-	if len(res) != len(ref) {
-		notMatch = true
+	bucket := newMemBucketMock()
+
+	// First snapshot uploads all blobs
+	snap1 := newConfiguredSnapshot("incr1", "InProgress")
+	snap1.Spec.Incremental = true
+	writeTestArchive(t, "incr1", map[string]string{"a.json": "{\"a\":1}", "b.json": "{\"b\":1}"})
+	err := UploadSnapshot(context.TODO(), snap1, bucket)
+	if err != nil {
+		t.Errorf("Error in UploadSnapshot : %s", err.Error())
 	}
-	for _, x := range res {
-		notFound := true
-		for _, y := range ref {
-			if x == y {
-				notFound = false
-				break
-			}
-		}
-		if notFound {
-			notMatch = true
-			break
+	if _, ok := bucket.objects["incr1"+ManifestSuffix]; !ok {
+		t.Error("Manifest of incr1 not uploaded")
+	}
+	if len(bucket.blobs()) != 2 {
+		t.Errorf("Number of blobs %d not equals to 2", len(bucket.blobs()))
+	}
+
+	// Second snapshot uploads only changed blob
+	snap2 := newConfiguredSnapshot("incr2", "InProgress")
+	snap2.Spec.Incremental = true
+	writeTestArchive(t, "incr2", map[string]string{"a.json": "{\"a\":1}", "c.json": "{\"c\":1}"})
+	err = UploadSnapshot(context.TODO(), snap2, bucket)
+	if err != nil {
+		t.Errorf("Error in UploadSnapshot : %s", err.Error())
+	}
+	if len(bucket.blobs()) != 3 {
+		t.Errorf("Number of blobs %d not equals to 3", len(bucket.blobs()))
+	}
+	if snap2.Status.UploadedFileSize != snap2.Status.StoredFileSize+int64(len("{\"c\":1}")) {
+		t.Errorf("Uploaded size %d includes existing blobs", snap2.Status.UploadedFileSize)
+	}
+
+	// Download rebuilds the archive
+	_ = os.Remove("/tmp/incr2" + ArchiveSuffix)
+	err = DownloadSnapshotArchive(context.TODO(), "incr2", bucket)
+	if err != nil {
+		t.Errorf("Error in DownloadSnapshotArchive : %s", err.Error())
+	}
+	entries := readTestArchive(t, "incr2")
+	if entries["incr2/a.json"] != "{\"a\":1}" || entries["incr2/c.json"] != "{\"c\":1}" || len(entries) != 2 {
+		t.Errorf("Rebuilt archive not match : %v", entries)
+	}
+
+	// Unreferenced blob kept in the grace period for uploads not written manifests yet
+	_ = bucket.Delete(context.TODO(), "incr1"+ManifestSuffix)
+	err = GarbageCollectBlobs(context.TODO(), bucket)
+	if err != nil {
+		t.Errorf("Error in GarbageCollectBlobs : %s", err.Error())
+	}
+	if len(bucket.blobs()) != 3 {
+		t.Errorf("Number of blobs %d not equals to 3 in grace period", len(bucket.blobs()))
+	}
+
+	// Unreferenced blob collected after the grace period
+	bucket.age(BlobPrefix, blobGracePeriod+time.Minute)
+	err = GarbageCollectBlobs(context.TODO(), bucket)
+	if err != nil {
+		t.Errorf("Error in GarbageCollectBlobs : %s", err.Error())
+	}
+	if len(bucket.blobs()) != 2 {
+		t.Errorf("Number of blobs %d not equals to 2 after GC", len(bucket.blobs()))
+	}
+	err = DownloadSnapshotArchive(context.TODO(), "incr2", bucket)
+	if err != nil {
+		t.Errorf("Error in DownloadSnapshotArchive after GC : %s", err.Error())
+	}
+
+	// No manifest left when uploading blobs failed
+	snap3 := newConfiguredSnapshot("incr3", "InProgress")
+	snap3.Spec.Incremental = true
+	writeTestArchive(t, "incr3", map[string]string{"d.json": "{\"d\":1}"})
+	err = UploadSnapshot(context.TODO(), snap3, &prefixFailingBucketMock{bucket, BlobPrefix})
+	if err == nil {
+		t.Error("Blob upload error not returned")
+	}
+	if _, ok := bucket.objects["incr3"+ManifestSuffix]; ok {
+		t.Error("Manifest of incr3 uploaded with blobs failed")
+	}
+
+	// Stored blobs collected by GC of another controller while uploading are uploaded again
+	snap4 := newConfiguredSnapshot("incr4", "InProgress")
+	snap4.Spec.Incremental = true
+	writeTestArchive(t, "incr4", map[string]string{"a.json": "{\"a\":1}", "e.json": "{\"e\":1}"})
+	err = UploadSnapshot(context.TODO(), snap4, &collectingBucketMock{bucket})
+	if err != nil {
+		t.Errorf("Error in UploadSnapshot : %s", err.Error())
+	}
+	_ = os.Remove("/tmp/incr4" + ArchiveSuffix)
+	err = DownloadSnapshotArchive(context.TODO(), "incr4", bucket)
+	if err != nil {
+		t.Errorf("Error in DownloadSnapshotArchive with blobs collected : %s", err.Error())
+	}
+
+	// Archive rebuilt in the compression of the snapshot
+	snap5 := newConfiguredSnapshot("incr5", "InProgress")
+	snap5.Spec.Incremental = true
+	snap5.Status.Compression = CompressionZstd
+	writeTestArchive(t, "incr5", map[string]string{"a.json": "{\"a\":1}"})
+	_ = os.Rename("/tmp/incr5"+ArchiveSuffix, snapshotArchivePath(snap5))
+	err = UploadSnapshot(context.TODO(), snap5, bucket)
+	if err != nil {
+		t.Errorf("Error in UploadSnapshot : %s", err.Error())
+	}
+	_ = os.Remove("/tmp/incr5" + ArchiveSuffix)
+	err = DownloadSnapshotArchive(context.TODO(), "incr5", bucket)
+	if err != nil {
+		t.Errorf("Error in DownloadSnapshotArchive : %s", err.Error())
+	}
+	data, _ := ioutil.ReadFile("/tmp/incr5" + ArchiveSuffix)
+	if !bytes.HasPrefix(data, codecs[CompressionZstd].magic) {
+		t.Error("Rebuilt archive not compressed with zstd")
+	}
+	entries = readTestArchive(t, "incr5")
+	if entries["incr5/a.json"] != "{\"a\":1}" || len(entries) != 1 {
+		t.Errorf("Rebuilt archive not match : %v", entries)
+	}
+
+	// Corrupted blob detected
+	for name := range bucket.objects {
+		if strings.HasPrefix(name, BlobPrefix) {
+			bucket.objects[name] = []byte("corrupted")
 		}
 	}
-	if notMatch {
-		t.Errorf("List not match\nResult : %v\nExpected : %v", res, ref)
+	err = DownloadSnapshotArchive(context.TODO(), "incr5", bucket)
+	if err == nil || !strings.Contains(err.Error(), "corrupted") {
+		t.Errorf("Corrupted blob not detected : %v", err)
 	}
 }
 
-// Mock bucket
+// Bucket deleting all blobs when the manifest uploaded, as GC of another controller does
+type collectingBucketMock struct {
+	*memBucketMock
+}
 
-type bucketMock struct {
-	objectstore.Objectstore
+func (b *collectingBucketMock) Upload(ctx context.Context, file io.Reader, filename string) error {
+	if strings.HasSuffix(filename, ManifestSuffix) {
+		for _, name := range b.blobs() {
+			delete(b.objects, name)
+		}
+	}
+	return b.memBucketMock.Upload(ctx, file, filename)
 }
 
-var uploadFilename string
+// Bucket failing to upload objects with the prefix
+type prefixFailingBucketMock struct {
+	*memBucketMock
+	prefix string
+}
 
-func (b bucketMock) Upload(file *os.File, filename string) error {
-	uploadFilename = filename
-	return nil
+func (b *prefixFailingBucketMock) Upload(ctx context.Context, file io.Reader, filename string) error {
+	if strings.HasPrefix(filename, b.prefix) {
+		return fmt.Errorf("Mock upload error")
+	}
+	return b.memBucketMock.Upload(ctx, file, filename)
 }
 
-var downloadFilename string
+func TestVerify(t *testing.T) {
+
+	bucket := newMemBucketMock()
+	content := "{\"a\":1}"
+	manifest := newArchiveManifest("v1.20.0")
+	manifest.add("verify1/a.json", []byte(content))
+	manifestJSON, _ := json.Marshal(manifest)
+
+	cases := []struct {
+		files   map[string]string
+		status  metav1.ConditionStatus
+		message string
+	}{
+		// Checksums matched
+		{map[string]string{"a.json": content, ManifestFile: string(manifestJSON)},
+			metav1.ConditionTrue, "1 entries verified"},
+		// Archive in format version 0 without manifest
+		{map[string]string{"a.json": content},
+			metav1.ConditionUnknown, "No manifest in the archive, migrate the snapshot to verify"},
+		// Tampered entry
+		{map[string]string{"a.json": "{\"a\":2}", ManifestFile: string(manifestJSON)},
+			metav1.ConditionFalse, "Checksum not matched for verify1/a.json"},
+		// Entry not in manifest
+		{map[string]string{"a.json": content, "b.json": content, ManifestFile: string(manifestJSON)},
+			metav1.ConditionFalse, "Entries not in manifest : verify1/b.json"},
+	}
 
-func (b bucketMock) Download(file *os.File, filename string) error {
-	downloadFilename = filename
-	return nil
+	for i, c := range cases {
+		writeTestArchive(t, "verify1", c.files)
+		snap := newConfiguredSnapshot("verify1", "Completed")
+		err := UploadSnapshot(context.TODO(), snap, bucket)
+		if err != nil {
+			t.Errorf("#%d Error in UploadSnapshot : %s", i, err.Error())
+		}
+		_, err = Verify(context.TODO(), snap, bucket)
+		if err != nil {
+			t.Errorf("#%d Error in Verify : %s", i, err.Error())
+		}
+		condition := meta.FindStatusCondition(snap.Status.Conditions, ConditionVerified)
+		if condition == nil || condition.Status != c.status || condition.Message != c.message {
+			t.Errorf("#%d Verified condition not match : %v", i, condition)
+		}
+		if snap.Status.VerifiedTimestamp.IsZero() {
+			t.Errorf("#%d Verified timestamp not set", i)
+		}
+	}
+
+	// Snapshot not in bucket
+	_, err := Verify(context.TODO(), newConfiguredSnapshot("notfound", "Completed"), bucket)
+	if err == nil {
+		t.Error("Error must be occurred verifying snapshot not in bucket")
+	}
 }
 
-var objectInfo *objectstore.ObjectInfo
-var getObjectInfoFilename string
+func TestArchiveFormat(t *testing.T) {
 
-func (b bucketMock) GetObjectInfo(filename string) (*objectstore.ObjectInfo, error) {
-	getObjectInfoFilename = filename
-	return objectInfo, nil
+	// Snapshot resource in older archives has no kind and apiVersion
+	oldSnapshotJSON := "{\"metadata\":{\"name\":\"format1\"},\"spec\":{\"objectstoreConfig\":\"config\"}}"
+	content := "{\"a\":1}"
+
+	// Version 0 archive
+	writeTestArchive(t, "format1", map[string]string{"a.json": content, SnapshotFile: oldSnapshotJSON})
+	archive, err := ReadSnapshotArchive("format1", "/tmp/format1"+ArchiveSuffix)
+	if err != nil {
+		t.Fatalf("Error in ReadSnapshotArchive : %s", err.Error())
+	}
+	if archive.FormatVersion != 0 || archive.Manifest != nil {
+		t.Errorf("Format version not match : %d", archive.FormatVersion)
+	}
+	if archive.Snapshot.GetKind() != "Snapshot" ||
+		archive.Snapshot.GetAPIVersion() != clustersnapshot.SchemeGroupVersion.String() ||
+		archive.Snapshot.GetName() != "format1" {
+		t.Errorf("Snapshot resource not patched : %v", archive.Snapshot.Object)
+	}
+	if len(archive.Entries) != 1 || archive.Entries[0].Path != "/a.json" || string(archive.Entries[0].Content) != content {
+		t.Errorf("Entries not match : %v", archive.Entries)
+	}
+
+	// Entries streamed without being kept
+	streamed := make(map[string]string)
+	archive, err = StreamSnapshotArchive("format1", "/tmp/format1"+ArchiveSuffix,
+		func(path string, r io.Reader) error {
+			b, err := ioutil.ReadAll(r)
+			streamed[path] = string(b)
+			return err
+		})
+	if err != nil {
+		t.Fatalf("Error in StreamSnapshotArchive : %s", err.Error())
+	}
+	if archive.Entries != nil || !reflect.DeepEqual(streamed, map[string]string{"/a.json": content}) {
+		t.Errorf("Entries not streamed : %v / %v", archive.Entries, streamed)
+	}
+	_, err = StreamSnapshotArchive("format1", "/tmp/format1"+ArchiveSuffix,
+		func(path string, r io.Reader) error { return fmt.Errorf("stop") })
+	if err == nil || !strings.Contains(err.Error(), "stop") {
+		t.Errorf("Error of entry func not returned : %v", err)
+	}
+
+	// Unsupported version
+	writeTestArchive(t, "format1", map[string]string{"a.json": content, SnapshotFile: oldSnapshotJSON,
+		ManifestFile: "{\"formatVersion\":99}"})
+	_, err = ReadSnapshotArchive("format1", "/tmp/format1"+ArchiveSuffix)
+	if err == nil || !strings.Contains(err.Error(), "Unsupported archive format version 99") {
+		t.Errorf("Error must be occurred reading unsupported version : %v", err)
+	}
+
+	// Version 1 archive requires kind
+	writeTestArchive(t, "format1", map[string]string{"a.json": content, SnapshotFile: oldSnapshotJSON,
+		ManifestFile: "{\"formatVersion\":1}"})
+	_, err = ReadSnapshotArchive("format1", "/tmp/format1"+ArchiveSuffix)
+	if err == nil {
+		t.Error("Error must be occurred reading version 1 snapshot.json without kind")
+	}
+
+	// No snapshot.json
+	writeTestArchive(t, "format1", map[string]string{"a.json": content})
+	_, err = ReadSnapshotArchive("format1", "/tmp/format1"+ArchiveSuffix)
+	if err == nil {
+		t.Error("Error must be occurred reading archive without snapshot.json")
+	}
 }
 
-// Mock k8s API
+func TestMigrateSnapshot(t *testing.T) {
 
-var dynamicTracker ObjectTracker
+	oldSnapshotJSON := "{\"metadata\":{\"name\":\"migrate1\"},\"spec\":{\"objectstoreConfig\":\"config\"}}"
+	content := "{\"a\":1}"
 
-func newDynamicClient(scheme *runtime.Scheme, rv uint64, objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	for _, incremental := range []bool{false, true} {
+		bucket := newMemBucketMock()
+		writeTestArchive(t, "migrate1", map[string]string{"a.json": content, SnapshotFile: oldSnapshotJSON})
+		snap := newConfiguredSnapshot("migrate1", "Completed")
+		snap.Spec.Incremental = incremental
+		err := UploadSnapshot(context.TODO(), snap, bucket)
+		if err != nil {
+			t.Fatalf("Error in UploadSnapshot : %s", err.Error())
+		}
 
-	// In order to use List with this client, you have to have the v1.List registered in your scheme. Neat thing though
-	// it does NOT have to be the *same* list
-	scheme.AddKnownTypeWithName(
-		schema.GroupVersionKind{Group: "fake-dynamic-client-group", Version: "v1", Kind: "List"},
-		&unstructured.UnstructuredList{})
-	scheme.AddKnownTypeWithName(
-		schema.GroupVersionKind{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "ClusterRoleBinding"},
-		&unstructured.Unstructured{})
+		// Migrate version 0 archive
+		migrated, err := MigrateSnapshot(context.TODO(), snap, bucket)
+		if err != nil {
+			t.Fatalf("Error in MigrateSnapshot : %s", err.Error())
+		}
+		if !migrated || snap.Status.ArchiveFormatVersion != ArchiveFormatVersion {
+			t.Errorf("Snapshot not migrated : incremental=%t", incremental)
+		}
 
-	codecs := serializer.NewCodecFactory(scheme)
-	dynamicTracker = NewObjectTracker(scheme, codecs.UniversalDecoder(), rv)
-	for _, obj := range objects {
-		if err := dynamicTracker.Add(obj); err != nil {
-			panic(err)
+		// Read migrated archive
+		err = DownloadSnapshotArchive(context.TODO(), "migrate1", bucket)
+		if err != nil {
+			t.Fatalf("Error in DownloadSnapshotArchive : %s", err.Error())
+		}
+		archivePath := "/tmp/migrate1" + ArchiveSuffix
+		_, err = VerifyArchive("migrate1", archivePath)
+		if err != nil {
+			t.Errorf("Error in VerifyArchive : %s", err.Error())
+		}
+		archive, err := ReadSnapshotArchive("migrate1", archivePath)
+		if err != nil {
+			t.Fatalf("Error in ReadSnapshotArchive : %s", err.Error())
+		}
+		if archive.FormatVersion != ArchiveFormatVersion || archive.Snapshot.GetKind() != "Snapshot" {
+			t.Errorf("Migrated archive not match : version=%d kind=%s",
+				archive.FormatVersion, archive.Snapshot.GetKind())
+		}
+		version, _, _ := unstructured.NestedInt64(archive.Snapshot.Object, "status", "archiveFormatVersion")
+		if version != ArchiveFormatVersion {
+			t.Errorf("Archive format version in snapshot.json not match : %d", version)
+		}
+		if len(archive.Entries) != 1 || string(archive.Entries[0].Content) != content {
+			t.Errorf("Entries not match : %v", archive.Entries)
+		}
+
+		// Already in current format
+		migrated, err = MigrateSnapshot(context.TODO(), snap, bucket)
+		if err != nil {
+			t.Errorf("Error in MigrateSnapshot : %s", err.Error())
+		}
+		if migrated {
+			t.Errorf("Snapshot in current format must not be migrated")
 		}
 	}
 
-	cs := dynamicfake.NewSimpleDynamicClient(scheme, objects...)
+	// Snapshot not in bucket
+	_, err := MigrateSnapshot(context.TODO(), newConfiguredSnapshot("notfound", "Completed"), newMemBucketMock())
+	if err == nil {
+		t.Error("Error must be occurred migrating snapshot not in bucket")
+	}
+}
 
-	// Change the tracker with versioned
-	cs.ReactionChain = nil
-	cs.AddReactor("*", "*", core.ObjectReaction(dynamicTracker))
-	cs.WatchReactionChain = nil
-	cs.AddWatchReactor("*", func(action core.Action) (handled bool, ret watch.Interface, err error) {
-		gvr := action.GetResource()
-		ns := action.GetNamespace()
-		watch, err := dynamicTracker.Watch(gvr, ns)
+func TestCompression(t *testing.T) {
+
+	snapshotJSON := "{\"kind\":\"Snapshot\",\"apiVersion\":\"clustersnapshot.rywt.io/v1alpha1\"," +
+		"\"metadata\":{\"name\":\"comp1\"}}"
+	content := "{\"a\":1}"
+
+	cases := []struct {
+		compression string
+		level       int
+		objectName  string
+		magic       []byte
+	}{
+		{CompressionGzip, 0, "comp1.tgz", []byte{0x1f, 0x8b}},
+		{CompressionGzip, 9, "comp1.tgz", []byte{0x1f, 0x8b}},
+		{CompressionZstd, 0, "comp1.tar.zst", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+		{CompressionZstd, 19, "comp1.tar.zst", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+		{CompressionNone, 0, "comp1.tar", []byte("comp1/")},
+	}
+
+	for i, c := range cases {
+		bucket := newMemBucketMock()
+		snapshot := &unstructured.Unstructured{}
+		_ = snapshot.UnmarshalJSON([]byte(snapshotJSON))
+		archive := &SnapshotArchive{
+			Name:     "comp1",
+			Snapshot: snapshot,
+			Entries:  []ArchiveEntry{ArchiveEntry{Path: "/a.json", Content: []byte(content)}},
+		}
+		// Local archive suffixed with the codec
+		err := writeSnapshotArchive(archive, "/tmp/"+c.objectName, c.compression, c.level)
 		if err != nil {
-			return false, nil, err
+			t.Fatalf("#%d Error in writeSnapshotArchive : %s", i, err.Error())
+		}
+		data, _ := ioutil.ReadFile("/tmp/" + c.objectName)
+		if !bytes.HasPrefix(data, c.magic) {
+			t.Errorf("#%d Archive not compressed with %s", i, c.compression)
 		}
-		return true, watch, nil
-	})
 
-	return cs
-}
+		// Object name reflects the compression
+		snap := newConfiguredSnapshot("comp1", "Completed")
+		snap.Status.Compression = c.compression
+		err = UploadSnapshot(context.TODO(), snap, bucket)
+		if err != nil {
+			t.Fatalf("#%d Error in UploadSnapshot : %s", i, err.Error())
+		}
+		if _, ok := bucket.objects[c.objectName]; !ok || SnapshotObjectName(snap) != c.objectName {
+			t.Errorf("#%d Object %s not uploaded", i, c.objectName)
+		}
+		if name, ok := SnapshotNameFromObject(c.objectName); !ok || name != "comp1" {
+			t.Errorf("#%d Snapshot name not match for %s", i, c.objectName)
+		}
+		if CompressionFromObject(c.objectName) != c.compression {
+			t.Errorf("#%d Compression not match for %s", i, c.objectName)
+		}
 
-func convertToUnstructured(t *testing.T, obj runtime.Object) runtime.Object {
-	maped, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+		// Codec detected from the archive itself
+		err = DownloadSnapshotArchive(context.TODO(), "comp1", bucket)
+		if err != nil {
+			t.Fatalf("#%d Error in DownloadSnapshotArchive : %s", i, err.Error())
+		}
+		_, err = VerifyArchive("comp1", "/tmp/comp1"+ArchiveSuffix)
+		if err != nil {
+			t.Errorf("#%d Error in VerifyArchive : %s", i, err.Error())
+		}
+		read, err := ReadSnapshotArchive("comp1", "/tmp/comp1"+ArchiveSuffix)
+		if err != nil {
+			t.Fatalf("#%d Error in ReadSnapshotArchive : %s", i, err.Error())
+		}
+		if len(read.Entries) != 1 || string(read.Entries[0].Content) != content {
+			t.Errorf("#%d Entries not match : %v", i, read.Entries)
+		}
+	}
+
+	// Entries of the caller not overwritten with snapshot.json
+	entries := make([]ArchiveEntry, 1, 2)
+	entries[0] = ArchiveEntry{Path: "/a.json", Content: []byte(content)}
+	spare := entries[:2]
+	snapshot := &unstructured.Unstructured{}
+	_ = snapshot.UnmarshalJSON([]byte(snapshotJSON))
+	err := writeSnapshotArchive(&SnapshotArchive{Name: "comp1", Snapshot: snapshot, Entries: entries},
+		"/tmp/comp1.tgz", CompressionGzip, 0)
 	if err != nil {
-		t.Errorf("Error converting object to unstructured : %s", err.Error())
+		t.Fatalf("Error in writeSnapshotArchive : %s", err.Error())
+	}
+	if spare[1].Path != "" {
+		t.Errorf("Entries of the caller overwritten : %v", spare)
+	}
+
+	// Invalid settings
+	if validateCompression("lz4", 0) == nil {
+		t.Error("Error must be occurred with unknown codec")
+	}
+	if validateCompression(CompressionGzip, 10) == nil {
+		t.Error("Error must be occurred with gzip level out of range")
+	}
+	if validateCompression(CompressionZstd, 23) == nil {
+		t.Error("Error must be occurred with zstd level out of range")
+	}
+	if validateCompression(CompressionNone, 0) != nil {
+		t.Error("Error must not be occurred with none")
 	}
-	unstrctrd := &unstructured.Unstructured{Object: maped}
-	return unstrctrd.DeepCopyObject()
 }
 
-func unstrctrdResource(group, version, ns, name, kind, resourcename string) *unstructured.Unstructured {
-	item := &unstructured.Unstructured{}
-	item.SetGroupVersionKind(schema.GroupVersionKind{Group: group, Version: version, Kind: kind})
-	item.SetName(name)
-	if ns != "" {
-		item.SetNamespace(ns)
+// slowDynamicClient counts concurrent list calls taking a while
+type slowDynamicClient struct {
+	dynamic.Interface
+	lock        sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+type slowResourceClient struct {
+	dynamic.NamespaceableResourceInterface
+	client *slowDynamicClient
+}
+
+func (c *slowDynamicClient) Resource(resource schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
+	return &slowResourceClient{NamespaceableResourceInterface: c.Interface.Resource(resource), client: c}
+}
+
+func (r *slowResourceClient) List(ctx context.Context, opts metav1.ListOptions) (*unstructured.UnstructuredList, error) {
+	r.client.lock.Lock()
+	r.client.inFlight++
+	if r.client.inFlight > r.client.maxInFlight {
+		r.client.maxInFlight = r.client.inFlight
 	}
-	return item
+	r.client.lock.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	r.client.lock.Lock()
+	r.client.inFlight--
+	r.client.lock.Unlock()
+	return r.NamespaceableResourceInterface.List(ctx, opts)
 }
 
-func setAPIResourceList(resources []*metav1.APIResourceList,
-	group, version, name, kind string, namespaced bool) []*metav1.APIResourceList {
-	gv := group + "/" + version
-	if group == "" {
-		gv = version
+func TestListResources(t *testing.T) {
+
+	failResource := ""
+
+	listKinds := make(map[schema.GroupVersionResource]string)
+	for i := 0; i < 10; i++ {
+		listKinds[schema.GroupVersionResource{Group: "test", Version: "v1", Resource: fmt.Sprintf("res%d", i)}] = "ResList"
 	}
-	for _, r := range resources {
-		if r.GroupVersion == gv {
-			r.APIResources = append(r.APIResources, metav1.APIResource{
-				Name: name, Group: group, Version: version, Kind: kind, Namespaced: namespaced,
-				Verbs: []string{"list", "create", "get", "delete"},
+	fakeClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds)
+	fakeClient.PrependReactor("list", "*", func(action core.Action) (bool, runtime.Object, error) {
+		resource := action.GetResource().Resource
+		if resource == failResource {
+			return true, nil, fmt.Errorf("list error")
+		}
+		item := unstructured.Unstructured{}
+		item.SetName(resource)
+		return true, &unstructured.UnstructuredList{Items: []unstructured.Unstructured{item}}, nil
+	})
+	dynamicClient := &slowDynamicClient{Interface: fakeClient}
+
+	newTasks := func() []*listTask {
+		tasks := make([]*listTask, 0)
+		for i := 0; i < 10; i++ {
+			name := fmt.Sprintf("res%d", i)
+			tasks = append(tasks, &listTask{
+				gvr:          schema.GroupVersionResource{Group: "test", Version: "v1", Resource: name},
+				groupVersion: "test/v1",
+				name:         name,
 			})
-			return resources
 		}
+		return tasks
 	}
-	resources = append(resources, &metav1.APIResourceList{
-		GroupVersion: gv,
-		APIResources: []metav1.APIResource{
-			metav1.APIResource{
-				Name: name, Group: group, Version: version, Kind: kind, Namespaced: namespaced,
-				Verbs: []string{"list", "create", "get", "delete"},
+
+	// Bounded and merged in order
+	collector := newEventCollector(newServerResources(nil))
+	tasks := newTasks()
+	err := listResources(context.TODO(), dynamicClient, tasks, "list1", 3, "", collector)
+	collector.stop()
+	if err != nil {
+		t.Fatalf("Error in listResources : %s", err.Error())
+	}
+	if dynamicClient.maxInFlight > 3 || dynamicClient.maxInFlight < 2 {
+		t.Errorf("Concurrent lists %d not in limit 3", dynamicClient.maxInFlight)
+	}
+	for i, task := range tasks {
+		if len(task.items) != 1 || task.items[0].GetName() != fmt.Sprintf("res%d", i) {
+			t.Errorf("Items of task %d not match : %v", i, task.items)
+		}
+	}
+
+	// Snapshots of the same cluster share the limit
+	dynamicClient.maxInFlight = 0
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			collector := newEventCollector(newServerResources(nil))
+			defer collector.stop()
+			err := listResources(context.TODO(), dynamicClient, newTasks(), "list2", 2, "", collector)
+			if err != nil {
+				t.Errorf("Error in listResources : %s", err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+	if dynamicClient.maxInFlight > 2 {
+		t.Errorf("Concurrent lists %d for a cluster not in limit 2", dynamicClient.maxInFlight)
+	}
+	if len(clusterSemaphores) != 0 {
+		t.Errorf("Semaphores not released : %v", clusterSemaphores)
+	}
+
+	// Semaphore in use kept for the other limit
+	sem, release := acquireClusterSemaphore("list3", 2)
+	sem2, release2 := acquireClusterSemaphore("list3", 5)
+	if sem != sem2 || cap(sem2) != 2 {
+		t.Errorf("Semaphore in use replaced : cap %d", cap(sem2))
+	}
+	release()
+	release2()
+	if _, ok := clusterSemaphores["list3"]; ok {
+		t.Errorf("Semaphore not deleted when unused")
+	}
+
+	// Keyed by API server host, or the snapshot when unknown
+	snap := newConfiguredSnapshot("snap1", "InQueue")
+	snap.Spec.Kubeconfig = "apiVersion: v1\nkind: Config\n" +
+		"clusters:\n- name: c1\n  cluster:\n    server: https://10.0.0.1:6443\n" +
+		"contexts:\n- name: c1\n  context:\n    cluster: c1\ncurrent-context: c1\n"
+	if key := clusterKey(snap); key != "https://10.0.0.1:6443" {
+		t.Errorf("Cluster key %s not the API server host", key)
+	}
+	snap.Spec.Kubeconfig = ""
+	if key := clusterKey(snap); key == "" || key == clusterKey(newConfiguredSnapshot("snap2", "InQueue")) {
+		t.Errorf("Cluster key %s of unknown host shared", key)
+	}
+
+	// List error
+	failResource = "res5"
+	collector = newEventCollector(newServerResources(nil))
+	err = listResources(context.TODO(), dynamicClient, newTasks(), "list1", 3, "", collector)
+	collector.stop()
+	if err == nil || !strings.Contains(err.Error(), "Get resource res5 list failed") {
+		t.Errorf("Error must be occurred on list error : %v", err)
+	}
+
+	// Events sorted by resource version
+	collector = newEventCollector(newServerResources(nil))
+	for _, rv := range []string{"5", "3", "4"} {
+		item := &unstructured.Unstructured{}
+		item.SetResourceVersion(rv)
+		collector.events = append(collector.events, watch.Event{Type: watch.Modified, Object: item})
+	}
+	rvs := ""
+	for _, e := range collector.sortedEvents() {
+		rvs += e.Object.(*unstructured.Unstructured).GetResourceVersion()
+	}
+	if rvs != "345" {
+		t.Errorf("Events not sorted by resource version : %s", rvs)
+	}
+}
+
+func TestSyncWatchEvents(t *testing.T) {
+
+	res := make([]*metav1.APIResourceList, 0)
+	res = setAPIResourceList(res, "", "v1", "configmaps", "ConfigMap", true)
+	sr := newServerResources(res)
+	blog := utils.NewNamedLog("sync:test")
+
+	configMap := func(name, rv string) *unstructured.Unstructured {
+		item := &unstructured.Unstructured{}
+		item.SetAPIVersion("v1")
+		item.SetKind("ConfigMap")
+		item.SetNamespace("default")
+		item.SetName(name)
+		item.SetResourceVersion(rv)
+		return item
+	}
+
+	snapshotList := []unstructured.Unstructured{
+		*configMap("cm1", "10"), *configMap("cm2", "11"), *configMap("cm3", "12"), *configMap("cm4", "13"),
+	}
+	events := []watch.Event{
+		// applied
+		watch.Event{Type: watch.Modified, Object: configMap("cm2", "21")},
+		// ignored, older than stored
+		watch.Event{Type: watch.Modified, Object: configMap("cm3", "9")},
+		// deleted
+		watch.Event{Type: watch.Deleted, Object: configMap("cm1", "22")},
+		// added
+		watch.Event{Type: watch.Added, Object: configMap("cm5", "23")},
+		// already deleted
+		watch.Event{Type: watch.Deleted, Object: configMap("cm6", "24")},
+		// deleted and added again
+		watch.Event{Type: watch.Deleted, Object: configMap("cm4", "25")},
+		watch.Event{Type: watch.Added, Object: configMap("cm4", "26")},
+		// ignored, not older than end resource version
+		watch.Event{Type: watch.Modified, Object: configMap("cm3", "30")},
+		// unknown type
+		watch.Event{Type: watch.Error, Object: &metav1.Status{}},
+	}
+
+	synced := syncWatchEvents(snapshotList, events, "30", sr, blog)
+	result := make([]string, 0)
+	for _, item := range synced {
+		result = append(result, item.GetName()+":"+item.GetResourceVersion())
+	}
+	expected := []string{"cm2:21", "cm3:12", "cm4:26", "cm5:23"}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Synced resources not match : %v", result)
+	}
+}
+
+// Test util funcs //////////////
+
+func writeTestArchive(t *testing.T, name string, files map[string]string) {
+	f, err := os.Create("/tmp/" + name + ArchiveSuffix)
+	if err != nil {
+		t.Fatalf("Error creating archive : %s", err.Error())
+	}
+	defer func() { _ = f.Close() }()
+	tgz := gzip.NewWriter(f)
+	defer func() { _ = tgz.Close() }()
+	tarWriter := tar.NewWriter(tgz)
+	defer func() { _ = tarWriter.Close() }()
+	for path, content := range files {
+		hdr := &tar.Header{Name: name + "/" + path, Size: int64(len(content)), Typeflag: tar.TypeReg, Mode: 0755}
+		if err := tarWriter.WriteHeader(hdr); err != nil {
+			t.Fatalf("Error writing archive : %s", err.Error())
+		}
+		if _, err := tarWriter.Write([]byte(content)); err != nil {
+			t.Fatalf("Error writing archive : %s", err.Error())
+		}
+	}
+}
+
+func readTestArchive(t *testing.T, name string) map[string]string {
+	entries := make(map[string]string)
+	f, err := os.Open("/tmp/" + name + ArchiveSuffix)
+	if err != nil {
+		t.Fatalf("Error opening archive : %s", err.Error())
+	}
+	defer func() { _ = f.Close() }()
+	tgz, err := newArchiveReader(f)
+	if err != nil {
+		t.Fatalf("Error reading archive : %s", err.Error())
+	}
+	defer func() { _ = tgz.Close() }()
+	tarReader := tar.NewReader(tgz)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error reading archive : %s", err.Error())
+		}
+		content, _ := ioutil.ReadAll(tarReader)
+		entries[header.Name] = string(content)
+	}
+	return entries
+}
+
+func chkResourceList(t *testing.T, res, ref []string) {
+	notMatch := false
+	if len(res) != len(ref) {
+		notMatch = true
+	}
+	for _, x := range res {
+		notFound := true
+		for _, y := range ref {
+			if x == y {
+				notFound = false
+				break
+			}
+		}
+		if notFound {
+			notMatch = true
+			break
+		}
+	}
+	if notMatch {
+		t.Errorf("List not match\nResult : %v\nExpected : %v", res, ref)
+	}
+}
+
+// Mock bucket
+
+type bucketMock struct {
+	objectstore.Objectstore
+}
+
+func (b bucketMock) GetName() string {
+	return "bucket"
+}
+
+var uploadFilenames []string
+
+func (b bucketMock) Upload(ctx context.Context, file io.Reader, filename string) error {
+	uploadFilenames = append(uploadFilenames, filename)
+	return nil
+}
+
+var downloadFilename string
+
+func (b bucketMock) Download(ctx context.Context, file *os.File, filename string) error {
+	downloadFilename = filename
+	return nil
+}
+
+var objectInfo *objectstore.ObjectInfo
+var getObjectInfoFilename string
+
+func (b bucketMock) GetObjectInfo(ctx context.Context, filename string) (*objectstore.ObjectInfo, error) {
+	getObjectInfoFilename = filename
+	if objectInfo == nil || objectInfo.Name != filename {
+		return nil, fmt.Errorf("Object %s not found", filename)
+	}
+	return objectInfo, nil
+}
+
+// In-memory bucket
+
+type memBucketMock struct {
+	objectstore.Objectstore
+	objects  map[string][]byte
+	modified map[string]time.Time
+}
+
+func newMemBucketMock() *memBucketMock {
+	return &memBucketMock{objects: make(map[string][]byte), modified: make(map[string]time.Time)}
+}
+
+// age makes objects with the prefix look uploaded before the duration
+func (b *memBucketMock) age(prefix string, d time.Duration) {
+	for name := range b.objects {
+		if strings.HasPrefix(name, prefix) {
+			b.modified[name] = b.modified[name].Add(-d)
+		}
+	}
+}
+
+func (b *memBucketMock) blobs() []string {
+	blobs := make([]string, 0)
+	for name := range b.objects {
+		if strings.HasPrefix(name, BlobPrefix) {
+			blobs = append(blobs, name)
+		}
+	}
+	return blobs
+}
+
+func (b *memBucketMock) GetName() string {
+	return "bucket"
+}
+
+func (b *memBucketMock) Upload(ctx context.Context, file io.Reader, filename string) error {
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	b.objects[filename] = data
+	b.modified[filename] = time.Now()
+	return nil
+}
+
+func (b *memBucketMock) Download(ctx context.Context, file *os.File, filename string) error {
+	data, ok := b.objects[filename]
+	if !ok {
+		return fmt.Errorf("Object %s not found", filename)
+	}
+	_, err := file.WriteAt(data, 0)
+	return err
+}
+
+func (b *memBucketMock) Delete(ctx context.Context, filename string) error {
+	delete(b.objects, filename)
+	return nil
+}
+
+func (b *memBucketMock) GetObjectInfo(ctx context.Context, filename string) (*objectstore.ObjectInfo, error) {
+	data, ok := b.objects[filename]
+	if !ok {
+		return nil, fmt.Errorf("Object %s not found", filename)
+	}
+	return &objectstore.ObjectInfo{
+		Name: filename, Size: int64(len(data)), Timestamp: b.modified[filename], BucketConfigName: "mem"}, nil
+}
+
+func (b *memBucketMock) ListObjectInfo(ctx context.Context) ([]objectstore.ObjectInfo, error) {
+	return b.ListObjectInfoWithPrefix(ctx, "")
+}
+
+func (b *memBucketMock) ListObjectInfoWithPrefix(ctx context.Context, prefix string) ([]objectstore.ObjectInfo, error) {
+	list := make([]objectstore.ObjectInfo, 0)
+	for name, data := range b.objects {
+		if strings.HasPrefix(name, prefix) {
+			list = append(list, objectstore.ObjectInfo{
+				Name: name, Size: int64(len(data)), Timestamp: b.modified[name], BucketConfigName: "mem"})
+		}
+	}
+	return list, nil
+}
+
+// Mock k8s API
+
+var dynamicTracker ObjectTracker
+
+func newDynamicClient(scheme *runtime.Scheme, rv uint64, objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+
+	// In order to use List with this client, you have to have the v1.List registered in your scheme. Neat thing though
+	// it does NOT have to be the *same* list
+	scheme.AddKnownTypeWithName(
+		schema.GroupVersionKind{Group: "fake-dynamic-client-group", Version: "v1", Kind: "List"},
+		&unstructured.UnstructuredList{})
+	scheme.AddKnownTypeWithName(
+		schema.GroupVersionKind{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "ClusterRoleBinding"},
+		&unstructured.Unstructured{})
+
+	codecs := serializer.NewCodecFactory(scheme)
+	dynamicTracker = NewObjectTracker(scheme, codecs.UniversalDecoder(), rv)
+	for _, obj := range objects {
+		if err := dynamicTracker.Add(obj); err != nil {
+			panic(err)
+		}
+	}
+
+	cs := dynamicfake.NewSimpleDynamicClient(scheme, objects...)
+
+	// Change the tracker with versioned
+	cs.ReactionChain = nil
+	cs.AddReactor("*", "*", core.ObjectReaction(dynamicTracker))
+	cs.WatchReactionChain = nil
+	cs.AddWatchReactor("*", func(action core.Action) (handled bool, ret watch.Interface, err error) {
+		gvr := action.GetResource()
+		ns := action.GetNamespace()
+		watch, err := dynamicTracker.Watch(gvr, ns)
+		if err != nil {
+			return false, nil, err
+		}
+		return true, watch, nil
+	})
+
+	return cs
+}
+
+func convertToUnstructured(t *testing.T, obj runtime.Object) runtime.Object {
+	maped, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		t.Errorf("Error converting object to unstructured : %s", err.Error())
+	}
+	unstrctrd := &unstructured.Unstructured{Object: maped}
+	return unstrctrd.DeepCopyObject()
+}
+
+func unstrctrdResource(group, version, ns, name, kind, resourcename string) *unstructured.Unstructured {
+	item := &unstructured.Unstructured{}
+	item.SetGroupVersionKind(schema.GroupVersionKind{Group: group, Version: version, Kind: kind})
+	item.SetName(name)
+	if ns != "" {
+		item.SetNamespace(ns)
+	}
+	return item
+}
+
+func setAPIResourceList(resources []*metav1.APIResourceList,
+	group, version, name, kind string, namespaced bool) []*metav1.APIResourceList {
+	gv := group + "/" + version
+	if group == "" {
+		gv = version
+	}
+	for _, r := range resources {
+		if r.GroupVersion == gv {
+			r.APIResources = append(r.APIResources, metav1.APIResource{
+				Name: name, Group: group, Version: version, Kind: kind, Namespaced: namespaced,
+				Verbs: []string{"list", "create", "get", "delete"},
+			})
+			return resources
+		}
+	}
+	resources = append(resources, &metav1.APIResourceList{
+		GroupVersion: gv,
+		APIResources: []metav1.APIResource{
+			metav1.APIResource{
+				Name: name, Group: group, Version: version, Kind: kind, Namespaced: namespaced,
+				Verbs: []string{"list", "create", "get", "delete"},
 			},
 		},
 	})
@@ -686,3 +1627,1089 @@ func newPVC(ns, name, class, pvname string) *corev1.PersistentVolumeClaim {
 		},
 	}
 }
+
+func TestResourceVersionMarker(t *testing.T) {
+
+	// ConfigMap mode creates and deletes in the configured namespace
+	kubeClient := k8sfake.NewSimpleClientset()
+	snap := newConfiguredSnapshot("marker1", "InProgress")
+	snap.Spec.MarkerNamespace = "tenant"
+	snap.Spec.MarkerPrefix = "snap-marker-"
+	marker, err := newResourceVersionMarker(snap, kubeClient)
+	if err != nil {
+		t.Fatalf("Error in newResourceVersionMarker : %s", err.Error())
+	}
+	_, err = marker.mark(context.TODO())
+	if err != nil {
+		t.Errorf("Error in configmap mark : %s", err.Error())
+	}
+	actions := kubeClient.Actions()
+	if len(actions) != 2 || !actions[0].Matches("create", "configmaps") || !actions[1].Matches("delete", "configmaps") {
+		t.Errorf("Unexpected actions in configmap mode : %v", actions)
+	} else {
+		name := actions[1].(core.DeleteAction).GetName()
+		if actions[0].GetNamespace() != "tenant" || !strings.HasPrefix(name, "snap-marker-") {
+			t.Errorf("Marker %s/%s not in configured namespace and prefix", actions[0].GetNamespace(), name)
+		}
+	}
+
+	// ReadOnly mode only lists
+	kubeClient = k8sfake.NewSimpleClientset()
+	kubeClient.Fake.PrependReactor("list", "configmaps", func(action core.Action) (bool, runtime.Object, error) {
+		return true, &corev1.ConfigMapList{ListMeta: metav1.ListMeta{ResourceVersion: "12345"}}, nil
+	})
+	snap.Spec.MarkerMode = MarkerModeReadOnly
+	marker, err = newResourceVersionMarker(snap, kubeClient)
+	if err != nil {
+		t.Fatalf("Error in newResourceVersionMarker : %s", err.Error())
+	}
+	mark, err := marker.mark(context.TODO())
+	if err != nil {
+		t.Errorf("Error in readonly mark : %s", err.Error())
+	} else if mark.ResourceVersion != "12345" {
+		t.Errorf("Resource version %s not taken from list", mark.ResourceVersion)
+	}
+	for _, action := range kubeClient.Actions() {
+		if action.GetVerb() != "list" || action.GetNamespace() != "tenant" {
+			t.Errorf("Unexpected action in readonly mode : %v", action)
+		}
+	}
+
+	// Unknown mode is not retried
+	snap.Spec.MarkerMode = "unknown"
+	_, err = newResourceVersionMarker(snap, kubeClient)
+	if _, ok := err.(*backoff.PermanentError); !ok {
+		t.Errorf("Unknown marker mode not permanent error : %v", err)
+	}
+
+	// Restore marker configured in the restore spec
+	kubeClient = k8sfake.NewSimpleClientset()
+	restore := newConfiguredRestore("marker1", "marker1", "pref1", "InProgress")
+	restore.Spec.MarkerNamespace = "tenant"
+	marker, err = newRestoreMarker(restore, kubeClient)
+	if err != nil {
+		t.Fatalf("Error in newRestoreMarker : %s", err.Error())
+	}
+	_, err = marker.mark(context.TODO())
+	if err != nil {
+		t.Errorf("Error in restore mark : %s", err.Error())
+	}
+	for _, action := range kubeClient.Actions() {
+		if action.GetNamespace() != "tenant" {
+			t.Errorf("Restore marker action not in configured namespace : %v", action)
+		}
+	}
+}
+
+type fakePodExecutor struct {
+	execs []string
+}
+
+func (e *fakePodExecutor) Exec(ctx context.Context, namespace, pod, container string,
+	command []string, stdout, stderr io.Writer) error {
+	e.execs = append(e.execs, namespace+"/"+pod+":"+container+" "+strings.Join(command, " "))
+	if command[0] == "fail" {
+		_, _ = stderr.Write([]byte("failed"))
+		return utilexec.CodeExitError{Err: fmt.Errorf("command terminated with exit code 2"), Code: 2}
+	}
+	_, _ = stdout.Write([]byte("ok"))
+	return nil
+}
+
+func newHookPod(name string, labels map[string]string, phase corev1.PodPhase) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "db", Labels: labels},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "main"}, {Name: "sidecar"}}},
+		Status:     corev1.PodStatus{Phase: phase},
+	}
+}
+
+func TestSnapshotHooks(t *testing.T) {
+
+	kubeClient := k8sfake.NewSimpleClientset(
+		newHookPod("db-0", map[string]string{"app": "db"}, corev1.PodRunning),
+		newHookPod("db-1", map[string]string{"app": "db"}, corev1.PodPending),
+		newHookPod("web-0", map[string]string{"app": "web"}, corev1.PodRunning),
+	)
+	executor := &fakePodExecutor{}
+	blog := utils.NewNamedLog("hooks:test")
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}}
+
+	// Hooks run in running pods selected, failure recorded and continued
+	snap := newConfiguredSnapshot("hooks", "InProgress")
+	hooks := []clustersnapshot.SnapshotHook{
+		{Name: "flush", Namespace: "db", Selector: selector, Command: []string{"flush"}},
+		{Name: "check", Namespace: "db", Selector: selector, Container: "sidecar",
+			Command: []string{"fail"}, OnError: HookOnErrorContinue},
+	}
+	err := runHooks(context.TODO(), snap, hooks, HookPhasePre, kubeClient, executor, blog)
+	if err != nil {
+		t.Errorf("Error in runHooks : %s", err.Error())
+	}
+	expected := []string{"db/db-0:main flush", "db/db-0:sidecar fail"}
+	if !reflect.DeepEqual(executor.execs, expected) {
+		t.Errorf("Hook executions %v not equal to %v", executor.execs, expected)
+	}
+	if len(snap.Status.HookResults) != 2 {
+		t.Fatalf("Number of hook results %d not equals to 2", len(snap.Status.HookResults))
+	}
+	if r := snap.Status.HookResults[0]; r.Phase != HookPhasePre || r.Pod != "db/db-0" || r.ExitCode != 0 || r.Stdout != "ok" {
+		t.Errorf("Unexpected hook result : %#v", r)
+	}
+	if r := snap.Status.HookResults[1]; r.ExitCode != 2 || r.Stderr != "failed" || r.Error == "" {
+		t.Errorf("Unexpected failed hook result : %#v", r)
+	}
+
+	// Failure aborts without retry by default
+	hooks[1].OnError = ""
+	err = runHooks(context.TODO(), snap, hooks, HookPhasePost, kubeClient, executor, blog)
+	if _, ok := err.(*backoff.PermanentError); !ok {
+		t.Errorf("Failed hook not permanent error : %v", err)
+	}
+
+	// No namespace, no selector and no running pods matched follow the on-error policy
+	none := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "none"}}
+	for _, hook := range []clustersnapshot.SnapshotHook{
+		{Name: "nons", Selector: selector, Command: []string{"flush"}},
+		{Name: "nosel", Namespace: "db", Command: []string{"flush"}},
+		{Name: "emptysel", Namespace: "db", Selector: &metav1.LabelSelector{}, Command: []string{"flush"}},
+		{Name: "nopods", Namespace: "db", Selector: none, Command: []string{"flush"}},
+	} {
+		executor.execs = nil
+		err = runHooks(context.TODO(), snap, []clustersnapshot.SnapshotHook{hook}, HookPhasePre, kubeClient, executor, blog)
+		if _, ok := err.(*backoff.PermanentError); !ok {
+			t.Errorf("Hook %s not failed : %v", hook.Name, err)
+		}
+		if len(executor.execs) != 0 {
+			t.Errorf("Hook %s executed : %v", hook.Name, executor.execs)
+		}
+		hook.OnError = HookOnErrorContinue
+		err = runHooks(context.TODO(), snap, []clustersnapshot.SnapshotHook{hook}, HookPhasePre, kubeClient, executor, blog)
+		if err != nil {
+			t.Errorf("Hook %s not continued : %s", hook.Name, err.Error())
+		}
+	}
+}
+
+// Exec stream writing stdin to stdout as cat
+type catStreamMock struct {
+	done chan error
+}
+
+func (s *catStreamMock) Stream(options remotecommand.StreamOptions) error {
+	_, err := io.Copy(options.Stdout, options.Stdin)
+	s.done <- err
+	return err
+}
+
+func TestStreamExec(t *testing.T) {
+
+	// Stream ended by closing stdin, output written when completed
+	stream := &catStreamMock{done: make(chan error, 1)}
+	var stdout, stderr bytes.Buffer
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := streamExec(ctx, stream, &stdout, &stderr)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Timeout not returned : %v", err)
+	}
+	select {
+	case <-stream.done:
+	case <-time.After(time.Second):
+		t.Error("Exec stream left behind after timeout")
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("Output %s written after timeout", stdout.String())
+	}
+}
+
+func newWorkload(apiVersion, kind, name string, spec, status map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       kind,
+		"metadata":   map[string]interface{}{"name": name, "namespace": "app"},
+		"spec":       spec,
+		"status":     status,
+	}}
+}
+
+func TestRestoreHooks(t *testing.T) {
+
+	readinessPollInterval = 10 * time.Millisecond
+	blog := utils.NewNamedLog("restore:test")
+
+	// Wait for restored workloads
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+		newWorkload("apps/v1", "Deployment", "web", map[string]interface{}{"replicas": int64(2)},
+			map[string]interface{}{"updatedReplicas": int64(2), "availableReplicas": int64(2)}),
+		newWorkload("apps/v1", "StatefulSet", "db", map[string]interface{}{"replicas": int64(3)},
+			map[string]interface{}{"readyReplicas": int64(1)}),
+		newWorkload("batch/v1", "Job", "migrate", map[string]interface{}{},
+			map[string]interface{}{"conditions": []interface{}{
+				map[string]interface{}{"type": "Failed", "status": "True", "reason": "BackoffLimitExceeded"},
+			}}),
+	)
+	restore := newConfiguredRestore("test1", "test1", "test1", "InProgress")
+	restore.Spec.ReadinessTimeout = metav1.Duration{Duration: 100 * time.Millisecond}
+	restore.Status.Created = []string{
+		"/api/v1/namespaces/app/configmaps/cm",
+		"/apis/apps/v1/namespaces/app/deployments/web",
+		"/apis/apps/v1/namespaces/app/statefulsets/db",
+		"/apis/batch/v1/namespaces/app/jobs/migrate",
+	}
+	waitForWorkloads(context.TODO(), restore, dynamicClient, blog)
+	expected := []clustersnapshot.WorkloadReadiness{
+		{Path: "/apis/apps/v1/namespaces/app/deployments/web", Ready: true},
+		{Path: "/apis/apps/v1/namespaces/app/statefulsets/db", Reason: "1 of 3 replicas ready"},
+		{Path: "/apis/batch/v1/namespaces/app/jobs/migrate", Reason: "Job failed : BackoffLimitExceeded"},
+	}
+	if !reflect.DeepEqual(restore.Status.Workloads, expected) {
+		t.Errorf("Workloads readiness %#v not equal to %#v", restore.Status.Workloads, expected)
+	}
+
+	// Post-restore hooks in pods and jobs
+	kubeClient := k8sfake.NewSimpleClientset(newHookPod("db-0", map[string]string{"app": "db"}, corev1.PodRunning))
+	kubeClient.Fake.PrependReactor("create", "jobs", func(action core.Action) (bool, runtime.Object, error) {
+		job := action.(core.CreateAction).GetObject().(*batchv1.Job)
+		job.Name = job.GenerateName + "x"
+		job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+		return false, nil, nil
+	})
+	executor := &fakePodExecutor{}
+	restore.Spec.PostHooks = []clustersnapshot.RestoreHook{
+		{Name: "warm", Namespace: "db", Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}},
+			Command: []string{"warm"}},
+		{Name: "check", Namespace: "db", Job: &batchv1.JobSpec{}},
+	}
+	err := runRestoreHooks(context.TODO(), restore, kubeClient, executor, blog)
+	if err != nil {
+		t.Errorf("Error in runRestoreHooks : %s", err.Error())
+	}
+	if len(restore.Status.HookResults) != 2 {
+		t.Fatalf("Number of hook results %d not equals to 2", len(restore.Status.HookResults))
+	}
+	if r := restore.Status.HookResults[0]; r.Pod != "db/db-0" || r.Phase != HookPhasePostRestore {
+		t.Errorf("Unexpected exec hook result : %#v", r)
+	}
+	if r := restore.Status.HookResults[1]; r.Job != "db/test1-check-x" || r.Error != "" {
+		t.Errorf("Unexpected job hook result : %#v", r)
+	}
+}
+
+func newRestoreTestNode(t *testing.T, file string, obj runtime.Object) *restoreNode {
+	item := convertToUnstructured(t, obj)
+	return newRestoreNode(file, file, item.(*unstructured.Unstructured), nil)
+}
+
+func TestRestoreOrder(t *testing.T) {
+
+	// Dependencies ordered into levels
+	deploy := &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{Kind: "Deployment", APIVersion: "apps/v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "app"},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			ServiceAccountName: "web",
+			Volumes: []corev1.Volume{{Name: "conf", VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "conf"}},
+			}}},
+			Containers: []corev1.Container{{Name: "web", EnvFrom: []corev1.EnvFromSource{
+				{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "creds"}}},
+			}}},
+		}}},
+	}
+	conf := newConfiguredConfigMap("conf", "conf")
+	conf.Namespace = "app"
+	webhook := &admissionregistrationv1.ValidatingWebhookConfiguration{
+		TypeMeta:   metav1.TypeMeta{Kind: "ValidatingWebhookConfiguration", APIVersion: "admissionregistration.k8s.io/v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "validate"},
+		Webhooks: []admissionregistrationv1.ValidatingWebhook{{Name: "validate.app", ClientConfig: admissionregistrationv1.WebhookClientConfig{
+			Service: &admissionregistrationv1.ServiceReference{Namespace: "app", Name: "webhook"},
+		}}},
+	}
+	nodes := []*restoreNode{
+		newRestoreTestNode(t, "a-deploy", deploy),
+		newRestoreTestNode(t, "b-webhook", webhook),
+		newRestoreTestNode(t, "c-service", &corev1.Service{
+			TypeMeta: metav1.TypeMeta{Kind: "Service", APIVersion: "v1"}, ObjectMeta: metav1.ObjectMeta{Name: "webhook", Namespace: "app"}}),
+		newRestoreTestNode(t, "d-sa", &corev1.ServiceAccount{
+			TypeMeta: metav1.TypeMeta{Kind: "ServiceAccount", APIVersion: "v1"}, ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "app"}}),
+		newRestoreTestNode(t, "e-conf", conf),
+		newRestoreTestNode(t, "f-creds", &corev1.Secret{
+			TypeMeta: metav1.TypeMeta{Kind: "Secret", APIVersion: "v1"}, ObjectMeta: metav1.ObjectMeta{Name: "creds", Namespace: "app"}}),
+	}
+	levels := orderRestoreNodes(nodes)
+	order := make([][]string, 0)
+	for _, level := range levels {
+		files := make([]string, 0)
+		for _, n := range level {
+			files = append(files, n.file)
+		}
+		order = append(order, files)
+	}
+	expected := [][]string{{"c-service", "d-sa", "e-conf", "f-creds"}, {"a-deploy", "b-webhook"}}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("Restore order %v not equal to %v", order, expected)
+	}
+
+	// Resources failed for ordering reasons retried
+	maxRestoreRetries = 2
+	restoreRetryInterval = time.Millisecond
+	sch := runtime.NewScheme()
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(sch)
+	var failures int
+	dynamicClient.PrependReactor("create", "deployments", func(action core.Action) (bool, runtime.Object, error) {
+		if failures < 1 {
+			failures++
+			return true, nil, fmt.Errorf("serviceaccount \"web\" not found")
+		}
+		return false, nil, nil
+	})
+	dynamicClient.PrependReactor("create", "services", func(action core.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("forbidden")
+	})
+	dynamicClient.PrependReactor("create", "validatingwebhookconfigurations", func(action core.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("service \"webhook\" not found")
+	})
+	verbs := metav1.Verbs{"list", "create", "get", "delete"}
+	sr := newServerResources([]*metav1.APIResourceList{
+		{GroupVersion: "v1", APIResources: []metav1.APIResource{
+			{Name: "services", Kind: "Service", Namespaced: true, Verbs: verbs},
+			{Name: "serviceaccounts", Kind: "ServiceAccount", Namespaced: true, Verbs: verbs},
+			{Name: "configmaps", Kind: "ConfigMap", Namespaced: true, Verbs: verbs},
+			{Name: "secrets", Kind: "Secret", Namespaced: true, Verbs: verbs},
+		}},
+		{GroupVersion: "apps/v1", APIResources: []metav1.APIResource{{Name: "deployments", Kind: "Deployment", Namespaced: true, Verbs: verbs}}},
+		{GroupVersion: "admissionregistration.k8s.io/v1", APIResources: []metav1.APIResource{
+			{Name: "validatingwebhookconfigurations", Kind: "ValidatingWebhookConfiguration", Verbs: verbs},
+		}},
+	})
+	p := newPreference(newRestorePreference("test1"))
+	p.pref.Spec.RestoreConcurrency = 1
+	restore := newConfiguredRestore("test1", "test1", "test1", "InProgress")
+	restoreNodes(context.TODO(), nodes, p, dynamicClient, restore, sr, utils.NewNamedLog("restore:test"))
+	if !reflect.DeepEqual(restore.Status.Failed, []string{"c-service,forbidden", "b-webhook,service \"webhook\" not found"}) {
+		t.Errorf("Unexpected failed resources : %v", restore.Status.Failed)
+	}
+	if restore.Status.NumCreated != 4 || restore.Status.Created[3] != "a-deploy" {
+		t.Errorf("Unexpected created resources : %v", restore.Status.Created)
+	}
+
+	// Independent resources restored concurrently
+	nodes = make([]*restoreNode, 0)
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("cm%02d", i)
+		nodes = append(nodes, newRestoreTestNode(t, name, newConfiguredConfigMap(name, name)))
+	}
+	dynamicClient = dynamicfake.NewSimpleDynamicClient(sch)
+	restore = newConfiguredRestore("test1", "test1", "test1", "InProgress")
+	p.pref.Spec.RestoreConcurrency = 8
+	outcomesCtx, _ := withOutcomes(context.TODO())
+	restoreNodes(outcomesCtx, nodes, p, dynamicClient, restore, sr, utils.NewNamedLog("restore:test"))
+	if restore.Status.NumCreated != 50 || len(restore.Status.Created) != 50 {
+		t.Errorf("Number of created resources %d not equals to 50", restore.Status.NumCreated)
+	}
+
+	// Status locked for each restore, not blocking other restores
+	_, locked := withOutcomes(context.TODO())
+	unlock := locked.lockStatus()
+	done := make(chan struct{})
+	go func() {
+		excludeWithMsg(outcomesCtx, restore, utils.NewNamedLog("restore:test"), "cm-other", "other")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Status of a restore blocked by another restore")
+	}
+	unlock()
+}
+
+func TestOwnerReferencePolicy(t *testing.T) {
+
+	// Policies matched by kind and api version
+	p := newPreference(newRestorePreference("test1"))
+	p.pref.Spec.OwnerReferencePolicies = []clustersnapshot.OwnerReferencePolicy{
+		{APIVersion: "apps/v1", Kind: "ReplicaSet", Policy: OwnerReferenceRewrite},
+		{Kind: "Pod", Policy: OwnerReferenceStrip},
+	}
+	if err := p.validate(); err != nil {
+		t.Errorf("Error in validate : %s", err.Error())
+	}
+	policyOf := func(apiVersion, kind string) string {
+		item := &unstructured.Unstructured{}
+		item.SetAPIVersion(apiVersion)
+		item.SetKind(kind)
+		return p.ownerReferencePolicy(item)
+	}
+	for _, c := range []struct{ apiVersion, kind, policy string }{
+		{"apps/v1", "ReplicaSet", OwnerReferenceRewrite},
+		{"extensions/v1beta1", "ReplicaSet", OwnerReferenceSkip},
+		{"v1", "Pod", OwnerReferenceStrip},
+		{"v1", "Secret", OwnerReferenceSkip},
+	} {
+		if policy := policyOf(c.apiVersion, c.kind); policy != c.policy {
+			t.Errorf("Policy for %s %s : %s not equal to %s", c.apiVersion, c.kind, policy, c.policy)
+		}
+	}
+	bad := newPreference(newRestorePreference("test1"))
+	bad.pref.Spec.OwnerReferencePolicies = []clustersnapshot.OwnerReferencePolicy{{Kind: "Pod", Policy: "Adopt"}}
+	if err := bad.validate(); err == nil {
+		t.Error("Unknown owner reference policy not rejected")
+	}
+
+	// Owner UIDs rewritten to restored owners, references to owners not restored dropped
+	deploy := &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{Kind: "Deployment", APIVersion: "apps/v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "app", UID: "old-web"},
+	}
+	rs := &appsv1.ReplicaSet{
+		TypeMeta: metav1.TypeMeta{Kind: "ReplicaSet", APIVersion: "apps/v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "web-1", Namespace: "app", UID: "old-web-1", OwnerReferences: []metav1.OwnerReference{
+			{APIVersion: "apps/v1", Kind: "Deployment", Name: "web", UID: "old-web"},
+			{APIVersion: "v1", Kind: "ConfigMap", Name: "gone", UID: "old-gone"},
+			{APIVersion: "apps/v1", Kind: "Deployment", Name: "db", UID: "old-db"},
+		}},
+	}
+	nodes := []*restoreNode{newRestoreTestNode(t, "a-rs", rs), newRestoreTestNode(t, "b-deploy", deploy)}
+	nodes[0].rewriteOwners = true
+
+	// Owner existing in the cluster
+	liveDB := newWorkload("apps/v1", "Deployment", "db", map[string]interface{}{}, map[string]interface{}{})
+	liveDB.SetUID("live-db")
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), liveDB)
+	var createdRS *unstructured.Unstructured
+	dynamicClient.PrependReactor("create", "*", func(action core.Action) (bool, runtime.Object, error) {
+		obj := action.(core.CreateAction).GetObject().(*unstructured.Unstructured).DeepCopy()
+		obj.SetUID(types.UID("new-" + obj.GetName()))
+		if obj.GetKind() == "ReplicaSet" {
+			createdRS = obj
+		}
+		return true, obj, nil
+	})
+	verbs := metav1.Verbs{"list", "create", "get", "delete"}
+	sr := newServerResources([]*metav1.APIResourceList{
+		{GroupVersion: "apps/v1", APIResources: []metav1.APIResource{
+			{Name: "deployments", Kind: "Deployment", Namespaced: true, Verbs: verbs},
+			{Name: "replicasets", Kind: "ReplicaSet", Namespaced: true, Verbs: verbs},
+		}},
+	})
+	restore := newConfiguredRestore("test1", "test1", "test1", "InProgress")
+	outcomesCtx, outcomes := withOutcomes(context.TODO())
+	restoreNodes(outcomesCtx, nodes, p, dynamicClient, restore, sr, utils.NewNamedLog("restore:test"))
+	if restore.Status.NumCreated != 2 || restore.Status.Created[0] != "b-deploy" {
+		t.Errorf("Owner not restored before owned resource : %v", restore.Status.Created)
+	}
+	if createdRS == nil {
+		t.Fatal("Replicaset not created")
+	}
+	owners := createdRS.GetOwnerReferences()
+	if len(owners) != 2 || owners[0].Name != "web" || owners[0].UID != "new-web" ||
+		owners[1].Name != "db" || owners[1].UID != "live-db" {
+		t.Errorf("Owner references not rewritten : %v", owners)
+	}
+	if uid, _ := p.uids.get("old-web-1"); uid != "new-web-1" {
+		t.Errorf("UID of restored replicaset not recorded : %s", uid)
+	}
+	// References dropped recorded in the outcome
+	for _, r := range outcomes.list() {
+		if r.Path == "a-rs" && !reflect.DeepEqual(r.DroppedOwners, []string{"ConfigMap/gone"}) {
+			t.Errorf("Dropped owner references not recorded : %v", r)
+		}
+	}
+
+	// Cluster scoped owners referred without namespace
+	sr = newServerResources([]*metav1.APIResourceList{
+		{GroupVersion: "v1", APIResources: []metav1.APIResource{
+			{Name: "nodes", Kind: "Node", Verbs: verbs},
+			{Name: "configmaps", Kind: "ConfigMap", Namespaced: true, Verbs: verbs},
+		}},
+		{GroupVersion: "apps/v1", APIResources: []metav1.APIResource{
+			{Name: "deployments", Kind: "Deployment", Namespaced: true, Verbs: verbs},
+		}},
+	})
+	cm := newConfiguredConfigMap("conf", "conf")
+	cm.Namespace = "app"
+	cm.OwnerReferences = []metav1.OwnerReference{
+		{APIVersion: "v1", Kind: "Node", Name: "node1", UID: "old-node1"},
+		{APIVersion: "apps/v1", Kind: "Deployment", Name: "web", UID: "old-web"},
+	}
+	item := convertToUnstructured(t, cm).(*unstructured.Unstructured)
+	node := newRestoreNode("conf", "conf", item, sr)
+	if !reflect.DeepEqual(node.ownerKeys(sr), []string{"Node//node1", "Deployment/app/web"}) {
+		t.Errorf("Owner keys not match : %v", node.ownerKeys(sr))
+	}
+	if !isInList("Node//node1", node.deps) {
+		t.Errorf("Cluster scoped owner not in dependencies : %v", node.deps)
+	}
+	liveNode := &unstructured.Unstructured{}
+	liveNode.SetAPIVersion("v1")
+	liveNode.SetKind("Node")
+	liveNode.SetName("node1")
+	liveNode.SetUID("live-node1")
+	live, err := liveOwner(context.TODO(), cm.OwnerReferences[0], "app",
+		dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), liveNode), sr)
+	if err != nil || live == nil || live.GetUID() != "live-node1" {
+		t.Errorf("Cluster scoped owner not found : %v %v", live, err)
+	}
+
+	// Resources held until owners restored in later stages
+	dir, err := ioutil.TempDir("", "owners")
+	if err != nil {
+		t.Fatalf("Error in TempDir : %s", err.Error())
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	cm.OwnerReferences = cm.OwnerReferences[1:]
+	for stage, obj := range map[string]runtime.Object{"Restore": cm, "App": deploy} {
+		b, _ := json.Marshal(convertToUnstructured(t, obj))
+		_ = os.MkdirAll(filepath.Join(dir, stage), 0755)
+		err = ioutil.WriteFile(filepath.Join(dir, stage, "item.json"), b, 0644)
+		if err != nil {
+			t.Fatalf("Error in WriteFile : %s", err.Error())
+		}
+	}
+	p = newPreference(newRestorePreference("test1"))
+	p.pref.Spec.OwnerReferencePolicies = []clustersnapshot.OwnerReferencePolicy{
+		{Kind: "ConfigMap", Policy: OwnerReferenceRewrite},
+	}
+	if err := p.initializeByDir(dir); err != nil {
+		t.Fatalf("Error in initializeByDir : %s", err.Error())
+	}
+	if err := p.indexStages(dir); err != nil {
+		t.Fatalf("Error in indexStages : %s", err.Error())
+	}
+	var createdCM *unstructured.Unstructured
+	dynamicClient = dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	dynamicClient.PrependReactor("create", "*", func(action core.Action) (bool, runtime.Object, error) {
+		obj := action.(core.CreateAction).GetObject().(*unstructured.Unstructured).DeepCopy()
+		obj.SetUID(types.UID("new-" + obj.GetName()))
+		if obj.GetKind() == "ConfigMap" {
+			createdCM = obj
+		}
+		return true, obj, nil
+	})
+	restore = newConfiguredRestore("test1", "test1", "test1", "InProgress")
+	outcomesCtx, _ = withOutcomes(context.TODO())
+	for _, stage := range []string{"Restore", "App"} {
+		err = restoreDir(outcomesCtx, dir, stage, dynamicClient, p, restore, sr, utils.NewNamedLog("restore:test"))
+		if err != nil {
+			t.Errorf("Error in restoreDir %s : %s", stage, err.Error())
+		}
+		if stage == "Restore" && restore.Status.NumCreated != 0 {
+			t.Errorf("Resource not held until owners restored : %v", restore.Status.Created)
+		}
+	}
+	if restore.Status.NumCreated != 2 || createdCM == nil {
+		t.Fatalf("Resources not restored with owners in later stages : %v", restore.Status.Created)
+	}
+	if owners := createdCM.GetOwnerReferences(); len(owners) != 1 || owners[0].UID != "new-web" {
+		t.Errorf("Owner reference to owner in later stage not rewritten : %v", owners)
+	}
+
+	// Only not found errors of resources referred are for ordering
+	deps := itemDependencies(item, sr)
+	for _, c := range []struct {
+		err      error
+		ordering bool
+	}{
+		{fmt.Errorf("namespaces \"app\" not found"), true},
+		{fmt.Errorf("deployments.apps \"web\" not found"), true},
+		{fmt.Errorf("configmaps \"other\" not found"), false},
+		{fmt.Errorf("the server could not find the requested resource"), false},
+		{fmt.Errorf("Internal error occurred: failed calling webhook \"validate.app\""), true},
+	} {
+		if isOrderingError(c.err, deps) != c.ordering {
+			t.Errorf("Ordering error of %s not %t", c.err.Error(), c.ordering)
+		}
+	}
+}
+
+func TestSanitizeItem(t *testing.T) {
+
+	p := newPreference(newRestorePreference("test1"))
+	p.pref.Spec.SanitizePolicies = []clustersnapshot.SanitizePolicy{
+		{Kind: "Pod", Fields: []string{"spec.priority"}, DisableDefaults: true},
+		{Kind: "ConfigMap", Annotations: []string{"example.com/cluster"}},
+	}
+	if err := p.validate(); err != nil {
+		t.Errorf("Error in validate : %s", err.Error())
+	}
+
+	// Cluster-bound fields of services removed, headless services keep cluster IP
+	svc := &corev1.Service{
+		TypeMeta: metav1.TypeMeta{Kind: "Service", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "app", UID: "uid-web", ResourceVersion: "100",
+			Generation: 2, SelfLink: "/api/v1/namespaces/app/services/web",
+			ManagedFields: []metav1.ManagedFieldsEntry{{Manager: "kubectl"}}},
+		Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeNodePort, ClusterIP: "10.0.0.1", ClusterIPs: []string{"10.0.0.1"},
+			Ports: []corev1.ServicePort{{Name: "http", Port: 80, NodePort: 30080}}},
+		Status: corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{Ingress: []corev1.LoadBalancerIngress{{IP: "1.2.3.4"}}}},
+	}
+	item := convertToUnstructured(t, svc).(*unstructured.Unstructured)
+	sanitizeItem(item, p)
+	expected := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata":   map[string]interface{}{"name": "web", "namespace": "app"},
+		"spec": map[string]interface{}{
+			"type":  "NodePort",
+			"ports": []interface{}{map[string]interface{}{"name": "http", "port": int64(80), "targetPort": int64(0)}},
+		},
+	}
+	if !reflect.DeepEqual(item.Object, expected) {
+		t.Errorf("Sanitized service %v not equal to %v", item.Object, expected)
+	}
+	svc.Spec.ClusterIP = "None"
+	svc.Spec.ClusterIPs = []string{"None"}
+	item = convertToUnstructured(t, svc).(*unstructured.Unstructured)
+	sanitizeItem(item, p)
+	if clusterIP, _, _ := unstructured.NestedString(item.Object, "spec", "clusterIP"); clusterIP != "None" {
+		t.Errorf("Cluster IP of headless service removed")
+	}
+
+	// Policies replace or add to built-in fields
+	pod := &corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "app"},
+		Spec:       corev1.PodSpec{NodeName: "node1", Priority: new(int32)},
+	}
+	item = convertToUnstructured(t, pod).(*unstructured.Unstructured)
+	sanitizeItem(item, p)
+	if nodeName, _, _ := unstructured.NestedString(item.Object, "spec", "nodeName"); nodeName != "node1" {
+		t.Errorf("Node name removed with defaults disabled")
+	}
+	if _, found, _ := unstructured.NestedFieldNoCopy(item.Object, "spec", "priority"); found {
+		t.Errorf("Field in policy not removed")
+	}
+	cm := newConfiguredConfigMap("cm1", "cm1")
+	cm.Annotations = map[string]string{"example.com/cluster": "c1", "example.com/app": "web"}
+	item = convertToUnstructured(t, cm).(*unstructured.Unstructured)
+	sanitizeItem(item, p)
+	if !reflect.DeepEqual(item.GetAnnotations(), map[string]string{"example.com/app": "web"}) {
+		t.Errorf("Unexpected annotations : %v", item.GetAnnotations())
+	}
+
+	bad := newPreference(newRestorePreference("test1"))
+	bad.pref.Spec.SanitizePolicies = []clustersnapshot.SanitizePolicy{{Kind: "Pod", Fields: []string{"spec..nodeName"}}}
+	if err := bad.validate(); err == nil {
+		t.Error("Invalid sanitize field not rejected")
+	}
+}
+
+func TestConvertAPIVersion(t *testing.T) {
+
+	verbs := metav1.Verbs{"list", "create", "get", "delete"}
+	sr := newServerResources([]*metav1.APIResourceList{
+		{GroupVersion: "networking.k8s.io/v1", APIResources: []metav1.APIResource{
+			{Name: "ingresses", Kind: "Ingress", Namespaced: true, Verbs: verbs}}},
+		{GroupVersion: "apps/v1", APIResources: []metav1.APIResource{
+			{Name: "daemonsets", Kind: "DaemonSet", Namespaced: true, Verbs: verbs}}},
+		{GroupVersion: "admissionregistration.k8s.io/v1", APIResources: []metav1.APIResource{
+			{Name: "validatingwebhookconfigurations", Kind: "ValidatingWebhookConfiguration", Verbs: verbs}}},
+		{GroupVersion: "example.com/v1", APIResources: []metav1.APIResource{
+			{Name: "widgets", Kind: "Widget", Namespaced: true, Verbs: verbs}}},
+	})
+	load := func(obj string) *unstructured.Unstructured {
+		item := &unstructured.Unstructured{}
+		err := item.UnmarshalJSON([]byte(obj))
+		if err != nil {
+			t.Fatalf("Error unmarshaling %s : %s", obj, err.Error())
+		}
+		return item
+	}
+
+	// Ingress backends converted to networking.k8s.io/v1
+	item := load(`{"apiVersion":"extensions/v1beta1","kind":"Ingress","metadata":{"name":"web","namespace":"app"},
+		"spec":{"backend":{"serviceName":"default","servicePort":80},
+		"rules":[{"host":"web.example.com","http":{"paths":[{"path":"/","backend":{"serviceName":"web","servicePort":"http"}}]}}]}}`)
+	from, err := convertAPIVersion(item, sr)
+	if err != nil || from != "extensions/v1beta1" {
+		t.Errorf("Ingress not converted : %s %v", from, err)
+	}
+	expected := load(`{"apiVersion":"networking.k8s.io/v1","kind":"Ingress","metadata":{"name":"web","namespace":"app"},
+		"spec":{"defaultBackend":{"service":{"name":"default","port":{"number":80}}},
+		"rules":[{"host":"web.example.com","http":{"paths":[{"path":"/","pathType":"ImplementationSpecific",
+		"backend":{"service":{"name":"web","port":{"name":"http"}}}}]}}]}}`)
+	if !reflect.DeepEqual(item.Object, expected.Object) {
+		t.Errorf("Converted ingress %v not equal to %v", item.Object, expected.Object)
+	}
+
+	// Selector and update strategy set on workloads
+	item = load(`{"apiVersion":"extensions/v1beta1","kind":"DaemonSet","metadata":{"name":"agent","namespace":"app"},
+		"spec":{"templateGeneration":3,"template":{"metadata":{"labels":{"app":"agent"}}}}}`)
+	_, err = convertAPIVersion(item, sr)
+	if err != nil || item.GetAPIVersion() != "apps/v1" {
+		t.Errorf("Daemonset not converted : %s %v", item.GetAPIVersion(), err)
+	}
+	selector, _, _ := unstructured.NestedStringMap(item.Object, "spec", "selector", "matchLabels")
+	strategy, _, _ := unstructured.NestedString(item.Object, "spec", "updateStrategy", "type")
+	_, found, _ := unstructured.NestedFieldNoCopy(item.Object, "spec", "templateGeneration")
+	if !reflect.DeepEqual(selector, map[string]string{"app": "agent"}) || strategy != "OnDelete" || found {
+		t.Errorf("Unexpected converted daemonset spec : %v", item.Object["spec"])
+	}
+
+	// Webhooks with side effects not allowed in v1 fail
+	item = load(`{"apiVersion":"admissionregistration.k8s.io/v1beta1","kind":"ValidatingWebhookConfiguration",
+		"metadata":{"name":"validate"},"webhooks":[{"name":"validate.app","sideEffects":"Unknown"}]}`)
+	from, err = convertAPIVersion(item, sr)
+	if err == nil || from != "admissionregistration.k8s.io/v1beta1" || item.GetAPIVersion() != "admissionregistration.k8s.io/v1" {
+		t.Errorf("Webhook with unknown side effects not failed : %s %s", from, item.GetAPIVersion())
+	}
+
+	// CRD schema and printer columns moved into versions
+	crdSR := newServerResources([]*metav1.APIResourceList{
+		{GroupVersion: "apiextensions.k8s.io/v1", APIResources: []metav1.APIResource{
+			{Name: "customresourcedefinitions", Kind: "CustomResourceDefinition", Verbs: verbs}}},
+	})
+	item = load(`{"apiVersion":"apiextensions.k8s.io/v1beta1","kind":"CustomResourceDefinition","metadata":{"name":"widgets.example.com"},
+		"spec":{"group":"example.com","version":"v1","preserveUnknownFields":false,
+		"validation":{"openAPIV3Schema":{"type":"object"}},"subresources":{"status":{}},
+		"additionalPrinterColumns":[{"name":"Age","type":"date","JSONPath":".metadata.creationTimestamp"}]}}`)
+	_, err = convertAPIVersion(item, crdSR)
+	if err != nil {
+		t.Errorf("Error converting CRD : %s", err.Error())
+	}
+	expected = load(`{"apiVersion":"apiextensions.k8s.io/v1","kind":"CustomResourceDefinition","metadata":{"name":"widgets.example.com"},
+		"spec":{"group":"example.com","versions":[{"name":"v1","served":true,"storage":true,
+		"schema":{"openAPIV3Schema":{"type":"object"}},"subresources":{"status":{}},
+		"additionalPrinterColumns":[{"name":"Age","type":"date","jsonPath":".metadata.creationTimestamp"}]}]}}`)
+	if !reflect.DeepEqual(item.Object, expected.Object) {
+		t.Errorf("Converted CRD %v not equal to %v", item.Object, expected.Object)
+	}
+
+	// Preferred version of the group without a known successor
+	item = load(`{"apiVersion":"example.com/v1beta1","kind":"Widget","metadata":{"name":"w1","namespace":"app"}}`)
+	from, err = convertAPIVersion(item, sr)
+	if err != nil || from != "example.com/v1beta1" || item.GetAPIVersion() != "example.com/v1" {
+		t.Errorf("Widget not converted to preferred version : %s %s", from, item.GetAPIVersion())
+	}
+
+	// Served versions not converted
+	from, err = convertAPIVersion(item, sr)
+	if err != nil || from != "" {
+		t.Errorf("Served version converted from %s", from)
+	}
+}
+
+func TestSelectVersions(t *testing.T) {
+
+	verbs := metav1.Verbs{"list", "create", "get", "delete"}
+	groups := []*metav1.APIGroup{
+		{Name: "apps", PreferredVersion: metav1.GroupVersionForDiscovery{GroupVersion: "apps/v1"},
+			Versions: []metav1.GroupVersionForDiscovery{{GroupVersion: "apps/v1"}, {GroupVersion: "apps/v1beta1"}}},
+		{Name: "autoscaling", PreferredVersion: metav1.GroupVersionForDiscovery{GroupVersion: "autoscaling/v1"},
+			Versions: []metav1.GroupVersionForDiscovery{{GroupVersion: "autoscaling/v1"}, {GroupVersion: "autoscaling/v2beta2"}}},
+	}
+	resources := []*metav1.APIResourceList{
+		{GroupVersion: "apps/v1", APIResources: []metav1.APIResource{
+			{Name: "deployments", Kind: "Deployment", Verbs: verbs}}},
+		{GroupVersion: "apps/v1beta1", APIResources: []metav1.APIResource{
+			{Name: "deployments", Kind: "Deployment", Verbs: verbs},
+			{Name: "legacies", Kind: "Legacy", Verbs: verbs}}},
+		{GroupVersion: "autoscaling/v1", APIResources: []metav1.APIResource{
+			{Name: "horizontalpodautoscalers", Kind: "HorizontalPodAutoscaler", Verbs: verbs}}},
+		{GroupVersion: "autoscaling/v2beta2", APIResources: []metav1.APIResource{
+			{Name: "horizontalpodautoscalers", Kind: "HorizontalPodAutoscaler", Verbs: verbs}}},
+	}
+	selectedOf := func(lists []*metav1.APIResourceList) []string {
+		selected := make([]string, 0)
+		for _, list := range lists {
+			for _, r := range list.APIResources {
+				selected = append(selected, list.GroupVersion+"/"+r.Name)
+			}
+		}
+		return selected
+	}
+
+	// Preferred versions, versions not preferred kept for resources only in them
+	selected := selectedOf(selectVersions(groups, resources, nil))
+	expected := []string{"apps/v1/deployments", "apps/v1beta1/legacies", "autoscaling/v1/horizontalpodautoscalers"}
+	if !reflect.DeepEqual(selected, expected) {
+		t.Errorf("Selected resources %v not equal to %v", selected, expected)
+	}
+
+	// Configured versions
+	selected = selectedOf(selectVersions(groups, resources, []string{"autoscaling/v2beta2"}))
+	expected = []string{"apps/v1/deployments", "apps/v1beta1/legacies", "autoscaling/v2beta2/horizontalpodautoscalers"}
+	if !reflect.DeepEqual(selected, expected) {
+		t.Errorf("Selected resources %v not equal to %v", selected, expected)
+	}
+
+	// Objects in legacy groups dropped in favor of successors
+	newItem := func(apiVersion, name, uid string) unstructured.Unstructured {
+		item := unstructured.Unstructured{}
+		item.SetAPIVersion(apiVersion)
+		item.SetKind("Deployment")
+		item.SetName(name)
+		item.SetUID(types.UID(uid))
+		return item
+	}
+	items, dropped := dedupByUID([]unstructured.Unstructured{
+		newItem("extensions/v1beta1", "web", "uid-web"),
+		newItem("apps/v1", "api", "uid-api"),
+		newItem("apps/v1", "web", "uid-web"),
+		newItem("extensions/v1beta1", "api", "uid-api"),
+	})
+	if dropped != 2 || len(items) != 2 || items[0].GetAPIVersion() != "apps/v1" || items[1].GetAPIVersion() != "apps/v1" {
+		t.Errorf("Unexpected deduped objects : %d dropped %v", dropped, items)
+	}
+}
+
+func TestSecretPolicy(t *testing.T) {
+
+	_, err := newSecretPolicy([]clustersnapshot.SecretRule{{Action: "Encrypt"}})
+	if err == nil {
+		t.Error("Unknown secret rule action not rejected")
+	}
+	policy, err := newSecretPolicy([]clustersnapshot.SecretRule{
+		{Action: SecretActionExclude, Types: []string{"kubernetes.io/tls"}, Namespaces: []string{"cert-manager"}},
+		{Action: SecretActionRedact, Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"confidential": "true"}}},
+	})
+	if err != nil {
+		t.Fatalf("Error in newSecretPolicy : %s", err.Error())
+	}
+
+	newSecret := func(namespace, name string, secretType corev1.SecretType, labels map[string]string) unstructured.Unstructured {
+		secret := &corev1.Secret{
+			TypeMeta: metav1.TypeMeta{Kind: "Secret", APIVersion: "v1"},
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: labels,
+				Annotations: map[string]string{lastAppliedAnnotation: `{"data":{"password":"c2VjcmV0"}}`}},
+			Type: secretType,
+			Data: map[string][]byte{"password": []byte("secret")},
+		}
+		return *convertToUnstructured(t, secret).(*unstructured.Unstructured)
+	}
+	confidential := map[string]string{"confidential": "true"}
+	items := []unstructured.Unstructured{
+		newSecret("cert-manager", "tls1", corev1.SecretTypeTLS, nil),
+		newSecret("app", "tls2", corev1.SecretTypeTLS, nil),
+		newSecret("app", "db", corev1.SecretTypeOpaque, confidential),
+		*convertToUnstructured(t, newConfiguredConfigMap("cm1", "cm1")).(*unstructured.Unstructured),
+	}
+	items[3].SetLabels(confidential)
+
+	snap := newConfiguredSnapshot("test1", "InProgress")
+	items = applySecretPolicy(items, policy, snap, utils.NewNamedLog("snapshot:test"))
+	names := make([]string, 0)
+	for _, item := range items {
+		names = append(names, item.GetName())
+	}
+	if !reflect.DeepEqual(names, []string{"tls2", "db", "cm1"}) {
+		t.Errorf("Unexpected objects after secret policy : %v", names)
+	}
+	if snap.Status.NumSecretsExcluded != 1 || snap.Status.NumSecretsRedacted != 1 {
+		t.Errorf("Unexpected numbers of secrets excluded %d, redacted %d",
+			snap.Status.NumSecretsExcluded, snap.Status.NumSecretsRedacted)
+	}
+	data, _, _ := unstructured.NestedStringMap(items[1].Object, "data")
+	if !reflect.DeepEqual(data, map[string]string{"password": ""}) {
+		t.Errorf("Secret data not redacted : %v", data)
+	}
+	if !isRedacted(&items[1]) || items[1].GetAnnotations()[lastAppliedAnnotation] != "" {
+		t.Errorf("Unexpected annotations of redacted secret : %v", items[1].GetAnnotations())
+	}
+	if isRedacted(&items[0]) || isRedacted(&items[2]) {
+		t.Error("Objects not matched redacted")
+	}
+}
+
+func TestRollback(t *testing.T) {
+
+	// Resources created by restore and one existed before
+	cm1 := newConfiguredConfigMap("cm1", "cm1")
+	cm1.Namespace = "app"
+	cm1.UID = "uid-cm1"
+	cm2 := newConfiguredConfigMap("cm2", "cm2")
+	cm2.Namespace = "app"
+	cm2.UID = "uid-cm2-replaced"
+	existed := newConfiguredConfigMap("existed", "existed")
+	existed.Namespace = "app"
+	ns := &corev1.Namespace{TypeMeta: metav1.TypeMeta{Kind: "Namespace", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "app", UID: "uid-app"}}
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+		convertToUnstructured(t, ns), convertToUnstructured(t, cm1), convertToUnstructured(t, cm2),
+		convertToUnstructured(t, existed))
+
+	// UID precondition is not checked by the fake client, cm2 replaced after restore
+	var deleted []string
+	dynamicClient.PrependReactor("delete", "*", func(action core.Action) (bool, runtime.Object, error) {
+		deleteAction := action.(core.DeleteActionImpl)
+		if deleteAction.Name == "cm2" {
+			return true, nil, apierrors.NewConflict(action.GetResource().GroupResource(), deleteAction.Name,
+				fmt.Errorf("Precondition failed: UID in precondition: uid-cm2, UID in object meta: uid-cm2-replaced"))
+		}
+		deleted = append(deleted, deleteAction.Name)
+		return false, nil, nil
+	})
+
+	restore := newConfiguredRestore("test1", "test1", "test1", "Failed")
+	restore.Status.AlreadyExisted = []string{"/api/v1/namespaces/app/configmaps/existed"}
+	restore.Status.Journal = []clustersnapshot.RestoreJournalEntry{
+		{Path: "/api/v1/namespaces/app", UID: "uid-app"},
+		{Path: "/api/v1/namespaces/app/configmaps/cm1", UID: "uid-cm1"},
+		{Path: "/api/v1/namespaces/app/configmaps/cm2", UID: "uid-cm2"},
+		{Path: "/api/v1/namespaces/app/configmaps/gone", UID: "uid-gone"},
+	}
+	err := rollbackWithClient(context.TODO(), restore, restore.Status.Journal, dynamicClient)
+	if err != nil {
+		t.Errorf("Error in rollbackWithClient : %s", err.Error())
+	}
+	if !reflect.DeepEqual(deleted, []string{"gone", "cm1", "app"}) {
+		t.Errorf("Deleted resources %v not in reverse order of the journal", deleted)
+	}
+	if !reflect.DeepEqual(restore.Status.RolledBack, []string{
+		"/api/v1/namespaces/app/configmaps/cm1", "/api/v1/namespaces/app"}) {
+		t.Errorf("Unexpected rolled back resources : %v", restore.Status.RolledBack)
+	}
+	cmGVR := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	for _, name := range []string{"cm2", "existed"} {
+		_, err = dynamicClient.Resource(cmGVR).Namespace("app").Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Errorf("Configmap %s not left : %s", name, err.Error())
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+
+	bucket := newMemBucketMock()
+	sampleSize := StatusSampleSize
+	StatusSampleSize = 2
+	defer func() { StatusSampleSize = sampleSize }()
+
+	// Snapshot contents sampled in status
+	snap := newConfiguredSnapshot("test1", "Completed")
+	snap.Status.Contents = []string{"a", "b", "c"}
+	err := UploadSnapshotReport(context.TODO(), snap, bucket)
+	if err != nil {
+		t.Fatalf("Error in UploadSnapshotReport : %s", err.Error())
+	}
+	if !reflect.DeepEqual(snap.Status.Contents, []string{"a", "b"}) {
+		t.Errorf("Contents %v not sampled", snap.Status.Contents)
+	}
+	snapReport := &SnapshotReport{}
+	err = downloadReport(context.TODO(), snapReport, snap.Status.Report.Name, bucket)
+	if err != nil {
+		t.Fatalf("Error in downloadReport : %s", err.Error())
+	}
+	if !reflect.DeepEqual(snapReport.Contents, []string{"a", "b", "c"}) {
+		t.Errorf("Contents %v not whole in report", snapReport.Contents)
+	}
+
+	// Restore lists sampled and journal moved to report
+	restore := newConfiguredRestore("test1", "test1", "test1", "Completed")
+	restore.Status.Created = []string{"/api/v1/namespaces/a", "/api/v1/namespaces/b", "/api/v1/namespaces/c"}
+	restore.Status.Journal = []clustersnapshot.RestoreJournalEntry{
+		{Path: "/api/v1/namespaces/a"}, {Path: "/api/v1/namespaces/b"}, {Path: "/api/v1/namespaces/c"}}
+	restore.Spec.JUnitReport = true
+	resources := []ResourceOutcome{
+		{Path: "/api/v1/namespaces/a", Stage: "Namespace", Outcome: OutcomeCreated},
+		{Path: "/api/v1/namespaces/a/pods/p", Stage: "App", Outcome: OutcomeFailed, Message: "forbidden"},
+		{Path: "/api/v1/namespaces/a/pods/q", Stage: "App", Outcome: OutcomeExcluded, Message: "owner-ref"},
+	}
+	err = uploadRestoreReport(context.TODO(), restore, resources, bucket)
+	if err != nil {
+		t.Fatalf("Error in uploadRestoreReport : %s", err.Error())
+	}
+	if len(restore.Status.Created) != 2 || restore.Status.Journal != nil {
+		t.Errorf("Restore status %v not sampled", restore.Status)
+	}
+	if restore.Status.Report.Name != "reports/restores/test1.json" {
+		t.Errorf("Report name %s not match", restore.Status.Report.Name)
+	}
+	restoreReport := &RestoreReport{}
+	err = downloadReport(context.TODO(), restoreReport, restore.Status.Report.Name, bucket)
+	if err != nil {
+		t.Fatalf("Error in downloadReport : %s", err.Error())
+	}
+	if len(restoreReport.Created) != 3 || len(restoreReport.Journal) != 3 || len(restoreReport.Resources) != 3 {
+		t.Errorf("Lists in report %v not whole", restoreReport)
+	}
+
+	// JUnit report with failures and skipped
+	if restore.Status.Report.JUnit != "reports/restores/test1.xml" {
+		t.Errorf("JUnit report name %s not match", restore.Status.Report.JUnit)
+	}
+	junit := string(bucket.objects[restore.Status.Report.JUnit])
+	for _, s := range []string{`tests="3" failures="1" skipped="1"`, `<failure message="forbidden">`,
+		`<skipped message="Excluded : owner-ref">`} {
+		if !strings.Contains(junit, s) {
+			t.Errorf("JUnit report not contains %s : %s", s, junit)
+		}
+	}
+
+	// Operations failed without retry when reports not uploaded
+	retryElapsed := reportRetryElapsed
+	reportRetryElapsed = 10 * time.Millisecond
+	defer func() { reportRetryElapsed = retryElapsed }()
+	failing := &prefixFailingBucketMock{newMemBucketMock(), ReportPrefix}
+	snap = newConfiguredSnapshot("test2", "Completed")
+	snap.Status.Contents = []string{"a", "b", "c"}
+	err = UploadSnapshotReport(context.TODO(), snap, failing)
+	if _, ok := err.(*backoff.PermanentError); !ok {
+		t.Errorf("Snapshot report upload error not permanent : %v", err)
+	}
+	if len(snap.Status.Contents) != 2 || snap.Status.Report != nil {
+		t.Errorf("Snapshot status %v not sampled without report", snap.Status)
+	}
+	restore = newConfiguredRestore("test2", "test1", "test1", "Completed")
+	restore.Status.Created = []string{"/api/v1/namespaces/a", "/api/v1/namespaces/b", "/api/v1/namespaces/c"}
+	restore.Status.Journal = []clustersnapshot.RestoreJournalEntry{{Path: "/api/v1/namespaces/a"}}
+	err = uploadRestoreReport(context.TODO(), restore, resources, failing)
+	if _, ok := err.(*backoff.PermanentError); !ok {
+		t.Errorf("Restore report upload error not permanent : %v", err)
+	}
+	// The journal is kept to rollback
+	if len(restore.Status.Created) != 3 || len(restore.Status.Journal) != 1 || restore.Status.Report != nil {
+		t.Errorf("Restore status %v not kept whole without report", restore.Status)
+	}
+
+	// Reports are not snapshot objects
+	if _, ok := SnapshotNameFromObject(SnapshotReportName("test1")); ok {
+		t.Error("Report taken as a snapshot object")
+	}
+}
+
+func TestProgress(t *testing.T) {
+
+	reported := make([]clustersnapshot.Progress, 0)
+	ctx := WithProgress(context.TODO(), func(p clustersnapshot.Progress) {
+		reported = append(reported, p)
+	})
+
+	// ETA estimated from resources done
+	p := progressFrom(ctx)
+	p.stage(StageArchiving, 4)
+	if reported[0].ETA != nil {
+		t.Error("ETA estimated without resources done")
+	}
+	p.done(1)
+	last := reported[len(reported)-1]
+	if last.ResourcesDone != 1 || last.ResourcesTotal != 4 || last.ETA == nil {
+		t.Errorf("Unexpected progress %#v", last)
+	}
+	p.done(3)
+	if reported[len(reported)-1].ETA != nil {
+		t.Error("ETA remains after all resources done")
+	}
+
+	// No progress reported without the func
+	progressFrom(context.TODO()).done(1)
+
+	// Bytes uploaded
+	bucket := newMemBucketMock()
+	snap := newConfiguredSnapshot("progress1", "InProgress")
+	snap.Spec.Incremental = true
+	writeTestArchive(t, "progress1", map[string]string{"a.json": "{\"a\":1}", "b.json": "{\"b\":1}"})
+	err := UploadSnapshot(ctx, snap, bucket)
+	if err != nil {
+		t.Errorf("Error in UploadSnapshot : %s", err.Error())
+	}
+	last = reported[len(reported)-1]
+	if last.Stage != StageUploading || last.ResourcesDone != 2 || last.ResourcesTotal != 2 {
+		t.Errorf("Unexpected resources in upload progress %#v", last)
+	}
+	if last.BytesTotal == 0 || last.BytesUploaded != last.BytesTotal || last.BytesUploaded != snap.Status.UploadedFileSize {
+		t.Errorf("Unexpected bytes in upload progress %#v, uploaded %d", last, snap.Status.UploadedFileSize)
+	}
+}
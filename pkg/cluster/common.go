@@ -3,6 +3,7 @@ package cluster
 import (
 	"context"
 	"fmt"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -14,11 +15,19 @@ import (
 	"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
 )
 
+// CancelAnnotation cancels a snapshot or restore in queue or in progress when set "true"
+const CancelAnnotation = "clustersnapshot.rywt.io/cancel"
+
 // Cluster interfaces for taking and restoring snapshot of k8s clusters
 type Cluster interface {
 	Snapshot(ctx context.Context, snapshot *cbv1alpha1.Snapshot) error
-	UploadSnapshot(snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) error
-	Restore(restore *cbv1alpha1.Restore, pref *cbv1alpha1.RestorePreference, bucket objectstore.Objectstore) error
+	SnapshotHooks(ctx context.Context, snapshot *cbv1alpha1.Snapshot, phase string) error
+	UploadSnapshot(ctx context.Context, snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) error
+	Restore(ctx context.Context, restore *cbv1alpha1.Restore, pref *cbv1alpha1.RestorePreference,
+		bucket objectstore.Objectstore) error
+	Verify(ctx context.Context, snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) (*ArchiveManifest, error)
+	Migrate(ctx context.Context, snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) (bool, error)
+	Rollback(ctx context.Context, restore *cbv1alpha1.Restore, bucket objectstore.Objectstore) error
 }
 
 // Cmd for execute cluster commands
@@ -35,19 +44,43 @@ func (c *Cmd) Snapshot(ctx context.Context, snapshot *cbv1alpha1.Snapshot) error
 	return Snapshot(ctx, snapshot)
 }
 
+// SnapshotHooks runs hooks of the phase around the snapshot
+func (c *Cmd) SnapshotHooks(ctx context.Context, snapshot *cbv1alpha1.Snapshot, phase string) error {
+	return RunSnapshotHooks(ctx, snapshot, phase)
+}
+
 // UploadSnapshot uploads the snapshot data to the object store bucket
-func (c *Cmd) UploadSnapshot(snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) error {
-	return UploadSnapshot(snapshot, bucket)
+func (c *Cmd) UploadSnapshot(ctx context.Context, snapshot *cbv1alpha1.Snapshot,
+	bucket objectstore.Objectstore) error {
+	return UploadSnapshot(ctx, snapshot, bucket)
 }
 
 // Restore restores snapshot data on a cluster
-func (c *Cmd) Restore(restore *cbv1alpha1.Restore, pref *cbv1alpha1.RestorePreference,
+func (c *Cmd) Restore(ctx context.Context, restore *cbv1alpha1.Restore, pref *cbv1alpha1.RestorePreference,
 	bucket objectstore.Objectstore) error {
-	return Restore(restore, pref, bucket)
+	return Restore(ctx, restore, pref, bucket)
+}
+
+// Verify validates the snapshot archive against its manifest
+func (c *Cmd) Verify(ctx context.Context, snapshot *cbv1alpha1.Snapshot,
+	bucket objectstore.Objectstore) (*ArchiveManifest, error) {
+	return Verify(ctx, snapshot, bucket)
+}
+
+// Migrate rewrites the snapshot archive into the current format version
+func (c *Cmd) Migrate(ctx context.Context, snapshot *cbv1alpha1.Snapshot,
+	bucket objectstore.Objectstore) (bool, error) {
+	return MigrateSnapshot(ctx, snapshot, bucket)
+}
+
+// Rollback deletes resources created by the restore
+func (c *Cmd) Rollback(ctx context.Context, restore *cbv1alpha1.Restore, bucket objectstore.Objectstore) error {
+	return Rollback(ctx, restore, bucket)
 }
 
 // Setup Kubernetes client for target cluster.
-func buildKubeClient(kubeconfig string) (*kubernetes.Clientset, error) {
+// Requests without context such as discovery time out on the deadline of the context.
+func buildKubeClient(ctx context.Context, kubeconfig string) (*kubernetes.Clientset, error) {
 	// Check if Kubeconfig available.
 	if kubeconfig == "" {
 		return nil, fmt.Errorf("Cannot create Kubeconfig : Kubeconfig not given")
@@ -58,6 +91,9 @@ func buildKubeClient(kubeconfig string) (*kubernetes.Clientset, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Error building kubeconfig: %s", err.Error())
 	}
+	if deadline, ok := ctx.Deadline(); ok {
+		cfg.Timeout = time.Until(deadline)
+	}
 	kubeClient, err := kubernetes.NewForConfig(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("Error building kubernetes clientset: %s", err.Error())
@@ -66,7 +102,8 @@ func buildKubeClient(kubeconfig string) (*kubernetes.Clientset, error) {
 }
 
 // Setup Kubernetes dynamic client for target cluster.
-func buildDynamicClient(kubeconfig string) (dynamic.Interface, error) {
+// QPS and burst are left to client-go defaults when 0.
+func buildDynamicClient(kubeconfig string, qps float32, burst int) (dynamic.Interface, error) {
 	// Check if Kubeconfig available.
 	if kubeconfig == "" {
 		return nil, fmt.Errorf("Cannot create Kubeconfig : Kubeconfig not given")
@@ -77,6 +114,12 @@ func buildDynamicClient(kubeconfig string) (dynamic.Interface, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Error building kubeconfig: %s", err.Error())
 	}
+	if qps > 0 {
+		cfg.QPS = qps
+	}
+	if burst > 0 {
+		cfg.Burst = burst
+	}
 	dynamicClient, err := dynamic.NewForConfig(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("Error building dynamic client: %s", err.Error())
@@ -85,7 +128,7 @@ func buildDynamicClient(kubeconfig string) (dynamic.Interface, error) {
 }
 
 // ConfigMapMarker creates and deletes a config map to get a marker for Resource Version
-func ConfigMapMarker(ctx context.Context, kubeClient kubernetes.Interface, name string) (*corev1.ConfigMap, error) {
+func ConfigMapMarker(ctx context.Context, kubeClient kubernetes.Interface, namespace, name string) (*corev1.ConfigMap, error) {
 	configMap := &corev1.ConfigMap{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "ConfigMap",
@@ -93,14 +136,14 @@ func ConfigMapMarker(ctx context.Context, kubeClient kubernetes.Interface, name
 		},
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
-			Namespace: "default",
+			Namespace: namespace,
 		},
 	}
-	configMap, err := kubeClient.CoreV1().ConfigMaps("default").Create(ctx, configMap, metav1.CreateOptions{})
+	configMap, err := kubeClient.CoreV1().ConfigMaps(namespace).Create(ctx, configMap, metav1.CreateOptions{})
 	if err != nil {
 		return nil, err
 	}
-	err = kubeClient.CoreV1().ConfigMaps("default").Delete(ctx, name, metav1.DeleteOptions{})
+	err = kubeClient.CoreV1().ConfigMaps(namespace).Delete(ctx, name, metav1.DeleteOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,166 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+)
+
+// Compression codecs for snapshot archives
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionNone = "none"
+)
+
+// codec compresses and decompresses snapshot archives
+type codec struct {
+	// Object name suffix of archives
+	suffix string
+	// Leading bytes of compressed stream, nil for plain tar
+	magic     []byte
+	minLevel  int
+	maxLevel  int
+	newWriter func(w io.Writer, level int) (io.WriteCloser, error)
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = map[string]codec{
+	CompressionGzip: {
+		suffix:   ArchiveSuffix,
+		magic:    []byte{0x1f, 0x8b},
+		minLevel: gzip.BestSpeed,
+		maxLevel: gzip.BestCompression,
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			if level == 0 {
+				level = gzip.DefaultCompression
+			}
+			return gzip.NewWriterLevel(w, level)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	CompressionZstd: {
+		suffix:   ".tar.zst",
+		magic:    []byte{0x28, 0xb5, 0x2f, 0xfd},
+		minLevel: 1,
+		maxLevel: 22,
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			if level == 0 {
+				return zstd.NewWriter(w)
+			}
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			dec, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return dec.IOReadCloser(), nil
+		},
+	},
+	CompressionNone: {
+		suffix: ".tar",
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return ioutil.NopCloser(r), nil
+		},
+	},
+}
+
+// Compression codecs in the order to look up archive objects
+var compressions = []string{CompressionGzip, CompressionZstd, CompressionNone}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// ArchiveCompression returns the compression codec of the snapshot archive
+func ArchiveCompression(snapshot *cbv1alpha1.Snapshot) string {
+	if snapshot.Status.Compression != "" {
+		return snapshot.Status.Compression
+	}
+	if snapshot.Spec.Compression != "" {
+		return snapshot.Spec.Compression
+	}
+	return CompressionGzip
+}
+
+// validateCompression checks the compression codec and level of the snapshot
+func validateCompression(compression string, level int) error {
+	c, ok := codecs[compression]
+	if !ok {
+		return fmt.Errorf("Unknown compression codec %s", compression)
+	}
+	if level != 0 && (level < c.minLevel || level > c.maxLevel) {
+		return fmt.Errorf("Compression level %d out of range for %s", level, compression)
+	}
+	return nil
+}
+
+// newArchiveWriter compresses archive stream with the codec
+func newArchiveWriter(w io.Writer, compression string, level int) (io.WriteCloser, error) {
+	c, ok := codecs[compression]
+	if !ok {
+		return nil, fmt.Errorf("Unknown compression codec %s", compression)
+	}
+	return c.newWriter(w, level)
+}
+
+// detectCompression returns the codec of the compressed stream from its leading bytes
+func detectCompression(header []byte) string {
+	for _, compression := range compressions {
+		magic := codecs[compression].magic
+		if magic != nil && bytes.HasPrefix(header, magic) {
+			return compression
+		}
+	}
+	return CompressionNone
+}
+
+// newArchiveReader decompresses archive stream with the codec detected from the stream itself
+func newArchiveReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return codecs[detectCompression(header)].newReader(br)
+}
+
+// CompressionFromObject returns the compression codec of an archive object name
+func CompressionFromObject(objectName string) string {
+	for _, compression := range compressions {
+		if strings.HasSuffix(objectName, codecs[compression].suffix) {
+			return compression
+		}
+	}
+	return ""
+}
+
+// snapshotArchivePath returns the local archive file of the snapshot taken, suffixed with its codec
+func snapshotArchivePath(snapshot *cbv1alpha1.Snapshot) string {
+	return "/tmp/" + archiveObjectName(snapshot.ObjectMeta.Name, ArchiveCompression(snapshot))
+}
+
+// archiveObjectName returns the archive object name of the snapshot in the compression
+func archiveObjectName(name, compression string) string {
+	c, ok := codecs[compression]
+	if !ok {
+		return name + ArchiveSuffix
+	}
+	return name + c.suffix
+}
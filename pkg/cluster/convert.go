@@ -0,0 +1,269 @@
+package cluster
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// apiConversion converts a resource to a successor API version
+type apiConversion struct {
+	to string
+	// Field transformations, nil when fields are compatible
+	convert func(item *unstructured.Unstructured) error
+}
+
+// Successors of removed API versions in the order of preference
+var apiConversions = newAPIConversions()
+
+func newAPIConversions() map[schema.GroupVersionKind][]apiConversion {
+	c := make(map[schema.GroupVersionKind][]apiConversion)
+	add := func(from string, kinds []string, to ...apiConversion) {
+		gv, _ := schema.ParseGroupVersion(from)
+		for _, kind := range kinds {
+			c[gv.WithKind(kind)] = to
+		}
+	}
+	rbac := []string{"Role", "ClusterRole", "RoleBinding", "ClusterRoleBinding"}
+	webhooks := []string{"ValidatingWebhookConfiguration", "MutatingWebhookConfiguration"}
+
+	add("extensions/v1beta1", []string{"Ingress"},
+		apiConversion{"networking.k8s.io/v1", convertIngress}, apiConversion{"networking.k8s.io/v1beta1", nil})
+	add("networking.k8s.io/v1beta1", []string{"Ingress"}, apiConversion{"networking.k8s.io/v1", convertIngress})
+	add("networking.k8s.io/v1beta1", []string{"IngressClass"}, apiConversion{"networking.k8s.io/v1", nil})
+	add("extensions/v1beta1", []string{"NetworkPolicy"}, apiConversion{"networking.k8s.io/v1", nil})
+	add("extensions/v1beta1", []string{"Deployment", "DaemonSet", "ReplicaSet"}, apiConversion{"apps/v1", convertWorkload})
+	add("apps/v1beta1", []string{"Deployment", "StatefulSet"}, apiConversion{"apps/v1", convertWorkload})
+	add("apps/v1beta2", []string{"Deployment", "DaemonSet", "ReplicaSet", "StatefulSet"}, apiConversion{"apps/v1", convertWorkload})
+	add("extensions/v1beta1", []string{"PodSecurityPolicy"}, apiConversion{"policy/v1beta1", nil})
+	add("policy/v1beta1", []string{"PodDisruptionBudget"}, apiConversion{"policy/v1", nil})
+	add("batch/v1beta1", []string{"CronJob"}, apiConversion{"batch/v1", nil})
+	add("rbac.authorization.k8s.io/v1beta1", rbac, apiConversion{"rbac.authorization.k8s.io/v1", nil})
+	add("rbac.authorization.k8s.io/v1alpha1", rbac, apiConversion{"rbac.authorization.k8s.io/v1", nil})
+	add("scheduling.k8s.io/v1beta1", []string{"PriorityClass"}, apiConversion{"scheduling.k8s.io/v1", nil})
+	add("scheduling.k8s.io/v1alpha1", []string{"PriorityClass"}, apiConversion{"scheduling.k8s.io/v1", nil})
+	add("storage.k8s.io/v1beta1", []string{"StorageClass", "VolumeAttachment", "CSIDriver", "CSINode"},
+		apiConversion{"storage.k8s.io/v1", nil})
+	add("coordination.k8s.io/v1beta1", []string{"Lease"}, apiConversion{"coordination.k8s.io/v1", nil})
+	add("apiregistration.k8s.io/v1beta1", []string{"APIService"}, apiConversion{"apiregistration.k8s.io/v1", nil})
+	add("admissionregistration.k8s.io/v1beta1", webhooks,
+		apiConversion{"admissionregistration.k8s.io/v1", convertWebhookConfiguration})
+	add("apiextensions.k8s.io/v1beta1", []string{"CustomResourceDefinition"},
+		apiConversion{"apiextensions.k8s.io/v1", convertCRD})
+	return c
+}
+
+// convertAPIVersion converts the resource to a version served in the target cluster.
+// Returns the original API version when converted, or empty when no conversion needed.
+func convertAPIVersion(item *unstructured.Unstructured, sr *ServerResources) (string, error) {
+	from := item.GetAPIVersion()
+	gv, err := schema.ParseGroupVersion(from)
+	if err != nil {
+		return "", err
+	}
+	kind := item.GetKind()
+	if sr.served(gv.WithKind(kind)) {
+		return "", nil
+	}
+
+	// Known successors
+	for _, c := range apiConversions[gv.WithKind(kind)] {
+		to, _ := schema.ParseGroupVersion(c.to)
+		if !sr.served(to.WithKind(kind)) {
+			continue
+		}
+		converted := item.DeepCopy()
+		if c.convert != nil {
+			err = c.convert(converted)
+		}
+		converted.SetAPIVersion(c.to)
+		item.Object = converted.Object
+		return from, err
+	}
+
+	// Preferred version of the group in the target cluster
+	if to, ok := sr.PreferredVersion(gv.Group, kind); ok {
+		item.SetAPIVersion(to.String())
+		return from, nil
+	}
+	return "", nil
+}
+
+// convertIngress converts ingress backends to networking.k8s.io/v1
+func convertIngress(item *unstructured.Unstructured) error {
+	spec := getUnstructuredMap(item.Object, "spec")
+	if spec == nil {
+		return nil
+	}
+	if backend, ok := spec["backend"].(map[string]interface{}); ok {
+		spec["defaultBackend"] = convertIngressBackend(backend)
+		delete(spec, "backend")
+	}
+	for _, r := range getUnstructuredSlice(spec, "rules") {
+		rule, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, p := range getUnstructuredSlice(getUnstructuredMap(rule, "http"), "paths") {
+			path, ok := p.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if backend, ok := path["backend"].(map[string]interface{}); ok {
+				path["backend"] = convertIngressBackend(backend)
+			}
+			if _, ok := path["pathType"]; !ok {
+				path["pathType"] = "ImplementationSpecific"
+			}
+		}
+	}
+	return nil
+}
+
+func convertIngressBackend(backend map[string]interface{}) map[string]interface{} {
+	if _, ok := backend["serviceName"]; !ok {
+		return backend
+	}
+	port := map[string]interface{}{}
+	switch p := backend["servicePort"].(type) {
+	case string:
+		port["name"] = p
+	case int64:
+		port["number"] = p
+	case float64:
+		port["number"] = int64(p)
+	}
+	return map[string]interface{}{
+		"service": map[string]interface{}{
+			"name": backend["serviceName"],
+			"port": port,
+		},
+	}
+}
+
+// convertWorkload converts beta workloads to apps/v1.
+// Selectors are required and update strategies default differently in apps/v1.
+func convertWorkload(item *unstructured.Unstructured) error {
+	spec := getUnstructuredMap(item.Object, "spec")
+	if spec == nil {
+		return nil
+	}
+	if _, ok := spec["selector"]; !ok {
+		labels, _, _ := unstructured.NestedMap(spec, "template", "metadata", "labels")
+		spec["selector"] = map[string]interface{}{"matchLabels": labels}
+	}
+	delete(spec, "rollbackTo")
+	delete(spec, "templateGeneration")
+	if _, ok := spec["updateStrategy"]; !ok {
+		switch {
+		case item.GetKind() == "DaemonSet" && item.GetAPIVersion() == "extensions/v1beta1",
+			item.GetKind() == "StatefulSet" && item.GetAPIVersion() == "apps/v1beta1":
+			spec["updateStrategy"] = map[string]interface{}{"type": "OnDelete"}
+		}
+	}
+	return nil
+}
+
+// convertWebhookConfiguration sets v1beta1 defaults which are changed or required in v1
+func convertWebhookConfiguration(item *unstructured.Unstructured) error {
+	for _, w := range getUnstructuredSlice(item.Object, "webhooks") {
+		webhook, ok := w.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		sideEffects := getUnstructuredString(webhook, "sideEffects")
+		if sideEffects != "None" && sideEffects != "NoneOnDryRun" {
+			return fmt.Errorf("sideEffects %q of webhook %s not allowed in v1", sideEffects,
+				getUnstructuredString(webhook, "name"))
+		}
+		defaults := map[string]interface{}{
+			"admissionReviewVersions": []interface{}{"v1beta1"},
+			"timeoutSeconds":          int64(30),
+			"failurePolicy":           "Ignore",
+			"matchPolicy":             "Exact",
+		}
+		for key, value := range defaults {
+			if _, ok := webhook[key]; !ok {
+				webhook[key] = value
+			}
+		}
+	}
+	return nil
+}
+
+// convertCRD moves v1beta1 per-CRD schema, subresources and columns into versions
+func convertCRD(item *unstructured.Unstructured) error {
+	spec := getUnstructuredMap(item.Object, "spec")
+	if spec == nil {
+		return nil
+	}
+	versions := getUnstructuredSlice(spec, "versions")
+	if len(versions) == 0 {
+		version := getUnstructuredString(spec, "version")
+		if version == "" {
+			return fmt.Errorf("No versions in CRD %s", item.GetName())
+		}
+		versions = []interface{}{map[string]interface{}{"name": version, "served": true, "storage": true}}
+	}
+	preserve, found, _ := unstructured.NestedBool(spec, "preserveUnknownFields")
+	preserve = preserve || !found
+
+	for _, v := range versions {
+		version, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if _, ok := version["schema"]; !ok {
+			if validation, ok := spec["validation"].(map[string]interface{}); ok {
+				version["schema"] = runtime.DeepCopyJSON(validation)
+			} else {
+				version["schema"] = map[string]interface{}{"openAPIV3Schema": map[string]interface{}{"type": "object"}}
+			}
+		}
+		if preserve {
+			_ = unstructured.SetNestedField(version, true, "schema", "openAPIV3Schema", "x-kubernetes-preserve-unknown-fields")
+		}
+		if _, ok := version["subresources"]; !ok {
+			if subresources, ok := spec["subresources"].(map[string]interface{}); ok {
+				version["subresources"] = runtime.DeepCopyJSON(subresources)
+			}
+		}
+		columns, ok := version["additionalPrinterColumns"].([]interface{})
+		if !ok {
+			columns, _, _ = unstructured.NestedSlice(spec, "additionalPrinterColumns")
+		}
+		for _, c := range columns {
+			if column, ok := c.(map[string]interface{}); ok {
+				if path, ok := column["JSONPath"]; ok {
+					column["jsonPath"] = path
+					delete(column, "JSONPath")
+				}
+			}
+		}
+		if len(columns) > 0 {
+			version["additionalPrinterColumns"] = columns
+		}
+	}
+	spec["versions"] = versions
+
+	if conversion, ok := spec["conversion"].(map[string]interface{}); ok {
+		if getUnstructuredString(conversion, "strategy") == "Webhook" {
+			reviewVersions, ok := conversion["conversionReviewVersions"]
+			if !ok {
+				reviewVersions = []interface{}{"v1beta1"}
+			}
+			conversion["webhook"] = map[string]interface{}{
+				"clientConfig":             conversion["webhookClientConfig"],
+				"conversionReviewVersions": reviewVersions,
+			}
+		}
+		delete(conversion, "webhookClientConfig")
+		delete(conversion, "conversionReviewVersions")
+	}
+	for _, key := range []string{"version", "validation", "subresources", "additionalPrinterColumns", "preserveUnknownFields"} {
+		delete(spec, key)
+	}
+	return nil
+}
@@ -0,0 +1,448 @@
+package cluster
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
+	"github.com/ryo-watanabe/k8s-snap/pkg/utils"
+)
+
+// Object names in the incremental (content-addressed) layout
+const (
+	BlobPrefix     = "blobs/"
+	ManifestSuffix = ".manifest.json"
+	ArchiveSuffix  = ".tgz"
+)
+
+// Blobs not referenced are collected after the grace period from their upload,
+// so that blobs of uploads in progress in any controller are kept until their manifests written.
+var blobGracePeriod = 24 * time.Hour
+
+// blobManifest lists the blobs of an incremental snapshot
+type blobManifest struct {
+	Name    string      `json:"name"`
+	Entries []blobEntry `json:"entries"`
+	// Compression of the archive rebuilt from blobs, gzip when empty
+	Compression      string `json:"compression,omitempty"`
+	CompressionLevel int    `json:"compressionLevel,omitempty"`
+}
+
+// blobEntry is a file in the snapshot archive stored as a blob
+type blobEntry struct {
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// SnapshotNameFromObject returns the snapshot name of an archive or manifest object
+func SnapshotNameFromObject(objectName string) (string, bool) {
+	if strings.HasPrefix(objectName, BlobPrefix) || strings.HasPrefix(objectName, ReportPrefix) {
+		return "", false
+	}
+	if strings.HasSuffix(objectName, ManifestSuffix) {
+		return strings.TrimSuffix(objectName, ManifestSuffix), true
+	}
+	for _, compression := range compressions {
+		if strings.HasSuffix(objectName, codecs[compression].suffix) {
+			return strings.TrimSuffix(objectName, codecs[compression].suffix), true
+		}
+	}
+	return "", false
+}
+
+// SnapshotObjectName returns the object name which represents the snapshot in the bucket
+func SnapshotObjectName(snapshot *cbv1alpha1.Snapshot) string {
+	if snapshot.Spec.Incremental {
+		return snapshot.ObjectMeta.Name + ManifestSuffix
+	}
+	return archiveObjectName(snapshot.ObjectMeta.Name, ArchiveCompression(snapshot))
+}
+
+func blobName(hash string) string {
+	return BlobPrefix + hash
+}
+
+// Upload snapshot archive entries as blobs and a manifest.
+// Entries are streamed from the archive, hashed first and new ones uploaded in a second read,
+// so that memory does not grow with the size of the snapshot.
+func uploadSnapshotBlobs(ctx context.Context, snapshot *cbv1alpha1.Snapshot, archivePath string,
+	bucket objectstore.Objectstore, blog *utils.NamedLog) error {
+
+	// Hash entries
+	manifest := blobManifest{
+		Name:             snapshot.ObjectMeta.Name,
+		Compression:      ArchiveCompression(snapshot),
+		CompressionLevel: snapshot.Spec.CompressionLevel,
+	}
+	err := streamArchiveEntries(archivePath, func(header *tar.Header, reader io.Reader) error {
+		hasher := sha256.New()
+		size, err := io.Copy(hasher, reader)
+		if err != nil {
+			return err
+		}
+		hash := hex.EncodeToString(hasher.Sum(nil))
+		manifest.Entries = append(manifest.Entries, blobEntry{Path: header.Name, Hash: hash, Size: size})
+		return nil
+	})
+	if err != nil {
+		return backoff.Permanent(err)
+	}
+
+	// Blobs already stored
+	storedBlobs, err := listBlobs(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	referenced := make(map[string]bool)
+	newBlobs, newBytes := make(map[string]bool), int64(0)
+	for _, entry := range manifest.Entries {
+		referenced[entry.Hash] = true
+		if !storedBlobs[blobName(entry.Hash)] && !newBlobs[entry.Hash] {
+			newBlobs[entry.Hash] = true
+			newBytes += entry.Size
+		}
+	}
+	manifestJSON, err := json.Marshal(&manifest)
+	if err != nil {
+		return backoff.Permanent(fmt.Errorf("Marshalling manifest failed : %s", err.Error()))
+	}
+	progress := progressFrom(ctx)
+	progress.stage(StageUploading, len(newBlobs))
+	progress.setTotal(len(newBlobs), newBytes+int64(len(manifestJSON)))
+
+	// Upload new blobs streamed from the archive
+	numUploaded, uploadedSize, err := uploadBlobs(ctx, archivePath, &manifest, newBlobs, bucket, progress)
+	if err != nil {
+		return err
+	}
+	blog.Infof("-- blobs : %d uploaded / %d referenced", numUploaded, len(referenced))
+
+	// Upload the manifest last so that it never refers blobs not stored
+	manifestName := snapshot.ObjectMeta.Name + ManifestSuffix
+	blog.Infof("Uploading manifest %s", manifestName)
+	err = bucket.Upload(ctx, progress.uploadReader(bytes.NewReader(manifestJSON)), manifestName)
+	if err != nil {
+		if objectstorePermError(err.Error()) {
+			return backoff.Permanent(fmt.Errorf("Uploading manifest failed : %s", err.Error()))
+		}
+		return fmt.Errorf("Uploading manifest failed : %s", err.Error())
+	}
+	uploadedSize += int64(len(manifestJSON))
+
+	// Blobs stored before and collected while uploading are uploaded again, the manifest keeps them from now
+	storedBlobs, err = listBlobs(ctx, bucket)
+	if err == nil {
+		collected := make(map[string]bool)
+		for hash := range referenced {
+			if !storedBlobs[blobName(hash)] {
+				collected[hash] = true
+			}
+		}
+		if len(collected) > 0 {
+			blog.Infof("-- blobs : %d collected while uploading, uploading again", len(collected))
+			_, size, uerr := uploadBlobs(ctx, archivePath, &manifest, collected, bucket, nil)
+			err = uerr
+			uploadedSize += size
+		}
+	}
+	if err != nil {
+		// Not to leave the manifest of a failed snapshot
+		if derr := bucket.Delete(ctx, manifestName); derr != nil {
+			blog.Warningf("Deleting manifest %s failed : %s", manifestName, derr.Error())
+		}
+		return err
+	}
+
+	objInfo, err := bucket.GetObjectInfo(ctx, manifestName)
+	if err != nil {
+		// Not to leave the manifest of a failed snapshot
+		if derr := bucket.Delete(ctx, manifestName); derr != nil {
+			blog.Warningf("Deleting manifest %s failed : %s", manifestName, derr.Error())
+		}
+		return fmt.Errorf("Getting objectstore file info failed : %s", err.Error())
+	}
+
+	// Timestamps and size
+	snapshot.Status.StoredTimestamp = metav1.NewTime(objInfo.Timestamp)
+	snapshot.Status.StoredFileSize = objInfo.Size
+	snapshot.Status.UploadedFileSize = uploadedSize
+
+	return nil
+}
+
+// listBlobs returns names of blobs stored in the bucket
+func listBlobs(ctx context.Context, bucket objectstore.Objectstore) (map[string]bool, error) {
+	stored, err := bucket.ListObjectInfoWithPrefix(ctx, BlobPrefix)
+	if err != nil {
+		if objectstorePermError(err.Error()) {
+			return nil, backoff.Permanent(fmt.Errorf("Listing blobs failed : %s", err.Error()))
+		}
+		return nil, fmt.Errorf("Listing blobs failed : %s", err.Error())
+	}
+	blobs := make(map[string]bool, len(stored))
+	for _, obj := range stored {
+		blobs[obj.Name] = true
+	}
+	return blobs, nil
+}
+
+// uploadBlobs uploads blobs of the hashes streamed from the archive, and returns the number and bytes uploaded
+func uploadBlobs(ctx context.Context, archivePath string, manifest *blobManifest, hashes map[string]bool,
+	bucket objectstore.Objectstore, progress *progress) (int, int64, error) {
+
+	uploaded := make(map[string]bool)
+	uploadedSize := int64(0)
+	entryIndex := 0
+	err := streamArchiveEntries(archivePath, func(header *tar.Header, reader io.Reader) error {
+		entry := manifest.Entries[entryIndex]
+		entryIndex++
+		if !hashes[entry.Hash] || uploaded[entry.Hash] {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return backoff.Permanent(ctx.Err())
+		}
+		err := bucket.Upload(ctx, progress.uploadReader(reader), blobName(entry.Hash))
+		if err != nil {
+			if objectstorePermError(err.Error()) {
+				return backoff.Permanent(fmt.Errorf("Uploading blob failed : %s", err.Error()))
+			}
+			return fmt.Errorf("Uploading blob failed : %s", err.Error())
+		}
+		uploaded[entry.Hash] = true
+		uploadedSize += entry.Size
+		progress.done(1)
+		return nil
+	})
+	return len(uploaded), uploadedSize, err
+}
+
+// streamArchiveEntries calls the func with regular file entries of the archive streamed in order
+func streamArchiveEntries(archivePath string, f func(header *tar.Header, reader io.Reader) error) error {
+	snapshotFile, err := os.Open(filepath.Clean(archivePath))
+	if err != nil {
+		return fmt.Errorf("Re-opening tgz file failed : %s", err.Error())
+	}
+	defer func() { _ = snapshotFile.Close() }()
+	tgz, err := newArchiveReader(snapshotFile)
+	if err != nil {
+		return fmt.Errorf("Reading tgz file failed : %s", err.Error())
+	}
+	defer func() { _ = tgz.Close() }()
+
+	tarReader := tar.NewReader(tgz)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Reading tgz file failed : %s", err.Error())
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		err = f(header, tarReader)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Download a manifest from the bucket
+func downloadManifest(ctx context.Context, name string, bucket objectstore.Objectstore) (*blobManifest, error) {
+	manifestFile, err := ioutil.TempFile("", "manifest")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = manifestFile.Close()
+		_ = os.Remove(manifestFile.Name())
+	}()
+	err = bucket.Download(ctx, manifestFile, name+ManifestSuffix)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(manifestFile.Name())
+	if err != nil {
+		return nil, err
+	}
+	var manifest blobManifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("Unmarshalling manifest %s failed : %s", name+ManifestSuffix, err.Error())
+	}
+	return &manifest, nil
+}
+
+// Rebuild a snapshot archive file from the manifest and blobs in the compression of the snapshot.
+// Blobs are streamed through a temp file one by one.
+func downloadSnapshotBlobs(ctx context.Context, name, archivePath string, bucket objectstore.Objectstore) error {
+	manifest, err := downloadManifest(ctx, name, bucket)
+	if err != nil {
+		return err
+	}
+	compression := manifest.Compression
+	if compression == "" {
+		compression = CompressionGzip
+	}
+
+	snapshotFile, err := os.Create(filepath.Clean(archivePath))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = snapshotFile.Close() }()
+	tgz, err := newArchiveWriter(snapshotFile, compression, manifest.CompressionLevel)
+	if err != nil {
+		return fmt.Errorf("Creating archive writer failed : %s", err.Error())
+	}
+	defer func() { _ = tgz.Close() }()
+	tarWriter := tar.NewWriter(tgz)
+	defer func() { _ = tarWriter.Close() }()
+
+	blobFile, err := ioutil.TempFile("", "blob")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = blobFile.Close()
+		_ = os.Remove(blobFile.Name())
+	}()
+
+	for _, entry := range manifest.Entries {
+		err = blobFile.Truncate(0)
+		if err != nil {
+			return err
+		}
+		err = bucket.Download(ctx, blobFile, blobName(entry.Hash))
+		if err != nil {
+			return err
+		}
+		err = writeBlobEntry(tarWriter, blobFile, entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeBlobEntry copies the blob downloaded into the tar checking its hash
+func writeBlobEntry(tarWriter *tar.Writer, blobFile *os.File, entry blobEntry) error {
+	info, err := blobFile.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := blobFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:     entry.Path,
+		Size:     info.Size(),
+		Typeflag: tar.TypeReg,
+		Mode:     0755,
+		ModTime:  time.Now(),
+	}
+	if err := tarWriter.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("Tar writer writing header failed : %s", err.Error())
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(tarWriter, io.TeeReader(blobFile, hasher)); err != nil {
+		return fmt.Errorf("Tar writer writing content failed : %s", err.Error())
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != entry.Hash {
+		return fmt.Errorf("Blob %s for %s is corrupted", entry.Hash, entry.Path)
+	}
+	return nil
+}
+
+// DownloadSnapshotArchive downloads a snapshot into /tmp/<name>.tgz from either layout.
+// The local file keeps the .tgz suffix whatever the compression of the archive is.
+func DownloadSnapshotArchive(ctx context.Context, name string, bucket objectstore.Objectstore) error {
+	return downloadSnapshotArchive(ctx, name, "/tmp/"+name+ArchiveSuffix, bucket)
+}
+
+func downloadSnapshotArchive(ctx context.Context, name, archivePath string, bucket objectstore.Objectstore) error {
+	_, err := bucket.GetObjectInfo(ctx, name+ManifestSuffix)
+	if err == nil {
+		return downloadSnapshotBlobs(ctx, name, archivePath, bucket)
+	}
+
+	// Archive object in any compression
+	objectName := name + ArchiveSuffix
+	for _, compression := range compressions {
+		_, err := bucket.GetObjectInfo(ctx, archiveObjectName(name, compression))
+		if err == nil {
+			objectName = archiveObjectName(name, compression)
+			break
+		}
+	}
+	snapshotFile, err := os.Create(filepath.Clean(archivePath))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = snapshotFile.Close() }()
+	return bucket.Download(ctx, snapshotFile, objectName)
+}
+
+// GarbageCollectBlobs deletes blobs not referenced from any manifest in the bucket.
+// Blobs uploaded in the grace period are kept for manifests not written yet.
+func GarbageCollectBlobs(ctx context.Context, bucket objectstore.Objectstore) error {
+
+	// sync objects log
+	slog := utils.NewNamedLog("sync objects:")
+
+	objects, err := bucket.ListObjectInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Collect referenced blobs
+	referenced := make(map[string]bool)
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Name, ManifestSuffix) {
+			continue
+		}
+		manifest, err := downloadManifest(ctx, strings.TrimSuffix(object.Name, ManifestSuffix), bucket)
+		if err != nil {
+			// Keep all blobs when a manifest cannot be read
+			return err
+		}
+		for _, entry := range manifest.Entries {
+			referenced[blobName(entry.Hash)] = true
+		}
+	}
+
+	// Delete others uploaded before the grace period
+	for _, object := range objects {
+		if !strings.HasPrefix(object.Name, BlobPrefix) || referenced[object.Name] {
+			continue
+		}
+		if time.Since(object.Timestamp) < blobGracePeriod {
+			continue
+		}
+		slog.Infof("Deleting unreferenced blob %s", object.Name)
+		err = bucket.Delete(ctx, object.Name)
+		if err != nil {
+			slog.Warningf("- Cannot delete blob %s : %s", object.Name, err.Error())
+		}
+	}
+
+	return nil
+}
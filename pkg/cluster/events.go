@@ -0,0 +1,192 @@
+package cluster
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog"
+
+	"github.com/ryo-watanabe/k8s-snap/pkg/utils"
+)
+
+// Max time to wait for watch goroutines draining after stop
+const watchDrainTimeout = 30 * time.Second
+
+// eventCollector collects watch events of resources during snapshot
+type eventCollector struct {
+	sr       *ServerResources
+	lock     sync.Mutex
+	watches  map[schema.GroupVersionResource]watch.Interface
+	events   []watch.Event
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func newEventCollector(sr *ServerResources) *eventCollector {
+	return &eventCollector{
+		sr:      sr,
+		watches: make(map[schema.GroupVersionResource]watch.Interface),
+		events:  make([]watch.Event, 0),
+		done:    make(chan struct{}),
+	}
+}
+
+// Start watching the resource from the resource version
+func (c *eventCollector) watch(ctx context.Context, dynamicClient dynamic.Interface,
+	task *listTask, startRV string) error {
+
+	resourceWatch, err := dynamicClient.Resource(task.gvr).Watch(ctx, metav1.ListOptions{ResourceVersion: startRV})
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	c.watches[task.gvr] = resourceWatch
+	c.lock.Unlock()
+
+	name := task.groupVersion + "/" + task.name
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		klog.V(4).Infof("+++ %s watch started", name)
+		for e := range resourceWatch.ResultChan() {
+			item, ok := e.Object.(*unstructured.Unstructured)
+			if ok {
+				resourcePath, _ := c.sr.ResourcePath(item)
+				switch e.Type {
+				case watch.Added:
+					klog.V(4).Infof("!!! Resource added : %s - rv:%s", resourcePath, item.GetResourceVersion())
+				case watch.Modified:
+					klog.V(4).Infof("!!! Resource modified : %s - rv:%s", resourcePath, item.GetResourceVersion())
+				case watch.Deleted:
+					klog.V(4).Infof("!!! Resource deleted : %s - rv:%s", resourcePath, item.GetResourceVersion())
+				}
+			}
+			c.lock.Lock()
+			c.events = append(c.events, e)
+			c.lock.Unlock()
+		}
+		klog.V(4).Infof("+++ %s watch exiting", name)
+	}()
+	return nil
+}
+
+// Stop watch resources and drain events.
+// done is closed when all watch goroutines exited.
+func (c *eventCollector) stop() {
+	c.stopOnce.Do(func() {
+		c.lock.Lock()
+		for _, resourceWatch := range c.watches {
+			resourceWatch.Stop()
+		}
+		c.lock.Unlock()
+		go func() {
+			c.wg.Wait()
+			close(c.done)
+		}()
+	})
+	select {
+	case <-c.done:
+	case <-time.After(watchDrainTimeout):
+		klog.Warning("+++ watch goroutines not exited")
+	}
+}
+
+// Events in order of resource version, so that the result does not depend on
+// which watch delivered first.
+func (c *eventCollector) sortedEvents() []watch.Event {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	events := make([]watch.Event, len(c.events))
+	copy(events, c.events)
+	sort.SliceStable(events, func(i, j int) bool {
+		return eventResourceVersion(events[i]) < eventResourceVersion(events[j])
+	})
+	return events
+}
+
+func eventResourceVersion(e watch.Event) int64 {
+	item, ok := e.Object.(*unstructured.Unstructured)
+	if !ok {
+		return 0
+	}
+	rv, err := strconv.ParseInt(item.GetResourceVersion(), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return rv
+}
+
+// syncWatchEvents applies watch events older than the end resource version to the listed resources.
+// Resources are indexed by resource path, and the order of listed resources is kept.
+func syncWatchEvents(snapshotList []unstructured.Unstructured, events []watch.Event, endRV string,
+	sr *ServerResources, blog *utils.NamedLog) []unstructured.Unstructured {
+
+	paths := make([]string, 0, len(snapshotList))
+	items := make(map[string]*unstructured.Unstructured, len(snapshotList))
+	for i := range snapshotList {
+		resourcePath, _ := sr.ResourcePath(&snapshotList[i])
+		if _, ok := items[resourcePath]; !ok {
+			paths = append(paths, resourcePath)
+		}
+		items[resourcePath] = &snapshotList[i]
+	}
+
+	for _, e := range events {
+		item, ok := e.Object.(*unstructured.Unstructured)
+		if !ok {
+			blog.Infof("-- [%s] %#v", e.Type, e.Object)
+			continue
+		}
+		message := "unknown type"
+		resourcePath, _ := sr.ResourcePath(item)
+		if !isOlderValidResourceVersion(item.GetResourceVersion(), endRV) {
+			message = "ignored, not older than end resource version"
+			blog.Infof("-- [%s] rv:%s %s - %s", e.Type, item.GetResourceVersion(), resourcePath, message)
+			continue
+		}
+		stored, found := items[resourcePath]
+		if found && stored != nil {
+			if isNewerValidResourceVersion(item.GetResourceVersion(), stored.GetResourceVersion()) {
+				switch e.Type {
+				case watch.Added, watch.Modified:
+					items[resourcePath] = item
+					message = "applied"
+				case watch.Deleted:
+					items[resourcePath] = nil
+					message = "deleted"
+				}
+			} else {
+				message = "ignored, resource version is older than stored"
+			}
+		} else {
+			switch e.Type {
+			case watch.Added, watch.Modified:
+				if !found {
+					paths = append(paths, resourcePath)
+				}
+				items[resourcePath] = item
+				message = "added"
+			case watch.Deleted:
+				message = "already deleted"
+			}
+		}
+		blog.Infof("-- [%s] rv:%s %s - %s", e.Type, item.GetResourceVersion(), resourcePath, message)
+	}
+
+	synced := make([]unstructured.Unstructured, 0, len(paths))
+	for _, resourcePath := range paths {
+		if item := items[resourcePath]; item != nil {
+			synced = append(synced, *item)
+		}
+	}
+	return synced
+}
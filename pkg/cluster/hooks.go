@@ -0,0 +1,272 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/utils"
+)
+
+// Hook phases
+const (
+	HookPhasePre         = "pre"
+	HookPhasePost        = "post"
+	HookPhasePostRestore = "post-restore"
+)
+
+// Hook on-error policies
+const (
+	// Abort the snapshot (default)
+	HookOnErrorFail = "Fail"
+	// Record the error and go on
+	HookOnErrorContinue = "Continue"
+)
+
+// DefaultHookTimeout is the timeout of a hook command in a pod
+const DefaultHookTimeout = 30 * time.Second
+
+// PodExecutor executes commands in containers of target cluster pods
+type PodExecutor interface {
+	Exec(ctx context.Context, namespace, pod, container string, command []string, stdout, stderr io.Writer) error
+}
+
+// remotePodExecutor executes commands with the pod exec subresource
+type remotePodExecutor struct {
+	config     *rest.Config
+	kubeClient kubernetes.Interface
+}
+
+// Setup pod executor for target cluster.
+func buildPodExecutor(kubeconfig string, kubeClient kubernetes.Interface) (PodExecutor, error) {
+	cfg, err := clientcmd.RESTConfigFromKubeConfig([]byte(kubeconfig))
+	if err != nil {
+		return nil, fmt.Errorf("Error building kubeconfig: %s", err.Error())
+	}
+	return &remotePodExecutor{config: cfg, kubeClient: kubeClient}, nil
+}
+
+// Exec runs the command in the container.
+// The exec stream has no context, its pipes are closed when the context is done.
+func (e *remotePodExecutor) Exec(ctx context.Context, namespace, pod, container string,
+	command []string, stdout, stderr io.Writer) error {
+
+	req := e.kubeClient.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(pod).
+		Namespace(namespace).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdin:     true,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+
+	executor, err := remotecommand.NewSPDYExecutor(e.config, "POST", req.URL())
+	if err != nil {
+		return err
+	}
+	return streamExec(ctx, executor, stdout, stderr)
+}
+
+// streamExec streams the exec through pipes.
+// On timeout stdin is closed and outputs fail to be written, so that the stream left behind ends.
+func streamExec(ctx context.Context, executor remotecommand.Executor, stdout, stderr io.Writer) error {
+
+	stdinReader, stdinWriter := io.Pipe()
+	outReader, outWriter := io.Pipe()
+	errReader, errWriter := io.Pipe()
+
+	// Outputs are buffered so that a stream left behind never writes to the caller
+	var outBuf, errBuf bytes.Buffer
+	var copies sync.WaitGroup
+	copies.Add(2)
+	go func() {
+		defer copies.Done()
+		_, _ = io.Copy(&outBuf, outReader)
+	}()
+	go func() {
+		defer copies.Done()
+		_, _ = io.Copy(&errBuf, errReader)
+	}()
+
+	errCh := make(chan error, 1)
+	go func() {
+		err := executor.Stream(remotecommand.StreamOptions{Stdin: stdinReader, Stdout: outWriter, Stderr: errWriter})
+		_ = outWriter.Close()
+		_ = errWriter.Close()
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		_ = stdinWriter.Close()
+		copies.Wait()
+		_, _ = io.Copy(stdout, &outBuf)
+		_, _ = io.Copy(stderr, &errBuf)
+		return err
+	case <-ctx.Done():
+		_ = stdinWriter.Close()
+		_ = outReader.CloseWithError(ctx.Err())
+		_ = errReader.CloseWithError(ctx.Err())
+		return ctx.Err()
+	}
+}
+
+// runHooks executes hooks in the pods selected and records results in the snapshot status
+func runHooks(ctx context.Context, snapshot *cbv1alpha1.Snapshot, hooks []cbv1alpha1.SnapshotHook, phase string,
+	kubeClient kubernetes.Interface, executor PodExecutor, blog *utils.NamedLog) error {
+
+	for _, hook := range hooks {
+		results, err := execHook(ctx, hook, phase, kubeClient, executor, blog)
+		snapshot.Status.HookResults = append(snapshot.Status.HookResults, results...)
+		err = hookError(hook.Name, hook.OnError, err, blog)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunSnapshotHooks executes hooks of the phase in the snapshot target cluster
+func RunSnapshotHooks(ctx context.Context, snapshot *cbv1alpha1.Snapshot, phase string) error {
+
+	hooks := snapshot.Spec.PreHooks
+	if phase == HookPhasePost {
+		hooks = snapshot.Spec.PostHooks
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	// kubeClient for external cluster.
+	kubeClient, err := buildKubeClient(ctx, snapshot.Spec.Kubeconfig)
+	if err != nil {
+		return err
+	}
+
+	// Executor for hooks in target cluster pods
+	executor, err := buildPodExecutor(snapshot.Spec.Kubeconfig, kubeClient)
+	if err != nil {
+		return err
+	}
+
+	blog := utils.NewNamedLog("snapshot:" + snapshot.ObjectMeta.Name)
+	return runHooks(ctx, snapshot, hooks, phase, kubeClient, executor, blog)
+}
+
+// hookError applies the on-error policy of a hook to its error
+func hookError(name, onError string, err error, blog *utils.NamedLog) error {
+	if err == nil {
+		return nil
+	}
+	if onError == HookOnErrorContinue {
+		blog.Warningf("Hook %s failed, continue : %s", name, err.Error())
+		return nil
+	}
+	return backoff.Permanent(fmt.Errorf("Hook %s failed : %s", name, err.Error()))
+}
+
+func validateOnError(onError string) error {
+	if onError != "" && onError != HookOnErrorFail && onError != HookOnErrorContinue {
+		return fmt.Errorf("Unknown on-error policy %s", onError)
+	}
+	return nil
+}
+
+func hookTimeout(timeout metav1.Duration) time.Duration {
+	if timeout.Duration == 0 {
+		return DefaultHookTimeout
+	}
+	return timeout.Duration
+}
+
+// execHook executes the hook command in running pods selected
+func execHook(ctx context.Context, hook cbv1alpha1.SnapshotHook, phase string,
+	kubeClient kubernetes.Interface, executor PodExecutor, blog *utils.NamedLog) ([]cbv1alpha1.HookResult, error) {
+
+	err := validateOnError(hook.OnError)
+	if err != nil {
+		return nil, err
+	}
+	if len(hook.Command) == 0 {
+		return nil, fmt.Errorf("No command")
+	}
+	if executor == nil {
+		return nil, fmt.Errorf("No pod executor")
+	}
+	// Hooks never run across namespaces or in every pod of a namespace
+	if hook.Namespace == "" {
+		return nil, fmt.Errorf("No namespace")
+	}
+	if hook.Selector == nil || (len(hook.Selector.MatchLabels) == 0 && len(hook.Selector.MatchExpressions) == 0) {
+		return nil, fmt.Errorf("No selector")
+	}
+	selector, err := metav1.LabelSelectorAsSelector(hook.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid selector : %s", err.Error())
+	}
+	pods, err := kubeClient.CoreV1().Pods(hook.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, fmt.Errorf("Listing pods failed : %s", err.Error())
+	}
+	timeout := hookTimeout(hook.Timeout)
+
+	results := make([]cbv1alpha1.HookResult, 0)
+	var hookErr error
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != corev1.PodRunning {
+			continue
+		}
+		container := hook.Container
+		if container == "" && len(pod.Spec.Containers) > 0 {
+			container = pod.Spec.Containers[0].Name
+		}
+		blog.Infof("Running %s hook %s in %s/%s:%s", phase, hook.Name, pod.Namespace, pod.Name, container)
+
+		var stdout, stderr bytes.Buffer
+		execCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := executor.Exec(execCtx, pod.Namespace, pod.Name, container, hook.Command, &stdout, &stderr)
+		cancel()
+
+		result := cbv1alpha1.HookResult{
+			Name:      hook.Name,
+			Phase:     phase,
+			Pod:       pod.Namespace + "/" + pod.Name,
+			Container: container,
+			Stdout:    truncateMessage(stdout.String()),
+			Stderr:    truncateMessage(stderr.String()),
+		}
+		if err != nil {
+			if exitErr, ok := err.(utilexec.ExitError); ok {
+				result.ExitCode = int32(exitErr.ExitStatus())
+			} else {
+				result.ExitCode = -1
+			}
+			result.Error = err.Error()
+			if hookErr == nil {
+				hookErr = fmt.Errorf("%s in %s", err.Error(), result.Pod)
+			}
+		}
+		results = append(results, result)
+	}
+	if len(results) == 0 {
+		return results, fmt.Errorf("No running pods matched in %s", hook.Namespace)
+	}
+	return results, hookErr
+}
@@ -0,0 +1,171 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/clientcmd"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+)
+
+// Defaults for listing resources of a target cluster
+const (
+	DefaultListConcurrency = 4
+	DefaultClientQPS       = 20
+	DefaultClientBurst     = 40
+)
+
+// listConcurrency returns the number of resources listed at once for the snapshot
+func listConcurrency(snapshot *cbv1alpha1.Snapshot) int {
+	if snapshot.Spec.ListConcurrency > 0 {
+		return snapshot.Spec.ListConcurrency
+	}
+	return DefaultListConcurrency
+}
+
+// clientQPS returns QPS and burst of the target cluster client for the snapshot
+func clientQPS(snapshot *cbv1alpha1.Snapshot) (float32, int) {
+	qps := DefaultClientQPS
+	burst := DefaultClientBurst
+	if snapshot.Spec.ClientQPS > 0 {
+		qps = snapshot.Spec.ClientQPS
+	}
+	if snapshot.Spec.ClientBurst > 0 {
+		burst = snapshot.Spec.ClientBurst
+	}
+	return float32(qps), burst
+}
+
+// clusterKey returns the API server host of the target cluster of the snapshot,
+// or the snapshot itself when the host is unknown.
+func clusterKey(snapshot *cbv1alpha1.Snapshot) string {
+	cfg, err := clientcmd.RESTConfigFromKubeConfig([]byte(snapshot.Spec.Kubeconfig))
+	if err != nil || cfg.Host == "" {
+		return "snapshot:" + snapshot.ObjectMeta.Namespace + "/" + snapshot.ObjectMeta.Name
+	}
+	return cfg.Host
+}
+
+// Semaphores limiting concurrent list calls per target cluster.
+// Snapshots of the same cluster taken at once share the limit of the first one,
+// and the semaphore is deleted when no snapshot uses it.
+type clusterSemaphore struct {
+	sem  chan struct{}
+	refs int
+}
+
+var clusterSemaphores = make(map[string]*clusterSemaphore)
+var clusterSemaphoresLock sync.Mutex
+
+// acquireClusterSemaphore returns the semaphore of the cluster and a func to release it
+func acquireClusterSemaphore(key string, concurrency int) (chan struct{}, func()) {
+	clusterSemaphoresLock.Lock()
+	defer clusterSemaphoresLock.Unlock()
+	s, ok := clusterSemaphores[key]
+	if !ok {
+		s = &clusterSemaphore{sem: make(chan struct{}, concurrency)}
+		clusterSemaphores[key] = s
+	}
+	s.refs++
+	return s.sem, func() {
+		clusterSemaphoresLock.Lock()
+		defer clusterSemaphoresLock.Unlock()
+		s.refs--
+		if s.refs == 0 {
+			delete(clusterSemaphores, key)
+		}
+	}
+}
+
+// listTask is a resource to list and watch on snapshot
+type listTask struct {
+	gvr          schema.GroupVersionResource
+	groupVersion string
+	name         string
+	items        []unstructured.Unstructured
+}
+
+// listResources lists and starts watching resources of the tasks with a bounded worker pool.
+// Listed items are stored in each task, so the merged result keeps the order of tasks.
+func listResources(ctx context.Context, dynamicClient dynamic.Interface, tasks []*listTask,
+	clusterKey string, concurrency int, startRV string, collector *eventCollector) error {
+
+	listCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	progress := progressFrom(ctx)
+	progress.stage(StageListing, len(tasks))
+
+	sem, release := acquireClusterSemaphore(clusterKey, concurrency)
+	defer release()
+	taskCh := make(chan *listTask)
+	errCh := make(chan error, 1)
+	var wg sync.WaitGroup
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range taskCh {
+				sem <- struct{}{}
+				err := listResource(listCtx, ctx, dynamicClient, task, startRV, collector)
+				<-sem
+				if err != nil {
+					select {
+					case errCh <- err:
+					default:
+					}
+					cancel()
+					continue
+				}
+				progress.done(1)
+			}
+		}()
+	}
+
+feed:
+	for _, task := range tasks {
+		select {
+		case taskCh <- task:
+		case <-listCtx.Done():
+			break feed
+		}
+	}
+	close(taskCh)
+	wg.Wait()
+
+	select {
+	case err := <-errCh:
+		return err
+	default:
+	}
+	return ctx.Err()
+}
+
+// List a resource and start watching it.
+// Watches live on the snapshot context, not on the list context cancelled when listing ends.
+func listResource(listCtx, watchCtx context.Context, dynamicClient dynamic.Interface,
+	task *listTask, startRV string, collector *eventCollector) error {
+
+	if listCtx.Err() != nil {
+		return listCtx.Err()
+	}
+
+	unstructuredList, err := dynamicClient.Resource(task.gvr).List(listCtx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("Get resource %s list failed : %s", task.name, err.Error())
+	}
+	task.items = unstructuredList.Items
+
+	err = collector.watch(watchCtx, dynamicClient, task, startRV)
+	if err != nil {
+		return fmt.Errorf("Watch resource %s list failed : %s", task.name, err.Error())
+	}
+	return nil
+}
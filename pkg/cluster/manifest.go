@@ -0,0 +1,243 @@
+package cluster
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
+	"github.com/ryo-watanabe/k8s-snap/pkg/utils"
+)
+
+// ArchiveFormatVersion is the format version of snapshot archives written by this k8s-snap
+const ArchiveFormatVersion = 1
+
+// ManifestFile is the file name of the manifest in snapshot archives
+const ManifestFile = "manifest.json"
+
+// Condition type and reasons for archive verification
+const (
+	ConditionVerified        = "Verified"
+	ReasonChecksumsMatched   = "ChecksumsMatched"
+	ReasonVerificationFailed = "VerificationFailed"
+	ReasonNoManifest         = "NoManifest"
+)
+
+// Archives in format version 0 have no manifest to verify
+const noManifestMessage = "manifest.json not found"
+
+// Version is the k8s-snap version recorded in archive manifests
+var Version = "unknown"
+
+// ArchiveManifest describes the entries of a snapshot archive
+type ArchiveManifest struct {
+	FormatVersion   int             `json:"formatVersion"`
+	SnapVersion     string          `json:"snapVersion"`
+	ClusterVersion  string          `json:"clusterVersion"`
+	NumberOfEntries int             `json:"numberOfEntries"`
+	TotalSize       int64           `json:"totalSize"`
+	Entries         []ManifestEntry `json:"entries"`
+}
+
+// ManifestEntry is a file in the snapshot archive
+type ManifestEntry struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+func newArchiveManifest(clusterVersion string) *ArchiveManifest {
+	return &ArchiveManifest{
+		FormatVersion:  ArchiveFormatVersion,
+		SnapVersion:    Version,
+		ClusterVersion: clusterVersion,
+	}
+}
+
+func (m *ArchiveManifest) add(path string, content []byte) {
+	sum := sha256.Sum256(content)
+	m.Entries = append(m.Entries, ManifestEntry{
+		Path:   path,
+		SHA256: hex.EncodeToString(sum[:]),
+		Size:   int64(len(content)),
+	})
+	m.NumberOfEntries++
+	m.TotalSize += int64(len(content))
+}
+
+// Write the manifest as the last entry of the archive
+func writeManifest(tarWriter *tar.Writer, name string, m *ArchiveManifest) error {
+	content, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("Marshalling manifest.json failed : %s", err.Error())
+	}
+	hdr := &tar.Header{
+		Name:     filepath.Join(name, ManifestFile),
+		Size:     int64(len(content)),
+		Typeflag: tar.TypeReg,
+		Mode:     0755,
+		ModTime:  time.Now(),
+	}
+	if err := tarWriter.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("tar writer manifest.json header failed : %s", err.Error())
+	}
+	if _, err := tarWriter.Write(content); err != nil {
+		return fmt.Errorf("tar writer manifest.json content failed : %s", err.Error())
+	}
+	return nil
+}
+
+// VerifyArchive validates every entry of a snapshot tgz file against its manifest
+func VerifyArchive(name, archivePath string) (*ArchiveManifest, error) {
+
+	archiveFile, err := os.Open(filepath.Clean(archivePath))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = archiveFile.Close() }()
+	tgz, err := newArchiveReader(archiveFile)
+	if err != nil {
+		return nil, fmt.Errorf("Reading tgz file failed : %s", err.Error())
+	}
+	defer func() { _ = tgz.Close() }()
+
+	// Hash all entries
+	var manifest *ArchiveManifest
+	hashes := make(map[string]ManifestEntry)
+	tarReader := tar.NewReader(tgz)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Reading tgz file failed : %s", err.Error())
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if header.Name == filepath.Join(name, ManifestFile) {
+			content, err := ioutil.ReadAll(tarReader)
+			if err != nil {
+				return nil, fmt.Errorf("Reading manifest.json failed : %s", err.Error())
+			}
+			manifest = &ArchiveManifest{}
+			err = json.Unmarshal(content, manifest)
+			if err != nil {
+				return nil, fmt.Errorf("Unmarshalling manifest.json failed : %s", err.Error())
+			}
+			continue
+		}
+		h := sha256.New()
+		size, err := io.Copy(h, tarReader)
+		if err != nil {
+			return nil, fmt.Errorf("Reading %s failed : %s", header.Name, err.Error())
+		}
+		hashes[header.Name] = ManifestEntry{Path: header.Name, SHA256: hex.EncodeToString(h.Sum(nil)), Size: size}
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("%s in snapshot %s", noManifestMessage, name)
+	}
+	if manifest.FormatVersion > ArchiveFormatVersion {
+		return manifest, fmt.Errorf("Unsupported archive format version %d", manifest.FormatVersion)
+	}
+	if manifest.NumberOfEntries != len(manifest.Entries) {
+		return manifest, fmt.Errorf("Number of entries %d not matched to manifest %d",
+			len(manifest.Entries), manifest.NumberOfEntries)
+	}
+
+	// Compare with manifest
+	for _, entry := range manifest.Entries {
+		actual, ok := hashes[entry.Path]
+		if !ok {
+			return manifest, fmt.Errorf("Entry %s not found in archive", entry.Path)
+		}
+		if actual.SHA256 != entry.SHA256 || actual.Size != entry.Size {
+			return manifest, fmt.Errorf("Checksum not matched for %s", entry.Path)
+		}
+		delete(hashes, entry.Path)
+	}
+	if len(hashes) > 0 {
+		paths := make([]string, 0, len(hashes))
+		for path := range hashes {
+			paths = append(paths, path)
+		}
+		return manifest, fmt.Errorf("Entries not in manifest : %s", strings.Join(paths, ","))
+	}
+
+	return manifest, nil
+}
+
+// SetNoManifestCondition sets the Verified condition unknown for archives without manifest
+func SetNoManifestCondition(snapshot *cbv1alpha1.Snapshot) {
+	meta.SetStatusCondition(&snapshot.Status.Conditions, metav1.Condition{
+		Type:               ConditionVerified,
+		Status:             metav1.ConditionUnknown,
+		Reason:             ReasonNoManifest,
+		Message:            "No manifest in the archive, migrate the snapshot to verify",
+		ObservedGeneration: snapshot.ObjectMeta.Generation,
+	})
+	snapshot.Status.VerifiedTimestamp = metav1.NewTime(time.Now())
+}
+
+// Verify downloads the snapshot archive, validates it against the manifest and
+// sets the Verified condition of the snapshot.
+// Errors are returned only when the archive cannot be downloaded.
+func Verify(ctx context.Context, snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) (*ArchiveManifest, error) {
+
+	// Snapshot log
+	blog := utils.NewNamedLog("verify:" + snapshot.ObjectMeta.Name)
+
+	archiveFile, err := ioutil.TempFile("", snapshot.ObjectMeta.Name)
+	if err != nil {
+		return nil, err
+	}
+	_ = archiveFile.Close()
+	defer func() { _ = os.Remove(archiveFile.Name()) }()
+
+	blog.Infof("Downloading snapshot %s", snapshot.ObjectMeta.Name)
+	err = downloadSnapshotArchive(ctx, snapshot.ObjectMeta.Name, archiveFile.Name(), bucket)
+	if err != nil {
+		return nil, fmt.Errorf("Downloading snapshot failed : %s", err.Error())
+	}
+
+	manifest, verr := VerifyArchive(snapshot.ObjectMeta.Name, archiveFile.Name())
+
+	condition := metav1.Condition{
+		Type:               ConditionVerified,
+		ObservedGeneration: snapshot.ObjectMeta.Generation,
+	}
+	if verr != nil && strings.HasPrefix(verr.Error(), noManifestMessage) {
+		blog.Warningf("Not verified : %s", verr.Error())
+		SetNoManifestCondition(snapshot)
+		return nil, nil
+	} else if verr != nil {
+		blog.Warningf("Verification failed : %s", verr.Error())
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = ReasonVerificationFailed
+		condition.Message = verr.Error()
+	} else {
+		blog.Infof("Verified %d entries", manifest.NumberOfEntries)
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = ReasonChecksumsMatched
+		condition.Message = fmt.Sprintf("%d entries verified", manifest.NumberOfEntries)
+	}
+	meta.SetStatusCondition(&snapshot.Status.Conditions, condition)
+	snapshot.Status.VerifiedTimestamp = metav1.NewTime(time.Now())
+
+	return manifest, nil
+}
@@ -0,0 +1,108 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cenkalti/backoff"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/utils"
+)
+
+// Resource version marker modes
+const (
+	// Create and delete a config map
+	MarkerModeConfigMap = "configmap"
+	// Read resource version of a config map list, no write to the cluster
+	MarkerModeReadOnly = "readonly"
+)
+
+// Defaults for resource version markers
+const (
+	DefaultMarkerNamespace = "default"
+	DefaultMarkerPrefix    = "resource-version-marker-"
+)
+
+// resourceVersionMark is a resource version of the cluster at a moment
+type resourceVersionMark struct {
+	ResourceVersion string
+	Timestamp       metav1.Time
+}
+
+// resourceVersionMarker gets current resource versions of a cluster
+type resourceVersionMarker interface {
+	mark(ctx context.Context) (*resourceVersionMark, error)
+}
+
+// newResourceVersionMarker returns the marker configured in the snapshot spec
+func newResourceVersionMarker(snapshot *cbv1alpha1.Snapshot, kubeClient kubernetes.Interface) (resourceVersionMarker, error) {
+	return newMarker(snapshot.Spec.MarkerMode, snapshot.Spec.MarkerNamespace, snapshot.Spec.MarkerPrefix, kubeClient)
+}
+
+// newRestoreMarker returns the marker configured in the restore spec
+func newRestoreMarker(restore *cbv1alpha1.Restore, kubeClient kubernetes.Interface) (resourceVersionMarker, error) {
+	return newMarker(restore.Spec.MarkerMode, restore.Spec.MarkerNamespace, restore.Spec.MarkerPrefix, kubeClient)
+}
+
+func newMarker(mode, namespace, prefix string, kubeClient kubernetes.Interface) (resourceVersionMarker, error) {
+	if namespace == "" {
+		namespace = DefaultMarkerNamespace
+	}
+	if prefix == "" {
+		prefix = DefaultMarkerPrefix
+	}
+
+	switch mode {
+	case "", MarkerModeConfigMap:
+		return &configMapMarker{
+			kubeClient: kubeClient,
+			namespace:  namespace,
+			name:       prefix + utils.RandString(10),
+		}, nil
+	case MarkerModeReadOnly:
+		return &listMarker{kubeClient: kubeClient, namespace: namespace}, nil
+	}
+	return nil, backoff.Permanent(fmt.Errorf("Unknown marker mode %s", mode))
+}
+
+// configMapMarker gets resource versions from a config map created and deleted
+type configMapMarker struct {
+	kubeClient kubernetes.Interface
+	namespace  string
+	name       string
+}
+
+func (m *configMapMarker) mark(ctx context.Context) (*resourceVersionMark, error) {
+	marker, err := ConfigMapMarker(ctx, m.kubeClient, m.namespace, m.name)
+	if err != nil {
+		return nil, err
+	}
+	return &resourceVersionMark{
+		ResourceVersion: marker.ObjectMeta.ResourceVersion,
+		Timestamp:       marker.ObjectMeta.CreationTimestamp,
+	}, nil
+}
+
+// listMarker gets resource versions from config map list responses.
+// A list without resourceVersion is served from etcd, so it carries the latest resource version.
+type listMarker struct {
+	kubeClient kubernetes.Interface
+	namespace  string
+}
+
+func (m *listMarker) mark(ctx context.Context) (*resourceVersionMark, error) {
+	list, err := m.kubeClient.CoreV1().ConfigMaps(m.namespace).List(ctx, metav1.ListOptions{Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+	if list.ListMeta.ResourceVersion == "" {
+		return nil, fmt.Errorf("No resource version in config map list of %s", m.namespace)
+	}
+	return &resourceVersionMark{
+		ResourceVersion: list.ListMeta.ResourceVersion,
+		Timestamp:       metav1.Now(),
+	}, nil
+}
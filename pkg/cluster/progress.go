@@ -0,0 +1,138 @@
+package cluster
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+)
+
+// Stages of snapshots and restores reported in progress
+const (
+	StageListing     = "Listing"
+	StageSyncing     = "ReconcilingWatchEvents"
+	StageArchiving   = "Archiving"
+	StageUploading   = "Uploading"
+	StageDownloading = "Downloading"
+	StageRestoring   = "Restoring"
+)
+
+type progressKey struct{}
+
+// WithProgress returns a context reporting progress of a snapshot or restore to the func.
+// The func is called on every change, so it should be cheap and throttle updates by itself.
+func WithProgress(ctx context.Context, report func(cbv1alpha1.Progress)) context.Context {
+	return context.WithValue(ctx, progressKey{}, &progress{report: report})
+}
+
+// progress tracks the stage in progress and estimates the time to complete it
+type progress struct {
+	lock    sync.Mutex
+	report  func(cbv1alpha1.Progress)
+	current cbv1alpha1.Progress
+	started time.Time
+}
+
+// progressFrom returns the progress of the context, nil when not reported
+func progressFrom(ctx context.Context) *progress {
+	p, _ := ctx.Value(progressKey{}).(*progress)
+	return p
+}
+
+// stage starts a stage with the total number of resources
+func (p *progress) stage(stage string, total int) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.current = cbv1alpha1.Progress{Stage: stage, ResourcesTotal: int32(total)}
+	p.started = time.Now()
+	p.send()
+}
+
+// setTotal sets the number of resources or bytes of the stage when known after it started
+func (p *progress) setTotal(resources int, bytes int64) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.current.ResourcesTotal = int32(resources)
+	p.current.BytesTotal = bytes
+	p.send()
+}
+
+// done adds resources processed
+func (p *progress) done(n int) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.current.ResourcesDone += int32(n)
+	p.send()
+}
+
+// setDone sets resources processed
+func (p *progress) setDone(n int) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.current.ResourcesDone = int32(n)
+	p.send()
+}
+
+// uploaded adds bytes uploaded
+func (p *progress) uploaded(n int64) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.current.BytesUploaded += n
+	p.send()
+}
+
+// send reports the current progress with ETA estimated from bytes if known, or from resources
+func (p *progress) send() {
+	now := time.Now()
+	done, total := float64(p.current.ResourcesDone), float64(p.current.ResourcesTotal)
+	if p.current.BytesTotal > 0 {
+		done, total = float64(p.current.BytesUploaded), float64(p.current.BytesTotal)
+	}
+	p.current.ETA = nil
+	if done > 0 && total > done {
+		remaining := time.Duration(float64(now.Sub(p.started)) * (total - done) / done)
+		eta := metav1.NewTime(now.Add(remaining).Truncate(time.Second))
+		p.current.ETA = &eta
+	}
+	p.current.UpdatedAt = metav1.NewTime(now)
+	p.report(*p.current.DeepCopy())
+}
+
+// progressReader counts bytes read from the reader as uploaded
+type progressReader struct {
+	reader   io.Reader
+	progress *progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	r.progress.uploaded(int64(n))
+	return n, err
+}
+
+// uploadReader returns the reader counting bytes uploaded, or the reader as is when progress not reported
+func (p *progress) uploadReader(reader io.Reader) io.Reader {
+	if p == nil {
+		return reader
+	}
+	return &progressReader{reader: reader, progress: p}
+}
@@ -0,0 +1,286 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
+)
+
+// ReportPrefix is the prefix of report objects, which are not snapshot objects
+const ReportPrefix = "reports/"
+
+// LogSuffix is the suffix of snapshot log objects uploaded next to archives
+const LogSuffix = ".log"
+
+// StatusSampleSize is the number of items of each list kept in status as a sample
+var StatusSampleSize = 20
+
+// Max elapsed time of retries uploading a report.
+// Lists are kept whole only in the report, so an operation fails when its report is not uploaded.
+var reportRetryElapsed = time.Minute
+
+// Timeout of uploading a restore report, apart from the operation which may be cancelled or timed out
+var reportTimeout = 2 * time.Minute
+
+// SnapshotReportName returns the report object name of the snapshot
+func SnapshotReportName(name string) string {
+	return ReportPrefix + "snapshots/" + name + ".json"
+}
+
+// RestoreReportName returns the report object name of the restore
+func RestoreReportName(name string) string {
+	return ReportPrefix + "restores/" + name + ".json"
+}
+
+// RestoreJUnitReportName returns the JUnit XML report object name of the restore
+func RestoreJUnitReportName(name string) string {
+	return ReportPrefix + "restores/" + name + ".xml"
+}
+
+// SnapshotLogName returns the log object name of the snapshot
+func SnapshotLogName(name string) string {
+	return name + LogSuffix
+}
+
+// SnapshotReport holds lists of a snapshot too large for the status
+type SnapshotReport struct {
+	Name     string   `json:"name"`
+	Contents []string `json:"contents"`
+}
+
+// RestoreReport holds lists of a restore too large for the status
+type RestoreReport struct {
+	Name           string                           `json:"name"`
+	Excluded       []string                         `json:"excluded"`
+	Created        []string                         `json:"created"`
+	Updated        []string                         `json:"updated"`
+	AlreadyExisted []string                         `json:"alreadyExisted"`
+	Failed         []string                         `json:"failed"`
+	Converted      []string                         `json:"converted"`
+	Journal        []cbv1alpha1.RestoreJournalEntry `json:"journal"`
+	RolledBack     []string                         `json:"rolledBack"`
+	Resources      []ResourceOutcome                `json:"resources,omitempty"`
+}
+
+func sampleList(list []string) []string {
+	if len(list) > StatusSampleSize {
+		return list[:StatusSampleSize]
+	}
+	return list
+}
+
+// uploadReport stores the report as a JSON object with retries.
+// Errors are permanent, the operation is not retried with lists already sampled.
+func uploadReport(ctx context.Context, report interface{}, name string, bucket objectstore.Objectstore) error {
+	content, err := json.Marshal(report)
+	if err != nil {
+		return backoff.Permanent(fmt.Errorf("Marshalling report failed : %s", err.Error()))
+	}
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = reportRetryElapsed
+	err = backoff.Retry(func() error {
+		err := bucket.Upload(ctx, bytes.NewReader(content), name)
+		if err != nil && objectstorePermError(err.Error()) {
+			return backoff.Permanent(err)
+		}
+		return err
+	}, backoff.WithContext(b, ctx))
+	if err != nil {
+		return backoff.Permanent(fmt.Errorf("Uploading report failed : %s", err.Error()))
+	}
+	return nil
+}
+
+// downloadReport reads the report JSON object
+func downloadReport(ctx context.Context, report interface{}, name string, bucket objectstore.Objectstore) error {
+	reportFile, err := ioutil.TempFile("", "report")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = reportFile.Close()
+		_ = os.Remove(reportFile.Name())
+	}()
+	err = bucket.Download(ctx, reportFile, name)
+	if err != nil {
+		return fmt.Errorf("Downloading report %s failed : %s", name, err.Error())
+	}
+	data, err := ioutil.ReadFile(reportFile.Name())
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, report)
+	if err != nil {
+		return fmt.Errorf("Unmarshalling report %s failed : %s", name, err.Error())
+	}
+	return nil
+}
+
+// UploadSnapshotReport stores contents of the snapshot as a report.
+// Only a sample is kept in the status, whether the report is uploaded or not.
+func UploadSnapshotReport(ctx context.Context, snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) error {
+	name := SnapshotReportName(snapshot.ObjectMeta.Name)
+	report := SnapshotReport{Name: snapshot.ObjectMeta.Name, Contents: snapshot.Status.Contents}
+	snapshot.Status.Contents = sampleList(snapshot.Status.Contents)
+	err := uploadReport(ctx, &report, name, bucket)
+	if err != nil {
+		return err
+	}
+	snapshot.Status.Report = &cbv1alpha1.ReportReference{ObjectstoreConfig: bucket.GetName(), Name: name}
+	return nil
+}
+
+// uploadRestoreReport stores lists and outcomes of resources of the restore as a report.
+// Lists are sampled and the journal cleared only when the report is uploaded, to keep the journal to rollback.
+func uploadRestoreReport(ctx context.Context, restore *cbv1alpha1.Restore, resources []ResourceOutcome,
+	bucket objectstore.Objectstore) error {
+	name := RestoreReportName(restore.ObjectMeta.Name)
+	s := &restore.Status
+	report := RestoreReport{
+		Name:           restore.ObjectMeta.Name,
+		Excluded:       s.Excluded,
+		Created:        s.Created,
+		Updated:        s.Updated,
+		AlreadyExisted: s.AlreadyExisted,
+		Failed:         s.Failed,
+		Converted:      s.Converted,
+		Journal:        s.Journal,
+		RolledBack:     s.RolledBack,
+		Resources:      resources,
+	}
+	err := uploadReport(ctx, &report, name, bucket)
+	if err != nil {
+		return err
+	}
+	s.Excluded = sampleList(s.Excluded)
+	s.Created = sampleList(s.Created)
+	s.Updated = sampleList(s.Updated)
+	s.AlreadyExisted = sampleList(s.AlreadyExisted)
+	s.Failed = sampleList(s.Failed)
+	s.Converted = sampleList(s.Converted)
+	s.RolledBack = sampleList(s.RolledBack)
+	// The whole journal is read from the report on rollback
+	s.Journal = nil
+	s.Report = &cbv1alpha1.ReportReference{ObjectstoreConfig: bucket.GetName(), Name: name}
+	if restore.Spec.JUnitReport {
+		junitName := RestoreJUnitReportName(restore.ObjectMeta.Name)
+		err = uploadJUnitReport(ctx, restore.ObjectMeta.Name, resources, junitName, bucket)
+		if err != nil {
+			return err
+		}
+		s.Report.JUnit = junitName
+	}
+	return nil
+}
+
+// JUnit XML of restore outcomes, a test case for each resource
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+}
+
+// uploadJUnitReport stores outcomes of resources as a JUnit XML.
+// Failed resources are failures, and excluded or already existing ones skipped.
+func uploadJUnitReport(ctx context.Context, restoreName string, resources []ResourceOutcome, name string,
+	bucket objectstore.Objectstore) error {
+	suite := junitTestSuite{Name: "restore:" + restoreName, Tests: len(resources)}
+	total := 0.0
+	for _, r := range resources {
+		tc := junitTestCase{Name: r.Path, ClassName: r.Stage, Time: fmt.Sprintf("%.3f", r.Seconds)}
+		switch r.Outcome {
+		case OutcomeFailed:
+			tc.Failure = &junitMessage{Message: r.Message}
+			suite.Failures++
+		case OutcomeExcluded, OutcomePreferenceExcluded, OutcomeAlreadyExisted:
+			msg := r.Outcome
+			if r.Message != "" {
+				msg += " : " + r.Message
+			} else if r.Rule != "" {
+				msg += " : " + r.Rule
+			}
+			tc.Skipped = &junitMessage{Message: msg}
+			suite.Skipped++
+		}
+		total += r.Seconds
+		suite.Cases = append(suite.Cases, tc)
+	}
+	suite.Time = fmt.Sprintf("%.3f", total)
+	content, err := xml.MarshalIndent(junitTestSuites{Suites: []junitTestSuite{suite}}, "", "  ")
+	if err != nil {
+		return backoff.Permanent(fmt.Errorf("Marshalling JUnit report failed : %s", err.Error()))
+	}
+	err = bucket.Upload(ctx, io.MultiReader(strings.NewReader(xml.Header), bytes.NewReader(content)), name)
+	if err != nil {
+		if objectstorePermError(err.Error()) {
+			return backoff.Permanent(fmt.Errorf("Uploading JUnit report failed : %s", err.Error()))
+		}
+		return fmt.Errorf("Uploading JUnit report failed : %s", err.Error())
+	}
+	return nil
+}
+
+// UploadSnapshotLog stores the log of the snapshot next to the archive and refers it in the status
+func UploadSnapshotLog(ctx context.Context, snapshot *cbv1alpha1.Snapshot, log []byte,
+	bucket objectstore.Objectstore) error {
+	name := SnapshotLogName(snapshot.ObjectMeta.Name)
+	err := bucket.Upload(ctx, bytes.NewReader(log), name)
+	if err != nil {
+		return fmt.Errorf("Uploading log failed : %s", err.Error())
+	}
+	snapshot.Status.Log = &cbv1alpha1.LogReference{ObjectstoreConfig: bucket.GetName(), Name: name}
+	return nil
+}
+
+// DownloadSnapshotLog reads the log of the snapshot uploaded next to the archive
+func DownloadSnapshotLog(ctx context.Context, snapshot *cbv1alpha1.Snapshot,
+	bucket objectstore.Objectstore) ([]byte, error) {
+	if snapshot.Status.Log == nil || snapshot.Status.Log.Name == "" {
+		return nil, fmt.Errorf("No log of snapshot %s in objectstore", snapshot.ObjectMeta.Name)
+	}
+	logFile, err := ioutil.TempFile("", "log")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = logFile.Close()
+		_ = os.Remove(logFile.Name())
+	}()
+	err = bucket.Download(ctx, logFile, snapshot.Status.Log.Name)
+	if err != nil {
+		return nil, fmt.Errorf("Downloading log %s failed : %s", snapshot.Status.Log.Name, err.Error())
+	}
+	return ioutil.ReadFile(logFile.Name())
+}
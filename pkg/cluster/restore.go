@@ -1,14 +1,15 @@
 package cluster
 
 import (
-	"archive/tar"
-	"compress/gzip"
 	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -53,26 +54,54 @@ func createItem(ctx context.Context, item *unstructured.Unstructured,
 	return dyn.Resource(gvr).Namespace(ns).Create(ctx, item, metav1.CreateOptions{})
 }
 
-func excludeWithMsg(restore *cbv1alpha1.Restore, rlog *utils.NamedLog, selflink, msg string) {
-	rlog.Infof("     [Excluded] %s", msg)
+func excludeWithMsg(ctx context.Context, restore *cbv1alpha1.Restore, rlog *utils.NamedLog, selflink, msg string) {
+	o := outcomesFrom(ctx)
+	o.record(selflink, OutcomeExcluded, msg)
+	defer o.lockStatus()()
+	rlog.Infof("     [Excluded] %s %s", selflink, msg)
 	restore.Status.NumExcluded++
 	restore.Status.Excluded = append(restore.Status.Excluded, selflink+",("+msg+")")
 }
 
-func alreadyExist(restore *cbv1alpha1.Restore, rlog *utils.NamedLog, selflink string) {
-	rlog.Info("     [Already exists]")
+func converted(ctx context.Context, restore *cbv1alpha1.Restore, rlog *utils.NamedLog, selflink, from string) {
+	o := outcomesFrom(ctx)
+	o.convert(selflink, from)
+	defer o.lockStatus()()
+	rlog.Infof("     [Converted] %s from %s", selflink, from)
+	restore.Status.NumConverted++
+	restore.Status.Converted = append(restore.Status.Converted, selflink+",("+from+")")
+}
+
+func alreadyExist(ctx context.Context, restore *cbv1alpha1.Restore, rlog *utils.NamedLog, selflink string) {
+	o := outcomesFrom(ctx)
+	o.record(selflink, OutcomeAlreadyExisted, "")
+	defer o.lockStatus()()
+	rlog.Infof("     [Already exists] %s", selflink)
 	restore.Status.NumAlreadyExisted++
 	restore.Status.AlreadyExisted = append(restore.Status.AlreadyExisted, selflink)
 }
 
-func created(restore *cbv1alpha1.Restore, rlog *utils.NamedLog, selflink string) {
-	rlog.Info("     [Created]")
+func created(ctx context.Context, restore *cbv1alpha1.Restore, rlog *utils.NamedLog, selflink string,
+	obj *unstructured.Unstructured) {
+	o := outcomesFrom(ctx)
+	o.record(selflink, OutcomeCreated, "")
+	defer o.lockStatus()()
+	rlog.Infof("     [Created] %s", selflink)
 	restore.Status.NumCreated++
 	restore.Status.Created = append(restore.Status.Created, selflink)
+	// Journal to rollback
+	entry := cbv1alpha1.RestoreJournalEntry{Path: selflink}
+	if obj != nil {
+		entry.UID = string(obj.GetUID())
+	}
+	restore.Status.Journal = append(restore.Status.Journal, entry)
 }
 
-func failedWithMsg(restore *cbv1alpha1.Restore, rlog *utils.NamedLog, selflink, msg string) {
-	rlog.Warningf("     [Failed] %s", msg)
+func failedWithMsg(ctx context.Context, restore *cbv1alpha1.Restore, rlog *utils.NamedLog, selflink, msg string) {
+	o := outcomesFrom(ctx)
+	o.record(selflink, OutcomeFailed, msg)
+	defer o.lockStatus()()
+	rlog.Warningf("     [Failed] %s %s", selflink, msg)
 	restore.Status.NumFailed++
 	if len(msg) > 300 {
 		restore.Status.Failed = append(restore.Status.Failed, selflink+","+msg[0:300]+".....")
@@ -81,6 +110,13 @@ func failedWithMsg(restore *cbv1alpha1.Restore, rlog *utils.NamedLog, selflink,
 	}
 }
 
+// restoreProgress reports resources with results recorded as done
+func restoreProgress(ctx context.Context, restore *cbv1alpha1.Restore) {
+	defer outcomesFrom(ctx).lockStatus()()
+	s := restore.Status
+	progressFrom(ctx).setDone(int(s.NumExcluded + s.NumCreated + s.NumUpdated + s.NumAlreadyExisted + s.NumFailed))
+}
+
 // Restore resources according to preferences.
 func restoreDir(ctx context.Context, dir, restorePref string, dyn dynamic.Interface, p *preference,
 	restore *cbv1alpha1.Restore, sr *ServerResources, rlog *utils.NamedLog) error {
@@ -89,135 +125,311 @@ func restoreDir(ctx context.Context, dir, restorePref string, dyn dynamic.Interf
 	if err != nil {
 		return err
 	}
+	// Resources selected in spec are restored as requested
+	selected := restorePref == "Selected"
+	// Resources held until owners restored in this stage
+	nodes := p.releaseHeld(restorePref, sr)
 	for _, f := range files {
 
 		// Load item
-		var item unstructured.Unstructured
-		err := loadItem(&item, filepath.Join(dir, restorePref, f.Name()))
+		item := &unstructured.Unstructured{}
+		err := loadItem(item, filepath.Join(dir, restorePref, f.Name()))
 		if err != nil {
 			return err
 		}
-		resourcePath, err := sr.ResourcePath(&item)
+
+		// Convert API version removed in the target cluster
+		from, convErr := convertAPIVersion(item, sr)
+		resourcePath, err := sr.ResourcePath(item)
 		if err != nil {
 			return err
 		}
+		// Preference rule matched to the resource
+		rule := "resources"
+		if !selected {
+			_, rule = p.preferenceRule(strings.Replace(f.Name(), "|", "/", -1))
+		}
+		outcomesFrom(ctx).setRule(resourcePath, rule)
+		if convErr != nil {
+			failedWithMsg(ctx, restore, rlog, resourcePath, "Conversion from "+from+" failed : "+convErr.Error())
+			continue
+		}
+		if from != "" {
+			converted(ctx, restore, rlog, resourcePath, from)
+		}
 
-		rlog.Infof("---- %s", resourcePath)
-
-		// Check owner
+		// Check owner, resources selected in spec are restored with owners rewritten unless stripped
 		owners := item.GetOwnerReferences()
+		rewriteOwners := false
 		if len(owners) > 0 {
-			excludeWithMsg(restore, rlog, resourcePath, "owner-ref")
-			for _, owner := range owners {
-				rlog.Infof("     owner : %s %s", owner.Kind, owner.Name)
+			policy := p.ownerReferencePolicy(item)
+			if selected && policy == OwnerReferenceSkip {
+				policy = OwnerReferenceRewrite
+			}
+			switch policy {
+			case OwnerReferenceStrip:
+				item.SetOwnerReferences(nil)
+			case OwnerReferenceRewrite:
+				rewriteOwners = true
+			default:
+				excludeWithMsg(ctx, restore, rlog, resourcePath, "owner-ref")
+				for _, owner := range owners {
+					rlog.Infof("     owner : %s %s", owner.Kind, owner.Name)
+				}
+				continue
 			}
-			continue
 		}
 
 		// Operation for each resources
 		switch item.GetKind() {
 		case "Secret":
 			if getUnstructuredString(item.Object, "type") == "kubernetes.io/service-account-token" {
-				excludeWithMsg(restore, rlog, resourcePath, "token-secret")
+				excludeWithMsg(ctx, restore, rlog, resourcePath, "token-secret")
+				continue
+			}
+			if isRedacted(item) && p.pref.Spec.RedactedSecrets != RedactedSecretsPlaceholder {
+				excludeWithMsg(ctx, restore, rlog, resourcePath, "redacted-secret")
 				continue
 			}
 		case "ClusterRole":
-			if !isInList(item.GetName(), p.includedClusterRoles) {
-				excludeWithMsg(restore, rlog, resourcePath, "not-binded-to-ns")
+			if !selected && !isInList(item.GetName(), p.includedClusterRoles) {
+				excludeWithMsg(ctx, restore, rlog, resourcePath, "not-binded-to-ns")
 				continue
 			}
 		case "ClusterRoleBinding":
-			if !isInList(item.GetName(), p.includedClusterRoleBindings) {
-				excludeWithMsg(restore, rlog, resourcePath, "not-binded-to-ns")
+			if !selected && !isInList(item.GetName(), p.includedClusterRoleBindings) {
+				excludeWithMsg(ctx, restore, rlog, resourcePath, "not-binded-to-ns")
 				continue
 			}
 		case "PersistentVolume":
 		case "PersistentVolumeClaim":
-			klog.Warningf("     Warning : Excluded : PVs/PVCs must not be included here")
-			continue
+			if !selected {
+				klog.Warningf("     Warning : Excluded : PVs/PVCs must not be included here")
+				continue
+			}
 		case "Endpoints":
 			if isInList(item.GetNamespace()+"/"+item.GetName(), p.serviceList) {
-				excludeWithMsg(restore, rlog, resourcePath, "service-exists")
+				excludeWithMsg(ctx, restore, rlog, resourcePath, "service-exists")
 				continue
 			}
 		}
 
-		// Restore item
-		item.SetResourceVersion("")
-		item.SetUID("")
-		_, err = createItem(ctx, &item, dyn, sr)
-		if err != nil {
-			//p.cntUpCnnotRestore(err.Error())
-			if strings.Contains(err.Error(), "already exists") {
-				alreadyExist(restore, rlog, resourcePath)
-			} else {
-				failedWithMsg(restore, rlog, resourcePath, err.Error())
+		node := newRestoreNode(f.Name(), resourcePath, item, sr)
+		node.rewriteOwners = rewriteOwners
+		if rewriteOwners && p.ownersLater(node, restorePref, sr) {
+			rlog.Infof("     [Held until owners restored] %s", resourcePath)
+			p.held = append(p.held, node)
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	restoreNodes(ctx, nodes, p, dyn, restore, sr, rlog)
+	restoreProgress(ctx, restore)
+	return ctx.Err()
+}
+
+// Number and interval of retries for resources failed for ordering reasons
+var maxRestoreRetries = 3
+var restoreRetryInterval = 2 * time.Second
+
+// Restore items in the order of dependencies.
+// Items in a level are independent of each other and restored concurrently.
+func restoreNodes(ctx context.Context, nodes []*restoreNode, p *preference, dyn dynamic.Interface,
+	restore *cbv1alpha1.Restore, sr *ServerResources, rlog *utils.NamedLog) {
+
+	levels := orderRestoreNodes(nodes)
+
+	// Retry items failed for ordering reasons while any item restored.
+	// The last try records the failures.
+	for retry := 0; len(levels) > 0; retry++ {
+		if retry > 0 {
+			rlog.Infof("Retrying resources (%d/%d)", retry, maxRestoreRetries)
+			select {
+			case <-time.After(restoreRetryInterval):
+			case <-ctx.Done():
+				return
+			}
+		}
+		final := retry == maxRestoreRetries
+		progress := false
+		deferred := make([][]*restoreNode, 0)
+		for _, level := range levels {
+			if ctx.Err() != nil {
+				rlog.Warningf("Restore cancelled : %s", ctx.Err().Error())
+				return
+			}
+			d := restoreLevel(ctx, level, p, dyn, restore, sr, rlog, final)
+			if len(d) < len(level) {
+				progress = true
+			}
+			if len(d) > 0 {
+				deferred = append(deferred, d)
+			}
+		}
+		if !progress {
+			// Go to the last try
+			retry = maxRestoreRetries - 1
+		}
+		levels = deferred
+	}
+}
+
+// restoreLevel restores items with a bounded worker pool and returns items deferred
+func restoreLevel(ctx context.Context, level []*restoreNode, p *preference, dyn dynamic.Interface,
+	restore *cbv1alpha1.Restore, sr *ServerResources, rlog *utils.NamedLog, final bool) []*restoreNode {
+
+	done := make([]bool, len(level))
+	indexCh := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < restoreConcurrency(p.pref); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexCh {
+				// Remaining items left when cancelled
+				if ctx.Err() != nil {
+					continue
+				}
+				done[index] = restoreNodeItem(ctx, level[index], p, dyn, restore, sr, rlog, final)
+				if done[index] {
+					restoreProgress(ctx, restore)
+				}
 			}
+		}()
+	}
+	for i := range level {
+		indexCh <- i
+	}
+	close(indexCh)
+	wg.Wait()
+
+	deferred := make([]*restoreNode, 0)
+	for i, n := range level {
+		if !done[i] {
+			deferred = append(deferred, n)
+		}
+	}
+	return deferred
+}
+
+// restoreNodeItem creates the resource and records the result.
+// It returns false without recording when the create failed for ordering reasons and not final.
+func restoreNodeItem(ctx context.Context, n *restoreNode, p *preference, dyn dynamic.Interface,
+	restore *cbv1alpha1.Restore, sr *ServerResources, rlog *utils.NamedLog, final bool) bool {
+
+	// Restore item
+	item := n.item.DeepCopy()
+	sanitizeItem(item, p)
+	if n.rewriteOwners {
+		dropped, err := rewriteOwnerReferences(ctx, item, p.uids, dyn, sr)
+		if err != nil {
+			failedWithMsg(ctx, restore, rlog, n.resourcePath, err.Error())
+			return true
+		}
+		for _, owner := range dropped {
+			rlog.Infof("     [Owner not existing] %s %s", n.resourcePath, owner)
+		}
+		outcomesFrom(ctx).dropOwners(n.resourcePath, dropped)
+	}
+	outcomesFrom(ctx).start(n.resourcePath)
+	obj, err := createItem(ctx, item, dyn, sr)
+	if err != nil {
+		//p.cntUpCnnotRestore(err.Error())
+		if strings.Contains(err.Error(), "already exists") {
+			alreadyExist(ctx, restore, rlog, n.resourcePath)
+		} else if !final && isOrderingError(err, n.deps) {
+			rlog.Infof("     [Retry] %s %s", n.resourcePath, err.Error())
+			return false
 		} else {
-			created(restore, rlog, resourcePath)
+			failedWithMsg(ctx, restore, rlog, n.resourcePath, err.Error())
 		}
+	} else {
+		p.uids.set(n.item.GetUID(), obj.GetUID())
+		created(ctx, restore, rlog, n.resourcePath, obj)
 	}
-	return nil
+	return true
 }
 
 // create a file
-func writeFile(filepath string, tarReader *tar.Reader) error {
+func writeFile(filepath string, reader io.Reader) error {
 	file, err := os.Create(filepath)
 	if err != nil {
 		return err
 	}
 	defer func() { _ = file.Close() }()
-	if _, err := io.Copy(file, tarReader); err != nil {
+	if _, err := io.Copy(file, reader); err != nil {
 		return err
 	}
 	return nil
 }
 
 // Restore k8s resources
-func Restore(restore *cbv1alpha1.Restore, pref *cbv1alpha1.RestorePreference, bucket objectstore.Objectstore) error {
+func Restore(ctx context.Context, restore *cbv1alpha1.Restore, pref *cbv1alpha1.RestorePreference,
+	bucket objectstore.Objectstore) error {
 	// download snapshot tgz
-	err := downloadSnapshot(restore, bucket)
+	err := downloadSnapshot(ctx, restore, bucket)
 	if err != nil {
 		return err
 	}
 
 	// kubeClient for external cluster.
-	kubeClient, err := buildKubeClient(restore.Spec.Kubeconfig)
+	kubeClient, err := buildKubeClient(ctx, restore.Spec.Kubeconfig)
 	if err != nil {
 		return err
 	}
 
 	// DynamicClient for external cluster.
-	dynamicClient, err := buildDynamicClient(restore.Spec.Kubeconfig)
+	qps, burst := restoreClientQPS(pref)
+	dynamicClient, err := buildDynamicClient(restore.Spec.Kubeconfig, qps, burst)
+	if err != nil {
+		return err
+	}
+
+	// Executor for hooks in target cluster pods
+	executor, err := buildPodExecutor(restore.Spec.Kubeconfig, kubeClient)
 	if err != nil {
 		return err
 	}
 
-	return restoreResources(restore, pref, kubeClient, dynamicClient)
+	return restoreWithReport(ctx, restore, pref, kubeClient, dynamicClient, executor, bucket)
+}
+
+// restoreWithReport restores resources and uploads the report, also when the restore is cancelled or timed out
+func restoreWithReport(ctx context.Context, restore *cbv1alpha1.Restore, pref *cbv1alpha1.RestorePreference,
+	kubeClient kubernetes.Interface, dynamicClient dynamic.Interface, executor PodExecutor,
+	bucket objectstore.Objectstore) error {
+
+	ctx, outcomes := withOutcomes(ctx)
+	err := restoreResources(ctx, restore, pref, kubeClient, dynamicClient, executor)
+
+	// Lists only in the report, the restore fails without it.
+	// Uploaded apart from the operation context, which is done when the restore cancelled or timed out.
+	reportCtx, cancel := context.WithTimeout(context.Background(), reportTimeout)
+	defer cancel()
+	rerr := uploadRestoreReport(reportCtx, restore, outcomes.list(), bucket)
+	if err == nil {
+		err = rerr
+	}
+	return err
 }
 
-func downloadSnapshot(restore *cbv1alpha1.Restore, bucket objectstore.Objectstore) error {
+func downloadSnapshot(ctx context.Context, restore *cbv1alpha1.Restore, bucket objectstore.Objectstore) error {
 	// Restore log
 	rlog := utils.NewNamedLog("restore:" + restore.ObjectMeta.Name)
 
 	// Download
-	rlog.Infof("Downloading file %s", restore.Spec.SnapshotName+".tgz")
-	snapshotFile, err := os.Create("/tmp/" + restore.Spec.SnapshotName + ".tgz")
-	defer func() { _ = snapshotFile.Close() }()
-	if err != nil {
-		return err
-	}
-	return bucket.Download(snapshotFile, restore.Spec.SnapshotName+".tgz")
+	rlog.Infof("Downloading snapshot %s", restore.Spec.SnapshotName)
+	progressFrom(ctx).stage(StageDownloading, 0)
+	return DownloadSnapshotArchive(ctx, restore.Spec.SnapshotName, bucket)
 }
 
 func restoreResources(
+	ctx context.Context,
 	restore *cbv1alpha1.Restore,
 	pref *cbv1alpha1.RestorePreference,
 	kubeClient kubernetes.Interface,
-	dynamicClient dynamic.Interface) error {
-
-	// context for restore
-	ctx := context.TODO()
+	dynamicClient dynamic.Interface,
+	executor PodExecutor) error {
 
 	// Restore log
 	rlog := utils.NewNamedLog("restore:" + restore.ObjectMeta.Name)
@@ -231,6 +443,20 @@ func restoreResources(
 	sr := newServerResources(spr)
 
 	p := newPreference(pref)
+	err = p.validate()
+	if err != nil {
+		return err
+	}
+	err = validateResources(restore.Spec.Resources)
+	if err != nil {
+		return err
+	}
+
+	// Resource version marker
+	marker, err := newRestoreMarker(restore, kubeClient)
+	if err != nil {
+		return err
+	}
 
 	// Initialize restore status
 	restore.Status.NumPreferenceExcluded = 0
@@ -244,63 +470,81 @@ func restoreResources(
 	restore.Status.Updated = nil
 	restore.Status.AlreadyExisted = nil
 	restore.Status.Failed = nil
-
-	// Read tar.gz
-	snapshotFile, err := os.Open("/tmp/" + restore.Spec.SnapshotName + ".tgz")
-	if err != nil {
-		return err
-	}
-	tgz, err := gzip.NewReader(snapshotFile)
-	if err != nil {
-		return err
-	}
-	defer func() { _ = tgz.Close() }()
-
-	tarReader := tar.NewReader(tgz)
+	restore.Status.NumConverted = 0
+	restore.Status.Converted = nil
+	restore.Status.Workloads = nil
+	restore.Status.HookResults = nil
+	restore.Status.Journal = nil
+	restore.Status.RolledBack = nil
+	restore.Status.NumRolledBack = 0
 
 	dir, err := ioutil.TempDir("", "")
 	if err != nil {
 		return err
 	}
+	defer func() { _ = os.RemoveAll(dir) }()
 
+	// Outcomes recorded and status locked for each restore
+	outcomes := outcomesFrom(ctx)
+	if outcomes == nil {
+		ctx, outcomes = withOutcomes(ctx)
+	}
+	outcomes.setStage("Extract")
 	rlog.Info("Extract files in snapshot tgz :")
-	for {
-		header, err := tarReader.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
-		if header.Typeflag == tar.TypeReg {
-			path := strings.Replace(header.Name, restore.Spec.SnapshotName, "", 1)
-
-			if path == "/snapshot.json" {
-				klog.Infof("-- [Snapshot resource file] %s", path)
-				continue
-			}
-
-			restorePref := p.preferedToRestore(path)
-			if restorePref == "Exclude" {
-				rlog.Infof("-- [%s] %s", restorePref, path)
-				//p.cntUpExcluded()
-				restore.Status.NumPreferenceExcluded++
-				continue
+	numEntries := 0
+	numSelected := 0
+	numExtracted := 0
+	// Stream tar.gz entries to files, with the reader for its format version
+	archive, err := StreamSnapshotArchive(restore.Spec.SnapshotName,
+		"/tmp/"+restore.Spec.SnapshotName+ArchiveSuffix, func(entryPath string, content io.Reader) error {
+			numEntries++
+
+			// Resources selected in spec bypass preference and restore steps
+			var restorePref string
+			if len(restore.Spec.Resources) > 0 {
+				if !isSelected(strings.TrimSuffix(entryPath, ".json"), restore.Spec.Resources) {
+					return nil
+				}
+				rlog.Infof("-- [Selected] %s", entryPath)
+				numSelected++
+				restorePref = "Selected"
+			} else {
+				var rule string
+				restorePref, rule = p.preferenceRule(entryPath)
+				if restorePref == "Exclude" {
+					rlog.Infof("-- [%s] %s", restorePref, entryPath)
+					//p.cntUpExcluded()
+					restore.Status.NumPreferenceExcluded++
+					path := strings.TrimSuffix(entryPath, ".json")
+					outcomes.setRule(path, rule)
+					outcomes.record(path, OutcomePreferenceExcluded, "")
+					return nil
+				}
 			}
 
 			// create dir
-			fullpath := filepath.Join(dir, restorePref, strings.Replace(path, "/", "|", -1))
-			err := os.MkdirAll(filepath.Dir(fullpath), header.FileInfo().Mode())
+			fullpath := filepath.Join(dir, restorePref, strings.Replace(entryPath, "/", "|", -1))
+			err := os.MkdirAll(filepath.Dir(fullpath), 0755)
 			if err != nil {
 				return err
 			}
 
 			// create file
-			err = writeFile(fullpath, tarReader)
+			err = writeFile(fullpath, content)
 			if err != nil {
 				return err
 			}
-		}
+			numExtracted++
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	rlog.Infof("Snapshot archive format version : %d", archive.FormatVersion)
+	progressFrom(ctx).stage(StageRestoring, numExtracted)
+
+	if len(restore.Spec.Resources) > 0 {
+		rlog.Infof("Selected %d of %d resources", numSelected, numEntries)
 	}
 
 	// Initialize preference
@@ -308,10 +552,15 @@ func restoreResources(
 	if err != nil {
 		return err
 	}
+	err = p.indexStages(dir)
+	if err != nil {
+		return err
+	}
 
 	// Restore namespaces
 	if p.isIn("Namespace") {
 		rlog.Info("Restore Namespaces :")
+		outcomes.setStage("Namespace")
 		err = restoreDir(ctx, dir, "Namespace", dynamicClient, p, restore, sr, rlog)
 		if err != nil {
 			return err
@@ -320,6 +569,7 @@ func restoreResources(
 	// Restore CRDs
 	if p.isIn("CRD") {
 		rlog.Info("Restore CRDs :")
+		outcomes.setStage("CRD")
 		err = restoreDir(ctx, dir, "CRD", dynamicClient, p, restore, sr, rlog)
 		if err != nil {
 			return err
@@ -334,6 +584,7 @@ func restoreResources(
 	// Restore PV/PVC
 	if p.isIn("PV") && p.isIn("PVC") {
 		rlog.Info("Restore PV/PVC :")
+		outcomes.setStage("PV")
 		err = restorePV(ctx, dir, dynamicClient, p, restore, sr, rlog)
 		if err != nil {
 			return err
@@ -342,6 +593,7 @@ func restoreResources(
 	// Other resources
 	if p.isIn("Restore") {
 		rlog.Info("Restore resources except Apps :")
+		outcomes.setStage("Restore")
 		err = restoreDir(ctx, dir, "Restore", dynamicClient, p, restore, sr, rlog)
 		if err != nil {
 			return err
@@ -350,37 +602,52 @@ func restoreResources(
 	// Restore apps
 	if p.isIn("App") {
 		rlog.Info("Restore Apps :")
+		outcomes.setStage("App")
 		err = restoreDir(ctx, dir, "App", dynamicClient, p, restore, sr, rlog)
 		if err != nil {
 			return err
 		}
 	}
-	// Remove tmp files
-	err = os.RemoveAll(dir)
+	// Restore resources selected in spec
+	if p.isIn("Selected") {
+		rlog.Info("Restore selected resources :")
+		outcomes.setStage("Selected")
+		err = restoreDir(ctx, dir, "Selected", dynamicClient, p, restore, sr, rlog)
+		if err != nil {
+			return err
+		}
+	}
+	// Wait for restored workloads
+	if restore.Spec.ReadinessTimeout.Duration > 0 {
+		waitForWorkloads(ctx, restore, dynamicClient, rlog)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+
+	// Post-restore hooks
+	err = runRestoreHooks(ctx, restore, kubeClient, executor, rlog)
 	if err != nil {
 		return err
 	}
 
-	// Generate marker name
-	markerName := "resource-version-marker-" + utils.RandString(10)
-
 	// Get end resource version
-	marker, err := ConfigMapMarker(ctx, kubeClient, markerName)
+	mark, err := marker.mark(ctx)
 	if err != nil {
-		return err
+		return fmt.Errorf("Making end resource version marker failed : %s", err.Error())
 	}
 
 	// Timestamp and resource version
-	restore.Status.RestoreTimestamp = marker.ObjectMeta.CreationTimestamp
+	restore.Status.RestoreTimestamp = mark.Timestamp
 	// Set expiration
 	if restore.Spec.AvailableUntil.IsZero() {
-		restore.Status.AvailableUntil = metav1.NewTime(marker.ObjectMeta.CreationTimestamp.Add(restore.Spec.TTL.Duration))
+		restore.Status.AvailableUntil = metav1.NewTime(mark.Timestamp.Add(restore.Spec.TTL.Duration))
 		restore.Status.TTL = restore.Spec.TTL
 	} else {
 		restore.Status.AvailableUntil = restore.Spec.AvailableUntil
 		restore.Status.TTL.Duration = restore.Status.AvailableUntil.Time.Sub(restore.Status.RestoreTimestamp.Time)
 	}
-	restore.Status.RestoreResourceVersion = marker.ObjectMeta.ResourceVersion
+	restore.Status.RestoreResourceVersion = mark.ResourceVersion
 
 	// result
 	rlog.Info("Restore completed")
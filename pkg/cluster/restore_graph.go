@@ -0,0 +1,423 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+)
+
+// restoreNode is a resource to create on restore
+type restoreNode struct {
+	file         string
+	resourcePath string
+	item         *unstructured.Unstructured
+	// Keys of resources this resource refers to
+	deps []string
+	// Rewrite owner references to restored owners
+	rewriteOwners bool
+}
+
+// nodeKey returns the key to refer a resource in the dependency graph
+func nodeKey(kind, namespace, name string) string {
+	return kind + "/" + namespace + "/" + name
+}
+
+func newRestoreNode(file, resourcePath string, item *unstructured.Unstructured, sr *ServerResources) *restoreNode {
+	return &restoreNode{
+		file:         file,
+		resourcePath: resourcePath,
+		item:         item,
+		deps:         itemDependencies(item, sr),
+	}
+}
+
+func (n *restoreNode) key() string {
+	return nodeKey(n.item.GetKind(), n.item.GetNamespace(), n.item.GetName())
+}
+
+// Paths to pod specs in workload resources
+var podSpecPaths = map[string][]string{
+	"Pod":                   {"spec"},
+	"Deployment":            {"spec", "template", "spec"},
+	"StatefulSet":           {"spec", "template", "spec"},
+	"DaemonSet":             {"spec", "template", "spec"},
+	"ReplicaSet":            {"spec", "template", "spec"},
+	"ReplicationController": {"spec", "template", "spec"},
+	"Job":                   {"spec", "template", "spec"},
+	"CronJob":               {"spec", "jobTemplate", "spec", "template", "spec"},
+}
+
+// ownerKeys returns keys of owners of the resource
+func (n *restoreNode) ownerKeys(sr *ServerResources) []string {
+	keys := make([]string, 0)
+	for _, owner := range n.item.GetOwnerReferences() {
+		keys = append(keys, nodeKey(owner.Kind, ownerNamespace(owner, n.item.GetNamespace(), sr), owner.Name))
+	}
+	return keys
+}
+
+// ownerNamespace returns the namespace of the owner, empty for cluster scoped owners.
+// Owners of namespaced resources are in the same namespace or cluster scoped.
+func ownerNamespace(owner metav1.OwnerReference, namespace string, sr *ServerResources) string {
+	if namespace == "" || sr == nil {
+		return namespace
+	}
+	gv, err := schema.ParseGroupVersion(owner.APIVersion)
+	if err != nil {
+		return namespace
+	}
+	gvk := gv.WithKind(owner.Kind)
+	if _, err := sr.ResourceName(gvk); err == nil && !sr.namespaced(gvk) {
+		return ""
+	}
+	return namespace
+}
+
+// itemDependencies returns keys of resources referred from the resource
+func itemDependencies(item *unstructured.Unstructured, sr *ServerResources) []string {
+	deps := make([]string, 0)
+	namespace := item.GetNamespace()
+	add := func(kind, ns, name string) {
+		if name != "" {
+			deps = append(deps, nodeKey(kind, ns, name))
+		}
+	}
+
+	add("Namespace", "", namespace)
+	for _, owner := range item.GetOwnerReferences() {
+		add(owner.Kind, ownerNamespace(owner, namespace, sr), owner.Name)
+	}
+
+	if path, ok := podSpecPaths[item.GetKind()]; ok {
+		spec, found, _ := unstructured.NestedMap(item.Object, path...)
+		if found {
+			podSpecDependencies(spec, namespace, add)
+		}
+	}
+
+	switch item.GetKind() {
+	case "ValidatingWebhookConfiguration", "MutatingWebhookConfiguration":
+		for _, w := range getUnstructuredSlice(item.Object, "webhooks") {
+			webhook, ok := w.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			service, _, _ := unstructured.NestedMap(webhook, "clientConfig", "service")
+			add("Service", getUnstructuredString(service, "namespace"), getUnstructuredString(service, "name"))
+		}
+	case "APIService":
+		service, _, _ := unstructured.NestedMap(item.Object, "spec", "service")
+		add("Service", getUnstructuredString(service, "namespace"), getUnstructuredString(service, "name"))
+	case "RoleBinding", "ClusterRoleBinding":
+		roleRef := getUnstructuredMap(item.Object, "roleRef")
+		if getUnstructuredString(roleRef, "kind") == "Role" {
+			add("Role", namespace, getUnstructuredString(roleRef, "name"))
+		} else {
+			add(getUnstructuredString(roleRef, "kind"), "", getUnstructuredString(roleRef, "name"))
+		}
+		for _, s := range getUnstructuredSlice(item.Object, "subjects") {
+			subject, ok := s.(map[string]interface{})
+			if ok && getUnstructuredString(subject, "kind") == "ServiceAccount" {
+				add("ServiceAccount", getUnstructuredString(subject, "namespace"), getUnstructuredString(subject, "name"))
+			}
+		}
+	}
+	return deps
+}
+
+// podSpecDependencies adds resources referred from a pod spec
+func podSpecDependencies(spec map[string]interface{}, namespace string, add func(kind, ns, name string)) {
+	add("ServiceAccount", namespace, getUnstructuredString(spec, "serviceAccountName"))
+	for _, s := range getUnstructuredSlice(spec, "imagePullSecrets") {
+		if secret, ok := s.(map[string]interface{}); ok {
+			add("Secret", namespace, getUnstructuredString(secret, "name"))
+		}
+	}
+
+	for _, v := range getUnstructuredSlice(spec, "volumes") {
+		volume, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		add("ConfigMap", namespace, getUnstructuredString(getUnstructuredMap(volume, "configMap"), "name"))
+		add("Secret", namespace, getUnstructuredString(getUnstructuredMap(volume, "secret"), "secretName"))
+		add("PersistentVolumeClaim", namespace,
+			getUnstructuredString(getUnstructuredMap(volume, "persistentVolumeClaim"), "claimName"))
+		sources, _, _ := unstructured.NestedSlice(volume, "projected", "sources")
+		for _, s := range sources {
+			source, ok := s.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			add("ConfigMap", namespace, getUnstructuredString(getUnstructuredMap(source, "configMap"), "name"))
+			add("Secret", namespace, getUnstructuredString(getUnstructuredMap(source, "secret"), "name"))
+		}
+	}
+
+	containers := append(getUnstructuredSlice(spec, "initContainers"), getUnstructuredSlice(spec, "containers")...)
+	for _, c := range containers {
+		container, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, e := range getUnstructuredSlice(container, "envFrom") {
+			envFrom, ok := e.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			add("ConfigMap", namespace, getUnstructuredString(getUnstructuredMap(envFrom, "configMapRef"), "name"))
+			add("Secret", namespace, getUnstructuredString(getUnstructuredMap(envFrom, "secretRef"), "name"))
+		}
+		for _, e := range getUnstructuredSlice(container, "env") {
+			env, ok := e.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			valueFrom := getUnstructuredMap(env, "valueFrom")
+			add("ConfigMap", namespace, getUnstructuredString(getUnstructuredMap(valueFrom, "configMapKeyRef"), "name"))
+			add("Secret", namespace, getUnstructuredString(getUnstructuredMap(valueFrom, "secretKeyRef"), "name"))
+		}
+	}
+}
+
+// Stages restored in order with the dependency graph
+var graphStages = []string{"Namespace", "CRD", "Restore", "App", "Selected"}
+
+func stageIndex(stage string) int {
+	for i, s := range graphStages {
+		if s == stage {
+			return i
+		}
+	}
+	return -1
+}
+
+// indexStages records stages of all resources to restore.
+// Resources are held until their owners restored in later stages.
+func (p *preference) indexStages(dir string) error {
+	p.stages = make(map[string]int)
+	p.held = nil
+	for i, stage := range graphStages {
+		if !p.isIn(stage) {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(dir, stage))
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			item := &unstructured.Unstructured{}
+			err := loadItem(item, filepath.Join(dir, stage, f.Name()))
+			if err != nil {
+				return err
+			}
+			p.stages[nodeKey(item.GetKind(), item.GetNamespace(), item.GetName())] = i
+		}
+	}
+	return nil
+}
+
+// ownersLater returns true when an owner of the resource is restored in a stage after the stage
+func (p *preference) ownersLater(n *restoreNode, stage string, sr *ServerResources) bool {
+	index := stageIndex(stage)
+	for _, key := range n.ownerKeys(sr) {
+		if s, ok := p.stages[key]; ok && s > index {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseHeld returns resources held with owners restored in the stage
+func (p *preference) releaseHeld(stage string, sr *ServerResources) []*restoreNode {
+	released := make([]*restoreNode, 0)
+	held := make([]*restoreNode, 0)
+	for _, n := range p.held {
+		if p.ownersLater(n, stage, sr) {
+			held = append(held, n)
+		} else {
+			released = append(released, n)
+		}
+	}
+	p.held = held
+	return released
+}
+
+// orderRestoreNodes sorts resources topologically into levels.
+// Resources in a level refer only to resources in former levels or not to restore.
+// Resources in a dependency cycle are put in the last level.
+func orderRestoreNodes(nodes []*restoreNode) [][]*restoreNode {
+	byKey := make(map[string]*restoreNode)
+	for _, n := range nodes {
+		byKey[n.key()] = n
+	}
+
+	// Count dependencies to restore with this
+	indegree := make(map[*restoreNode]int)
+	dependents := make(map[*restoreNode][]*restoreNode)
+	for _, n := range nodes {
+		seen := make(map[string]bool)
+		for _, dep := range n.deps {
+			d, ok := byKey[dep]
+			if !ok || d == n || seen[dep] {
+				continue
+			}
+			seen[dep] = true
+			indegree[n]++
+			dependents[d] = append(dependents[d], n)
+		}
+	}
+
+	levels := make([][]*restoreNode, 0)
+	level := make([]*restoreNode, 0)
+	for _, n := range nodes {
+		if indegree[n] == 0 {
+			level = append(level, n)
+		}
+	}
+	done := 0
+	for len(level) > 0 {
+		sort.Slice(level, func(i, j int) bool { return level[i].file < level[j].file })
+		levels = append(levels, level)
+		done += len(level)
+		next := make([]*restoreNode, 0)
+		for _, n := range level {
+			for _, d := range dependents[n] {
+				indegree[d]--
+				if indegree[d] == 0 {
+					next = append(next, d)
+				}
+			}
+		}
+		level = next
+	}
+
+	// Dependency cycles
+	if done < len(nodes) {
+		cycle := make([]*restoreNode, 0)
+		for _, n := range nodes {
+			if indegree[n] > 0 {
+				cycle = append(cycle, n)
+			}
+		}
+		sort.Slice(cycle, func(i, j int) bool { return cycle[i].file < cycle[j].file })
+		levels = append(levels, cycle)
+	}
+	return levels
+}
+
+// uidMap maps UIDs of resources in snapshot to UIDs of restored ones
+type uidMap struct {
+	lock sync.Mutex
+	uids map[types.UID]types.UID
+}
+
+func newUIDMap() *uidMap {
+	return &uidMap{uids: make(map[types.UID]types.UID)}
+}
+
+func (m *uidMap) set(old, new types.UID) {
+	if old == "" {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.uids[old] = new
+}
+
+func (m *uidMap) get(old types.UID) (types.UID, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	uid, ok := m.uids[old]
+	return uid, ok
+}
+
+// rewriteOwnerReferences points owner references to restored owners, or to owners existing in the cluster.
+// References to owners not existing are removed.
+func rewriteOwnerReferences(ctx context.Context, item *unstructured.Unstructured, uids *uidMap,
+	dyn dynamic.Interface, sr *ServerResources) ([]string, error) {
+
+	dropped := make([]string, 0)
+	owners := make([]metav1.OwnerReference, 0)
+	for _, owner := range item.GetOwnerReferences() {
+		uid, ok := uids.get(owner.UID)
+		if !ok {
+			live, err := liveOwner(ctx, owner, item.GetNamespace(), dyn, sr)
+			if err != nil {
+				return nil, fmt.Errorf("Getting owner %s/%s failed : %s", owner.Kind, owner.Name, err.Error())
+			}
+			if live == nil {
+				dropped = append(dropped, owner.Kind+"/"+owner.Name)
+				continue
+			}
+			uid = live.GetUID()
+			uids.set(owner.UID, uid)
+		}
+		owner.UID = uid
+		owners = append(owners, owner)
+	}
+	item.SetOwnerReferences(owners)
+	return dropped, nil
+}
+
+// liveOwner gets the owner existing in the cluster, nil when not existing
+func liveOwner(ctx context.Context, owner metav1.OwnerReference, namespace string,
+	dyn dynamic.Interface, sr *ServerResources) (*unstructured.Unstructured, error) {
+
+	gv, err := schema.ParseGroupVersion(owner.APIVersion)
+	if err != nil {
+		return nil, err
+	}
+	gvk := gv.WithKind(owner.Kind)
+	resource, err := sr.ResourceName(gvk)
+	if err != nil {
+		// Kind not served, no owner in the cluster
+		return nil, nil
+	}
+	var live *unstructured.Unstructured
+	if ns := ownerNamespace(owner, namespace, sr); ns != "" {
+		live, err = dyn.Resource(gv.WithResource(resource)).Namespace(ns).Get(ctx, owner.Name, metav1.GetOptions{})
+	} else {
+		live, err = dyn.Resource(gv.WithResource(resource)).Get(ctx, owner.Name, metav1.GetOptions{})
+	}
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	return live, err
+}
+
+// Messages of errors caused by webhook services not restored yet
+var orderingErrors = []string{
+	"failed calling webhook",
+	"no endpoints available for service",
+}
+
+// isOrderingError returns true when the create may succeed after other resources are restored.
+// Not found errors are only of resources the resource refers to, such as its namespace or owners.
+func isOrderingError(err error, deps []string) bool {
+	for _, e := range orderingErrors {
+		if strings.Contains(err.Error(), e) {
+			return true
+		}
+	}
+	msg := strings.ToLower(err.Error())
+	for _, dep := range deps {
+		// Keys are kind/namespace/name
+		p := strings.SplitN(dep, "/", 3)
+		if strings.Contains(msg, strings.ToLower(p[0])) && strings.Contains(msg, "\""+p[2]+"\" not found") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,247 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/utils"
+)
+
+// Interval to check restored workloads and hook jobs
+var readinessPollInterval = 2 * time.Second
+
+// runRestoreHooks executes post-restore hooks and records results in the restore status
+func runRestoreHooks(ctx context.Context, restore *cbv1alpha1.Restore,
+	kubeClient kubernetes.Interface, executor PodExecutor, rlog *utils.NamedLog) error {
+
+	for _, hook := range restore.Spec.PostHooks {
+		var results []cbv1alpha1.HookResult
+		var err error
+		if hook.Job != nil {
+			results, err = jobHook(ctx, restore, hook, kubeClient, rlog)
+		} else {
+			results, err = execHook(ctx, cbv1alpha1.SnapshotHook{
+				Name:      hook.Name,
+				Namespace: hook.Namespace,
+				Selector:  hook.Selector,
+				Container: hook.Container,
+				Command:   hook.Command,
+				Timeout:   hook.Timeout,
+				OnError:   hook.OnError,
+			}, HookPhasePostRestore, kubeClient, executor, rlog)
+		}
+		restore.Status.HookResults = append(restore.Status.HookResults, results...)
+		err = hookError(hook.Name, hook.OnError, err, rlog)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jobHook creates a job from the hook and waits for it to finish
+func jobHook(ctx context.Context, restore *cbv1alpha1.Restore, hook cbv1alpha1.RestoreHook,
+	kubeClient kubernetes.Interface, rlog *utils.NamedLog) ([]cbv1alpha1.HookResult, error) {
+
+	err := validateOnError(hook.OnError)
+	if err != nil {
+		return nil, err
+	}
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: restore.ObjectMeta.Name + "-" + hook.Name + "-",
+			Namespace:    hook.Namespace,
+		},
+		Spec: *hook.Job.DeepCopy(),
+	}
+	if job.Spec.Template.Spec.RestartPolicy == "" {
+		job.Spec.Template.Spec.RestartPolicy = corev1.RestartPolicyNever
+	}
+	job, err = kubeClient.BatchV1().Jobs(hook.Namespace).Create(ctx, job, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Creating job failed : %s", err.Error())
+	}
+	rlog.Infof("Running %s hook %s in job %s/%s", HookPhasePostRestore, hook.Name, job.Namespace, job.Name)
+
+	result := cbv1alpha1.HookResult{
+		Name:  hook.Name,
+		Phase: HookPhasePostRestore,
+		Job:   job.Namespace + "/" + job.Name,
+	}
+	jobCtx, cancel := context.WithTimeout(ctx, hookTimeout(hook.Timeout))
+	defer cancel()
+	for {
+		job, err = kubeClient.BatchV1().Jobs(job.Namespace).Get(jobCtx, job.Name, metav1.GetOptions{})
+		if err == nil {
+			if ok, reason := jobFinished(job); ok {
+				if reason != "" {
+					result.ExitCode = -1
+					result.Error = reason
+					return []cbv1alpha1.HookResult{result}, fmt.Errorf("%s in job %s", reason, result.Job)
+				}
+				return []cbv1alpha1.HookResult{result}, nil
+			}
+		}
+		select {
+		case <-time.After(readinessPollInterval):
+		case <-jobCtx.Done():
+			result.ExitCode = -1
+			result.Error = "Timeout waiting job"
+			return []cbv1alpha1.HookResult{result}, fmt.Errorf("Timeout waiting job %s", result.Job)
+		}
+	}
+}
+
+// jobFinished returns true when the job completed or failed, with the reason of failure
+func jobFinished(job *batchv1.Job) (bool, string) {
+	for _, c := range job.Status.Conditions {
+		if c.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch c.Type {
+		case batchv1.JobComplete:
+			return true, ""
+		case batchv1.JobFailed:
+			return true, "Job failed : " + c.Reason
+		}
+	}
+	return false, ""
+}
+
+// Workload resources to wait for on restore
+var workloadResources = map[string]bool{
+	"apps/deployments":  true,
+	"apps/statefulsets": true,
+	"apps/daemonsets":   true,
+	"batch/jobs":        true,
+}
+
+// workloadFromPath returns resource and name of a workload from an API path
+func workloadFromPath(path string) (schema.GroupVersionResource, string, string, bool) {
+	gvr, namespace, name, err := resourceFromPath(path)
+	if err != nil || namespace == "" || !workloadResources[gvr.Group+"/"+gvr.Resource] {
+		return schema.GroupVersionResource{}, "", "", false
+	}
+	return gvr, namespace, name, true
+}
+
+// waitForWorkloads waits restored workloads to be ready until the readiness timeout
+func waitForWorkloads(ctx context.Context, restore *cbv1alpha1.Restore,
+	dyn dynamic.Interface, rlog *utils.NamedLog) {
+
+	type workload struct {
+		gvr       schema.GroupVersionResource
+		namespace string
+		name      string
+		index     int
+	}
+	pending := make([]workload, 0)
+	restore.Status.Workloads = nil
+	for _, path := range restore.Status.Created {
+		gvr, namespace, name, ok := workloadFromPath(path)
+		if !ok {
+			continue
+		}
+		pending = append(pending, workload{gvr, namespace, name, len(restore.Status.Workloads)})
+		restore.Status.Workloads = append(restore.Status.Workloads, cbv1alpha1.WorkloadReadiness{Path: path})
+	}
+	if len(pending) == 0 {
+		return
+	}
+	rlog.Infof("Waiting %d workloads to be ready", len(pending))
+
+	waitCtx, cancel := context.WithTimeout(ctx, restore.Spec.ReadinessTimeout.Duration)
+	defer cancel()
+	for {
+		notReady := make([]workload, 0)
+		for _, w := range pending {
+			status := &restore.Status.Workloads[w.index]
+			obj, err := dyn.Resource(w.gvr).Namespace(w.namespace).Get(waitCtx, w.name, metav1.GetOptions{})
+			if err != nil {
+				status.Reason = err.Error()
+				notReady = append(notReady, w)
+				continue
+			}
+			ready, finished, reason := workloadReady(obj)
+			status.Ready = ready
+			status.Reason = reason
+			if ready {
+				rlog.Infof("-- [Ready] %s", status.Path)
+			} else if finished {
+				rlog.Warningf("-- [Failed] %s : %s", status.Path, reason)
+			} else {
+				notReady = append(notReady, w)
+			}
+		}
+		pending = notReady
+		if len(pending) == 0 {
+			return
+		}
+		select {
+		case <-time.After(readinessPollInterval):
+		case <-waitCtx.Done():
+			for _, w := range pending {
+				rlog.Warningf("-- [Not ready] %s : %s", restore.Status.Workloads[w.index].Path,
+					restore.Status.Workloads[w.index].Reason)
+			}
+			return
+		}
+	}
+}
+
+// workloadReady checks status of a workload.
+// finished is true when the workload never gets ready, e.g. a failed job.
+func workloadReady(obj *unstructured.Unstructured) (ready, finished bool, reason string) {
+	replicas, found, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+	if !found {
+		replicas = 1
+	}
+	status := func(field string) int64 {
+		v, _, _ := unstructured.NestedInt64(obj.Object, "status", field)
+		return v
+	}
+	if status("observedGeneration") < obj.GetGeneration() {
+		return false, false, "Generation not observed"
+	}
+
+	switch obj.GetKind() {
+	case "Deployment":
+		if status("updatedReplicas") < replicas || status("availableReplicas") < replicas {
+			return false, false, fmt.Sprintf("%d of %d replicas available", status("availableReplicas"), replicas)
+		}
+	case "StatefulSet":
+		if status("readyReplicas") < replicas {
+			return false, false, fmt.Sprintf("%d of %d replicas ready", status("readyReplicas"), replicas)
+		}
+	case "DaemonSet":
+		if status("numberReady") < status("desiredNumberScheduled") {
+			return false, false, fmt.Sprintf("%d of %d pods ready", status("numberReady"), status("desiredNumberScheduled"))
+		}
+	case "Job":
+		conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+		for _, c := range conditions {
+			condition, ok := c.(map[string]interface{})
+			if !ok || getUnstructuredString(condition, "status") != string(corev1.ConditionTrue) {
+				continue
+			}
+			switch getUnstructuredString(condition, "type") {
+			case string(batchv1.JobComplete):
+				return true, true, ""
+			case string(batchv1.JobFailed):
+				return false, true, "Job failed : " + getUnstructuredString(condition, "reason")
+			}
+		}
+		return false, false, "Job not completed"
+	}
+	return true, true, ""
+}
@@ -0,0 +1,156 @@
+package cluster
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Outcomes of resources recorded in the restore report
+const (
+	OutcomePreferenceExcluded = "PreferenceExcluded"
+	OutcomeExcluded           = "Excluded"
+	OutcomeCreated            = "Created"
+	OutcomeAlreadyExisted     = "AlreadyExisted"
+	OutcomeFailed             = "Failed"
+)
+
+// ResourceOutcome is the result of restoring a resource
+type ResourceOutcome struct {
+	Path          string    `json:"path"`
+	Stage         string    `json:"stage"`
+	Outcome       string    `json:"outcome"`
+	Message       string    `json:"message,omitempty"`
+	Rule          string    `json:"rule,omitempty"`
+	ConvertedFrom string    `json:"convertedFrom,omitempty"`
+	DroppedOwners []string  `json:"droppedOwners,omitempty"`
+	StartedAt     time.Time `json:"startedAt"`
+	Seconds       float64   `json:"seconds"`
+}
+
+type outcomesKey struct{}
+
+// withOutcomes returns a context recording outcomes of resources restored
+func withOutcomes(ctx context.Context) (context.Context, *outcomes) {
+	o := &outcomes{
+		rules:     make(map[string]string),
+		started:   make(map[string]time.Time),
+		converted: make(map[string]string),
+		dropped:   make(map[string][]string),
+	}
+	return context.WithValue(ctx, outcomesKey{}, o), o
+}
+
+// outcomes records outcomes of resources in the order of results.
+// It also locks the status of its restore updated from restore workers.
+type outcomes struct {
+	lock       sync.Mutex
+	statusLock sync.Mutex
+	stage      string
+	rules      map[string]string
+	started    map[string]time.Time
+	converted  map[string]string
+	dropped    map[string][]string
+	resources  []ResourceOutcome
+}
+
+// outcomesFrom returns the outcomes of the context, nil when not recorded
+func outcomesFrom(ctx context.Context) *outcomes {
+	o, _ := ctx.Value(outcomesKey{}).(*outcomes)
+	return o
+}
+
+// lockStatus locks the status of the restore and returns the func to unlock.
+// Restores record outcomes, so status is not locked only when updated without workers.
+func (o *outcomes) lockStatus() func() {
+	if o == nil {
+		return func() {}
+	}
+	o.statusLock.Lock()
+	return o.statusLock.Unlock
+}
+
+// setStage sets the stage of resources recorded after
+func (o *outcomes) setStage(stage string) {
+	if o == nil {
+		return
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.stage = stage
+}
+
+// setRule sets the preference rule matched to the resource
+func (o *outcomes) setRule(path, rule string) {
+	if o == nil {
+		return
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.rules[path] = rule
+}
+
+// start records the time restoring the resource started
+func (o *outcomes) start(path string) {
+	if o == nil {
+		return
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.started[path] = time.Now()
+}
+
+// convert records the API version the resource converted from
+func (o *outcomes) convert(path, from string) {
+	if o == nil {
+		return
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.converted[path] = from
+}
+
+// dropOwners records owner references removed for owners not existing
+func (o *outcomes) dropOwners(path string, owners []string) {
+	if o == nil || len(owners) == 0 {
+		return
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.dropped[path] = owners
+}
+
+// record adds the outcome of the resource timed from start, or zero when not started
+func (o *outcomes) record(path, outcome, msg string) {
+	if o == nil {
+		return
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	now := time.Now()
+	started, ok := o.started[path]
+	if !ok {
+		started = now
+	}
+	o.resources = append(o.resources, ResourceOutcome{
+		Path:          path,
+		Stage:         o.stage,
+		Outcome:       outcome,
+		Message:       msg,
+		Rule:          o.rules[path],
+		ConvertedFrom: o.converted[path],
+		DroppedOwners: o.dropped[path],
+		StartedAt:     started,
+		Seconds:       now.Sub(started).Seconds(),
+	})
+}
+
+// list returns outcomes recorded
+func (o *outcomes) list() []ResourceOutcome {
+	if o == nil {
+		return nil
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return append([]ResourceOutcome(nil), o.resources...)
+}
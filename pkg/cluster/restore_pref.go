@@ -1,8 +1,10 @@
 package cluster
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -31,70 +33,174 @@ type preference struct {
 	includedClusterRoleBindings []string
 	serviceList                 []string
 	dirs                        []os.FileInfo
+	// UIDs of resources in snapshot to UIDs of restored ones
+	uids *uidMap
+	// Stages of resources to restore by keys, and resources held until owners in later stages restored
+	stages map[string]int
+	held   []*restoreNode
 }
 
 func newPreference(pref *cbv1alpha1.RestorePreference) *preference {
 	return &preference{
 		pref: pref,
+		uids: newUIDMap(),
 	}
 }
 
+// Owner reference policies
+const (
+	// Do not restore resources with owner references (default)
+	OwnerReferenceSkip = "Skip"
+	// Restore resources without owner references
+	OwnerReferenceStrip = "Strip"
+	// Restore resources with owner references to restored owners
+	OwnerReferenceRewrite = "Rewrite"
+)
+
+func (p *preference) validate() error {
+	for _, policy := range p.pref.Spec.OwnerReferencePolicies {
+		switch policy.Policy {
+		case OwnerReferenceSkip, OwnerReferenceStrip, OwnerReferenceRewrite:
+		default:
+			return fmt.Errorf("Unknown owner reference policy %s for %s", policy.Policy, policy.Kind)
+		}
+	}
+	switch p.pref.Spec.RedactedSecrets {
+	case "", RedactedSecretsSkip, RedactedSecretsPlaceholder:
+	default:
+		return fmt.Errorf("Unknown redacted secrets policy %s", p.pref.Spec.RedactedSecrets)
+	}
+	for _, policy := range p.pref.Spec.SanitizePolicies {
+		err := validateSanitizePolicy(policy)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ownerReferencePolicy returns the owner reference policy for the kind of the resource
+func (p *preference) ownerReferencePolicy(item *unstructured.Unstructured) string {
+	for _, policy := range p.pref.Spec.OwnerReferencePolicies {
+		if policy.Kind != item.GetKind() {
+			continue
+		}
+		if policy.APIVersion != "" && policy.APIVersion != item.GetAPIVersion() {
+			continue
+		}
+		return policy.Policy
+	}
+	return OwnerReferenceSkip
+}
+
 func (p *preference) preferedToRestore(path string) string {
+	restorePref, _ := p.preferenceRule(path)
+	return restorePref
+}
+
+// preferenceRule returns where to restore the resource and the rule of the preference matched
+func (p *preference) preferenceRule(path string) (string, string) {
 
 	// namespace resources
 	if strings.HasPrefix(path, "/namespaces/") {
 		for _, n := range p.pref.Spec.ExcludeNamespaces {
 			if strings.Contains(path, n) {
-				return "Exclude"
+				return "Exclude", "excludeNamespaces:" + n
 			}
 		}
-		return "Namespace"
+		return "Namespace", ""
 	}
 	// crds
 	if strings.HasPrefix(path, "/crds/") {
 		for _, crd := range p.pref.Spec.ExcludeCRDs {
 			if strings.Contains(path, crd) {
-				return "Exclude"
+				return "Exclude", "excludeCRDs:" + crd
 			}
 		}
-		return "CRD"
+		return "CRD", ""
 	}
 	// check exclude API pathes
 	for _, p := range p.pref.Spec.ExcludeAPIPathes {
 		if apiPathMatched(path, p) {
-			return "Exclude"
+			return "Exclude", "excludeApiPathes:" + p
 		}
 	}
 	// check exclude namespaces
 	for _, n := range p.pref.Spec.ExcludeNamespaces {
 		if strings.Contains(path, "namespaces/"+n) {
-			return "Exclude"
+			return "Exclude", "excludeNamespaces:" + n
 		}
 	}
 	// check storage classes
 	if strings.Contains(path, "/storageclasses/") {
 		for _, s := range p.pref.Spec.RestoreNfsStorageClasses {
 			if strings.Contains(path, "storageclasses/"+s) {
-				return "Restore"
+				return "Restore", "restoreNfsStorageClasses:" + s
 			}
 		}
-		return "Exclude"
+		return "Exclude", "restoreNfsStorageClasses"
 	}
 	// check PV/PVC
 	if strings.Contains(path, "/persistentvolumes/") {
-		return "PV"
+		return "PV", ""
 	}
 	if strings.Contains(path, "/persistentvolumeclaims/") {
-		return "PVC"
+		return "PVC", ""
 	}
 	// check Apps API pathes
 	for _, p := range p.pref.Spec.RestoreAppAPIPathes {
 		if apiPathMatched(path, p) {
-			return "App"
+			return "App", "restoreAppApiPathes:" + p
 		}
 	}
 	// other resources to restore
-	return "Restore"
+	return "Restore", ""
+}
+
+// DefaultRestoreConcurrency is the default number of resources created at once on restore
+const DefaultRestoreConcurrency = 4
+
+// restoreConcurrency returns the number of resources created at once
+func restoreConcurrency(pref *cbv1alpha1.RestorePreference) int {
+	if pref.Spec.RestoreConcurrency > 0 {
+		return pref.Spec.RestoreConcurrency
+	}
+	return DefaultRestoreConcurrency
+}
+
+// restoreClientQPS returns QPS and burst of the target cluster client for restore
+func restoreClientQPS(pref *cbv1alpha1.RestorePreference) (float32, int) {
+	qps := DefaultClientQPS
+	burst := DefaultClientBurst
+	if pref.Spec.ClientQPS > 0 {
+		qps = pref.Spec.ClientQPS
+	}
+	if pref.Spec.ClientBurst > 0 {
+		burst = pref.Spec.ClientBurst
+	}
+	return float32(qps), burst
+}
+
+// validateResources checks glob patterns of resources to restore
+func validateResources(resources []string) error {
+	for _, r := range resources {
+		_, err := path.Match(r, "")
+		if err != nil {
+			return fmt.Errorf("Invalid resource pattern %s : %s", r, err.Error())
+		}
+	}
+	return nil
+}
+
+// isSelected returns true when the path in snapshot contents matches a resource path or pattern.
+// Patterns match per path segment, '*' does not match '/'.
+func isSelected(itempath string, resources []string) bool {
+	for _, r := range resources {
+		if matched, _ := path.Match(r, itempath); matched {
+			return true
+		}
+	}
+	return false
 }
 
 func (p *preference) isUserNamespace(nsName string) bool {
@@ -146,6 +252,12 @@ func (p *preference) initializeByDir(dir string) error {
 			return err
 		}
 	}
+	if p.isIn("Selected") {
+		err = p.setServiceList(dir, "Selected")
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -65,7 +65,7 @@ func restorePV(ctx context.Context, dir string, dyn dynamic.Interface, p *prefer
 		// Check storageClassName
 		pvcSpec := getUnstructuredMap(pvcItem.Object, "spec")
 		if pvcSpec == nil {
-			excludeWithMsg(restore, rlog, resourcePath, "no-pvc-spec")
+			excludeWithMsg(ctx, restore, rlog, resourcePath, "no-pvc-spec")
 			continue
 		}
 		storageClassName := getUnstructuredString(pvcSpec, "storageClassName")
@@ -73,7 +73,7 @@ func restorePV(ctx context.Context, dir string, dyn dynamic.Interface, p *prefer
 			// Check Annotations
 			annotaionStorageClassName := pvcItem.GetAnnotations()["volume.beta.kubernetes.io/storage-class"]
 			if annotaionStorageClassName == "" || !p.isIncludedStorageClass(annotaionStorageClassName) {
-				excludeWithMsg(restore, rlog, resourcePath, "no-storageclass")
+				excludeWithMsg(ctx, restore, rlog, resourcePath, "no-storageclass")
 				continue
 			}
 		}
@@ -81,7 +81,7 @@ func restorePV(ctx context.Context, dir string, dyn dynamic.Interface, p *prefer
 		// Check bounded and PV name
 		volumeName := getUnstructuredString(pvcSpec, "volumeName")
 		if volumeName == "" {
-			excludeWithMsg(restore, rlog, resourcePath, "not-bounded")
+			excludeWithMsg(ctx, restore, rlog, resourcePath, "not-bounded")
 			continue
 		}
 
@@ -107,52 +107,44 @@ func restorePV(ctx context.Context, dir string, dyn dynamic.Interface, p *prefer
 			}
 		}
 		if !pvFound {
-			excludeWithMsg(restore, rlog, resourcePath, "pv-not-found")
+			excludeWithMsg(ctx, restore, rlog, resourcePath, "pv-not-found")
 			continue
 		}
 
 		// Restore PV first
 		rlog.Infof("     Restoring PV %s", pvItem.GetName())
-		pvSpec := getUnstructuredMap(pvItem.Object, "spec")
-		if pvSpec == nil {
-			excludeWithMsg(restore, rlog, pvResourcePath, "no-pv-spec")
+		if getUnstructuredMap(pvItem.Object, "spec") == nil {
+			excludeWithMsg(ctx, restore, rlog, pvResourcePath, "no-pv-spec")
 			continue
 		}
-		pvSpec["claimRef"] = nil
-		pvItem.Object["status"] = nil
-		pvItem.SetResourceVersion("")
-		pvItem.SetUID("")
-		_, err = createItem(ctx, &pvItem, dyn, sr)
+		sanitizeItem(&pvItem, p)
+		outcomesFrom(ctx).start(pvResourcePath)
+		pvObj, err := createItem(ctx, &pvItem, dyn, sr)
 		if err != nil {
 			if strings.Contains(err.Error(), "already exists") {
-				alreadyExist(restore, rlog, pvResourcePath)
+				alreadyExist(ctx, restore, rlog, pvResourcePath)
 			} else {
-				failedWithMsg(restore, rlog, pvResourcePath, err.Error())
+				failedWithMsg(ctx, restore, rlog, pvResourcePath, err.Error())
 			}
 			continue
 		} else {
-			created(restore, rlog, pvResourcePath)
+			created(ctx, restore, rlog, pvResourcePath, pvObj)
 		}
 
 		// Then restore PVC
 		rlog.Infof("     Restoring PVC %s", pvcItem.GetName())
-		pvcSpec["volumeName"] = nil
-		pvcItem.Object["status"] = nil
-		pvcItem.SetResourceVersion("")
-		pvcItem.SetUID("")
-		annotations := pvcItem.GetAnnotations()
-		delete(annotations, "pv.kubernetes.io/bind-completed")
-		pvcItem.SetAnnotations(annotations)
-		_, err = createItem(ctx, &pvcItem, dyn, sr)
+		sanitizeItem(&pvcItem, p)
+		outcomesFrom(ctx).start(resourcePath)
+		pvcObj, err := createItem(ctx, &pvcItem, dyn, sr)
 		if err != nil {
 			if strings.Contains(err.Error(), "already exists") {
-				alreadyExist(restore, rlog, resourcePath)
+				alreadyExist(ctx, restore, rlog, resourcePath)
 			} else {
-				failedWithMsg(restore, rlog, resourcePath, err.Error())
+				failedWithMsg(ctx, restore, rlog, resourcePath, err.Error())
 			}
 			continue
 		} else {
-			created(restore, rlog, resourcePath)
+			created(ctx, restore, rlog, resourcePath, pvcObj)
 		}
 
 		// Wait for bound
@@ -170,9 +162,14 @@ func restorePV(ctx context.Context, dir string, dyn dynamic.Interface, p *prefer
 				rlog.Infof("     PV:%s - PVC:%s bounded successfully", pvItem.GetName(), pvcItem.GetName())
 				break
 			}
-			time.Sleep(5 * time.Second)
+			select {
+			case <-time.After(5 * time.Second):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 			count = count + 1
 		}
 	}
+	restoreProgress(ctx, restore)
 	return nil
 }
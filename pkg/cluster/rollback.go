@@ -0,0 +1,136 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
+	"github.com/ryo-watanabe/k8s-snap/pkg/utils"
+)
+
+// RollbackAnnotation triggers rollback of a completed or failed restore when set "true"
+const RollbackAnnotation = "clustersnapshot.rywt.io/rollback"
+
+// resourceFromPath returns resource, namespace and name from an API path made by ResourcePath
+func resourceFromPath(path string) (schema.GroupVersionResource, string, string, error) {
+	p := strings.Split(path, "/")
+	var gv schema.GroupVersion
+	switch {
+	case len(p) > 3 && p[1] == "api":
+		gv = schema.GroupVersion{Version: p[2]}
+		p = p[3:]
+	case len(p) > 4 && p[1] == "apis":
+		gv = schema.GroupVersion{Group: p[2], Version: p[3]}
+		p = p[4:]
+	default:
+		return schema.GroupVersionResource{}, "", "", fmt.Errorf("Invalid resource path %s", path)
+	}
+	switch len(p) {
+	case 2:
+		return gv.WithResource(p[0]), "", p[1], nil
+	case 4:
+		if p[0] == "namespaces" {
+			return gv.WithResource(p[2]), p[1], p[3], nil
+		}
+	}
+	return schema.GroupVersionResource{}, "", "", fmt.Errorf("Invalid resource path %s", path)
+}
+
+// Rollback deletes resources created by the restore.
+// The journal is read from the report when the restore has one.
+func Rollback(ctx context.Context, restore *cbv1alpha1.Restore, bucket objectstore.Objectstore) error {
+
+	journal := restore.Status.Journal
+	var report *RestoreReport
+	if restore.Status.Report != nil {
+		if bucket == nil {
+			return fmt.Errorf("Objectstore for report %s not found", restore.Status.Report.Name)
+		}
+		report = &RestoreReport{}
+		err := downloadReport(ctx, report, restore.Status.Report.Name, bucket)
+		if err != nil {
+			return err
+		}
+		journal = report.Journal
+	}
+
+	// DynamicClient for external cluster.
+	dynamicClient, err := buildDynamicClient(restore.Spec.Kubeconfig, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	err = rollbackWithClient(ctx, restore, journal, dynamicClient)
+	if report != nil {
+		report.RolledBack = restore.Status.RolledBack
+		uerr := uploadReport(ctx, report, restore.Status.Report.Name, bucket)
+		if uerr == nil {
+			restore.Status.RolledBack = sampleList(restore.Status.RolledBack)
+		} else if err == nil {
+			err = uerr
+		}
+	}
+	return err
+}
+
+// rollbackWithClient deletes resources in the journal in reverse order of creation.
+// Resources replaced after restore are left with UID precondition.
+func rollbackWithClient(ctx context.Context, restore *cbv1alpha1.Restore,
+	journal []cbv1alpha1.RestoreJournalEntry, dyn dynamic.Interface) error {
+
+	// Restore log
+	rlog := utils.NewNamedLog("rollback:" + restore.ObjectMeta.Name)
+
+	restore.Status.RolledBack = nil
+	restore.Status.NumRolledBack = 0
+	failed := 0
+	propagation := metav1.DeletePropagationBackground
+
+	rlog.Infof("Rolling back %d resources", len(journal))
+	for i := len(journal) - 1; i >= 0; i-- {
+		entry := journal[i]
+		gvr, namespace, name, err := resourceFromPath(entry.Path)
+		if err != nil {
+			rlog.Warningf("-- [Failed] %s", err.Error())
+			failed++
+			continue
+		}
+		opts := metav1.DeleteOptions{PropagationPolicy: &propagation}
+		if entry.UID != "" {
+			uid := types.UID(entry.UID)
+			opts.Preconditions = &metav1.Preconditions{UID: &uid}
+		}
+		if namespace == "" {
+			err = dyn.Resource(gvr).Delete(ctx, name, opts)
+		} else {
+			err = dyn.Resource(gvr).Namespace(namespace).Delete(ctx, name, opts)
+		}
+		switch {
+		case err == nil:
+			rlog.Infof("-- [Deleted] %s", entry.Path)
+			restore.Status.RolledBack = append(restore.Status.RolledBack, entry.Path)
+			restore.Status.NumRolledBack++
+		case apierrors.IsNotFound(err):
+			rlog.Infof("-- [Already deleted] %s", entry.Path)
+		case apierrors.IsConflict(err):
+			rlog.Infof("-- [Replaced, left] %s", entry.Path)
+		default:
+			rlog.Warningf("-- [Failed] %s %s", entry.Path, err.Error())
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Rollback failed for %d resources", failed)
+	}
+	rlog.Infof("Rollback completed : %d deleted", restore.Status.NumRolledBack)
+	return nil
+}
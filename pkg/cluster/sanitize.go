@@ -0,0 +1,141 @@
+package cluster
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+)
+
+// Fields bound to the source cluster removed from all resources
+var commonSanitizeFields = []string{
+	"metadata.managedFields",
+	"metadata.uid",
+	"metadata.resourceVersion",
+	"metadata.generation",
+	"metadata.selfLink",
+	"metadata.creationTimestamp",
+	"status",
+}
+
+// Built-in fields and annotations removed from resources of a kind
+var defaultSanitizePolicies = map[string]cbv1alpha1.SanitizePolicy{
+	"Service": {
+		Fields: []string{"spec.clusterIP", "spec.clusterIPs", "spec.ports[].nodePort", "spec.healthCheckNodePort"},
+	},
+	"Pod": {
+		Fields: []string{"spec.nodeName"},
+	},
+	"PersistentVolume": {
+		Fields:      []string{"spec.claimRef"},
+		Annotations: []string{"pv.kubernetes.io/bound-by-controller"},
+	},
+	"PersistentVolumeClaim": {
+		Fields: []string{"spec.volumeName"},
+		Annotations: []string{
+			"pv.kubernetes.io/bind-completed",
+			"pv.kubernetes.io/bound-by-controller",
+			"volume.beta.kubernetes.io/storage-provisioner",
+		},
+	},
+}
+
+func validateSanitizePolicy(policy cbv1alpha1.SanitizePolicy) error {
+	for _, field := range policy.Fields {
+		for _, f := range strings.Split(field, ".") {
+			if strings.TrimSuffix(f, "[]") == "" {
+				return fmt.Errorf("Invalid field %s in sanitize policy for %s", field, policy.Kind)
+			}
+		}
+	}
+	return nil
+}
+
+// sanitizePolicy returns the sanitize policy for the kind of the resource
+func (p *preference) sanitizePolicy(item *unstructured.Unstructured) *cbv1alpha1.SanitizePolicy {
+	for i, policy := range p.pref.Spec.SanitizePolicies {
+		if policy.Kind != item.GetKind() {
+			continue
+		}
+		if policy.APIVersion != "" && policy.APIVersion != item.GetAPIVersion() {
+			continue
+		}
+		return &p.pref.Spec.SanitizePolicies[i]
+	}
+	return nil
+}
+
+// sanitizeItem removes fields bound to the source cluster before restore
+func sanitizeItem(item *unstructured.Unstructured, p *preference) {
+	fields := append([]string{}, commonSanitizeFields...)
+	annotations := make([]string, 0)
+
+	policy := p.sanitizePolicy(item)
+	if policy == nil || !policy.DisableDefaults {
+		defaults := defaultSanitizePolicies[item.GetKind()]
+		fields = append(fields, defaults.Fields...)
+		annotations = append(annotations, defaults.Annotations...)
+	}
+	if policy != nil {
+		fields = append(fields, policy.Fields...)
+		annotations = append(annotations, policy.Annotations...)
+	}
+
+	// Headless services keep cluster IP "None"
+	if item.GetKind() == "Service" {
+		clusterIP, _, _ := unstructured.NestedString(item.Object, "spec", "clusterIP")
+		if clusterIP == "None" {
+			fields = removeFromList(fields, "spec.clusterIP", "spec.clusterIPs")
+		}
+	}
+
+	for _, field := range fields {
+		removeField(item.Object, strings.Split(field, "."))
+	}
+	if len(annotations) > 0 && item.GetAnnotations() != nil {
+		a := item.GetAnnotations()
+		for _, key := range annotations {
+			delete(a, key)
+		}
+		item.SetAnnotations(a)
+	}
+}
+
+// removeField removes the field at the path, "[]" in the path for every item of a list
+func removeField(obj map[string]interface{}, path []string) {
+	if len(path) == 0 {
+		return
+	}
+	key := strings.TrimSuffix(path[0], "[]")
+	if len(path) == 1 {
+		delete(obj, key)
+		return
+	}
+	if key != path[0] {
+		list, ok := obj[key].([]interface{})
+		if !ok {
+			return
+		}
+		for _, i := range list {
+			if m, ok := i.(map[string]interface{}); ok {
+				removeField(m, path[1:])
+			}
+		}
+		return
+	}
+	if m, ok := obj[key].(map[string]interface{}); ok {
+		removeField(m, path[1:])
+	}
+}
+
+func removeFromList(list []string, values ...string) []string {
+	filtered := make([]string, 0, len(list))
+	for _, l := range list {
+		if !isInList(l, values) {
+			filtered = append(filtered, l)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,131 @@
+package cluster
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/utils"
+)
+
+// RedactedAnnotation marks secrets with data values redacted on snapshot
+const RedactedAnnotation = "clustersnapshot.rywt.io/redacted"
+
+// Secret rule actions
+const (
+	// Secrets not stored in snapshots
+	SecretActionExclude = "Exclude"
+	// Secrets stored with keys only
+	SecretActionRedact = "Redact"
+)
+
+// Restore of redacted secrets
+const (
+	// Do not restore redacted secrets (default)
+	RedactedSecretsSkip = "Skip"
+	// Restore redacted secrets with empty values as placeholders
+	RedactedSecretsPlaceholder = "Placeholder"
+)
+
+// Annotation which may hold secret data
+const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// secretPolicy applies secret rules of a snapshot
+type secretPolicy struct {
+	rules     []cbv1alpha1.SecretRule
+	selectors []labels.Selector
+}
+
+func newSecretPolicy(rules []cbv1alpha1.SecretRule) (*secretPolicy, error) {
+	p := &secretPolicy{rules: rules}
+	for _, rule := range rules {
+		if rule.Action != SecretActionExclude && rule.Action != SecretActionRedact {
+			return nil, fmt.Errorf("Unknown secret rule action %s", rule.Action)
+		}
+		selector := labels.Everything()
+		if rule.Selector != nil {
+			s, err := metav1.LabelSelectorAsSelector(rule.Selector)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid secret rule selector : %s", err.Error())
+			}
+			selector = s
+		}
+		p.selectors = append(p.selectors, selector)
+	}
+	return p, nil
+}
+
+// action returns the action of the first rule matched, or empty when no rules matched
+func (p *secretPolicy) action(item *unstructured.Unstructured) string {
+	if item.GetKind() != "Secret" || item.GroupVersionKind().Group != "" {
+		return ""
+	}
+	secretType := getUnstructuredString(item.Object, "type")
+	for i, rule := range p.rules {
+		if len(rule.Types) > 0 && !isInList(secretType, rule.Types) {
+			continue
+		}
+		if len(rule.Namespaces) > 0 && !isInList(item.GetNamespace(), rule.Namespaces) {
+			continue
+		}
+		if !p.selectors[i].Matches(labels.Set(item.GetLabels())) {
+			continue
+		}
+		return rule.Action
+	}
+	return ""
+}
+
+// redactSecret empties data values and marks the secret redacted
+func redactSecret(item *unstructured.Unstructured) {
+	for _, field := range []string{"data", "stringData"} {
+		data, ok := item.Object[field].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for key := range data {
+			data[key] = ""
+		}
+	}
+	annotations := item.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	delete(annotations, lastAppliedAnnotation)
+	annotations[RedactedAnnotation] = "true"
+	item.SetAnnotations(annotations)
+}
+
+// applySecretPolicy excludes or redacts secrets and records numbers in the snapshot status
+func applySecretPolicy(items []unstructured.Unstructured, p *secretPolicy,
+	snapshot *cbv1alpha1.Snapshot, blog *utils.NamedLog) []unstructured.Unstructured {
+
+	snapshot.Status.NumSecretsExcluded = 0
+	snapshot.Status.NumSecretsRedacted = 0
+	if len(p.rules) == 0 {
+		return items
+	}
+	filtered := make([]unstructured.Unstructured, 0, len(items))
+	for i := range items {
+		switch p.action(&items[i]) {
+		case SecretActionExclude:
+			snapshot.Status.NumSecretsExcluded++
+			continue
+		case SecretActionRedact:
+			redactSecret(&items[i])
+			snapshot.Status.NumSecretsRedacted++
+		}
+		filtered = append(filtered, items[i])
+	}
+	blog.Infof("Secrets excluded : %d, redacted : %d",
+		snapshot.Status.NumSecretsExcluded, snapshot.Status.NumSecretsRedacted)
+	return filtered
+}
+
+// isRedacted returns true when the secret was redacted on snapshot
+func isRedacted(item *unstructured.Unstructured) bool {
+	return item.GetAnnotations()[RedactedAnnotation] == "true"
+}
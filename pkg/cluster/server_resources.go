@@ -2,17 +2,32 @@ package cluster
 
 import (
 	"fmt"
+	"sync"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/discovery"
 )
 
+// Version selections of resources on snapshot
+const (
+	// One version for each group resource, the preferred version of the group by default
+	VersionSelectionPreferred = "preferred"
+	// All versions served
+	VersionSelectionAll = "all"
+)
+
+// Groups replaced by other groups, objects in them are captured in successors
+var legacyGroups = map[string]bool{"extensions": true}
+
 // ServerResources holds informations of API resources
 type ServerResources struct {
 	serverResources []*metav1.APIResourceList
 	resourceNames   map[schema.GroupVersionKind]string
+	// resourceNames is filled from watch goroutines
+	lock sync.Mutex
 }
 
 func matchVerbs(groupVersion string, r *metav1.APIResource) bool {
@@ -31,8 +46,101 @@ func (sr *ServerResources) GetResources() []*metav1.APIResourceList {
 	return sr.serverResources
 }
 
+// selectVersions selects one version for each group resource.
+// Versions in groupVersions take precedence over the preferred versions of their groups.
+func selectVersions(groups []*metav1.APIGroup, resources []*metav1.APIResourceList, groupVersions []string) []*metav1.APIResourceList {
+
+	// Rank of versions in each group
+	rank := make(map[string]int)
+	setRank := func(gv string) {
+		if _, ok := rank[gv]; !ok {
+			rank[gv] = len(rank)
+		}
+	}
+	for _, gv := range groupVersions {
+		setRank(gv)
+	}
+	for _, g := range groups {
+		setRank(g.PreferredVersion.GroupVersion)
+		for _, v := range g.Versions {
+			setRank(v.GroupVersion)
+		}
+	}
+	rankOf := func(gv string) int {
+		if r, ok := rank[gv]; ok {
+			return r
+		}
+		return len(rank)
+	}
+
+	// Version selected for each group resource
+	selected := make(map[string]string)
+	for _, list := range resources {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil {
+			continue
+		}
+		for _, r := range list.APIResources {
+			key := gv.Group + "/" + r.Name
+			if s, ok := selected[key]; !ok || rankOf(list.GroupVersion) < rankOf(s) {
+				selected[key] = list.GroupVersion
+			}
+		}
+	}
+
+	filtered := make([]*metav1.APIResourceList, 0)
+	for _, list := range resources {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil {
+			continue
+		}
+		apiResources := make([]metav1.APIResource, 0)
+		for _, r := range list.APIResources {
+			if selected[gv.Group+"/"+r.Name] == list.GroupVersion {
+				apiResources = append(apiResources, r)
+			}
+		}
+		if len(apiResources) > 0 {
+			filtered = append(filtered, &metav1.APIResourceList{
+				TypeMeta:     list.TypeMeta,
+				GroupVersion: list.GroupVersion,
+				APIResources: apiResources,
+			})
+		}
+	}
+	return filtered
+}
+
+// dedupByUID drops objects captured more than once in different groups.
+// Objects in legacy groups are dropped in favor of ones in their successors.
+func dedupByUID(items []unstructured.Unstructured) ([]unstructured.Unstructured, int) {
+	index := make(map[types.UID]int)
+	deduped := make([]unstructured.Unstructured, 0, len(items))
+	dropped := 0
+	for _, item := range items {
+		uid := item.GetUID()
+		if uid == "" {
+			deduped = append(deduped, item)
+			continue
+		}
+		i, ok := index[uid]
+		if !ok {
+			index[uid] = len(deduped)
+			deduped = append(deduped, item)
+			continue
+		}
+		dropped++
+		if legacyGroups[deduped[i].GroupVersionKind().Group] && !legacyGroups[item.GroupVersionKind().Group] {
+			deduped[i] = item
+		}
+	}
+	return deduped, dropped
+}
+
 // ResourceName get resource string from GroupVersionKind
 func (sr *ServerResources) ResourceName(gvk schema.GroupVersionKind) (string, error) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
 	if name, ok := sr.resourceNames[gvk]; ok {
 		return name, nil
 	}
@@ -51,6 +159,42 @@ func (sr *ServerResources) ResourceName(gvk schema.GroupVersionKind) (string, er
 	return "", fmt.Errorf("unable to find %s in server resources", gvk)
 }
 
+func (sr *ServerResources) served(gvk schema.GroupVersionKind) bool {
+	_, err := sr.ResourceName(gvk)
+	return err == nil
+}
+
+// namespaced returns true when the kind is a namespaced resource
+func (sr *ServerResources) namespaced(gvk schema.GroupVersionKind) bool {
+	for _, resourceGroup := range sr.serverResources {
+		if resourceGroup.GroupVersion != gvk.GroupVersion().String() {
+			continue
+		}
+		for _, resource := range resourceGroup.APIResources {
+			if resource.Kind == gvk.Kind {
+				return resource.Namespaced
+			}
+		}
+	}
+	return false
+}
+
+// PreferredVersion returns the first version serving the kind in the group
+func (sr *ServerResources) PreferredVersion(group, kind string) (schema.GroupVersion, bool) {
+	for _, resourceGroup := range sr.serverResources {
+		gv, err := schema.ParseGroupVersion(resourceGroup.GroupVersion)
+		if err != nil || gv.Group != group {
+			continue
+		}
+		for _, resource := range resourceGroup.APIResources {
+			if resource.Kind == kind {
+				return gv, true
+			}
+		}
+	}
+	return schema.GroupVersion{}, false
+}
+
 // ResourcePath returns an API path of the resource
 func (sr *ServerResources) ResourcePath(item *unstructured.Unstructured) (string, error) {
 	path := "/api/v1"
@@ -2,7 +2,6 @@ package cluster
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -18,10 +17,8 @@ import (
 	"github.com/cenkalti/backoff"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/klog"
 
 	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
 	"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
@@ -52,17 +49,6 @@ func isNewerValidResourceVersion(rv, refrv string) bool {
 	return (irv > irefrv)
 }
 
-func stopWatch(eventsWatch map[schema.GroupVersionResource]watch.Interface) {
-	// Stop watch resources
-	for gvr, w := range eventsWatch {
-		if w != nil {
-			w.Stop()
-		} else {
-			klog.V(4).Infof("+++ %s watch already exited", gvr)
-		}
-	}
-}
-
 // k8s api errors not to retry
 var apiPermErrors = []string{
 	"Unauthorized",
@@ -81,13 +67,14 @@ func apiPermError(error string) bool {
 func Snapshot(ctx context.Context, snapshot *cbv1alpha1.Snapshot) error {
 
 	// kubeClient for external cluster.
-	kubeClient, err := buildKubeClient(snapshot.Spec.Kubeconfig)
+	kubeClient, err := buildKubeClient(ctx, snapshot.Spec.Kubeconfig)
 	if err != nil {
 		return err
 	}
 
 	// DynamicClient for external cluster.
-	dynamicClient, err := buildDynamicClient(snapshot.Spec.Kubeconfig)
+	qps, burst := clientQPS(snapshot)
+	dynamicClient, err := buildDynamicClient(snapshot.Spec.Kubeconfig, qps, burst)
 	if err != nil {
 		return err
 	}
@@ -95,7 +82,8 @@ func Snapshot(ctx context.Context, snapshot *cbv1alpha1.Snapshot) error {
 	return SnapshotWithClient(ctx, snapshot, kubeClient, dynamicClient)
 }
 
-// SnapshotWithClient takes a snapshot of k8s resources
+// SnapshotWithClient takes a snapshot of k8s resources.
+// Hooks run around it once with RunSnapshotHooks, not in every retry.
 func SnapshotWithClient(
 	ctx context.Context,
 	snapshot *cbv1alpha1.Snapshot,
@@ -105,9 +93,20 @@ func SnapshotWithClient(
 	// Snapshot log
 	blog := utils.NewNamedLog("snapshot:" + snapshot.ObjectMeta.Name)
 
+	// Compression codec of the archive
+	compression := snapshot.Spec.Compression
+	if compression == "" {
+		compression = CompressionGzip
+	}
+	err := validateCompression(compression, snapshot.Spec.CompressionLevel)
+	if err != nil {
+		return backoff.Permanent(err)
+	}
+	snapshot.Status.Compression = compression
+
 	discoveryClient := kubeClient.Discovery()
 
-	_, spr, err := discoveryClient.ServerGroupsAndResources()
+	groups, spr, err := discoveryClient.ServerGroupsAndResources()
 	if err != nil {
 
 		// This is the first time that k8s api of  target cluster accessed
@@ -119,148 +118,128 @@ func SnapshotWithClient(
 	}
 	sr := newServerResources(spr)
 	resources := sr.GetResources()
+	switch snapshot.Spec.VersionSelection {
+	case "", VersionSelectionPreferred:
+		resources = selectVersions(groups, resources, snapshot.Spec.GroupVersions)
+	case VersionSelectionAll:
+	default:
+		return backoff.Permanent(fmt.Errorf("Unknown version selection %s", snapshot.Spec.VersionSelection))
+	}
+
+	// Server version recorded in the archive manifest
+	serverVersion, err := discoveryClient.ServerVersion()
+	if err != nil {
+		return fmt.Errorf("Get server version failed : %s", err.Error())
+	}
+	manifest := newArchiveManifest(serverVersion.GitVersion)
 
 	blog.Info("Backing up resources")
 
-	eventsWatch := make(map[schema.GroupVersionResource]watch.Interface)
-	watchgvr := make(map[schema.GroupVersionResource]string)
 	snapshotList := make([]unstructured.Unstructured, 0)
-	watchEventList := make([]watch.Event, 0)
+	collector := newEventCollector(sr)
 
 	// goroutine gc
-	defer stopWatch(eventsWatch)
+	defer collector.stop()
 
-	// Generate marker name
-	markerName := "resource-version-marker-" + utils.RandString(10)
+	// Resource version marker
+	marker, err := newResourceVersionMarker(snapshot, kubeClient)
+	if err != nil {
+		return err
+	}
+
+	// Secrets excluded or redacted
+	secrets, err := newSecretPolicy(snapshot.Spec.SecretPolicy)
+	if err != nil {
+		return backoff.Permanent(err)
+	}
 
 	// Get start resource version
-	marker, err := ConfigMapMarker(ctx, kubeClient, markerName)
+	mark, err := marker.mark(ctx)
 	if err != nil {
-		return fmt.Errorf("Making start config map marker failed : %s", err.Error())
+		return fmt.Errorf("Making start resource version marker failed : %s", err.Error())
 	}
-	startRV := marker.ObjectMeta.ResourceVersion
+	startRV := mark.ResourceVersion
 
+	// Resources to list in the order of discovery
+	tasks := make([]*listTask, 0)
 	for _, resourceGroup := range resources {
 		gv, err := schema.ParseGroupVersion(resourceGroup.GroupVersion)
 		if err != nil {
 			return fmt.Errorf("unable to parse GroupVersion %s : %s", resourceGroup.GroupVersion, err.Error())
 		}
-		blog.Infof("- GroupVersion : %s", resourceGroup.GroupVersion)
-
 		for _, resource := range resourceGroup.APIResources {
 
 			// exclude resource 'nodes' and 'events' on snapshot
 			if resource.Name == "nodes" || resource.Name == "events" {
 				continue
 			}
+			tasks = append(tasks, &listTask{
+				gvr:          gv.WithResource(resource.Name),
+				groupVersion: resourceGroup.GroupVersion,
+				name:         resource.Name,
+			})
+		}
+	}
 
-			// Get list of a resource
-			gvr := gv.WithResource(resource.Name)
-			unstructuredList, err := dynamicClient.Resource(gvr).List(ctx, metav1.ListOptions{})
-			if err != nil {
-				return fmt.Errorf("Get resource %s list failed : %s", resource.Name, err.Error())
-			}
+	// List and watch resources concurrently
+	concurrency := listConcurrency(snapshot)
+	blog.Infof("Listing %d resources with %d workers", len(tasks), concurrency)
+	err = listResources(ctx, dynamicClient, tasks, clusterKey(snapshot), concurrency, startRV, collector)
+	if err != nil {
+		return err
+	}
 
-			// Start watching the resource
-			watchgvr[gvr] = resourceGroup.GroupVersion + "/" + resource.Name
-			eventsWatch[gvr], err = dynamicClient.Resource(gvr).Watch(ctx, metav1.ListOptions{ResourceVersion: startRV})
-			if err != nil {
-				return fmt.Errorf("Watch resource %s list failed : %s", resource.Name, err.Error())
-			}
-			go func() {
-				klog.V(4).Infof("+++ %s watch started", watchgvr[gvr])
-				for e := range eventsWatch[gvr].ResultChan() {
-					item, ok := e.Object.(*unstructured.Unstructured)
-					if ok {
-						resourcePath, _ := sr.ResourcePath(item)
-						switch e.Type {
-						case watch.Added:
-							klog.V(4).Infof("!!! Resource added : %s - rv:%s", resourcePath, item.GetResourceVersion())
-						case watch.Modified:
-							klog.V(4).Infof("!!! Resource modified : %s - rv:%s", resourcePath, item.GetResourceVersion())
-						case watch.Deleted:
-							klog.V(4).Infof("!!! Resource deleted : %s - rv:%s", resourcePath, item.GetResourceVersion())
-						}
-					}
-					watchEventList = append(watchEventList, e)
-				}
-				klog.V(4).Infof("+++ %s watch exiting", watchgvr[gvr])
-			}()
-
-			blog.Infof("-- %3d %s", len(unstructuredList.Items), resource.Name)
-
-			// Join resource list
-			snapshotList = append(snapshotList, unstructuredList.Items...)
+	// Join resource lists in the order of tasks
+	groupVersion := ""
+	for _, task := range tasks {
+		if task.groupVersion != groupVersion {
+			groupVersion = task.groupVersion
+			blog.Infof("- GroupVersion : %s", groupVersion)
 		}
+		blog.Infof("-- %3d %s", len(task.items), task.name)
+		snapshotList = append(snapshotList, task.items...)
 	}
 
 	// Get end resource version
-	marker, err = ConfigMapMarker(ctx, kubeClient, markerName)
+	mark, err = marker.mark(ctx)
 	if err != nil {
-		return fmt.Errorf("Making end config map marker failed : %s", err.Error())
+		return fmt.Errorf("Making end resource version marker failed : %s", err.Error())
 	}
-	endRV := marker.ObjectMeta.ResourceVersion
+	endRV := mark.ResourceVersion
 	blog.Infof("Start resource version : %s", startRV)
 	blog.Infof("End resource version   : %s", endRV)
 
-	// Stop watch resources and wait few seconds for running goroutines exiting
-	stopWatch(eventsWatch)
-	time.Sleep(3 * time.Second)
+	// Stop watch resources and drain events
+	collector.stop()
 
 	// Sync resources
+	watchEventList := collector.sortedEvents()
 	blog.Infof("Syncing modified resources: %d events", len(watchEventList))
-	for _, e := range watchEventList {
-		item, ok := e.Object.(*unstructured.Unstructured)
-		if ok {
-			message := "unknown type"
-			resourcePath, _ := sr.ResourcePath(item)
-			if !isOlderValidResourceVersion(item.GetResourceVersion(), endRV) {
-				message = "ignored, not older than end resource version"
-				blog.Infof("-- [%s] rv:%s %s - %s", e.Type, item.GetResourceVersion(), resourcePath, message)
-				continue
-			}
-			targetIndex := -1
-			for i := range snapshotList {
-				targetItemPath, _ := sr.ResourcePath(&snapshotList[i])
-				if targetItemPath == resourcePath {
-					targetIndex = i
-					break
-				}
-			}
-			if targetIndex >= 0 {
-				if isNewerValidResourceVersion(item.GetResourceVersion(), snapshotList[targetIndex].GetResourceVersion()) {
-					switch e.Type {
-					case watch.Added, watch.Modified:
-						snapshotList[targetIndex] = *item
-						message = "applied"
-					case watch.Deleted:
-						snapshotList = append(snapshotList[:targetIndex], snapshotList[targetIndex+1:]...)
-						message = "deleted"
-					}
-				} else {
-					message = "ignored, resource version is older than stored"
-				}
-			} else {
-				switch e.Type {
-				case watch.Added, watch.Modified:
-					snapshotList = append(snapshotList, *item)
-					message = "added"
-				case watch.Deleted:
-					message = "already deleted"
-				}
-			}
-			blog.Infof("-- [%s] rv:%s %s - %s", e.Type, item.GetResourceVersion(), resourcePath, message)
-		} else {
-			blog.Infof("-- [%s] %#v", e.Type, e.Object)
+	progress := progressFrom(ctx)
+	progress.stage(StageSyncing, len(watchEventList))
+	snapshotList = syncWatchEvents(snapshotList, watchEventList, endRV, sr, blog)
+	progress.setDone(len(watchEventList))
+
+	// Objects captured in several groups
+	if snapshot.Spec.VersionSelection != VersionSelectionAll {
+		var dropped int
+		snapshotList, dropped = dedupByUID(snapshotList)
+		if dropped > 0 {
+			blog.Infof("Dropped %d objects captured in several groups", dropped)
 		}
 	}
+	snapshotList = applySecretPolicy(snapshotList, secrets, snapshot, blog)
 
 	// snapshot file
-	snapshotFile, err := os.Create("/tmp/" + snapshot.ObjectMeta.Name + ".tgz")
+	snapshotFile, err := os.Create(snapshotArchivePath(snapshot))
 	if err != nil {
 		return fmt.Errorf("Creating tgz file failed : %s", err.Error())
 	}
-	tgz := gzip.NewWriter(snapshotFile)
+	defer func() { _ = snapshotFile.Close() }()
+	tgz, err := newArchiveWriter(snapshotFile, compression, snapshot.Spec.CompressionLevel)
+	if err != nil {
+		return backoff.Permanent(fmt.Errorf("Creating archive writer failed : %s", err.Error()))
+	}
 	defer func() { _ = tgz.Close() }()
 
 	tarWriter := tar.NewWriter(tgz)
@@ -269,6 +248,7 @@ func SnapshotWithClient(
 	// Write resources into json
 	snapshot.Status.Contents = nil
 	snapshot.Status.NumberOfContents = 0
+	progress.stage(StageArchiving, len(snapshotList))
 	for i, item := range snapshotList {
 
 		// Resources stored according to api path.
@@ -299,17 +279,19 @@ func SnapshotWithClient(
 		if _, err := tarWriter.Write(content); err != nil {
 			return fmt.Errorf("Tar writer writing content failed : %s", err.Error())
 		}
+		manifest.add(hdr.Name, content)
 
 		// Contents
 		snapshot.Status.Contents = append(snapshot.Status.Contents, itempath)
 		snapshot.Status.NumberOfContents++
+		progress.done(1)
 	}
 
 	blog.Info("Making snapshot.json")
-	snapshot.Status.SnapshotTimestamp = marker.ObjectMeta.CreationTimestamp
+	snapshot.Status.SnapshotTimestamp = mark.Timestamp
 	// Set expiration
 	if snapshot.Spec.AvailableUntil.IsZero() {
-		snapshot.Status.AvailableUntil = metav1.NewTime(marker.ObjectMeta.CreationTimestamp.Add(snapshot.Spec.TTL.Duration))
+		snapshot.Status.AvailableUntil = metav1.NewTime(mark.Timestamp.Add(snapshot.Spec.TTL.Duration))
 		snapshot.Status.TTL = snapshot.Spec.TTL
 	} else {
 		snapshot.Status.AvailableUntil = snapshot.Spec.AvailableUntil
@@ -319,6 +301,7 @@ func SnapshotWithClient(
 
 	// Sort Contents
 	sort.Strings(snapshot.Status.Contents)
+	snapshot.Status.ArchiveFormatVersion = ArchiveFormatVersion
 	snapshotCopy := snapshot.DeepCopy()
 	snapshotCopy.Status.Phase = ""
 	snapshotCopy.TypeMeta.SetGroupVersionKind(cbv1alpha1.SchemeGroupVersion.WithKind("Snapshot"))
@@ -331,7 +314,7 @@ func SnapshotWithClient(
 		return fmt.Errorf("Marshalling snapshot.json failed : %s", err.Error())
 	}
 	hdr := &tar.Header{
-		Name:     filepath.Join(snapshot.ObjectMeta.Name, "snapshot.json"),
+		Name:     filepath.Join(snapshot.ObjectMeta.Name, SnapshotFile),
 		Size:     int64(len(snapshotResource)),
 		Typeflag: tar.TypeReg,
 		Mode:     0755,
@@ -343,6 +326,14 @@ func SnapshotWithClient(
 	if _, err := tarWriter.Write(snapshotResource); err != nil {
 		return fmt.Errorf("tar writer snapshot.json content failed : %s", err.Error())
 	}
+	manifest.add(hdr.Name, snapshotResource)
+
+	// Store manifest with checksums of all entries as manifest.json
+	blog.Info("Making manifest.json")
+	err = writeManifest(tarWriter, snapshot.ObjectMeta.Name, manifest)
+	if err != nil {
+		return err
+	}
 
 	_ = tarWriter.Close()
 	_ = tgz.Close()
@@ -368,18 +359,63 @@ func objectstorePermError(error string) bool {
 }
 
 // UploadSnapshot uploads a snapshot tgz file to the bucket
-func UploadSnapshot(snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) error {
+func UploadSnapshot(ctx context.Context, snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstore) error {
 
 	// Snapshot log
 	blog := utils.NewNamedLog("snapshot:" + snapshot.ObjectMeta.Name)
 
-	snapshotFile, err := os.Open("/tmp/" + snapshot.ObjectMeta.Name + ".tgz")
+	if snapshot.Spec.Incremental {
+		// Upload only new resources as blobs
+		err := uploadSnapshotBlobs(ctx, snapshot, snapshotArchivePath(snapshot), bucket, blog)
+		if err != nil {
+			return err
+		}
+	} else {
+		err := uploadSnapshotFile(ctx, snapshot, snapshotArchivePath(snapshot), bucket, blog)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Contents only in the report, the snapshot fails without it
+	err := UploadSnapshotReport(ctx, snapshot, bucket)
+	if err != nil {
+		return err
+	}
+
+	blog.Info("Upload completed")
+	blog.Infof("-- resource version : %s", snapshot.Status.SnapshotResourceVersion)
+	blog.Infof("-- snapshot timestamp : %s", snapshot.Status.SnapshotTimestamp)
+	blog.Infof("-- available until  : %s", snapshot.Status.AvailableUntil)
+	blog.Infof("-- num resources    : %d", snapshot.Status.NumberOfContents)
+	blog.Infof("-- stored file size : %d", snapshot.Status.StoredFileSize)
+	blog.Infof("-- stored timestamp : %s", snapshot.Status.StoredTimestamp)
+	blog.Infof("-- uploaded size    : %d", snapshot.Status.UploadedFileSize)
+
+	return nil
+}
+
+// Upload whole snapshot tgz file
+func uploadSnapshotFile(ctx context.Context, snapshot *cbv1alpha1.Snapshot, archivePath string,
+	bucket objectstore.Objectstore, blog *utils.NamedLog) error {
+
+	if ctx.Err() != nil {
+		return backoff.Permanent(ctx.Err())
+	}
+
+	snapshotFile, err := os.Open(filepath.Clean(archivePath))
 	if err != nil {
 		return backoff.Permanent(fmt.Errorf("Re-opening tgz file failed : %s", err.Error()))
 	}
 	defer func() { _ = snapshotFile.Close() }()
-	blog.Infof("Uploading file %s", snapshot.ObjectMeta.Name+".tgz")
-	err = bucket.Upload(snapshotFile, snapshot.ObjectMeta.Name+".tgz")
+	objectName := SnapshotObjectName(snapshot)
+	blog.Infof("Uploading file %s", objectName)
+	progress := progressFrom(ctx)
+	progress.stage(StageUploading, 0)
+	if info, err := snapshotFile.Stat(); err == nil {
+		progress.setTotal(0, info.Size())
+	}
+	err = bucket.Upload(ctx, progress.uploadReader(snapshotFile), objectName)
 	if err != nil {
 		if objectstorePermError(err.Error()) {
 			return backoff.Permanent(fmt.Errorf("Uploading tgz file failed : %s", err.Error()))
@@ -387,7 +423,7 @@ func UploadSnapshot(snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstor
 		return fmt.Errorf("Uploading tgz file failed : %s", err.Error())
 	}
 
-	objInfo, err := bucket.GetObjectInfo(snapshot.ObjectMeta.Name + ".tgz")
+	objInfo, err := bucket.GetObjectInfo(ctx, objectName)
 	if err != nil {
 		return fmt.Errorf("Getting objectstore file info failed : %s", err.Error())
 	}
@@ -395,13 +431,7 @@ func UploadSnapshot(snapshot *cbv1alpha1.Snapshot, bucket objectstore.Objectstor
 	// Timestamps and size
 	snapshot.Status.StoredTimestamp = metav1.NewTime(objInfo.Timestamp)
 	snapshot.Status.StoredFileSize = objInfo.Size
-	blog.Info("Upload completed")
-	blog.Infof("-- resource version : %s", snapshot.Status.SnapshotResourceVersion)
-	blog.Infof("-- snapshot timestamp : %s", snapshot.Status.SnapshotTimestamp)
-	blog.Infof("-- available until  : %s", snapshot.Status.AvailableUntil)
-	blog.Infof("-- num resources    : %d", snapshot.Status.NumberOfContents)
-	blog.Infof("-- stored file size : %d", snapshot.Status.StoredFileSize)
-	blog.Infof("-- stored timestamp : %s", snapshot.Status.StoredTimestamp)
+	snapshot.Status.UploadedFileSize = objInfo.Size
 
 	return nil
 }
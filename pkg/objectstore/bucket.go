@@ -1,10 +1,13 @@
 package objectstore
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -20,13 +23,14 @@ import (
 
 // Objectstore interfaces
 type Objectstore interface {
-	ChkBucket() (bool, error)
-	CreateBucket() error
-	Upload(file *os.File, filename string) error
-	Download(file *os.File, filename string) error
-	Delete(filename string) error
-	GetObjectInfo(filename string) (*ObjectInfo, error)
-	ListObjectInfo() ([]ObjectInfo, error)
+	ChkBucket(ctx context.Context) (bool, error)
+	CreateBucket(ctx context.Context) error
+	Upload(ctx context.Context, file io.Reader, filename string) error
+	Download(ctx context.Context, file *os.File, filename string) error
+	Delete(ctx context.Context, filename string) error
+	GetObjectInfo(ctx context.Context, filename string) (*ObjectInfo, error)
+	ListObjectInfo(ctx context.Context) ([]ObjectInfo, error)
+	ListObjectInfoWithPrefix(ctx context.Context, prefix string) ([]ObjectInfo, error)
 
 	GetName() string
 	GetEndpoint() string
@@ -122,7 +126,7 @@ func (b *Bucket) setSession() (*session.Session, error) {
 }
 
 // ChkBucket checks the bucket exists
-func (b *Bucket) ChkBucket() (bool, error) {
+func (b *Bucket) ChkBucket(ctx context.Context) (bool, error) {
 	// set session
 	sess, err := b.setSession()
 	if err != nil {
@@ -131,7 +135,7 @@ func (b *Bucket) ChkBucket() (bool, error) {
 
 	// list buckets
 	svc := b.newS3func(sess)
-	result, err := svc.ListBuckets(nil)
+	result, err := svc.ListBucketsWithContext(ctx, &s3.ListBucketsInput{})
 	if err != nil {
 		return false, err
 	}
@@ -148,7 +152,7 @@ func (b *Bucket) ChkBucket() (bool, error) {
 }
 
 // CreateBucket creates a bucket
-func (b *Bucket) CreateBucket() error {
+func (b *Bucket) CreateBucket(ctx context.Context) error {
 	// set session
 	sess, err := b.setSession()
 	if err != nil {
@@ -156,12 +160,12 @@ func (b *Bucket) CreateBucket() error {
 	}
 	// Create bucket
 	svc := b.newS3func(sess)
-	_, err = svc.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(b.BucketName)})
+	_, err = svc.CreateBucketWithContext(ctx, &s3.CreateBucketInput{Bucket: aws.String(b.BucketName)})
 	return err
 }
 
 // Upload a file to the bucket
-func (b *Bucket) Upload(file *os.File, filename string) error {
+func (b *Bucket) Upload(ctx context.Context, file io.Reader, filename string) error {
 	// set session
 	sess, err := b.setSession()
 	if err != nil {
@@ -169,10 +173,11 @@ func (b *Bucket) Upload(file *os.File, filename string) error {
 	}
 
 	uploader := b.newUploaderfunc(sess)
-	_, err = uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(b.BucketName),
-		Key:    aws.String(filename),
-		Body:   file,
+	_, err = uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:      aws.String(b.BucketName),
+		Key:         aws.String(filename),
+		Body:        file,
+		ContentType: contentType(filename),
 	})
 	if err != nil {
 		return fmt.Errorf("Error uploading %s to bucket %s : %s", filename, b.BucketName, err.Error())
@@ -181,8 +186,28 @@ func (b *Bucket) Upload(file *os.File, filename string) error {
 	return nil
 }
 
+// Content types of objects by name suffix
+var contentTypes = []struct {
+	suffix      string
+	contentType string
+}{
+	{".tgz", "application/gzip"},
+	{".tar.zst", "application/zstd"},
+	{".tar", "application/x-tar"},
+	{".json", "application/json"},
+}
+
+func contentType(filename string) *string {
+	for _, c := range contentTypes {
+		if strings.HasSuffix(filename, c.suffix) {
+			return aws.String(c.contentType)
+		}
+	}
+	return nil
+}
+
 // Download a file from the bucket
-func (b *Bucket) Download(file *os.File, filename string) error {
+func (b *Bucket) Download(ctx context.Context, file *os.File, filename string) error {
 	// set session
 	sess, err := b.setSession()
 	if err != nil {
@@ -190,7 +215,7 @@ func (b *Bucket) Download(file *os.File, filename string) error {
 	}
 
 	downloader := b.newDownloaderfunc(sess)
-	_, err = downloader.Download(file,
+	_, err = downloader.DownloadWithContext(ctx, file,
 		&s3.GetObjectInput{
 			Bucket: aws.String(b.BucketName),
 			Key:    aws.String(filename),
@@ -203,7 +228,7 @@ func (b *Bucket) Download(file *os.File, filename string) error {
 }
 
 // Delete a file in the bucket
-func (b *Bucket) Delete(filename string) error {
+func (b *Bucket) Delete(ctx context.Context, filename string) error {
 	// set session
 	sess, err := b.setSession()
 	if err != nil {
@@ -211,7 +236,7 @@ func (b *Bucket) Delete(filename string) error {
 	}
 
 	svc := b.newS3func(sess)
-	_, err = svc.DeleteObject(&s3.DeleteObjectInput{
+	_, err = svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
 		Bucket: aws.String(b.BucketName),
 		Key:    aws.String(filename),
 	})
@@ -219,7 +244,7 @@ func (b *Bucket) Delete(filename string) error {
 		return fmt.Errorf("Error deleting %s from bucket %s : %s", filename, b.BucketName, err.Error())
 	}
 
-	err = svc.WaitUntilObjectNotExists(&s3.HeadObjectInput{
+	err = svc.WaitUntilObjectNotExistsWithContext(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(b.BucketName),
 		Key:    aws.String(filename),
 	})
@@ -227,7 +252,7 @@ func (b *Bucket) Delete(filename string) error {
 }
 
 // GetObjectInfo gets info of a file in the bucket
-func (b *Bucket) GetObjectInfo(filename string) (*ObjectInfo, error) {
+func (b *Bucket) GetObjectInfo(ctx context.Context, filename string) (*ObjectInfo, error) {
 	// set session
 	sess, err := b.setSession()
 	if err != nil {
@@ -236,7 +261,7 @@ func (b *Bucket) GetObjectInfo(filename string) (*ObjectInfo, error) {
 
 	// list objects
 	svc := b.newS3func(sess)
-	result, err := svc.ListObjects(&s3.ListObjectsInput{
+	result, err := svc.ListObjectsWithContext(ctx, &s3.ListObjectsInput{
 		Bucket: aws.String(b.BucketName),
 		Prefix: aws.String(filename),
 	})
@@ -261,32 +286,48 @@ func (b *Bucket) GetObjectInfo(filename string) (*ObjectInfo, error) {
 }
 
 // ListObjectInfo lists object info
-func (b *Bucket) ListObjectInfo() ([]ObjectInfo, error) {
+func (b *Bucket) ListObjectInfo(ctx context.Context) ([]ObjectInfo, error) {
+	return b.ListObjectInfoWithPrefix(ctx, "")
+}
+
+// ListObjectInfoWithPrefix lists info of objects which names start with the prefix
+func (b *Bucket) ListObjectInfoWithPrefix(ctx context.Context, prefix string) ([]ObjectInfo, error) {
 	// set session
 	sess, err := b.setSession()
 	if err != nil {
 		return nil, err
 	}
 
-	// list objects
+	// list objects page by page
 	svc := b.newS3func(sess)
-	result, err := svc.ListObjects(&s3.ListObjectsInput{
+	input := &s3.ListObjectsInput{
 		Bucket: aws.String(b.BucketName),
-	})
-	if err != nil {
-		return nil, err
 	}
-
-	// make ObjectInfo list
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
 	objInfoList := make([]ObjectInfo, 0)
-	for _, obj := range result.Contents {
-		objInfo := ObjectInfo{
-			Name:             aws.StringValue(obj.Key),
-			Size:             aws.Int64Value(obj.Size),
-			Timestamp:        aws.TimeValue(obj.LastModified),
-			BucketConfigName: b.Name,
+	for {
+		result, err := svc.ListObjectsWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+
+		// make ObjectInfo list
+		for _, obj := range result.Contents {
+			objInfo := ObjectInfo{
+				Name:             aws.StringValue(obj.Key),
+				Size:             aws.Int64Value(obj.Size),
+				Timestamp:        aws.TimeValue(obj.LastModified),
+				BucketConfigName: b.Name,
+			}
+			objInfoList = append(objInfoList, objInfo)
+		}
+
+		if !aws.BoolValue(result.IsTruncated) || len(result.Contents) == 0 {
+			break
 		}
-		objInfoList = append(objInfoList, objInfo)
+		input.Marker = result.Contents[len(result.Contents)-1].Key
 	}
 
 	return objInfoList, nil
@@ -1,11 +1,14 @@
 package objectstore
 
 import (
+	"context"
 	"flag"
 	"io"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
@@ -38,13 +41,15 @@ type mockS3Client struct {
 
 var listBucketsOutput s3.ListBucketsOutput
 
-func (m mockS3Client) ListBuckets(input *s3.ListBucketsInput) (*s3.ListBucketsOutput, error) {
+func (m mockS3Client) ListBucketsWithContext(ctx aws.Context, input *s3.ListBucketsInput,
+	opts ...request.Option) (*s3.ListBucketsOutput, error) {
 	return &listBucketsOutput, nil
 }
 
 var createdBucketName string
 
-func (m mockS3Client) CreateBucket(input *s3.CreateBucketInput) (*s3.CreateBucketOutput, error) {
+func (m mockS3Client) CreateBucketWithContext(ctx aws.Context, input *s3.CreateBucketInput,
+	opts ...request.Option) (*s3.CreateBucketOutput, error) {
 	createdBucketName = *input.Bucket
 	return &s3.CreateBucketOutput{}, nil
 }
@@ -52,7 +57,8 @@ func (m mockS3Client) CreateBucket(input *s3.CreateBucketInput) (*s3.CreateBucke
 var deleteObjectBucketName string
 var deleteObjectKey string
 
-func (m mockS3Client) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+func (m mockS3Client) DeleteObjectWithContext(ctx aws.Context, input *s3.DeleteObjectInput,
+	opts ...request.Option) (*s3.DeleteObjectOutput, error) {
 	deleteObjectBucketName = *input.Bucket
 	deleteObjectKey = *input.Key
 	return &s3.DeleteObjectOutput{}, nil
@@ -61,7 +67,8 @@ func (m mockS3Client) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjec
 var headObjectBucketName string
 var headObjectKey string
 
-func (m mockS3Client) WaitUntilObjectNotExists(input *s3.HeadObjectInput) error {
+func (m mockS3Client) WaitUntilObjectNotExistsWithContext(ctx aws.Context, input *s3.HeadObjectInput,
+	opts ...request.WaiterOption) error {
 	headObjectBucketName = *input.Bucket
 	headObjectKey = *input.Key
 	return nil
@@ -71,7 +78,8 @@ var listObjectsOutput s3.ListObjectsOutput
 var listObjectsBucketName string
 var listObjectsPrefix string
 
-func (m mockS3Client) ListObjects(input *s3.ListObjectsInput) (*s3.ListObjectsOutput, error) {
+func (m mockS3Client) ListObjectsWithContext(ctx aws.Context, input *s3.ListObjectsInput,
+	opts ...request.Option) (*s3.ListObjectsOutput, error) {
 	listObjectsBucketName = *input.Bucket
 	if input.Prefix != nil {
 		listObjectsPrefix = *input.Prefix
@@ -91,11 +99,13 @@ type mockUploader struct {
 
 var uploadBucketName string
 var uploadKey string
+var uploadContentType string
 
-func (m mockUploader) Upload(input *s3manager.UploadInput,
+func (m mockUploader) UploadWithContext(ctx aws.Context, input *s3manager.UploadInput,
 	options ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
 	uploadBucketName = *input.Bucket
 	uploadKey = *input.Key
+	uploadContentType = aws.StringValue(input.ContentType)
 	return &s3manager.UploadOutput{}, nil
 }
 
@@ -112,7 +122,7 @@ type mockDownloader struct {
 var downloadBucketName string
 var downloadKey string
 
-func (m mockDownloader) Download(w io.WriterAt, input *s3.GetObjectInput,
+func (m mockDownloader) DownloadWithContext(ctx aws.Context, w io.WriterAt, input *s3.GetObjectInput,
 	options ...func(*s3manager.Downloader)) (int64, error) {
 	downloadBucketName = *input.Bucket
 	downloadKey = *input.Key
@@ -133,9 +143,10 @@ func TestBucket(t *testing.T) {
 	klog.Flush()
 
 	b := NewMockBucket("test", "ACCESSKEY", "SECRETKEY", "https://endpoint.net", "region", "k8s-snap", true)
+	ctx := context.TODO()
 
 	// ChkBucket with no bucket
-	found, _ := b.ChkBucket()
+	found, _ := b.ChkBucket(ctx)
 	if found {
 		t.Error("Bucket k8s-snap must not be found")
 	}
@@ -144,35 +155,51 @@ func TestBucket(t *testing.T) {
 	bucketName := "k8s-snap"
 	bu := s3.Bucket{Name: &bucketName}
 	listBucketsOutput.SetBuckets([]*s3.Bucket{&bu})
-	found, _ = b.ChkBucket()
+	found, _ = b.ChkBucket(ctx)
 	if !found {
 		t.Error("Bucket k8s-snap must be found")
 	}
 
 	// ChkBucket with bucket named k8s-foo
 	bucketName = "k8s-foo"
-	found, _ = b.ChkBucket()
+	found, _ = b.ChkBucket(ctx)
 	if found {
 		t.Error("Bucket k8s-snap must not be found")
 	}
 
 	// Create Bucket
-	_ = b.CreateBucket()
+	_ = b.CreateBucket(ctx)
 	if createdBucketName != "k8s-snap" {
 		t.Errorf("Error in Created Bucket name")
 	}
 
 	// Upload a file
-	_ = b.Upload(nil, "UPLOAD_FILENAME")
+	_ = b.Upload(ctx, nil, "UPLOAD_FILENAME")
 	if uploadBucketName != "k8s-snap" {
 		t.Errorf("Error in Upload Bucket name")
 	}
 	if uploadKey != "UPLOAD_FILENAME" {
 		t.Errorf("Error in Upload Key")
 	}
+	if uploadContentType != "" {
+		t.Errorf("Error in Upload ContentType")
+	}
+
+	// Content type of archives
+	for filename, contentType := range map[string]string{
+		"snap.tgz":           "application/gzip",
+		"snap.tar.zst":       "application/zstd",
+		"snap.tar":           "application/x-tar",
+		"snap.manifest.json": "application/json",
+	} {
+		_ = b.Upload(ctx, nil, filename)
+		if uploadContentType != contentType {
+			t.Errorf("Error in Upload ContentType for %s : %s", filename, uploadContentType)
+		}
+	}
 
 	// Upload a file
-	_ = b.Download(nil, "DOWNLOAD_FILENAME")
+	_ = b.Download(ctx, nil, "DOWNLOAD_FILENAME")
 	if downloadBucketName != "k8s-snap" {
 		t.Errorf("Error in Download Bucket name")
 	}
@@ -181,7 +208,7 @@ func TestBucket(t *testing.T) {
 	}
 
 	// Delete a file
-	_ = b.Delete("DELETE_FILENAME")
+	_ = b.Delete(ctx, "DELETE_FILENAME")
 	if deleteObjectBucketName != "k8s-snap" {
 		t.Errorf("Error in Delete Object Bucket name")
 	}
@@ -196,7 +223,7 @@ func TestBucket(t *testing.T) {
 	}
 
 	// Get file info without list
-	_, err := b.GetObjectInfo("GETINFO_FILENAME")
+	_, err := b.GetObjectInfo(ctx, "GETINFO_FILENAME")
 	if listObjectsBucketName != "k8s-snap" {
 		t.Errorf("Error in list Object Bucket name")
 	}
@@ -213,7 +240,7 @@ func TestBucket(t *testing.T) {
 	objSize := int64(131072)
 	obj := s3.Object{Key: &objKey, LastModified: &objTime, Size: &objSize}
 	listObjectsOutput.SetContents([]*s3.Object{&obj})
-	objectInfo, err := b.GetObjectInfo("GETINFO_FILENAME")
+	objectInfo, err := b.GetObjectInfo(ctx, "GETINFO_FILENAME")
 	if err != nil {
 		t.Errorf("Error object not found")
 	}
@@ -231,7 +258,7 @@ func TestBucket(t *testing.T) {
 	}
 
 	// List file info
-	objectInfoList, _ := b.ListObjectInfo()
+	objectInfoList, _ := b.ListObjectInfo(ctx)
 	if objectInfoList[0].Name != "GETINFO_FILENAME" {
 		t.Errorf("Error in ListObjectInfo Name")
 	}
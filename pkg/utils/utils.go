@@ -1,7 +1,10 @@
 package utils
 
 import (
+	"bytes"
+	"fmt"
 	"math/rand"
+	"sync"
 	"time"
 
 	"k8s.io/klog"
@@ -21,30 +24,100 @@ func RandString(n int) string {
 
 // NamedLog inserts log name in klog
 type NamedLog struct {
-	Name string
+	Name    string
+	capture *logCapture
 }
 
-// NewNamedLog returns new NamedLog
+// NewNamedLog returns new NamedLog, which also buffers logs while captured with the name
 func NewNamedLog(name string) *NamedLog {
-	return &NamedLog{Name: name + " "}
+	capturesLock.Lock()
+	defer capturesLock.Unlock()
+	return &NamedLog{Name: name + " ", capture: captures[name]}
 }
 
 // Infof for klog.Infof
 func (b *NamedLog) Infof(format string, v ...interface{}) {
 	klog.Infof(b.Name+format, v...)
+	b.capture.write("I", fmt.Sprintf(format, v...))
 }
 
 // Info for klog.Info
 func (b *NamedLog) Info(string string) {
 	klog.Info(b.Name + string)
+	b.capture.write("I", string)
 }
 
 // Warningf for klog.Warningf
 func (b *NamedLog) Warningf(format string, v ...interface{}) {
 	klog.Warningf(b.Name+format, v...)
+	b.capture.write("W", fmt.Sprintf(format, v...))
 }
 
 // Warning for klog.Warning
 func (b *NamedLog) Warning(string string) {
 	klog.Warning(b.Name + string)
+	b.capture.write("W", string)
+}
+
+// MaxLogCaptureSize is the max bytes of a captured log, older lines are dropped over it
+var MaxLogCaptureSize = 512 * 1024
+
+// Logs captured by name
+var captures = make(map[string]*logCapture)
+var capturesLock sync.Mutex
+
+// logCapture buffers logs of an operation
+type logCapture struct {
+	lock      sync.Mutex
+	buf       bytes.Buffer
+	truncated bool
+}
+
+// StartLogCapture buffers logs of NamedLogs created with the name until the returned func called
+func StartLogCapture(name string) func() {
+	c := &logCapture{}
+	capturesLock.Lock()
+	defer capturesLock.Unlock()
+	captures[name] = c
+	return func() {
+		capturesLock.Lock()
+		defer capturesLock.Unlock()
+		if captures[name] == c {
+			delete(captures, name)
+		}
+	}
+}
+
+// CapturedLog returns logs captured with the name, nil when not captured
+func CapturedLog(name string) []byte {
+	capturesLock.Lock()
+	c := captures[name]
+	capturesLock.Unlock()
+	if c == nil {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	log := make([]byte, 0, c.buf.Len())
+	if c.truncated {
+		log = append(log, "... (truncated)\n"...)
+	}
+	return append(log, c.buf.Bytes()...)
+}
+
+func (c *logCapture) write(level, msg string) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	fmt.Fprintf(&c.buf, "%s %s %s\n", level, time.Now().UTC().Format(time.RFC3339Nano), msg)
+	if over := c.buf.Len() - MaxLogCaptureSize; over > 0 {
+		// Drop whole lines from the head
+		dropped := c.buf.Next(over)
+		if dropped[len(dropped)-1] != '\n' {
+			_, _ = c.buf.ReadBytes('\n')
+		}
+		c.truncated = true
+	}
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+)
+
+// Interval of progress updates of snapshots and restores in progress
+var progressUpdateInterval = 10 * time.Second
+
+// progressUpdater throttles progress reported by an operation into updates at intervals
+type progressUpdater struct {
+	lock     sync.Mutex
+	progress *cbv1alpha1.Progress
+	changed  bool
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+}
+
+// newProgressUpdater starts calling update with the latest progress when changed
+func newProgressUpdater(update func(progress *cbv1alpha1.Progress)) *progressUpdater {
+	u := &progressUpdater{
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+	go func() {
+		defer close(u.doneCh)
+		ticker := time.NewTicker(progressUpdateInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if progress := u.latest(); progress != nil {
+					update(progress)
+				}
+			case <-u.stopCh:
+				return
+			}
+		}
+	}()
+	return u
+}
+
+// report records the progress to update on the next tick
+func (u *progressUpdater) report(progress cbv1alpha1.Progress) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.progress = &progress
+	u.changed = true
+}
+
+// latest returns the progress changed since the last call, nil when not changed
+func (u *progressUpdater) latest() *cbv1alpha1.Progress {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if !u.changed {
+		return nil
+	}
+	u.changed = false
+	return u.progress.DeepCopy()
+}
+
+// stop stops updates and returns the last progress reported
+func (u *progressUpdater) stop() *cbv1alpha1.Progress {
+	close(u.stopCh)
+	<-u.doneCh
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.progress.DeepCopy()
+}
@@ -11,9 +11,11 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/klog"
 
 	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/cluster"
 	"github.com/ryo-watanabe/k8s-snap/pkg/objectstore"
 )
 
@@ -65,8 +67,8 @@ func (c *Controller) restoreSyncHandler(key string, queueonly bool) error {
 
 	//getOptions := metav1.GetOptions{IncludeUninitialized: false}
 
-	// context for restore
-	ctx := context.TODO()
+	// context for status updates, the restore itself bounded with its own timeout
+	ctx := c.ctx
 
 	// Convert the namespace/name string into a distinct namespace and name
 	namespace, name, err := cache.SplitMetaNamespaceKey(key)
@@ -86,8 +88,21 @@ func (c *Controller) restoreSyncHandler(key string, queueonly bool) error {
 		}
 		return err
 	}
+	restore = restore.DeepCopy()
+
+	// cancel requested in queue, or in progress while the controller stopped
+	if restoreCancelRequested(restore) && (restore.Status.Phase == "InQueue" || restore.Status.Phase == "InProgress") {
+		restore, err = c.updateRestoreStatus(ctx, restore, "Cancelled", "Cancel requested")
+		if err != nil {
+			return err
+		}
+	}
 
 	if !queueonly && restore.Status.Phase == "InQueue" {
+		// context cancelled on cancel request
+		opCtx, done := c.restoreOps.start(c.ctx, key, c.restoreTimeout(restore))
+		defer done()
+
 		restore, err = c.updateRestoreStatus(ctx, restore, "InProgress", "")
 		if err != nil {
 			return err
@@ -95,13 +110,9 @@ func (c *Controller) restoreSyncHandler(key string, queueonly bool) error {
 
 		// snapshot
 		snapshot, err := c.cbclientset.ClustersnapshotV1alpha1().Snapshots(c.namespace).Get(
-			ctx, restore.Spec.SnapshotName, metav1.GetOptions{})
+			opCtx, restore.Spec.SnapshotName, metav1.GetOptions{})
 		if err != nil {
-			_, err = c.updateRestoreStatus(ctx, restore, "Failed", err.Error())
-			if err != nil {
-				return err
-			}
-			return nil
+			return c.restoreFailed(ctx, opCtx, restore, err)
 		}
 		if snapshot.Status.Phase != "Completed" {
 			_, err = c.updateRestoreStatus(ctx, restore, "Failed", "Snapshot data is not in status 'Completed'")
@@ -114,24 +125,16 @@ func (c *Controller) restoreSyncHandler(key string, queueonly bool) error {
 
 		// bucket
 		osConfig, err := c.cbclientset.ClustersnapshotV1alpha1().ObjectstoreConfigs(c.namespace).Get(
-			ctx, snapshot.Spec.ObjectstoreConfig, metav1.GetOptions{})
+			opCtx, snapshot.Spec.ObjectstoreConfig, metav1.GetOptions{})
 		if err != nil {
-			_, err = c.updateRestoreStatus(ctx, restore, "Failed", err.Error())
-			if err != nil {
-				return err
-			}
-			return nil
+			return c.restoreFailed(ctx, opCtx, restore, err)
 		}
 
 		// cloud credentials secret
 		cred, err := c.kubeclientset.CoreV1().Secrets(c.namespace).Get(
-			ctx, osConfig.Spec.CloudCredentialSecret, metav1.GetOptions{})
+			opCtx, osConfig.Spec.CloudCredentialSecret, metav1.GetOptions{})
 		if err != nil {
-			_, err = c.updateRestoreStatus(ctx, restore, "Failed", err.Error())
-			if err != nil {
-				return err
-			}
-			return nil
+			return c.restoreFailed(ctx, opCtx, restore, err)
 		}
 		bucket := objectstore.NewBucket(osConfig.ObjectMeta.Name, string(cred.Data["accesskey"]),
 			string(cred.Data["secretkey"]), osConfig.Spec.Endpoint, osConfig.Spec.Region,
@@ -139,26 +142,59 @@ func (c *Controller) restoreSyncHandler(key string, queueonly bool) error {
 
 		// preference
 		pref, err := c.cbclientset.ClustersnapshotV1alpha1().RestorePreferences(c.namespace).Get(
-			ctx, restore.Spec.RestorePreferenceName, metav1.GetOptions{})
+			opCtx, restore.Spec.RestorePreferenceName, metav1.GetOptions{})
 		if err != nil {
-			_, err = c.updateRestoreStatus(ctx, restore, "Failed", err.Error())
-			if err != nil {
-				return err
-			}
-			return nil
+			return c.restoreFailed(ctx, opCtx, restore, err)
 		}
 
+		// progress updated on a copy not to race with restore workers
+		progressed := restore.DeepCopy()
+		progress := newProgressUpdater(func(p *cbv1alpha1.Progress) {
+			progressed = c.updateRestoreProgress(ctx, progressed, p)
+		})
+		opCtx = cluster.WithProgress(opCtx, progress.report)
+
 		// do restore
-		err = c.clusterCmd.Restore(restore, pref, bucket)
+		err = c.clusterCmd.Restore(opCtx, restore, pref, bucket)
+		restore.Status.Progress = progress.stop()
+		restore.ObjectMeta.ResourceVersion = progressed.ObjectMeta.ResourceVersion
 		if err != nil {
-			_, err = c.updateRestoreStatus(ctx, restore, "Failed", err.Error())
+			return c.restoreFailed(ctx, opCtx, restore, err)
+		}
+		restore.Status.Progress = nil
+
+		restore, err = c.updateRestoreStatus(ctx, restore, "Completed", "")
+		if err != nil {
+			return err
+		}
+	}
+
+	// rollback
+	if !queueonly && restore.ObjectMeta.Annotations[cluster.RollbackAnnotation] == "true" &&
+		(restore.Status.Phase == "Completed" || restore.Status.Phase == "Failed" || restore.Status.Phase == "Cancelled") {
+		restore, err = c.updateRestoreStatus(ctx, restore, "RollingBack", "")
+		if err != nil {
+			return err
+		}
+		rollbackCtx, cancel := withTimeout(ctx, c.restoreTimeout(restore))
+		var bucket objectstore.Objectstore
+		if restore.Status.Report != nil {
+			bucket, err = c.getBucket(rollbackCtx, c.namespace, restore.Status.Report.ObjectstoreConfig,
+				c.kubeclientset, c.cbclientset, c.insecure)
+			if err != nil {
+				klog.Warningf("restore:%s getting objectstore for report failed : %s", name, err.Error())
+			}
+		}
+		err = c.clusterCmd.Rollback(rollbackCtx, restore, bucket)
+		cancel()
+		if err != nil {
+			_, err = c.updateRestoreStatus(ctx, restore, "RollbackFailed", err.Error())
 			if err != nil {
 				return err
 			}
 			return nil
 		}
-
-		restore, err = c.updateRestoreStatus(ctx, restore, "Completed", "")
+		restore, err = c.updateRestoreStatus(ctx, restore, "RolledBack", "")
 		if err != nil {
 			return err
 		}
@@ -168,12 +204,7 @@ func (c *Controller) restoreSyncHandler(key string, queueonly bool) error {
 
 	if restore.Status.Phase == "" {
 		// Chack AvailableUntil
-		if restore.Spec.AvailableUntil.IsZero() {
-			// Check TTL string
-			if restore.Spec.TTL.Duration == 0 {
-				restore.Spec.TTL.Duration = 24 * 7 * time.Hour
-			}
-		} else if restore.Spec.AvailableUntil.Before(&nowTime) {
+		if !restore.Spec.AvailableUntil.IsZero() && restore.Spec.AvailableUntil.Before(&nowTime) {
 			_, err = c.updateRestoreStatus(ctx, restore, "Failed", "AvailableUntil is set as past.")
 			if err != nil {
 				return err
@@ -187,8 +218,9 @@ func (c *Controller) restoreSyncHandler(key string, queueonly bool) error {
 		}
 	}
 
-	// expiration for failed restore
-	if restore.Status.Phase == "Failed" && restore.Status.AvailableUntil.IsZero() {
+	// expiration for failed or cancelled restore
+	if (restore.Status.Phase == "Failed" || restore.Status.Phase == "Cancelled") &&
+		restore.Status.AvailableUntil.IsZero() {
 		if !restore.Spec.AvailableUntil.IsZero() {
 			restore.Status.AvailableUntil = restore.Spec.AvailableUntil
 			restore.Status.TTL.Duration = restore.Status.AvailableUntil.Time.Sub(restore.ObjectMeta.CreationTimestamp.Time)
@@ -203,7 +235,7 @@ func (c *Controller) restoreSyncHandler(key string, queueonly bool) error {
 	}
 
 	// expiration edited
-	if restore.Status.Phase == "Completed" || restore.Status.Phase == "Failed" {
+	if restore.Status.Phase == "Completed" || restore.Status.Phase == "Failed" || restore.Status.Phase == "Cancelled" {
 		if !restore.Spec.AvailableUntil.IsZero() && !restore.Spec.AvailableUntil.Equal(&restore.Status.AvailableUntil) {
 			restore.Status.AvailableUntil = restore.Spec.AvailableUntil
 			restore, err = c.updateRestoreStatus(ctx, restore, restore.Status.Phase, restore.Status.Reason)
@@ -231,18 +263,71 @@ func (c *Controller) restoreSyncHandler(key string, queueonly bool) error {
 	return nil
 }
 
+// updateRestoreStatus updates the status subresource of the restore.
+// On conflicts the status is set on the latest restore and the update retried.
 func (c *Controller) updateRestoreStatus(ctx context.Context, restore *cbv1alpha1.Restore,
 	phase, reason string) (*cbv1alpha1.Restore, error) {
-	restoreCopy := restore.DeepCopy()
-	restoreCopy.Status.Phase = phase
-	restoreCopy.Status.Reason = reason
+	status := restore.Status.DeepCopy()
+	status.Phase = phase
+	status.Reason = reason
 	klog.Infof("restore:%s status %s => %s : %s", restore.ObjectMeta.Name, restore.Status.Phase, phase, reason)
-	restore, err := c.cbclientset.ClustersnapshotV1alpha1().Restores(restore.Namespace).Update(
-		ctx, restoreCopy, metav1.UpdateOptions{})
+	restores := c.cbclientset.ClustersnapshotV1alpha1().Restores(restore.Namespace)
+	restoreCopy := restore.DeepCopy()
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		restoreCopy.Status = *status.DeepCopy()
+		updated, err := restores.UpdateStatus(ctx, restoreCopy, metav1.UpdateOptions{})
+		if errors.IsConflict(err) {
+			latest, getErr := restores.Get(ctx, restore.ObjectMeta.Name, metav1.GetOptions{})
+			if getErr != nil {
+				return getErr
+			}
+			restoreCopy = latest
+		} else if err == nil {
+			restoreCopy = updated
+		}
+		return err
+	})
 	if err != nil {
 		return nil, fmt.Errorf("Failed to update restore status for " + restore.ObjectMeta.Name + " : " + err.Error())
 	}
-	return restore, err
+	return restoreCopy, nil
+}
+
+// updateRestoreProgress updates the progress of the restore in progress.
+// The restore is returned as is when the update failed.
+func (c *Controller) updateRestoreProgress(ctx context.Context, restore *cbv1alpha1.Restore,
+	progress *cbv1alpha1.Progress) *cbv1alpha1.Restore {
+	restoreCopy := restore.DeepCopy()
+	restoreCopy.Status.Progress = progress
+	updated, err := c.cbclientset.ClustersnapshotV1alpha1().Restores(restore.Namespace).UpdateStatus(
+		ctx, restoreCopy, metav1.UpdateOptions{})
+	if err != nil {
+		klog.Warningf("restore:%s progress update failed : %s", restore.ObjectMeta.Name, err.Error())
+		return restore
+	}
+	return updated
+}
+
+// restoreFailed sets the restore Failed, or Cancelled when the operation cancelled
+func (c *Controller) restoreFailed(ctx, opCtx context.Context, restore *cbv1alpha1.Restore, err error) error {
+	if c.ctx.Err() != nil {
+		ctx, cancel := stoppedContext()
+		defer cancel()
+		_, err = c.updateRestoreStatus(ctx, restore, "Failed", "Controller stopped while restoring")
+		return err
+	}
+	switch opCtx.Err() {
+	case nil:
+		_, err = c.updateRestoreStatus(ctx, restore, "Failed", err.Error())
+		return err
+	case context.DeadlineExceeded:
+		_, err = c.updateRestoreStatus(ctx, restore, "Failed",
+			fmt.Sprintf("Timed out after %s : %s", c.restoreTimeout(restore), err.Error()))
+		return err
+	}
+	// The journal is kept to rollback
+	_, err = c.updateRestoreStatus(ctx, restore, "Cancelled", "Cancelled in progress")
+	return err
 }
 
 // enqueueRestore takes a Restore resource and converts it into a namespace/name
@@ -266,5 +351,52 @@ func (c *Controller) enqueueRestore(obj interface{}) {
 		runtime.HandleError(err)
 		return
 	}
+
+	// cancel the restore in progress
+	if restore, ok := obj.(*cbv1alpha1.Restore); ok && restoreCancelRequested(restore) {
+		if c.restoreOps.cancel(key) {
+			klog.Infof("restore:%s cancel requested", restore.ObjectMeta.Name)
+		}
+	}
 	c.restoreQueue.AddRateLimited(key)
 }
+
+// deleteRestore deletes reports of the restore from the objectstore
+func (c *Controller) deleteRestore(obj interface{}) {
+
+	// convert object into Restore and get info for deleting
+	restore, ok := obj.(*cbv1alpha1.Restore)
+	if !ok {
+		klog.Warningf("Delete restore: Invalid object passed: %#v", obj)
+		return
+	}
+
+	// delete only restores in our namespace with report
+	if restore.ObjectMeta.GetNamespace() != c.namespace || restore.Status.Report == nil {
+		return
+	}
+
+	// context for delete restore
+	ctx, cancel := c.handlerContext()
+	defer cancel()
+
+	bucket, err := c.getBucket(ctx, c.namespace, restore.Status.Report.ObjectstoreConfig,
+		c.kubeclientset, c.cbclientset, c.insecure)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	klog.Infof("Deleting restore %s report from objectstore %s",
+		restore.ObjectMeta.Name, restore.Status.Report.ObjectstoreConfig)
+	err = bucket.Delete(ctx, restore.Status.Report.Name)
+	if err != nil {
+		runtime.HandleError(err)
+	}
+	if restore.Status.Report.JUnit != "" {
+		err = bucket.Delete(ctx, restore.Status.Report.JUnit)
+		if err != nil {
+			runtime.HandleError(err)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+
+	cbv1alpha1 "github.com/ryo-watanabe/k8s-snap/pkg/apis/clustersnapshot/v1alpha1"
+	"github.com/ryo-watanabe/k8s-snap/pkg/cluster"
+)
+
+// runVerificationWorker is a long-running function that will continually call the
+// processNextVerificationItem function in order to read and process a message on the
+// workqueue.
+func (c *Controller) runVerificationWorker() {
+	for c.processNextVerificationItem() {
+	}
+}
+
+// processNextVerificationItem will read a single work item off the workqueue and
+// attempt to process it, by calling the syncHandler.
+func (c *Controller) processNextVerificationItem() bool {
+	// Process verification queue
+	obj, shutdown := c.verificationQueue.Get()
+	if shutdown {
+		return false
+	}
+	err := func(obj interface{}) error {
+		defer c.verificationQueue.Done(obj)
+		var key string
+		var ok bool
+		if key, ok = obj.(string); !ok {
+			c.verificationQueue.Forget(obj)
+			runtime.HandleError(fmt.Errorf("expected string in workqueue but got %#v", obj))
+			return nil
+		}
+		if err := c.verificationSyncHandler(key); err != nil {
+			c.verificationQueue.AddRateLimited(key)
+			return fmt.Errorf("error syncing '%s': %s, requeuing", key, err.Error())
+		}
+		c.verificationQueue.Forget(obj)
+		klog.V(4).Infof("Successfully synced '%s'", key)
+		return nil
+	}(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return true
+	}
+
+	return true
+}
+
+// verificationSyncHandler verifies the snapshot archive requested by a
+// SnapshotVerification resource and records the result on both resources.
+func (c *Controller) verificationSyncHandler(key string) error {
+
+	// context for verification
+	ctx, cancel := c.handlerContext()
+	defer cancel()
+
+	// Convert the namespace/name string into a distinct namespace and name
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		runtime.HandleError(fmt.Errorf("invalid resource key: %s", key))
+		return nil
+	}
+
+	// Get the SnapshotVerification resource with this namespace/name.
+	verification, err := c.verificationLister.SnapshotVerifications(namespace).Get(name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	// Verify only once
+	if verification.Status.Phase != "" {
+		return nil
+	}
+
+	verification, err = c.updateVerificationStatus(ctx, verification, "InProgress", "")
+	if err != nil {
+		return err
+	}
+
+	// snapshot
+	snapshot, err := c.cbclientset.ClustersnapshotV1alpha1().Snapshots(c.namespace).Get(
+		ctx, verification.Spec.SnapshotName, metav1.GetOptions{})
+	if err != nil {
+		_, err = c.updateVerificationStatus(ctx, verification, "Failed", err.Error())
+		return err
+	}
+	if snapshot.Status.Phase != "Completed" {
+		_, err = c.updateVerificationStatus(ctx, verification, "Failed", "Snapshot data is not in status 'Completed'")
+		return err
+	}
+
+	snapshot, manifest, err := c.verifySnapshot(ctx, snapshot)
+	if err != nil {
+		_, err = c.updateVerificationStatus(ctx, verification, "Failed", err.Error())
+		return err
+	}
+
+	verification.Status.VerifiedTimestamp = snapshot.Status.VerifiedTimestamp
+	if manifest != nil {
+		verification.Status.FormatVersion = int32(manifest.FormatVersion)
+		verification.Status.NumberOfEntries = int32(manifest.NumberOfEntries)
+		verification.Status.SnapVersion = manifest.SnapVersion
+		verification.Status.ClusterVersion = manifest.ClusterVersion
+	}
+	condition := meta.FindStatusCondition(snapshot.Status.Conditions, cluster.ConditionVerified)
+	if condition == nil || condition.Status != metav1.ConditionTrue {
+		reason := "Verification failed"
+		if condition != nil {
+			reason = condition.Message
+		}
+		_, err = c.updateVerificationStatus(ctx, verification, "Failed", reason)
+		return err
+	}
+	verification, err = c.updateVerificationStatus(ctx, verification, "Completed", "")
+	if err != nil {
+		return err
+	}
+
+	c.recorder.Event(verification, corev1.EventTypeNormal, "Synced", "SnapshotVerification synced successfully")
+	return nil
+}
+
+// verifySnapshot verifies the archive of the snapshot and updates its Verified condition
+func (c *Controller) verifySnapshot(ctx context.Context,
+	snapshot *cbv1alpha1.Snapshot) (*cbv1alpha1.Snapshot, *cluster.ArchiveManifest, error) {
+
+	opCtx, cancel := withTimeout(ctx, c.snapshotTimeout(snapshot))
+	defer cancel()
+
+	bucket, err := c.getBucket(opCtx, c.namespace, snapshot.Spec.ObjectstoreConfig,
+		c.kubeclientset, c.cbclientset, c.insecure)
+	if err != nil {
+		return snapshot, nil, err
+	}
+
+	snapshotCopy := snapshot.DeepCopy()
+	manifest, err := c.clusterCmd.Verify(opCtx, snapshotCopy, bucket)
+	if err != nil {
+		return snapshot, nil, err
+	}
+
+	snapshot, err = c.updateSnapshotStatus(ctx, snapshotCopy, snapshotCopy.Status.Phase, snapshotCopy.Status.Reason)
+	if err != nil {
+		return snapshotCopy, manifest, err
+	}
+	return snapshot, manifest, nil
+}
+
+// updateVerificationStatus updates the status subresource of the verification.
+// On conflicts the status is set on the latest verification and the update retried.
+func (c *Controller) updateVerificationStatus(ctx context.Context, verification *cbv1alpha1.SnapshotVerification,
+	phase, reason string) (*cbv1alpha1.SnapshotVerification, error) {
+	status := verification.Status.DeepCopy()
+	status.Phase = phase
+	status.Reason = reason
+	klog.Infof("verification:%s status %s => %s : %s",
+		verification.ObjectMeta.Name, verification.Status.Phase, phase, reason)
+	verifications := c.cbclientset.ClustersnapshotV1alpha1().SnapshotVerifications(verification.Namespace)
+	verificationCopy := verification.DeepCopy()
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		verificationCopy.Status = *status.DeepCopy()
+		updated, err := verifications.UpdateStatus(ctx, verificationCopy, metav1.UpdateOptions{})
+		if errors.IsConflict(err) {
+			latest, getErr := verifications.Get(ctx, verification.ObjectMeta.Name, metav1.GetOptions{})
+			if getErr != nil {
+				return getErr
+			}
+			verificationCopy = latest
+		} else if err == nil {
+			verificationCopy = updated
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to update verification status for %s : %s",
+			verification.ObjectMeta.Name, err.Error())
+	}
+	return verificationCopy, nil
+}
+
+// enqueueVerification takes a SnapshotVerification resource and converts it into a namespace/name
+// string which is then put onto the work queue. This method should *not* be
+// passed resources of any type other than SnapshotVerification.
+func (c *Controller) enqueueVerification(obj interface{}) {
+	var key string
+	var err error
+
+	// queue only verifications in our namespace
+	meta, err := meta.Accessor(obj)
+	if err != nil {
+		runtime.HandleError(fmt.Errorf("object has no meta: %v", err))
+		return
+	}
+	if meta.GetNamespace() != c.namespace {
+		return
+	}
+
+	if key, err = cache.MetaNamespaceKeyFunc(obj); err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	c.verificationQueue.AddRateLimited(key)
+}